@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of a signed request.
+// The signature is the hex encoded HMAC-SHA256 with the key named by KeyIDHeader of
+// the method, the request URI (path and query), the timestamp, the nonce and the hex encoded SHA256 of the body,
+// each followed by a newline.
+const (
+	KeyIDHeader     = "X-Auth-Key-Id"
+	TimestampHeader = "X-Auth-Timestamp"
+	NonceHeader     = "X-Auth-Nonce"
+	SignatureHeader = "X-Auth-Signature"
+)
+
+// ID of the key that may call admin-only endpoints. The IDs of the other keys are silo hostnames.
+const AdminKeyID = "admin"
+
+// Largest request body that Verify reads to verify its signature
+const MaxBodyBytes = 1 << 20
+
+// Load the keys in dir, where each file's name is a key ID and its content is the key.
+// This matches the layout of a kubernetes secret mounted as a volume, whose hidden files are skipped.
+func LoadKeys(dir string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return keys, errors.New(fmt.Sprintf("Couldn't read key directory %s: %s", dir, err.Error()))
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		// Follow symlinks, which is how secret volumes link to the current version of each key
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return keys, errors.New(fmt.Sprintf("Couldn't read key %s: %s", path, err.Error()))
+		}
+		key := bytes.TrimSpace(content)
+		if len(key) < 16 {
+			return keys, errors.New(fmt.Sprintf("Key %s is shorter than 16 bytes", entry.Name()))
+		}
+		keys[entry.Name()] = key
+	}
+	return keys, nil
+}
+
+func signature(key []byte, method string, requestURI string, timestamp string, nonce string, bodyHash []byte) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s\n", method, requestURI, timestamp, nonce, hex.EncodeToString(bodyHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign r, whose body is body, with key under keyID
+func Sign(r *http.Request, body []byte, keyID string, key []byte) error {
+	nonceBytes := make([]byte, 16)
+	_, err := rand.Read(nonceBytes)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't generate nonce: %s", err.Error()))
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	r.Header.Set(KeyIDHeader, keyID)
+	r.Header.Set(TimestampHeader, timestamp)
+	r.Header.Set(NonceHeader, nonce)
+	bodyHash := sha256.Sum256(body)
+	r.Header.Set(SignatureHeader, signature(key, r.Method, r.URL.RequestURI(), timestamp, nonce, bodyHash[:]))
+	return nil
+}
+
+// Verifies signed requests, rejecting requests whose timestamp is more than maxSkew from now,
+// and requests whose nonce was already used within that window, so that a captured request can't be replayed.
+type Verifier struct {
+	keys      map[string][]byte
+	maxSkew   time.Duration
+	nonces    map[string]time.Time
+	lastPrune time.Time
+	mutex     *sync.Mutex
+}
+
+func NewVerifier(keys map[string][]byte, maxSkew time.Duration) *Verifier {
+	var m sync.Mutex
+	return &Verifier{
+		keys:      keys,
+		maxSkew:   maxSkew,
+		nonces:    make(map[string]time.Time),
+		lastPrune: time.Now(),
+		mutex:     &m,
+	}
+}
+
+// Return true if there is a key with keyID
+func (v *Verifier) HasKey(keyID string) bool {
+	_, exists := v.keys[keyID]
+	return exists
+}
+
+// Verify the signature of r and return the ID of the key it was signed with.
+// The body is read to verify it, and replaced so that the handler can still read it.
+func (v *Verifier) Verify(r *http.Request) (string, error) {
+	return v.VerifyLimit(r, MaxBodyBytes)
+}
+
+// Request body spooled to a temporary file, which is removed when it's closed
+type spooledBody struct {
+	*os.File
+}
+
+func (b spooledBody) Close() error {
+	err := b.File.Close()
+	os.Remove(b.File.Name())
+	return err
+}
+
+// Read body of up to maxBodyBytes while hashing it, and return a body to read it again from.
+// Bodies that may be larger than MaxBodyBytes are spooled to a temporary file rather than held in memory.
+func readBody(body io.ReadCloser, maxBodyBytes int64, bodyHash hash.Hash) (io.ReadCloser, int64, error) {
+	limited := http.MaxBytesReader(nil, body, maxBodyBytes)
+	if maxBodyBytes <= MaxBodyBytes {
+		content, err := ioutil.ReadAll(io.TeeReader(limited, bodyHash))
+		if err != nil {
+			return nil, 0, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(content)), int64(len(content)), nil
+	}
+	file, err := ioutil.TempFile("", "request-body-")
+	if err != nil {
+		return nil, 0, err
+	}
+	spooled := spooledBody{file}
+	size, err := io.Copy(io.MultiWriter(file, bodyHash), limited)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spooled.Close()
+		return nil, 0, err
+	}
+	return spooled, size, nil
+}
+
+// Verify the signature of r like Verify, but allow a body of up to maxBodyBytes, e.g. for file uploads.
+// Since the body can't be passed on before its signature is verified, a body that may be larger than MaxBodyBytes
+// is spooled to a temporary file while it's hashed. The caller must close r.Body whether or not r was verified,
+// which removes the file. Once the body is read, r.ContentLength is set to its size.
+func (v *Verifier) VerifyLimit(r *http.Request, maxBodyBytes int64) (string, error) {
+	keyID := r.Header.Get(KeyIDHeader)
+	timestamp := r.Header.Get(TimestampHeader)
+	nonce := r.Header.Get(NonceHeader)
+	givenSignature := r.Header.Get(SignatureHeader)
+	if keyID == "" || timestamp == "" || nonce == "" || givenSignature == "" {
+		return "", errors.New("Request isn't signed")
+	}
+	key, exists := v.keys[keyID]
+	if !exists {
+		return "", errors.New(fmt.Sprintf("Unknown key %s", keyID))
+	}
+	unixTime, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Invalid timestamp %s", timestamp))
+	}
+	signedAt := time.Unix(unixTime, 0)
+	now := time.Now()
+	if signedAt.Before(now.Add(-v.maxSkew)) || signedAt.After(now.Add(v.maxSkew)) {
+		return "", errors.New(fmt.Sprintf("Timestamp %s is more than %s from the server's time", timestamp, v.maxSkew))
+	}
+
+	bodyHash := sha256.New()
+	body, size, err := readBody(r.Body, maxBodyBytes, bodyHash)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Couldn't read request body: %s", err.Error()))
+	}
+	r.Body = body
+	r.ContentLength = size
+	expected := signature(key, r.Method, r.URL.RequestURI(), timestamp, nonce, bodyHash.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(givenSignature)) {
+		return "", errors.New(fmt.Sprintf("Invalid signature for key %s", keyID))
+	}
+
+	// Only check the nonce once the signature is valid, so that unsigned requests can't fill the nonce cache
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.pruneNonces(now)
+	nonceKey := fmt.Sprintf("%s/%s", keyID, nonce)
+	if _, used := v.nonces[nonceKey]; used {
+		return "", errors.New(fmt.Sprintf("Nonce %s was already used", nonce))
+	}
+	v.nonces[nonceKey] = signedAt
+	return keyID, nil
+}
+
+// Forget nonces whose timestamps are too old to be accepted anyway. Must be called with the lock held.
+func (v *Verifier) pruneNonces(now time.Time) {
+	if now.Sub(v.lastPrune) < v.maxSkew/2 {
+		return
+	}
+	for nonce, signedAt := range v.nonces {
+		if signedAt.Before(now.Add(-v.maxSkew)) {
+			delete(v.nonces, nonce)
+		}
+	}
+	v.lastPrune = now
+}
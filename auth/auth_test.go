@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testKeys = map[string][]byte{
+	"silo1.sciencedata.dk": []byte("silo1-key-0123456789"),
+	AdminKeyID:             []byte("admin-key-0123456789"),
+}
+
+func signedRequest(t *testing.T, body string, keyID string, key []byte) *http.Request {
+	request := httptest.NewRequest("POST", "/create_pod?x=1", bytes.NewReader([]byte(body)))
+	err := Sign(request, []byte(body), keyID, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return request
+}
+
+func TestVerify(t *testing.T) {
+	v := NewVerifier(testKeys, time.Minute)
+	body := `{"user_id": "foo"}`
+	request := signedRequest(t, body, "silo1.sciencedata.dk", testKeys["silo1.sciencedata.dk"])
+	keyID, err := v.Verify(request)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if keyID != "silo1.sciencedata.dk" {
+		t.Fatalf("Verified with key %s instead of silo1.sciencedata.dk", keyID)
+	}
+	// The handler must still be able to read the body
+	read, err := ioutil.ReadAll(request.Body)
+	if err != nil || string(read) != body {
+		t.Fatalf("Body after verification was %s", string(read))
+	}
+
+	tests := []struct {
+		description string
+		request     func() *http.Request
+	}{
+		{"unsigned request", func() *http.Request {
+			return httptest.NewRequest("POST", "/create_pod", bytes.NewReader([]byte(body)))
+		}},
+		{"unknown key", func() *http.Request {
+			return signedRequest(t, body, "silo2.sciencedata.dk", testKeys["silo1.sciencedata.dk"])
+		}},
+		{"wrong key", func() *http.Request {
+			return signedRequest(t, body, AdminKeyID, testKeys["silo1.sciencedata.dk"])
+		}},
+		{"modified body", func() *http.Request {
+			request := signedRequest(t, body, "silo1.sciencedata.dk", testKeys["silo1.sciencedata.dk"])
+			request.Body = ioutil.NopCloser(bytes.NewReader([]byte(`{"user_id": "bar"}`)))
+			return request
+		}},
+		{"modified path", func() *http.Request {
+			request := signedRequest(t, body, "silo1.sciencedata.dk", testKeys["silo1.sciencedata.dk"])
+			request.URL.Path = "/delete_pod"
+			return request
+		}},
+		{"old timestamp", func() *http.Request {
+			request := signedRequest(t, body, "silo1.sciencedata.dk", testKeys["silo1.sciencedata.dk"])
+			request.Header.Set(TimestampHeader, strconv.FormatInt(time.Now().Add(-2*time.Minute).Unix(), 10))
+			return request
+		}},
+	}
+	for _, test := range tests {
+		_, err := v.Verify(test.request())
+		if err == nil {
+			t.Fatalf("Verified %s", test.description)
+		}
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	v := NewVerifier(testKeys, time.Minute)
+	body := `{"user_id": "foo"}`
+	request := signedRequest(t, body, AdminKeyID, testKeys[AdminKeyID])
+	replay := request.Clone(request.Context())
+	replay.Body = ioutil.NopCloser(bytes.NewReader([]byte(body)))
+	_, err := v.Verify(request)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = v.Verify(replay)
+	if err == nil {
+		t.Fatal("Verified a replayed request")
+	}
+}
+
+func TestVerifyLimit(t *testing.T) {
+	v := NewVerifier(testKeys, time.Minute)
+	body := string(bytes.Repeat([]byte("x"), MaxBodyBytes+1))
+	_, err := v.Verify(signedRequest(t, body, AdminKeyID, testKeys[AdminKeyID]))
+	if err == nil {
+		t.Fatal("Verified a body larger than MaxBodyBytes")
+	}
+	request := signedRequest(t, body, AdminKeyID, testKeys[AdminKeyID])
+	_, err = v.VerifyLimit(request, MaxBodyBytes+1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	read, err := ioutil.ReadAll(request.Body)
+	if err != nil || len(read) != len(body) || request.ContentLength != int64(len(body)) {
+		t.Fatalf("Body after verification had %d bytes and length %d instead of %d", len(read), request.ContentLength, len(body))
+	}
+
+	// The large body was spooled to a file, which is removed once the body is closed
+	spooled, isSpooled := request.Body.(spooledBody)
+	if !isSpooled {
+		t.Fatal("Body larger than MaxBodyBytes wasn't spooled to a file")
+	}
+	request.Body.Close()
+	if _, err := os.Stat(spooled.Name()); !os.IsNotExist(err) {
+		t.Fatalf("Spooled body %s wasn't removed", spooled.Name())
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"silo1.sciencedata.dk": "silo1-key-0123456789\n",
+		".hidden":              "not a key",
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	keys, err := LoadKeys(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(keys) != 1 || string(keys["silo1.sciencedata.dk"]) != "silo1-key-0123456789" {
+		t.Fatalf("Loaded keys %v", keys)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "short"), []byte("short"), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = LoadKeys(dir)
+	if err == nil {
+		t.Fatal("Loaded a key shorter than 16 bytes")
+	}
+}
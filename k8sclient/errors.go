@@ -0,0 +1,118 @@
+package k8sclient
+
+import (
+	"context"
+	"errors"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+)
+
+// Class of an error returned by a K8sClient, so that callers can branch on it
+// without inspecting errors from the apiserver
+type ErrorReason string
+
+const (
+	ReasonNotFound        ErrorReason = "NotFound"
+	ReasonAlreadyExists   ErrorReason = "AlreadyExists"
+	ReasonConflict        ErrorReason = "Conflict"
+	ReasonForbidden       ErrorReason = "Forbidden"
+	ReasonTooManyRequests ErrorReason = "TooManyRequests"
+	ReasonInvalid         ErrorReason = "Invalid"
+	ReasonTimeout         ErrorReason = "Timeout"
+	ReasonUnavailable     ErrorReason = "Unavailable"
+	ReasonCanceled        ErrorReason = "Canceled"
+	ReasonUnknown         ErrorReason = "Unknown"
+)
+
+// Error with the ErrorReason it was classified as. The message is that of the wrapped error.
+type Error struct {
+	Reason ErrorReason
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Make a new error with the given reason, for errors that the backend itself detects,
+// e.g. a pod that isn't owned by the requesting user
+func NewError(reason ErrorReason, message string) error {
+	return &Error{Reason: reason, Err: errors.New(message)}
+}
+
+// Wrap err from client-go in an Error with its reason. Returns nil if err is nil.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *Error
+	if errors.As(err, &classified) {
+		return err
+	}
+	return &Error{Reason: reasonForAPIError(err), Err: err}
+}
+
+func reasonForAPIError(err error) ErrorReason {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ReasonCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return ReasonTimeout
+	case apierrors.IsNotFound(err):
+		return ReasonNotFound
+	case apierrors.IsAlreadyExists(err):
+		return ReasonAlreadyExists
+	case apierrors.IsConflict(err):
+		return ReasonConflict
+	// Exceeded resource quotas are also reported as Forbidden
+	case apierrors.IsForbidden(err), apierrors.IsUnauthorized(err):
+		return ReasonForbidden
+	case apierrors.IsTooManyRequests(err):
+		return ReasonTooManyRequests
+	case apierrors.IsInvalid(err), apierrors.IsBadRequest(err):
+		return ReasonInvalid
+	case apierrors.IsTimeout(err), apierrors.IsServerTimeout(err):
+		return ReasonTimeout
+	case apierrors.IsServiceUnavailable(err), apierrors.IsInternalError(err), apierrors.IsUnexpectedServerError(err):
+		return ReasonUnavailable
+	// Errors from the connection itself, e.g. a reset exec stream
+	case utilnet.IsConnectionReset(err), utilnet.IsConnectionRefused(err), utilnet.IsProbableEOF(err):
+		return ReasonUnavailable
+	default:
+		return ReasonUnknown
+	}
+}
+
+// Return the reason that err was classified with, or ReasonUnknown if it wasn't
+func ReasonForError(err error) ErrorReason {
+	var classified *Error
+	if errors.As(err, &classified) {
+		return classified.Reason
+	}
+	return ReasonUnknown
+}
+
+func IsNotFound(err error) bool {
+	return ReasonForError(err) == ReasonNotFound
+}
+
+func IsAlreadyExists(err error) bool {
+	return ReasonForError(err) == ReasonAlreadyExists
+}
+
+func IsConflict(err error) bool {
+	return ReasonForError(err) == ReasonConflict
+}
+
+func IsForbidden(err error) bool {
+	return ReasonForError(err) == ReasonForbidden
+}
+
+func IsTooManyRequests(err error) bool {
+	return ReasonForError(err) == ReasonTooManyRequests
+}
@@ -0,0 +1,354 @@
+package k8sclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	watch "k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Default time that the fake cluster takes to react to a create or delete call,
+// e.g. for a created pod to become Ready or a deleted pod to disappear.
+const defaultFakeEventDelay = 50 * time.Millisecond
+
+// K8sClient backed by client-go's fake clientset, so that the backend can be tested without a cluster.
+// The fake clientset is extended to behave more like a real cluster:
+// - List and Watch calls on Clientset respect field selectors like metadata.name=x and status.podIP=x
+// - Created pods become Running and Ready, PVs become Available and PVCs become Bound after EventDelay
+// - NodePort services are assigned a node port
+// - Deleted objects disappear after EventDelay, like a graceful deletion
+// - Created and updated objects get increasing resourceVersions
+// - PodExec is answered by ExecFunc, which by default serves `cat` from files set with SetFile
+// - PodExecStream is answered by StreamExecFunc, which by default echoes stdin to stdout
+type FakeK8sClient struct {
+	*clientsetClient
+	Clientset  *fake.Clientset
+	EventDelay time.Duration
+	// If set, called instead of the default handler for PodExec
+	ExecFunc func(ctx context.Context, command []string, pod *apiv1.Pod, nContainer int) (bytes.Buffer, bytes.Buffer, error)
+	// If set, called instead of the default handler for PodExecStream
+	StreamExecFunc func(ctx context.Context, command []string, pod *apiv1.Pod, nContainer int, options remotecommand.StreamOptions) error
+	// files[podName][path] = content
+	files               map[string]map[string]string
+	nextPodIP           int
+	nextNodePort        int32
+	nextResourceVersion uint64
+	mutex               *sync.Mutex
+	// Closed by Stop, so that pending delayed events are dropped rather than outliving the test
+	stopped  chan struct{}
+	stopOnce *sync.Once
+}
+
+// initialize a new FakeK8sClient whose fake cluster already contains objects
+func NewFakeK8sClient(globalConfig util.GlobalConfig, objects ...runtime.Object) *FakeK8sClient {
+	var m sync.Mutex
+	clientset := fake.NewSimpleClientset(objects...)
+	c := &FakeK8sClient{
+		clientsetClient: &clientsetClient{
+			clientset:    clientset,
+			globalConfig: globalConfig,
+			retryPolicy:  newRetryPolicy(globalConfig),
+		},
+		Clientset:           clientset,
+		EventDelay:          defaultFakeEventDelay,
+		files:               make(map[string]map[string]string),
+		nextPodIP:           1,
+		nextNodePort:        30000,
+		nextResourceVersion: 1,
+		mutex:               &m,
+		stopped:             make(chan struct{}),
+		stopOnce:            &sync.Once{},
+	}
+	c.addReactors()
+	// Start the informers only after the reactors are in place, since they list and watch through them
+	informers, err := newInformerCache(clientset, globalConfig.Namespace)
+	if err != nil {
+		panic(err.Error())
+	}
+	c.informers = informers
+	return c
+}
+
+// Set the content of a file in the fake pod's filesystem, to be read by PodExec with `cat`
+func (c *FakeK8sClient) SetFile(podName string, path string, content string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	podFiles, exists := c.files[podName]
+	if !exists {
+		podFiles = make(map[string]string)
+		c.files[podName] = podFiles
+	}
+	podFiles[path] = content
+}
+
+// Answer PodExec with c.ExecFunc if set, otherwise only support `cat path`
+func (c *FakeK8sClient) PodExec(ctx context.Context, command []string, pod *apiv1.Pod, nContainer int) (bytes.Buffer, bytes.Buffer, error) {
+	if c.ExecFunc != nil {
+		return c.ExecFunc(ctx, command, pod, nContainer)
+	}
+	var stdout, stderr bytes.Buffer
+	if ctx.Err() != nil {
+		return stdout, stderr, errors.New(fmt.Sprintf("Stream error: %s", ctx.Err().Error()))
+	}
+	if len(command) != 2 || command[0] != "cat" {
+		return stdout, stderr, errors.New(fmt.Sprintf("Stream error: fake exec doesn't support command %s", strings.Join(command, " ")))
+	}
+	c.mutex.Lock()
+	content, exists := c.files[pod.Name][command[1]]
+	c.mutex.Unlock()
+	if !exists {
+		stderr.WriteString(fmt.Sprintf("cat: %s: No such file or directory\n", command[1]))
+		return stdout, stderr, nil
+	}
+	stdout.WriteString(content)
+	return stdout, stderr, nil
+}
+
+// Answer PodExecStream with c.StreamExecFunc if set, otherwise copy stdin to stdout like `cat`
+// until stdin is closed or ctx is done
+func (c *FakeK8sClient) PodExecStream(ctx context.Context, command []string, pod *apiv1.Pod, nContainer int, options remotecommand.StreamOptions) error {
+	if c.StreamExecFunc != nil {
+		return c.StreamExecFunc(ctx, command, pod, nContainer, options)
+	}
+	if options.Stdin == nil || options.Stdout == nil {
+		return nil
+	}
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(options.Stdout, options.Stdin)
+		copied <- err
+	}()
+	select {
+	case err := <-copied:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("Stream error: %w", ctx.Err())
+	}
+}
+
+// Stop the informers and drop the events that are still waiting for EventDelay
+func (c *FakeK8sClient) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopped)
+	})
+	c.clientsetClient.Stop()
+}
+
+// Run f after c.EventDelay without blocking the caller, unless c is stopped first
+func (c *FakeK8sClient) afterDelay(f func()) {
+	go func() {
+		timer := time.NewTimer(c.EventDelay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			f()
+		case <-c.stopped:
+		}
+	}()
+}
+
+// watch.Interface that passes on the events of incoming for which keep returns true.
+// Unlike watch.Filter, it stops waiting for the receiver once stopped, so that an event nobody receives doesn't leak its goroutine.
+type filteredWatch struct {
+	incoming watch.Interface
+	keep     func(watch.Event) bool
+	result   chan watch.Event
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func newFilteredWatch(incoming watch.Interface, keep func(watch.Event) bool) *filteredWatch {
+	w := &filteredWatch{incoming: incoming, keep: keep, result: make(chan watch.Event), stopped: make(chan struct{})}
+	go w.loop()
+	return w
+}
+
+func (w *filteredWatch) ResultChan() <-chan watch.Event {
+	return w.result
+}
+
+func (w *filteredWatch) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopped)
+		w.incoming.Stop()
+	})
+}
+
+func (w *filteredWatch) loop() {
+	defer close(w.result)
+	for event := range w.incoming.ResultChan() {
+		if !w.keep(event) {
+			continue
+		}
+		select {
+		case w.result <- event:
+		case <-w.stopped:
+			return
+		}
+	}
+}
+
+// Give obj the next resourceVersion, like the apiserver does on each write
+func (c *FakeK8sClient) setResourceVersion(obj runtime.Object) {
+	objMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	objMeta.SetResourceVersion(strconv.FormatUint(c.nextResourceVersion, 10))
+	c.nextResourceVersion++
+}
+
+// Add reactors to the fake clientset so that it behaves like a cluster with a scheduler, kubelet and storage provisioner
+func (c *FakeK8sClient) addReactors() {
+	tracker := c.Clientset.Tracker()
+
+	// The default reactors don't set resourceVersions, so store a copy with the next one.
+	// The other create reactors either store the object themselves or fall through to these.
+	c.Clientset.PrependReactor("create", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj := action.(k8stesting.CreateAction).GetObject().DeepCopyObject()
+		c.setResourceVersion(obj)
+		err := tracker.Create(action.GetResource(), obj, action.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		return true, obj, nil
+	})
+	c.Clientset.PrependReactor("update", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj := action.(k8stesting.UpdateAction).GetObject().DeepCopyObject()
+		c.setResourceVersion(obj)
+		err := tracker.Update(action.GetResource(), obj, action.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		return true, obj, nil
+	})
+
+	// The default reactors ignore field selectors, so filter the results here
+	c.Clientset.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		handled, list, err := k8stesting.ObjectReaction(tracker)(action)
+		if err != nil || list == nil {
+			return handled, list, err
+		}
+		selector := action.(k8stesting.ListAction).GetListRestrictions().Fields
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			return true, nil, err
+		}
+		var filtered []runtime.Object
+		for _, item := range items {
+			if matchesFieldSelector(selector, item) {
+				filtered = append(filtered, item)
+			}
+		}
+		err = meta.SetList(list, filtered)
+		if err != nil {
+			return true, nil, err
+		}
+		return true, list, nil
+	})
+	c.Clientset.PrependWatchReactor("*", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		watcher, err := tracker.Watch(action.GetResource(), action.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		selector := action.(k8stesting.WatchAction).GetWatchRestrictions().Fields
+		return true, newFilteredWatch(watcher, func(event watch.Event) bool {
+			return matchesFieldSelector(selector, event.Object)
+		}), nil
+	})
+
+	// Assign node ports to services as they are created
+	c.Clientset.PrependReactor("create", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		service := action.(k8stesting.CreateAction).GetObject().(*apiv1.Service).DeepCopy()
+		if service.Spec.Type == apiv1.ServiceTypeNodePort {
+			c.mutex.Lock()
+			for i := range service.Spec.Ports {
+				if service.Spec.Ports[i].NodePort == 0 {
+					service.Spec.Ports[i].NodePort = c.nextNodePort
+					c.nextNodePort++
+				}
+			}
+			c.mutex.Unlock()
+		}
+		c.setResourceVersion(service)
+		err := tracker.Create(action.GetResource(), service, action.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		return true, service, nil
+	})
+
+	// Bring pods, PVs and PVCs into their ready states shortly after creation
+	c.Clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*apiv1.Pod).DeepCopy()
+		c.mutex.Lock()
+		podIP := fmt.Sprintf("10.128.0.%d", c.nextPodIP)
+		c.nextPodIP++
+		c.mutex.Unlock()
+		c.afterDelay(func() {
+			now := metav1.Now()
+			pod.Status = apiv1.PodStatus{
+				Phase:     apiv1.PodRunning,
+				HostIP:    "10.0.0.1",
+				PodIP:     podIP,
+				StartTime: &now,
+				Conditions: []apiv1.PodCondition{
+					{Type: apiv1.PodScheduled, Status: apiv1.ConditionTrue},
+					{Type: apiv1.PodReady, Status: apiv1.ConditionTrue},
+				},
+			}
+			// This fails if the pod was deleted in the meantime, which is fine
+			c.setResourceVersion(pod)
+			tracker.Update(action.GetResource(), pod, action.GetNamespace())
+		})
+		return false, nil, nil
+	})
+	c.Clientset.PrependReactor("create", "persistentvolumes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pv := action.(k8stesting.CreateAction).GetObject().(*apiv1.PersistentVolume).DeepCopy()
+		c.afterDelay(func() {
+			pv.Status.Phase = apiv1.VolumeAvailable
+			c.setResourceVersion(pv)
+			tracker.Update(action.GetResource(), pv, action.GetNamespace())
+		})
+		return false, nil, nil
+	})
+	c.Clientset.PrependReactor("create", "persistentvolumeclaims", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pvc := action.(k8stesting.CreateAction).GetObject().(*apiv1.PersistentVolumeClaim).DeepCopy()
+		c.afterDelay(func() {
+			pvc.Status.Phase = apiv1.ClaimBound
+			c.setResourceVersion(pvc)
+			tracker.Update(action.GetResource(), pvc, action.GetNamespace())
+		})
+		return false, nil, nil
+	})
+
+	// Accept delete calls right away, but only remove the object after a delay
+	c.Clientset.PrependReactor("delete", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		deleteAction := action.(k8stesting.DeleteAction)
+		_, err := tracker.Get(action.GetResource(), action.GetNamespace(), deleteAction.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		c.afterDelay(func() {
+			tracker.Delete(action.GetResource(), action.GetNamespace(), deleteAction.GetName())
+		})
+		return true, nil, nil
+	})
+}
@@ -0,0 +1,391 @@
+package k8sclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	watch "k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	netlisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Number of events that can be buffered for a watch. A watch whose reader falls this far behind is stopped.
+const informerWatchBufferSize = 100
+
+// How often waitForCache checks whether the informer cache has caught up with a write
+const cacheWaitInterval = 10 * time.Millisecond
+
+// Shared informers for each resource type the backend manages.
+// List calls are answered from the informers' local cache,
+// and watches for a single object subscribe to the informers' events
+// instead of each opening a watch with the apiserver.
+type informerCache struct {
+	factory   informers.SharedInformerFactory
+	pods      corelisters.PodLister
+	pvcs      corelisters.PersistentVolumeClaimLister
+	pvs       corelisters.PersistentVolumeLister
+	services  corelisters.ServiceLister
+	ingresses netlisters.IngressLister
+	broker    *eventBroker
+	stopCh    chan struct{}
+	stopOnce  *sync.Once
+}
+
+// Start informers for pods, PVCs, services and ingresses in namespace and for all PVs,
+// and block until their caches have synced
+func newInformerCache(clientset kubernetes.Interface, namespace string) (*informerCache, error) {
+	var once sync.Once
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(namespace))
+	c := &informerCache{
+		factory:   factory,
+		pods:      factory.Core().V1().Pods().Lister(),
+		pvcs:      factory.Core().V1().PersistentVolumeClaims().Lister(),
+		pvs:       factory.Core().V1().PersistentVolumes().Lister(),
+		services:  factory.Core().V1().Services().Lister(),
+		ingresses: factory.Networking().V1().Ingresses().Lister(),
+		broker:    newEventBroker(),
+		stopCh:    make(chan struct{}),
+		stopOnce:  &once,
+	}
+	// Forward the events of each informer to the watches subscribed by WatchFor
+	factory.Core().V1().Pods().Informer().AddEventHandler(c.broker.handlerFor("Pod"))
+	factory.Core().V1().PersistentVolumeClaims().Informer().AddEventHandler(c.broker.handlerFor("PVC"))
+	factory.Core().V1().PersistentVolumes().Informer().AddEventHandler(c.broker.handlerFor("PV"))
+	factory.Core().V1().Services().Informer().AddEventHandler(c.broker.handlerFor("SVC"))
+	factory.Networking().V1().Ingresses().Informer().AddEventHandler(c.broker.handlerFor("ING"))
+	// The informers' reflectors resume their watches from the last resourceVersion they saw when the apiserver
+	// closes the stream, and relist when that resourceVersion has expired. A relist passes the current state
+	// of every object to the handlers, including tombstones for objects deleted in the meantime,
+	// so subscribed watches don't miss events while disconnected.
+	watchedInformers := map[string]cache.SharedIndexInformer{
+		"Pod": factory.Core().V1().Pods().Informer(),
+		"PVC": factory.Core().V1().PersistentVolumeClaims().Informer(),
+		"PV":  factory.Core().V1().PersistentVolumes().Informer(),
+		"SVC": factory.Core().V1().Services().Informer(),
+		"ING": factory.Networking().V1().Ingresses().Informer(),
+	}
+	for resourceType, informer := range watchedInformers {
+		err := informer.SetWatchErrorHandler(watchErrorHandlerFor(resourceType))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Couldn't set watch error handler for %s: %s", resourceType, err.Error()))
+		}
+	}
+
+	factory.Start(c.stopCh)
+	for informerType, synced := range factory.WaitForCacheSync(c.stopCh) {
+		if !synced {
+			c.stop()
+			return nil, errors.New(fmt.Sprintf("Informer cache for %s didn't sync", informerType))
+		}
+	}
+	return c, nil
+}
+
+// Stop the informers and close their watches with the apiserver
+func (c *informerCache) stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopCh)
+	})
+}
+
+// Return a handler that logs why the informer's watch for resourceType ended before it reconnects
+func watchErrorHandlerFor(resourceType string) cache.WatchErrorHandler {
+	return func(r *cache.Reflector, err error) {
+		if apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+			fmt.Printf("Watch for %s expired, relisting: %s\n", resourceType, err.Error())
+			return
+		}
+		metrics.APIServerErrors.Inc(fmt.Sprintf("Watch%s", resourceType), string(ReasonForError(classifyError(err))))
+		fmt.Printf("Warning: Watch for %s failed, resuming from the last resourceVersion: %s\n", resourceType, err.Error())
+	}
+}
+
+// Get the cached state of the object of resourceType with name, or false if it isn't in the cache
+func (c *informerCache) get(resourceType string, namespace string, name string) (runtime.Object, bool) {
+	var obj runtime.Object
+	var err error
+	switch resourceType {
+	case "Pod":
+		obj, err = c.pods.Pods(namespace).Get(name)
+	case "PVC":
+		obj, err = c.pvcs.PersistentVolumeClaims(namespace).Get(name)
+	case "PV":
+		obj, err = c.pvs.Get(name)
+	case "SVC":
+		obj, err = c.services.Services(namespace).Get(name)
+	case "ING":
+		obj, err = c.ingresses.Ingresses(namespace).Get(name)
+	default:
+		return nil, false
+	}
+	if err != nil {
+		return nil, false
+	}
+	return obj.DeepCopyObject(), true
+}
+
+// Wait until the informer cache has caught up with written, the object returned by a create or update call,
+// so that lists answered from the cache right after the call include the change.
+// If it doesn't within TimeoutApiCall, that is only logged, since the call itself succeeded.
+func (c *clientsetClient) waitForCache(ctx context.Context, resourceType string, written metav1.Object) {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	ticker := time.NewTicker(cacheWaitInterval)
+	defer ticker.Stop()
+	for {
+		if cached, exists := c.informers.get(resourceType, c.globalConfig.Namespace, written.GetName()); exists {
+			if cachedMeta, err := meta.Accessor(cached); err == nil && resourceVersionReached(cachedMeta.GetResourceVersion(), written.GetResourceVersion()) {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			fmt.Printf("Warning: Informer cache didn't catch up with %s %s: %s\n", resourceType, written.GetName(), ctx.Err().Error())
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Return true if an object cached at resourceVersion cached reflects a write that returned resourceVersion written.
+// ResourceVersions are opaque, but the apiserver's are increasing integers, so a later one also counts.
+func resourceVersionReached(cached string, written string) bool {
+	if cached == written {
+		return true
+	}
+	cachedVersion, cachedErr := strconv.ParseUint(cached, 10, 64)
+	writtenVersion, writtenErr := strconv.ParseUint(written, 10, 64)
+	return cachedErr == nil && writtenErr == nil && cachedVersion >= writtenVersion
+}
+
+// Parse the label and field selectors in opt to filter objects from the cache
+func parseListOptions(opt metav1.ListOptions) (labels.Selector, fields.Selector, error) {
+	labelSelector, err := labels.Parse(opt.LabelSelector)
+	if err != nil {
+		return nil, nil, NewError(ReasonInvalid, fmt.Sprintf("Couldn't parse label selector %s: %s", opt.LabelSelector, err.Error()))
+	}
+	fieldSelector, err := fields.ParseSelector(opt.FieldSelector)
+	if err != nil {
+		return nil, nil, NewError(ReasonInvalid, fmt.Sprintf("Couldn't parse field selector %s: %s", opt.FieldSelector, err.Error()))
+	}
+	return labelSelector, fieldSelector, nil
+}
+
+// Return true if obj matches the field selector, supporting the fields that the backend selects by
+func matchesFieldSelector(selector fields.Selector, obj runtime.Object) bool {
+	if selector == nil || selector.Empty() {
+		return true
+	}
+	objMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return false
+	}
+	set := fields.Set{
+		"metadata.name":      objMeta.GetName(),
+		"metadata.namespace": objMeta.GetNamespace(),
+	}
+	if pod, isPod := obj.(*apiv1.Pod); isPod {
+		set["status.podIP"] = pod.Status.PodIP
+		set["status.phase"] = string(pod.Status.Phase)
+		set["spec.nodeName"] = pod.Spec.NodeName
+	}
+	if event, isEvent := obj.(*apiv1.Event); isEvent {
+		set["involvedObject.kind"] = event.InvolvedObject.Kind
+		set["involvedObject.name"] = event.InvolvedObject.Name
+	}
+	return selector.Matches(set)
+}
+
+// Distributes informer events to the watches subscribed to a single object or to objects matching selectors
+type eventBroker struct {
+	// subscribers["resourceType/name"] is the set of watches for that object
+	subscribers map[string]map[*informerWatch]bool
+	// selectorSubscribers[resourceType] is the set of watches for objects of that type matching their selectors
+	selectorSubscribers map[string]map[*informerWatch]bool
+	mutex               *sync.RWMutex
+}
+
+func newEventBroker() *eventBroker {
+	var m sync.RWMutex
+	return &eventBroker{
+		subscribers:         make(map[string]map[*informerWatch]bool),
+		selectorSubscribers: make(map[string]map[*informerWatch]bool),
+		mutex:               &m,
+	}
+}
+
+func brokerKey(resourceType string, name string) string {
+	return fmt.Sprintf("%s/%s", resourceType, name)
+}
+
+// Return a watch.Interface that receives the informer events for the object of resourceType with name.
+// If current returns the object, its state is sent as an Added event before any other,
+// so that the watch doesn't miss a change that happened before it subscribed.
+func (b *eventBroker) subscribe(resourceType string, name string, current func() (runtime.Object, bool)) *informerWatch {
+	var once sync.Once
+	w := &informerWatch{
+		result:   make(chan watch.Event, informerWatchBufferSize),
+		stopped:  make(chan struct{}),
+		stopOnce: &once,
+		key:      brokerKey(resourceType, name),
+		broker:   b,
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	watches, exists := b.subscribers[w.key]
+	if !exists {
+		watches = make(map[*informerWatch]bool)
+		b.subscribers[w.key] = watches
+	}
+	watches[w] = true
+	// Holding the lock while checking the current state means that no event is published in between,
+	// so the current state can't be sent after a newer event. The result channel is empty, so this doesn't block.
+	if obj, exists := current(); exists {
+		w.result <- watch.Event{Type: watch.Added, Object: obj}
+	}
+	return w
+}
+
+// Return a watch.Interface that receives the informer events for the objects of resourceType
+// matching labelSelector and fieldSelector. The current state of those objects isn't sent.
+func (b *eventBroker) subscribeSelector(resourceType string, labelSelector labels.Selector, fieldSelector fields.Selector) *informerWatch {
+	var once sync.Once
+	w := &informerWatch{
+		result:        make(chan watch.Event, informerWatchBufferSize),
+		stopped:       make(chan struct{}),
+		stopOnce:      &once,
+		key:           resourceType,
+		labelSelector: labelSelector,
+		fieldSelector: fieldSelector,
+		broker:        b,
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	watches, exists := b.selectorSubscribers[resourceType]
+	if !exists {
+		watches = make(map[*informerWatch]bool)
+		b.selectorSubscribers[resourceType] = watches
+	}
+	watches[w] = true
+	return w
+}
+
+func (b *eventBroker) unsubscribe(w *informerWatch) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	subscribers := b.subscribers
+	if w.labelSelector != nil {
+		subscribers = b.selectorSubscribers
+	}
+	delete(subscribers[w.key], w)
+	if len(subscribers[w.key]) == 0 {
+		delete(subscribers, w.key)
+	}
+}
+
+// Send event to each watch subscribed to the object of resourceType in the event
+func (b *eventBroker) publish(resourceType string, eventType watch.EventType, obj interface{}) {
+	// Objects deleted while the informer was disconnected arrive wrapped in a tombstone
+	if tombstone, isTombstone := obj.(cache.DeletedFinalStateUnknown); isTombstone {
+		obj = tombstone.Obj
+	}
+	runtimeObj, isRuntimeObj := obj.(runtime.Object)
+	if !isRuntimeObj {
+		return
+	}
+	objMeta, err := meta.Accessor(runtimeObj)
+	if err != nil {
+		return
+	}
+	event := watch.Event{Type: eventType, Object: runtimeObj}
+	var behind []*informerWatch
+	b.mutex.RLock()
+	for w := range b.subscribers[brokerKey(resourceType, objMeta.GetName())] {
+		if !w.send(event) {
+			behind = append(behind, w)
+		}
+	}
+	for w := range b.selectorSubscribers[resourceType] {
+		if w.labelSelector.Matches(labels.Set(objMeta.GetLabels())) && matchesFieldSelector(w.fieldSelector, runtimeObj) {
+			if !w.send(event) {
+				behind = append(behind, w)
+			}
+		}
+	}
+	b.mutex.RUnlock()
+	// Stopping a watch unsubscribes it, which takes the lock, so this is done after releasing it.
+	// Its reader then sees the result channel close instead of silently missing the event.
+	for _, w := range behind {
+		fmt.Printf("Warning: stopping watch of %s, which fell %d events behind\n", w.key, informerWatchBufferSize)
+		w.Stop()
+	}
+}
+
+// Return the handler to add to the informer for resourceType
+func (b *eventBroker) handlerFor(resourceType string) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			b.publish(resourceType, watch.Added, obj)
+		},
+		UpdateFunc: func(oldObj interface{}, newObj interface{}) {
+			b.publish(resourceType, watch.Modified, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			b.publish(resourceType, watch.Deleted, obj)
+		},
+	}
+}
+
+// watch.Interface for the events of a single object, or of the objects matching its selectors, fed by an eventBroker
+type informerWatch struct {
+	result   chan watch.Event
+	stopped  chan struct{}
+	stopOnce *sync.Once
+	key      string
+	// nil for a watch of a single object
+	labelSelector labels.Selector
+	fieldSelector fields.Selector
+	broker        *eventBroker
+}
+
+func (w *informerWatch) ResultChan() <-chan watch.Event {
+	return w.result
+}
+
+// Send event to the watch without blocking the informer.
+// Returns false if the watch's buffer is full, in which case the watch has to be stopped.
+func (w *informerWatch) send(event watch.Event) bool {
+	select {
+	case w.result <- event:
+		return true
+	case <-w.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// Unsubscribe from the broker and close the result channel
+func (w *informerWatch) Stop() {
+	w.stopOnce.Do(func() {
+		// Closing stopped first makes publish skip this watch while it waits for the broker's lock
+		close(w.stopped)
+		w.broker.unsubscribe(w)
+		close(w.result)
+	})
+}
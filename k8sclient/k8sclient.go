@@ -5,29 +5,88 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"os"
 
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
 	"github.com/deic.dk/user_pods_k8s_backend/util"
 	apiv1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	netv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/httpstream"
 	watch "k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
 )
 
-// Struct to wrap kubernetes client functions
-type K8sClient struct {
-	config        *rest.Config
-	clientset     *kubernetes.Clientset
+// Interface for the kubernetes client functions used by the rest of the backend.
+// NewK8sClient returns one backed by the cluster the backend runs in,
+// and NewFakeK8sClient returns one backed by an in-memory fake clientset for testing.
+type K8sClient interface {
+	WatchFor(ctx context.Context, name string, resourceType string, signalFunc func(watch.Interface, *util.Future), ch *util.Future)
+
+	ListPods(ctx context.Context, opt metav1.ListOptions) (*apiv1.PodList, error)
+	DeletePod(ctx context.Context, name string) error
+	WatchDeletePod(ctx context.Context, name string, finished *util.Future)
+	CreatePod(ctx context.Context, target *apiv1.Pod) (*apiv1.Pod, error)
+	UpdatePod(ctx context.Context, target *apiv1.Pod) (*apiv1.Pod, error)
+	WatchCreatePod(ctx context.Context, name string, ready *util.Future)
+	WatchPods(ctx context.Context, opt metav1.ListOptions) (watch.Interface, error)
+	ListPodEvents(ctx context.Context, name string) (*apiv1.EventList, error)
+
+	ListPVC(ctx context.Context, opt metav1.ListOptions) (*apiv1.PersistentVolumeClaimList, error)
+	DeletePVC(ctx context.Context, name string) error
+	WatchDeletePVC(ctx context.Context, name string, finished *util.Future)
+	CreatePVC(ctx context.Context, target *apiv1.PersistentVolumeClaim) (*apiv1.PersistentVolumeClaim, error)
+	WatchCreatePVC(ctx context.Context, name string, ready *util.Future)
+
+	ListPV(ctx context.Context, opt metav1.ListOptions) (*apiv1.PersistentVolumeList, error)
+	DeletePV(ctx context.Context, name string) error
+	WatchDeletePV(ctx context.Context, name string, finished *util.Future)
+	CreatePV(ctx context.Context, target *apiv1.PersistentVolume) (*apiv1.PersistentVolume, error)
+	WatchCreatePV(ctx context.Context, name string, ready *util.Future)
+
+	ListServices(ctx context.Context, opt metav1.ListOptions) (*apiv1.ServiceList, error)
+	CreateService(ctx context.Context, target *apiv1.Service) (*apiv1.Service, error)
+	UpdateService(ctx context.Context, target *apiv1.Service) (*apiv1.Service, error)
+	DeleteService(ctx context.Context, name string) error
+	WatchDeleteService(ctx context.Context, name string, finished *util.Future)
+
+	ListIngresses(ctx context.Context, opt metav1.ListOptions) (*netv1.IngressList, error)
+	CreateIngress(ctx context.Context, target *netv1.Ingress) (*netv1.Ingress, error)
+	UpdateIngress(ctx context.Context, target *netv1.Ingress) (*netv1.Ingress, error)
+	DeleteIngress(ctx context.Context, name string) error
+
+	PodExec(ctx context.Context, command []string, pod *apiv1.Pod, nContainer int) (bytes.Buffer, bytes.Buffer, error)
+	PodExecStream(ctx context.Context, command []string, pod *apiv1.Pod, nContainer int, options remotecommand.StreamOptions) error
+	GetPodLogs(ctx context.Context, name string, opt *apiv1.PodLogOptions) ([]byte, error)
+
+	CheckAPIServer(ctx context.Context) error
+
+	Stop()
+}
+
+// Struct to wrap kubernetes client functions around a clientset,
+// which is either a real one or the fake one used by FakeK8sClient
+type clientsetClient struct {
+	config       *rest.Config
+	clientset    kubernetes.Interface
 	globalConfig util.GlobalConfig
+	informers    *informerCache
+	retryPolicy  retryPolicy
 }
 
-// initialize a new K8SClient
+// initialize a new K8sClient for the cluster that the backend is running in,
+// or for the cluster in a kubeconfig file when running outside of the cluster
 func NewK8sClient(globalConfig util.GlobalConfig) K8sClient {
-	// Generate the API config from ENV and /var/run/secrets/kubernetes.io/serviceaccount inside a pod
-	config, err := rest.InClusterConfig()
+	config, err := getRestConfig(globalConfig)
 	if err != nil {
 		panic(err.Error())
 	}
@@ -36,197 +95,588 @@ func NewK8sClient(globalConfig util.GlobalConfig) K8sClient {
 	if err != nil {
 		panic(err.Error())
 	}
-	return K8sClient{
-		config:    config,
-		clientset: clientset,
+	// Start the informers that List and Watch calls are answered from
+	informers, err := newInformerCache(clientset, globalConfig.Namespace)
+	if err != nil {
+		panic(err.Error())
+	}
+	return &clientsetClient{
+		config:       config,
+		clientset:    clientset,
 		globalConfig: globalConfig,
+		informers:    informers,
+		retryPolicy:  newRetryPolicy(globalConfig),
 	}
 }
 
-// Set up a watcher to pass to signalFunc, which should ch<-true when the desired event occurs
-func (c *K8sClient) WatchFor(
+// Get the API config for the cluster.
+// If a kubeconfig file is given by globalConfig.Kubeconfig or the KUBECONFIG environment variable, use it.
+// Otherwise use the service account of the pod the backend runs in,
+// and if it isn't running in a pod, fall back to the default kubeconfig file (~/.kube/config).
+// In either case with a kubeconfig file, globalConfig.KubeContext selects the context if it is set.
+func getRestConfig(globalConfig util.GlobalConfig) (*rest.Config, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if globalConfig.Kubeconfig != "" {
+		loadingRules.ExplicitPath = globalConfig.Kubeconfig
+	} else if os.Getenv(clientcmd.RecommendedConfigPathEnvVar) == "" {
+		// Generate the API config from ENV and /var/run/secrets/kubernetes.io/serviceaccount inside a pod
+		config, err := rest.InClusterConfig()
+		if err != rest.ErrNotInCluster {
+			if err == nil {
+				fmt.Printf("Using in-cluster config\n")
+			}
+			return config, err
+		}
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: globalConfig.KubeContext}
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides)
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Not running in a cluster and couldn't load kubeconfig: %s", err.Error()))
+	}
+	rawConfig, err := clientConfig.RawConfig()
+	if err == nil {
+		contextName := rawConfig.CurrentContext
+		if globalConfig.KubeContext != "" {
+			contextName = globalConfig.KubeContext
+		}
+		fmt.Printf("Using kubeconfig context %s, server %s\n", contextName, config.Host)
+	}
+	return config, nil
+}
+
+// Stop the client's informers, closing their watches with the apiserver.
+// Lists and watches can't be answered afterwards.
+func (c *clientsetClient) Stop() {
+	c.informers.stop()
+}
+
+// Return an error if the apiserver can't be reached or doesn't accept the client's credentials.
+// Unlike the other calls, it isn't answered from the informers or retried, so it reflects the apiserver's current state.
+func (c *clientsetClient) CheckAPIServer(ctx context.Context) error {
+	callCtx, cancel := c.callContext(ctx)
+	defer cancel()
+	_, err := c.clientset.CoreV1().Pods(c.globalConfig.Namespace).List(callCtx, metav1.ListOptions{Limit: 1})
+	if err != nil {
+		err = classifyError(err)
+		metrics.APIServerErrors.Inc("CheckAPIServer", string(ReasonForError(err)))
+		return err
+	}
+	return nil
+}
+
+// Derive a context for a single call to the apiserver from ctx, bounded by TimeoutApiCall
+func (c *clientsetClient) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, c.globalConfig.TimeoutApiCall)
+}
+
+// Subscribe a watcher to the informer events for the named object to pass to signalFunc,
+// which should complete ch when the desired event occurs. If ctx is done first, ch fails with ctx's error and the watcher stops.
+// If the object already exists, the watcher first receives its current state as an Added event,
+// so an object that reached the desired state before the watch started is still signalled.
+func (c *clientsetClient) WatchFor(
+	ctx context.Context,
 	name string,
 	resourceType string,
-	signalFunc func(watch.Interface, *util.ReadyChannel),
-	ch *util.ReadyChannel,
+	signalFunc func(watch.Interface, *util.Future),
+	ch *util.Future,
 ) {
-	listOptions := metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", name)}
-	var err error
-	var watcher watch.Interface
-	// create a watcher for the API resource of the correct type
 	switch resourceType {
-	case "Pod":
-		watcher, err = c.clientset.CoreV1().Pods(c.globalConfig.Namespace).Watch(context.TODO(), listOptions)
-	case "PV":
-		watcher, err = c.clientset.CoreV1().PersistentVolumes().Watch(context.TODO(), listOptions)
-	case "PVC":
-		watcher, err = c.clientset.CoreV1().PersistentVolumeClaims(c.globalConfig.Namespace).Watch(context.TODO(), listOptions)
-	case "SVC":
-		watcher, err = c.clientset.CoreV1().Services(c.globalConfig.Namespace).Watch(context.TODO(), listOptions)
+	case "Pod", "PV", "PVC", "SVC":
 	default:
-		err = errors.New("Unsupported resource type for watcher")
-	}
-	if err != nil {
-		ch.Send(false)
-		fmt.Printf("Error in WatchFor: %s\n", err.Error())
+		ch.Fail(errors.New(fmt.Sprintf("Unsupported resource type %s for watcher", resourceType)))
+		fmt.Printf("Error in WatchFor: Unsupported resource type for watcher\n")
 		return
 	}
-	// In a goroutine, wait until there's a value in the channel, and then stop the watcher.
-	// This will ensure that either a successful event or the timeout will terminate signalFunc
+	watcher := c.informers.broker.subscribe(resourceType, name, func() (runtime.Object, bool) {
+		return c.informers.get(resourceType, c.globalConfig.Namespace, name)
+	})
+	// In a goroutine, wait until ch is completed or ctx is done, and then stop the watcher.
+	// This will ensure that either a successful event, the timeout or cancellation will terminate signalFunc
 	go func() {
-		ch.Receive()
+		select {
+		case <-ch.Done():
+		case <-ctx.Done():
+			ch.Fail(classifyError(ctx.Err()))
+		}
 		watcher.Stop()
 	}()
-	// In this goroutine, call the function to ch<-true when the desired event occurs
+	// In this goroutine, call the function to complete ch when the desired event occurs
 	signalFunc(watcher, ch)
 }
 
-// Push ch<-true when watcher receives an event for a ready pod
-func signalPodReady(watcher watch.Interface, ch *util.ReadyChannel) {
+// Log a watch.Error event. The watch source is responsible for reconnecting,
+// so the signal functions keep waiting for the next event rather than failing.
+func logWatchError(event watch.Event) {
+	err := apierrors.FromObject(event.Object)
+	fmt.Printf("Warning: Watch error event, waiting for the watch to resume: %s\n", err.Error())
+}
+
+// Return true if the pod's Ready condition is true
+func podIsReady(pod *apiv1.Pod) bool {
+	// Loop through the pod conditions to find the one that's "Ready"
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == apiv1.PodReady {
+			return condition.Status == apiv1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// Complete ch when watcher receives an event for a ready pod,
+// or fail it if the pod is deleted before it becomes ready
+func signalPodReady(watcher watch.Interface, ch *util.Future) {
 	// Run this loop every time an event is ready in the watcher channel
 	for event := range watcher.ResultChan() {
-		// the event.Object is only sure to be an apiv1.Pod if the event.Type is Modified
-		if event.Type == watch.Modified {
-			// event.Object is a new runtime.Object with the pod in its state after the event
-			eventPod := event.Object.(*apiv1.Pod)
-			// Loop through the pod conditions to find the one that's "Ready"
-			for _, condition := range eventPod.Status.Conditions {
-				if condition.Type == apiv1.PodReady {
-					// If the pod is ready, then stop watching, so the event loop will terminate
-					if condition.Status == apiv1.ConditionTrue {
-						ch.Send(true)
-					}
-					break
-				}
+		switch event.Type {
+		// event.Object is the pod in its state after the event
+		case watch.Added, watch.Modified:
+			eventPod, isPod := event.Object.(*apiv1.Pod)
+			if isPod && podIsReady(eventPod) {
+				ch.Succeed()
 			}
+		case watch.Deleted:
+			ch.Fail(NewError(ReasonNotFound, "Pod was deleted before it was ready"))
+		case watch.Error:
+			logWatchError(event)
+		case watch.Bookmark:
+			// Bookmarks only carry a resourceVersion to resume from
 		}
 	}
 }
 
-// Push ch<-true when the object watcher is watching is deleted
-func signalDeleted(watcher watch.Interface, ch *util.ReadyChannel) {
+// Complete ch when the object watcher is watching is deleted
+func signalDeleted(watcher watch.Interface, ch *util.Future) {
 	for event := range watcher.ResultChan() {
-		if event.Type == watch.Deleted {
-			ch.Send(true)
+		switch event.Type {
+		case watch.Deleted:
+			ch.Succeed()
+		case watch.Error:
+			logWatchError(event)
 		}
 	}
 }
 
-// Push ch<-true when the Persistent Volume is ready
-func signalPVReady(watcher watch.Interface, ch *util.ReadyChannel) {
+// Complete ch when the Persistent Volume is ready, or fail it if the PV is deleted first
+func signalPVReady(watcher watch.Interface, ch *util.Future) {
 	for event := range watcher.ResultChan() {
-		if event.Type == watch.Modified {
-			pv := event.Object.(*apiv1.PersistentVolume)
-			if pv.Status.Phase == apiv1.VolumeAvailable {
-				ch.Send(true)
+		switch event.Type {
+		case watch.Added, watch.Modified:
+			pv, isPV := event.Object.(*apiv1.PersistentVolume)
+			if isPV && pv.Status.Phase == apiv1.VolumeAvailable {
+				ch.Succeed()
 			}
+		case watch.Deleted:
+			ch.Fail(NewError(ReasonNotFound, "PV was deleted before it was available"))
+		case watch.Error:
+			logWatchError(event)
 		}
 	}
 }
 
-// Push ch<-true when when Persistent Volume Claim is bound
-func signalPVCReady(watcher watch.Interface, ch *util.ReadyChannel) {
+// Complete ch when the Persistent Volume Claim is bound, or fail it if the PVC is deleted first
+func signalPVCReady(watcher watch.Interface, ch *util.Future) {
 	for event := range watcher.ResultChan() {
-		if event.Type == watch.Modified {
-			pvc := event.Object.(*apiv1.PersistentVolumeClaim)
-			if pvc.Status.Phase == apiv1.ClaimBound {
-				ch.Send(true)
+		switch event.Type {
+		case watch.Added, watch.Modified:
+			pvc, isPVC := event.Object.(*apiv1.PersistentVolumeClaim)
+			if isPVC && pvc.Status.Phase == apiv1.ClaimBound {
+				ch.Succeed()
 			}
+		case watch.Deleted:
+			ch.Fail(NewError(ReasonNotFound, "PVC was deleted before it was bound"))
+		case watch.Error:
+			logWatchError(event)
 		}
 	}
 }
 
-func (c *K8sClient) ListPods(opt metav1.ListOptions) (*apiv1.PodList, error) {
-	return c.clientset.CoreV1().Pods(c.globalConfig.Namespace).List(context.TODO(), opt)
+// List pods from the informer cache
+func (c *clientsetClient) ListPods(ctx context.Context, opt metav1.ListOptions) (*apiv1.PodList, error) {
+	if ctx.Err() != nil {
+		return nil, classifyError(ctx.Err())
+	}
+	labelSelector, fieldSelector, err := parseListOptions(opt)
+	if err != nil {
+		return nil, err
+	}
+	cached, err := c.informers.pods.Pods(c.globalConfig.Namespace).List(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &apiv1.PodList{}
+	for _, pod := range cached {
+		if matchesFieldSelector(fieldSelector, pod) {
+			list.Items = append(list.Items, *pod.DeepCopy())
+		}
+	}
+	return list, nil
+}
+
+// List the events that kubernetes recorded about the named pod, e.g. why it couldn't be scheduled or pull its image.
+// Events aren't cached by the informers, so this calls the apiserver.
+func (c *clientsetClient) ListPodEvents(ctx context.Context, name string) (*apiv1.EventList, error) {
+	var list *apiv1.EventList
+	opt := metav1.ListOptions{FieldSelector: fmt.Sprintf("involvedObject.kind=Pod,involvedObject.name=%s", name)}
+	_, err := c.withRetry(ctx, "ListPodEvents", fmt.Sprintf("list events of pod %s", name), func(ctx context.Context) error {
+		var err error
+		list, err = c.clientset.CoreV1().Events(c.globalConfig.Namespace).List(ctx, opt)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (c *clientsetClient) DeletePod(ctx context.Context, name string) error {
+	_, err := c.withRetry(ctx, "DeletePod", fmt.Sprintf("delete pod %s", name), func(ctx context.Context) error {
+		return c.clientset.CoreV1().Pods(c.globalConfig.Namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	})
+	return err
+}
+
+func (c *clientsetClient) WatchDeletePod(ctx context.Context, name string, finished *util.Future) {
+	c.WatchFor(ctx, name, "Pod", signalDeleted, finished)
+}
+
+func (c *clientsetClient) CreatePod(ctx context.Context, target *apiv1.Pod) (*apiv1.Pod, error) {
+	var created *apiv1.Pod
+	attempts, err := c.withRetry(ctx, "CreatePod", fmt.Sprintf("create pod %s", target.Name), func(ctx context.Context) error {
+		var err error
+		created, err = c.clientset.CoreV1().Pods(c.globalConfig.Namespace).Create(ctx, target, metav1.CreateOptions{})
+		return err
+	})
+	// An earlier attempt that timed out may have created the pod after all.
+	// Other resources are created idempotently by their callers, but a pod that already exists is a name conflict.
+	if attempts > 1 && IsAlreadyExists(err) {
+		getCtx, cancel := c.callContext(ctx)
+		defer cancel()
+		existing, getErr := c.clientset.CoreV1().Pods(c.globalConfig.Namespace).Get(getCtx, target.Name, metav1.GetOptions{})
+		if getErr == nil && util.GetUserIDFromLabels(existing.Labels) == util.GetUserIDFromLabels(target.Labels) {
+			fmt.Printf("Pod %s was created by an earlier attempt\n", target.Name)
+			return existing, nil
+		}
+	}
+	if err == nil {
+		c.waitForCache(ctx, "Pod", created)
+	}
+	return created, err
 }
 
-func (c *K8sClient) DeletePod(name string) error {
-	return c.clientset.CoreV1().Pods(c.globalConfig.Namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+// Replace the pod with target, which must have the resourceVersion of the existing one.
+// Kubernetes only allows few fields of a pod to change, like its annotations.
+// Fails with a Conflict error if the pod changed in the meantime.
+func (c *clientsetClient) UpdatePod(ctx context.Context, target *apiv1.Pod) (*apiv1.Pod, error) {
+	var updated *apiv1.Pod
+	_, err := c.withRetry(ctx, "UpdatePod", fmt.Sprintf("update pod %s", target.Name), func(ctx context.Context) error {
+		var err error
+		updated, err = c.clientset.CoreV1().Pods(c.globalConfig.Namespace).Update(ctx, target, metav1.UpdateOptions{})
+		return err
+	})
+	if err == nil {
+		c.waitForCache(ctx, "Pod", updated)
+	}
+	return updated, err
+}
+
+func (c *clientsetClient) WatchCreatePod(ctx context.Context, name string, ready *util.Future) {
+	c.WatchFor(ctx, name, "Pod", signalPodReady, ready)
+}
+
+// Watch the events of all pods matching the selectors in opt, until ctx is done or the watch is stopped.
+// Unlike WatchFor, the pods' current state isn't sent, so list them after starting the watch to get it.
+// The events come from the shared informer, which doesn't wait for the caller,
+// so the watch is stopped and its result channel closed if the caller falls too far behind.
+func (c *clientsetClient) WatchPods(ctx context.Context, opt metav1.ListOptions) (watch.Interface, error) {
+	labelSelector, fieldSelector, err := parseListOptions(opt)
+	if err != nil {
+		return nil, err
+	}
+	watcher := c.informers.broker.subscribeSelector("Pod", labelSelector, fieldSelector)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-watcher.stopped:
+		}
+		watcher.Stop()
+	}()
+	return watcher, nil
 }
 
-func (c *K8sClient) WatchDeletePod(name string, finished *util.ReadyChannel) {
-	c.WatchFor(name, "Pod", signalDeleted, finished)
+// List PVCs from the informer cache
+func (c *clientsetClient) ListPVC(ctx context.Context, opt metav1.ListOptions) (*apiv1.PersistentVolumeClaimList, error) {
+	if ctx.Err() != nil {
+		return nil, classifyError(ctx.Err())
+	}
+	labelSelector, fieldSelector, err := parseListOptions(opt)
+	if err != nil {
+		return nil, err
+	}
+	cached, err := c.informers.pvcs.PersistentVolumeClaims(c.globalConfig.Namespace).List(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &apiv1.PersistentVolumeClaimList{}
+	for _, pvc := range cached {
+		if matchesFieldSelector(fieldSelector, pvc) {
+			list.Items = append(list.Items, *pvc.DeepCopy())
+		}
+	}
+	return list, nil
 }
 
-func (c *K8sClient) CreatePod(target *apiv1.Pod) (*apiv1.Pod, error) {
-	return c.clientset.CoreV1().Pods(c.globalConfig.Namespace).Create(context.TODO(), target, metav1.CreateOptions{})
+func (c *clientsetClient) DeletePVC(ctx context.Context, name string) error {
+	_, err := c.withRetry(ctx, "DeletePVC", fmt.Sprintf("delete PVC %s", name), func(ctx context.Context) error {
+		return c.clientset.CoreV1().PersistentVolumeClaims(c.globalConfig.Namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	})
+	return err
 }
 
-func (c *K8sClient) WatchCreatePod(name string, ready *util.ReadyChannel) {
-	c.WatchFor(name, "Pod", signalPodReady, ready)
+func (c *clientsetClient) WatchDeletePVC(ctx context.Context, name string, finished *util.Future) {
+	c.WatchFor(ctx, name, "PVC", signalDeleted, finished)
 }
 
-func (c *K8sClient) ListPVC(opt metav1.ListOptions) (*apiv1.PersistentVolumeClaimList, error) {
-	return c.clientset.CoreV1().PersistentVolumeClaims(c.globalConfig.Namespace).List(context.TODO(), opt)
+func (c *clientsetClient) CreatePVC(ctx context.Context, target *apiv1.PersistentVolumeClaim) (*apiv1.PersistentVolumeClaim, error) {
+	var created *apiv1.PersistentVolumeClaim
+	_, err := c.withRetry(ctx, "CreatePVC", fmt.Sprintf("create PVC %s", target.Name), func(ctx context.Context) error {
+		var err error
+		created, err = c.clientset.CoreV1().PersistentVolumeClaims(c.globalConfig.Namespace).Create(ctx, target, metav1.CreateOptions{})
+		return err
+	})
+	if err == nil {
+		c.waitForCache(ctx, "PVC", created)
+	}
+	return created, err
 }
 
-func (c *K8sClient) DeletePVC(name string) error {
-	return c.clientset.CoreV1().PersistentVolumeClaims(c.globalConfig.Namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+func (c *clientsetClient) WatchCreatePVC(ctx context.Context, name string, ready *util.Future) {
+	c.WatchFor(ctx, name, "PVC", signalPVCReady, ready)
 }
 
-func (c *K8sClient) WatchDeletePVC(name string, finished *util.ReadyChannel) {
-	c.WatchFor(name, "PVC", signalDeleted, finished)
+// List PVs from the informer cache
+func (c *clientsetClient) ListPV(ctx context.Context, opt metav1.ListOptions) (*apiv1.PersistentVolumeList, error) {
+	if ctx.Err() != nil {
+		return nil, classifyError(ctx.Err())
+	}
+	labelSelector, fieldSelector, err := parseListOptions(opt)
+	if err != nil {
+		return nil, err
+	}
+	cached, err := c.informers.pvs.List(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &apiv1.PersistentVolumeList{}
+	for _, pv := range cached {
+		if matchesFieldSelector(fieldSelector, pv) {
+			list.Items = append(list.Items, *pv.DeepCopy())
+		}
+	}
+	return list, nil
 }
 
-func (c *K8sClient) CreatePVC(target *apiv1.PersistentVolumeClaim) (*apiv1.PersistentVolumeClaim, error) {
-	return c.clientset.CoreV1().PersistentVolumeClaims(c.globalConfig.Namespace).Create(context.TODO(), target, metav1.CreateOptions{})
+func (c *clientsetClient) DeletePV(ctx context.Context, name string) error {
+	_, err := c.withRetry(ctx, "DeletePV", fmt.Sprintf("delete PV %s", name), func(ctx context.Context) error {
+		return c.clientset.CoreV1().PersistentVolumes().Delete(ctx, name, metav1.DeleteOptions{})
+	})
+	return err
 }
 
-func (c *K8sClient) WatchCreatePVC(name string, ready *util.ReadyChannel) {
-	c.WatchFor(name, "PVC", signalPVCReady, ready)
+func (c *clientsetClient) WatchDeletePV(ctx context.Context, name string, finished *util.Future) {
+	c.WatchFor(ctx, name, "PV", signalDeleted, finished)
 }
 
-func (c *K8sClient) ListPV(opt metav1.ListOptions) (*apiv1.PersistentVolumeList, error) {
-	return c.clientset.CoreV1().PersistentVolumes().List(context.TODO(), opt)
+func (c *clientsetClient) CreatePV(ctx context.Context, target *apiv1.PersistentVolume) (*apiv1.PersistentVolume, error) {
+	var created *apiv1.PersistentVolume
+	_, err := c.withRetry(ctx, "CreatePV", fmt.Sprintf("create PV %s", target.Name), func(ctx context.Context) error {
+		var err error
+		created, err = c.clientset.CoreV1().PersistentVolumes().Create(ctx, target, metav1.CreateOptions{})
+		return err
+	})
+	if err == nil {
+		c.waitForCache(ctx, "PV", created)
+	}
+	return created, err
 }
 
-func (c *K8sClient) DeletePV(name string) error {
-	return c.clientset.CoreV1().PersistentVolumes().Delete(context.TODO(), name, metav1.DeleteOptions{})
+func (c *clientsetClient) WatchCreatePV(ctx context.Context, name string, ready *util.Future) {
+	c.WatchFor(ctx, name, "PV", signalPVReady, ready)
 }
 
-func (c *K8sClient) WatchDeletePV(name string, finished *util.ReadyChannel) {
-	c.WatchFor(name, "PV", signalDeleted, finished)
+// List services from the informer cache
+func (c *clientsetClient) ListServices(ctx context.Context, opt metav1.ListOptions) (*apiv1.ServiceList, error) {
+	if ctx.Err() != nil {
+		return nil, classifyError(ctx.Err())
+	}
+	labelSelector, fieldSelector, err := parseListOptions(opt)
+	if err != nil {
+		return nil, err
+	}
+	cached, err := c.informers.services.Services(c.globalConfig.Namespace).List(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &apiv1.ServiceList{}
+	for _, service := range cached {
+		if matchesFieldSelector(fieldSelector, service) {
+			list.Items = append(list.Items, *service.DeepCopy())
+		}
+	}
+	return list, nil
 }
 
-func (c *K8sClient) CreatePV(target *apiv1.PersistentVolume) (*apiv1.PersistentVolume, error) {
-	return c.clientset.CoreV1().PersistentVolumes().Create(context.TODO(), target, metav1.CreateOptions{})
+func (c *clientsetClient) CreateService(ctx context.Context, target *apiv1.Service) (*apiv1.Service, error) {
+	var created *apiv1.Service
+	_, err := c.withRetry(ctx, "CreateService", fmt.Sprintf("create SVC %s", target.Name), func(ctx context.Context) error {
+		var err error
+		created, err = c.clientset.CoreV1().Services(c.globalConfig.Namespace).Create(ctx, target, metav1.CreateOptions{})
+		return err
+	})
+	if err == nil {
+		c.waitForCache(ctx, "SVC", created)
+	}
+	return created, err
 }
 
-func (c *K8sClient) WatchCreatePV(name string, ready *util.ReadyChannel) {
-	c.WatchFor(name, "PV", signalPVReady, ready)
+// Replace the service with target, which must have the resourceVersion of the existing one.
+// Fails with a Conflict error if the service changed in the meantime.
+func (c *clientsetClient) UpdateService(ctx context.Context, target *apiv1.Service) (*apiv1.Service, error) {
+	var updated *apiv1.Service
+	_, err := c.withRetry(ctx, "UpdateService", fmt.Sprintf("update SVC %s", target.Name), func(ctx context.Context) error {
+		var err error
+		updated, err = c.clientset.CoreV1().Services(c.globalConfig.Namespace).Update(ctx, target, metav1.UpdateOptions{})
+		return err
+	})
+	if err == nil {
+		c.waitForCache(ctx, "SVC", updated)
+	}
+	return updated, err
 }
 
-func (c *K8sClient) ListServices(opt metav1.ListOptions) (*apiv1.ServiceList, error) {
-	return c.clientset.CoreV1().Services(c.globalConfig.Namespace).List(context.TODO(), opt)
+func (c *clientsetClient) DeleteService(ctx context.Context, name string) error {
+	_, err := c.withRetry(ctx, "DeleteService", fmt.Sprintf("delete SVC %s", name), func(ctx context.Context) error {
+		return c.clientset.CoreV1().Services(c.globalConfig.Namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	})
+	return err
 }
 
-func (c *K8sClient) CreateService(target *apiv1.Service) (*apiv1.Service, error) {
-	return c.clientset.CoreV1().Services(c.globalConfig.Namespace).Create(context.TODO(), target, metav1.CreateOptions{})
+func (c *clientsetClient) WatchDeleteService(ctx context.Context, name string, finished *util.Future) {
+	c.WatchFor(ctx, name, "SVC", signalDeleted, finished)
 }
 
-func (c *K8sClient) DeleteService(name string) error {
-	return c.clientset.CoreV1().Services(c.globalConfig.Namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+// List ingresses from the informer cache
+func (c *clientsetClient) ListIngresses(ctx context.Context, opt metav1.ListOptions) (*netv1.IngressList, error) {
+	if ctx.Err() != nil {
+		return nil, classifyError(ctx.Err())
+	}
+	labelSelector, fieldSelector, err := parseListOptions(opt)
+	if err != nil {
+		return nil, err
+	}
+	cached, err := c.informers.ingresses.Ingresses(c.globalConfig.Namespace).List(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &netv1.IngressList{}
+	for _, ingress := range cached {
+		if matchesFieldSelector(fieldSelector, ingress) {
+			list.Items = append(list.Items, *ingress.DeepCopy())
+		}
+	}
+	return list, nil
 }
 
-func (c *K8sClient) WatchDeleteService(name string, finished *util.ReadyChannel) {
-	c.WatchFor(name, "SVC", signalDeleted, finished)
+func (c *clientsetClient) CreateIngress(ctx context.Context, target *netv1.Ingress) (*netv1.Ingress, error) {
+	var created *netv1.Ingress
+	_, err := c.withRetry(ctx, "CreateIngress", fmt.Sprintf("create ING %s", target.Name), func(ctx context.Context) error {
+		var err error
+		created, err = c.clientset.NetworkingV1().Ingresses(c.globalConfig.Namespace).Create(ctx, target, metav1.CreateOptions{})
+		return err
+	})
+	if err == nil {
+		c.waitForCache(ctx, "ING", created)
+	}
+	return created, err
 }
 
-func (c *K8sClient) ListIngresses(opt metav1.ListOptions) (*netv1.IngressList, error) {
-	return c.clientset.NetworkingV1().Ingresses(c.globalConfig.Namespace).List(context.TODO(), opt)
+// Replace the ingress with target, which must have the resourceVersion of the existing one.
+// Fails with a Conflict error if the ingress changed in the meantime.
+func (c *clientsetClient) UpdateIngress(ctx context.Context, target *netv1.Ingress) (*netv1.Ingress, error) {
+	var updated *netv1.Ingress
+	_, err := c.withRetry(ctx, "UpdateIngress", fmt.Sprintf("update ING %s", target.Name), func(ctx context.Context) error {
+		var err error
+		updated, err = c.clientset.NetworkingV1().Ingresses(c.globalConfig.Namespace).Update(ctx, target, metav1.UpdateOptions{})
+		return err
+	})
+	if err == nil {
+		c.waitForCache(ctx, "ING", updated)
+	}
+	return updated, err
 }
 
-func (c *K8sClient) CreateIngress(target *netv1.Ingress) (*netv1.Ingress, error) {
-	return c.clientset.NetworkingV1().Ingresses(c.globalConfig.Namespace).Create(context.TODO(), target, metav1.CreateOptions{})
+func (c *clientsetClient) DeleteIngress(ctx context.Context, name string) error {
+	_, err := c.withRetry(ctx, "DeleteIngress", fmt.Sprintf("delete ING %s", name), func(ctx context.Context) error {
+		return c.clientset.NetworkingV1().Ingresses(c.globalConfig.Namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	})
+	return err
 }
 
-func (c *K8sClient) DeleteIngress(name string) error {
-	return c.clientset.NetworkingV1().Ingresses(c.globalConfig.Namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+// Get the logs of a container in the named pod, selected by opt.
+// If opt.LimitBytes is set, no more than that is returned, even if the apiserver sends more.
+func (c *clientsetClient) GetPodLogs(ctx context.Context, name string, opt *apiv1.PodLogOptions) ([]byte, error) {
+	var logs []byte
+	_, err := c.withRetry(ctx, "GetPodLogs", fmt.Sprintf("get logs of pod %s", name), func(ctx context.Context) error {
+		var err error
+		logs, err = c.clientset.CoreV1().Pods(c.globalConfig.Namespace).GetLogs(name, opt).DoRaw(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opt.LimitBytes != nil && int64(len(logs)) > *opt.LimitBytes {
+		logs = logs[:*opt.LimitBytes]
+	}
+	return logs, nil
 }
 
-// call a bash command inside of a pod, with the command given as a []string of bash words
-func (c *K8sClient) PodExec(command []string, pod *apiv1.Pod, nContainer int) (bytes.Buffer, bytes.Buffer, error) {
+// call a bash command inside of a pod, with the command given as a []string of bash words.
+// The stream is closed as soon as ctx is done. If the stream can't be opened or is reset,
+// the command is run again, so it should be safe to repeat.
+func (c *clientsetClient) PodExec(ctx context.Context, command []string, pod *apiv1.Pod, nContainer int) (bytes.Buffer, bytes.Buffer, error) {
 	var stdout, stderr bytes.Buffer
+	_, err := c.withRetry(ctx, "PodExec", fmt.Sprintf("exec in pod %s", pod.Name), func(ctx context.Context) error {
+		// Discard the output of a failed attempt
+		stdout.Reset()
+		stderr.Reset()
+		return c.podExecOnce(ctx, command, pod, nContainer, &stdout, &stderr)
+	})
+	return stdout, stderr, err
+}
+
+// Make a single exec call for PodExec, writing the output to stdout and stderr
+func (c *clientsetClient) podExecOnce(ctx context.Context, command []string, pod *apiv1.Pod, nContainer int, stdout, stderr *bytes.Buffer) error {
+	return c.streamExec(ctx, command, pod, nContainer, remotecommand.StreamOptions{
+		Stdin:  nil,
+		Stdout: stdout,
+		Stderr: stderr,
+		Tty:    false,
+	})
+}
+
+// call a command inside of a pod with the streams in options, e.g. an interactive shell with stdin and a TTY.
+// Unlike PodExec, this isn't retried, since what was already read from stdin can't be sent again.
+// The stream is closed as soon as ctx is done.
+func (c *clientsetClient) PodExecStream(ctx context.Context, command []string, pod *apiv1.Pod, nContainer int, options remotecommand.StreamOptions) error {
+	err := classifyError(c.streamExec(ctx, command, pod, nContainer, options))
+	if err != nil {
+		metrics.APIServerErrors.Inc("PodExecStream", string(ReasonForError(err)))
+	}
+	return err
+}
+
+// Make a single exec call, asking for the streams that are set in options
+func (c *clientsetClient) streamExec(ctx context.Context, command []string, pod *apiv1.Pod, nContainer int, options remotecommand.StreamOptions) error {
 	restRequest := c.clientset.CoreV1().RESTClient().Post().
 		Resource("pods").
 		Name(pod.Name).
@@ -236,26 +686,56 @@ func (c *K8sClient) PodExec(command []string, pod *apiv1.Pod, nContainer int) (b
 			&apiv1.PodExecOptions{
 				Container: pod.Spec.Containers[nContainer].Name,
 				Command:   command,
-				Stdin:     false,
-				Stdout:    true,
-				Stderr:    true,
-				TTY:       false,
+				Stdin:     options.Stdin != nil,
+				Stdout:    options.Stdout != nil,
+				Stderr:    options.Stderr != nil,
+				TTY:       options.Tty,
 			},
 			scheme.ParameterCodec,
 		)
-	exec, err := remotecommand.NewSPDYExecutor(c.config, "POST", restRequest.URL())
+	exec, err := newContextExecutor(ctx, c.config, restRequest.URL())
 	if err != nil {
-		return stdout, stderr, errors.New(fmt.Sprintf("Couldn't create executor: %s", err.Error()))
+		return errors.New(fmt.Sprintf("Couldn't create executor: %s", err.Error()))
 	}
 
-	err = exec.Stream(remotecommand.StreamOptions{
-		Stdin:  nil,
-		Stdout: &stdout,
-		Stderr: &stderr,
-		Tty:    false,
-	})
+	err = exec.Stream(options)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("Stream error: %w", ctx.Err())
+		}
+		// Wrap err so that a reset stream or an unavailable apiserver is classified as retryable
+		return fmt.Errorf("Stream error: %w", err)
+	}
+	return nil
+}
+
+// Make an SPDY executor for target whose connection is closed when ctx is done.
+// remotecommand in this version of client-go can't cancel a stream by itself.
+func newContextExecutor(ctx context.Context, config *rest.Config, target *url.URL) (remotecommand.Executor, error) {
+	transport, upgrader, err := spdy.RoundTripperFor(config)
 	if err != nil {
-		return stdout, stderr, errors.New(fmt.Sprintf("Stream error: %s", err.Error()))
+		return nil, err
 	}
-	return stdout, stderr, nil
+	return remotecommand.NewSPDYExecutorForTransports(transport, &contextUpgrader{ctx: ctx, upgrader: upgrader}, "POST", target)
+}
+
+// spdy.Upgrader that closes the upgraded connection when ctx is done
+type contextUpgrader struct {
+	ctx      context.Context
+	upgrader spdy.Upgrader
+}
+
+func (u *contextUpgrader) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	conn, err := u.upgrader.NewConnection(resp)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-u.ctx.Done():
+			conn.Close()
+		case <-conn.CloseChan():
+		}
+	}()
+	return conn, nil
 }
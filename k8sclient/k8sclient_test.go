@@ -0,0 +1,478 @@
+package k8sclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	watch "k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newFakeClient() *FakeK8sClient {
+	config := util.MustLoadGlobalConfig()
+	return NewFakeK8sClient(config)
+}
+
+func fakePod(name string, namespace string) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{"user": "foo", "domain": "bar"},
+		},
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{{Name: "fake", Image: "fake"}},
+		},
+	}
+}
+
+func TestFakeFieldSelectors(t *testing.T) {
+	ctx := context.Background()
+	config := util.MustLoadGlobalConfig()
+	// Objects given to the constructor are in the informer cache as soon as it returns
+	c := NewFakeK8sClient(config, fakePod("foo", config.Namespace), fakePod("bar", config.Namespace))
+	podList, err := c.ListPods(ctx, metav1.ListOptions{FieldSelector: "metadata.name=foo"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(podList.Items) != 1 || podList.Items[0].Name != "foo" {
+		t.Fatalf("Listing by metadata.name=foo returned %d pods", len(podList.Items))
+	}
+	podList, err = c.ListPods(ctx, metav1.ListOptions{LabelSelector: "user=foo,domain=bar"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(podList.Items) != 2 {
+		t.Fatalf("Listing by label should return both pods, but returned %d", len(podList.Items))
+	}
+	// Lists from the cache must be copies, so that callers can't modify the cache
+	podList.Items[0].Labels["user"] = "modified"
+	podList, err = c.ListPods(ctx, metav1.ListOptions{LabelSelector: "user=foo,domain=bar"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(podList.Items) != 2 {
+		t.Fatal("Modifying a listed pod modified the informer cache")
+	}
+}
+
+func TestFakeLifecycle(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeClient()
+	ready := util.NewFuture(5 * time.Second)
+	go c.WatchCreatePod(ctx, "foo", ready)
+	// Give the watch time to start before the pod becomes ready
+	time.Sleep(10 * time.Millisecond)
+	_, err := c.CreatePod(ctx, fakePod("foo", c.globalConfig.Namespace))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ready.Wait(); err != nil {
+		t.Fatalf("Fake pod didn't reach ready state: %s", err.Error())
+	}
+	podList, err := c.ListPods(ctx, metav1.ListOptions{FieldSelector: "metadata.name=foo"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	podIP := podList.Items[0].Status.PodIP
+	podList, err = c.ListPods(ctx, metav1.ListOptions{FieldSelector: "status.podIP=" + podIP})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(podList.Items) != 1 {
+		t.Fatalf("Couldn't find the fake pod by its IP %s", podIP)
+	}
+
+	c.SetFile("foo", "/tmp/token", "secret")
+	stdout, _, err := c.PodExec(ctx, []string{"cat", "/tmp/token"}, &podList.Items[0], 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if stdout.String() != "secret" {
+		t.Fatalf("Fake exec returned %s instead of the file content", stdout.String())
+	}
+
+	finished := util.NewFuture(5 * time.Second)
+	go c.WatchDeletePod(ctx, "foo", finished)
+	time.Sleep(10 * time.Millisecond)
+	err = c.DeletePod(ctx, "foo")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := finished.Wait(); err != nil {
+		t.Fatalf("Fake pod wasn't deleted: %s", err.Error())
+	}
+	err = c.DeletePod(ctx, "foo")
+	if err == nil {
+		t.Fatal("Deleting a pod that doesn't exist should fail")
+	}
+}
+
+func TestFakeWatchAfterReady(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeClient()
+	_, err := c.CreatePod(ctx, fakePod("foo", c.globalConfig.Namespace))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Wait until the pod is ready in the cache before starting the watch
+	for i := 0; i < 100; i++ {
+		pod, exists := c.informers.get("Pod", c.globalConfig.Namespace, "foo")
+		if exists && podIsReady(pod.(*apiv1.Pod)) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ready := util.NewFuture(time.Second)
+	go c.WatchCreatePod(ctx, "foo", ready)
+	if err := ready.Wait(); err != nil {
+		t.Fatalf("Watch started after the pod became ready didn't signal ready: %s", err.Error())
+	}
+}
+
+func TestFakeWatchCancel(t *testing.T) {
+	c := newFakeClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := util.NewFuture(time.Minute)
+	go c.WatchCreatePod(ctx, "foo", ready)
+	cancel()
+	select {
+	case <-ready.Done():
+		if ReasonForError(ready.Err()) != ReasonCanceled {
+			t.Fatalf("Cancelled watch completed with %v instead of being cancelled", ready.Err())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Cancelled watch didn't complete the Future")
+	}
+}
+
+func TestSignalPodReadyEvents(t *testing.T) {
+	readyPod := fakePod("foo", "default")
+	readyPod.Status.Conditions = []apiv1.PodCondition{{Type: apiv1.PodReady, Status: apiv1.ConditionTrue}}
+	tests := []struct {
+		description string
+		events      []watch.Event
+		expected    bool
+	}{
+		{
+			"error and bookmark events before ready",
+			[]watch.Event{
+				{Type: watch.Error, Object: &metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonExpired}},
+				{Type: watch.Bookmark, Object: fakePod("foo", "default")},
+				{Type: watch.Modified, Object: readyPod},
+			},
+			true,
+		},
+		{
+			"pod deleted before ready",
+			[]watch.Event{
+				{Type: watch.Added, Object: fakePod("foo", "default")},
+				{Type: watch.Deleted, Object: fakePod("foo", "default")},
+			},
+			false,
+		},
+	}
+	for _, test := range tests {
+		watcher := watch.NewFake()
+		ch := util.NewFuture(time.Second)
+		go signalPodReady(watcher, ch)
+		for _, event := range test.events {
+			watcher.Action(event.Type, event.Object)
+		}
+		if (ch.Wait() == nil) != test.expected {
+			t.Fatalf("Expected %t after %s", test.expected, test.description)
+		}
+		watcher.Stop()
+	}
+}
+
+func TestFakeErrorReasons(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeClient()
+	defer c.Stop()
+	_, err := c.CreatePod(ctx, fakePod("foo", c.globalConfig.Namespace))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = c.CreatePod(ctx, fakePod("foo", c.globalConfig.Namespace))
+	if !IsAlreadyExists(err) {
+		t.Fatalf("Creating a pod twice should give AlreadyExists, got %s", ReasonForError(err))
+	}
+	err = c.DeleteService(ctx, "doesnotexist")
+	if !IsNotFound(err) {
+		t.Fatalf("Deleting a service that doesn't exist should give NotFound, got %s", ReasonForError(err))
+	}
+	_, err = c.ListPods(ctx, metav1.ListOptions{LabelSelector: "user in (("})
+	if ReasonForError(err) != ReasonInvalid {
+		t.Fatalf("Listing with an invalid selector should give Invalid, got %s", ReasonForError(err))
+	}
+	// The reason is kept through wrapping
+	if !IsNotFound(fmt.Errorf("wrapped: %w", NewError(ReasonNotFound, "not found"))) {
+		t.Fatal("Wrapped error lost its reason")
+	}
+}
+
+func TestFakeRetry(t *testing.T) {
+	ctx := context.Background()
+	config := util.MustLoadGlobalConfig()
+	config.RetryMaxAttempts = 3
+	config.RetryInitialBackoff = time.Millisecond
+	config.RetryMaxBackoff = 10 * time.Millisecond
+	c := NewFakeK8sClient(config)
+	defer c.Stop()
+	service := &apiv1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: config.Namespace}}
+
+	// Fail the first `failures` create calls with failErr before letting them through
+	var attempts, failures int
+	var failErr error
+	c.Clientset.PrependReactor("create", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		attempts++
+		if attempts <= failures {
+			return true, nil, failErr
+		}
+		return false, nil, nil
+	})
+	tests := []struct {
+		description string
+		failures    int
+		failErr     error
+		attempts    int
+		reason      ErrorReason
+	}{
+		{"transient errors are retried", 2, apierrors.NewTooManyRequests("slow down", 0), 3, ""},
+		{"retries give up after RetryMaxAttempts", 5, apierrors.NewServiceUnavailable("unavailable"), 3, ReasonUnavailable},
+		{
+			"other errors aren't retried",
+			5,
+			apierrors.NewForbidden(schema.GroupResource{Resource: "services"}, "foo", errors.New("quota exceeded")),
+			1,
+			ReasonForbidden,
+		},
+	}
+	for i, test := range tests {
+		attempts, failures, failErr = 0, test.failures, test.failErr
+		service.Name = fmt.Sprintf("foo-%d", i)
+		failErrReason := string(ReasonForError(classifyError(test.failErr)))
+		errorsBefore := metrics.APIServerErrors.Value("CreateService", failErrReason)
+		_, err := c.CreateService(ctx, service)
+		if test.reason == "" && err != nil {
+			t.Fatalf("Expected success when %s, got %s", test.description, err.Error())
+		}
+		if test.reason != "" && ReasonForError(err) != test.reason {
+			t.Fatalf("Expected %s when %s, got %s", test.reason, test.description, ReasonForError(err))
+		}
+		if attempts != test.attempts {
+			t.Fatalf("Create was attempted %d times instead of %d when %s", attempts, test.attempts, test.description)
+		}
+		failedAttempts := test.attempts
+		if test.reason == "" {
+			failedAttempts = test.failures
+		}
+		if counted := metrics.APIServerErrors.Value("CreateService", failErrReason) - errorsBefore; counted != float64(failedAttempts) {
+			t.Fatalf("Counted %v apiserver errors instead of %d when %s", counted, failedAttempts, test.description)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 10, initialBackoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{5, time.Second},
+		{9, time.Second},
+	}
+	for _, test := range tests {
+		backoff := policy.backoff(test.attempt)
+		if backoff < test.max/2 || backoff > test.max {
+			t.Fatalf("Backoff after attempt %d was %s, should be between %s and %s", test.attempt, backoff, test.max/2, test.max)
+		}
+	}
+}
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: dev
+  cluster:
+    server: https://dev.example.com:6443
+- name: kind
+  cluster:
+    server: https://127.0.0.1:6443
+users:
+- name: tester
+  user:
+    token: faketoken
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: tester
+- name: kind
+  context:
+    cluster: kind
+    user: tester
+current-context: dev
+`
+
+func TestKubeconfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	err := ioutil.WriteFile(path, []byte(testKubeconfig), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config := util.MustLoadGlobalConfig()
+	config.Kubeconfig = path
+	tests := []struct {
+		context string
+		host    string
+	}{
+		{"", "https://dev.example.com:6443"},
+		{"dev", "https://dev.example.com:6443"},
+		{"kind", "https://127.0.0.1:6443"},
+	}
+	for _, test := range tests {
+		config.KubeContext = test.context
+		restConfig, err := getRestConfig(config)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if restConfig.Host != test.host {
+			t.Fatalf("Context %s gave host %s, expected %s", test.context, restConfig.Host, test.host)
+		}
+	}
+	config.KubeContext = "doesnotexist"
+	_, err = getRestConfig(config)
+	if err == nil {
+		t.Fatal("Loading a context that doesn't exist should fail")
+	}
+}
+
+func TestFakeReadAfterWrite(t *testing.T) {
+	ctx := context.Background()
+	config := util.MustLoadGlobalConfig()
+	c := NewFakeK8sClient(config)
+	defer c.Stop()
+	// Lists right after a write are answered from the informer cache, so it must have caught up
+	service := &apiv1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo-ssh", Labels: map[string]string{"createdForPod": "foo"}}}
+	created, err := c.CreateService(ctx, service)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	serviceList, err := c.ListServices(ctx, metav1.ListOptions{LabelSelector: "createdForPod=foo"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(serviceList.Items) != 1 {
+		t.Fatalf("Listing right after creating a service returned %d services", len(serviceList.Items))
+	}
+	created.Spec.Type = apiv1.ServiceTypeNodePort
+	updated, err := c.UpdateService(ctx, created)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !resourceVersionReached(updated.ResourceVersion, created.ResourceVersion) || updated.ResourceVersion == created.ResourceVersion {
+		t.Fatalf("Update gave resourceVersion %s after %s", updated.ResourceVersion, created.ResourceVersion)
+	}
+	serviceList, err = c.ListServices(ctx, metav1.ListOptions{LabelSelector: "createdForPod=foo"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(serviceList.Items) != 1 || serviceList.Items[0].Spec.Type != apiv1.ServiceTypeNodePort {
+		t.Fatal("Listing right after updating a service returned the old service")
+	}
+}
+
+func TestFakeWatchNotRead(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeClient()
+	defer c.Stop()
+	notRead, err := c.WatchPods(ctx, metav1.ListOptions{LabelSelector: "user=foo,domain=bar"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Each pod is added and then becomes ready, which is more events than the watch can buffer
+	n := informerWatchBufferSize/2 + 1
+	for i := 0; i < n; i++ {
+		_, err := c.CreatePod(ctx, fakePod(fmt.Sprintf("foo%d", i), c.globalConfig.Namespace))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// The informer keeps updating the cache regardless of the watch
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		podList, err := c.ListPods(ctx, metav1.ListOptions{LabelSelector: "user=foo,domain=bar"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		readyPods := 0
+		for _, pod := range podList.Items {
+			if podIsReady(&pod) {
+				readyPods++
+			}
+		}
+		if readyPods == n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Only %d of %d pods became ready in the cache while a watch wasn't read", readyPods, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// and the watch that fell behind is stopped
+	received := 0
+	for {
+		select {
+		case _, open := <-notRead.ResultChan():
+			if !open {
+				if received > informerWatchBufferSize {
+					t.Fatalf("Watch received %d events, more than its buffer", received)
+				}
+				return
+			}
+			received++
+		case <-time.After(time.Second):
+			t.Fatal("Watch that fell behind wasn't stopped")
+		}
+	}
+}
+
+func TestResourceVersionReached(t *testing.T) {
+	tests := []struct {
+		cached   string
+		written  string
+		expected bool
+	}{
+		{"5", "5", true},
+		{"6", "5", true},
+		{"4", "5", false},
+		{"10", "9", true},
+		{"", "5", false},
+		{"", "", true},
+		{"abc", "abd", false},
+	}
+	for _, test := range tests {
+		if resourceVersionReached(test.cached, test.written) != test.expected {
+			t.Fatalf("resourceVersionReached(%q, %q) should be %t", test.cached, test.written, test.expected)
+		}
+	}
+}
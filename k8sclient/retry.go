@@ -0,0 +1,97 @@
+package k8sclient
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// How often and how long to wait before repeating a call to the apiserver that failed with a transient error
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+func newRetryPolicy(globalConfig util.GlobalConfig) retryPolicy {
+	return retryPolicy{
+		maxAttempts:    globalConfig.RetryMaxAttempts,
+		initialBackoff: globalConfig.RetryInitialBackoff,
+		maxBackoff:     globalConfig.RetryMaxBackoff,
+	}
+}
+
+// Return the time to wait after the given failed attempt (starting from 1).
+// The backoff doubles with each attempt up to maxBackoff,
+// and a random half of it is added as jitter so that concurrent retries are spread out.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.initialBackoff
+	for i := 1; i < attempt && backoff < p.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.maxBackoff {
+		backoff = p.maxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Return true if err is a class of error that may not happen again when the call is repeated
+func isRetryable(err error) bool {
+	switch ReasonForError(err) {
+	case ReasonTooManyRequests, ReasonTimeout, ReasonUnavailable:
+		return true
+	default:
+		return false
+	}
+}
+
+// Call f until it succeeds, returns an error that isn't retryable, or the retry policy's attempts are used up.
+// Each attempt gets its own context bounded by TimeoutApiCall, and the waits between attempts end early if ctx is done.
+// Failed attempts are counted in the apiserver error metrics under method, the name of the K8sClient method.
+// Returns the number of attempts that were made and the classified error of the last one.
+func (c *clientsetClient) withRetry(ctx context.Context, method string, description string, f func(ctx context.Context) error) (int, error) {
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		callCtx, cancel := c.callContext(ctx)
+		err = classifyError(f(callCtx))
+		cancel()
+		if err == nil {
+			if attempt > 1 {
+				fmt.Printf("Succeeded to %s on attempt %d\n", description, attempt)
+			}
+			return attempt, nil
+		}
+		metrics.APIServerErrors.Inc(method, string(ReasonForError(err)))
+		if !isRetryable(err) || attempt >= c.retryPolicy.maxAttempts || ctx.Err() != nil {
+			break
+		}
+		wait := c.retryPolicy.backoff(attempt)
+		// When rate limited, the apiserver may say how long to wait
+		if seconds, hasDelay := apierrors.SuggestsClientDelay(err); hasDelay && time.Duration(seconds)*time.Second > wait {
+			wait = time.Duration(seconds) * time.Second
+		}
+		fmt.Printf(
+			"Warning: Attempt %d/%d to %s failed (%s), retrying in %s: %s\n",
+			attempt, c.retryPolicy.maxAttempts, description, ReasonForError(err), wait, err.Error(),
+		)
+		select {
+		case <-ctx.Done():
+			return attempt, err
+		case <-time.After(wait):
+		}
+	}
+	if attempt > 1 {
+		fmt.Printf("Error: Giving up on %s after %d attempts: %s\n", description, attempt, err.Error())
+	}
+	return attempt, err
+}
@@ -1,32 +1,113 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
 	"github.com/deic.dk/user_pods_k8s_backend/server"
 	"github.com/deic.dk/user_pods_k8s_backend/util"
 )
 
+// Time to wait before trying to load the pod caches again after failing
+const podCacheRetryInterval = 10 * time.Second
+
+// Time to wait for requests that are still open to finish once the background jobs are drained
+const httpShutdownTimeout = 10 * time.Second
+
 func main() {
 	globalConfig := util.MustLoadGlobalConfig()
 	k8sClient := k8sclient.NewK8sClient(globalConfig)
 	server := server.New(k8sClient, globalConfig)
-	server.ReloadPodCaches()
-
-	http.HandleFunc("/get_pods", server.ServeGetPods)
-	http.HandleFunc("/create_pod", server.ServeCreatePod)
-	http.HandleFunc("/watch_create_pod", server.ServeWatchCreatePod)
-	http.HandleFunc("/delete_pod", server.ServeDeletePod)
-	http.HandleFunc("/watch_delete_pod", server.ServeWatchDeletePod)
-	http.HandleFunc("/delete_all_user", server.ServeDeleteAllUserPods)
-	http.HandleFunc("/clean_all_unused", server.ServeCleanAllUnused)
-	http.HandleFunc("/get_podip_owner", server.ServeGetPodIPOwner)
-
-	fmt.Printf("Listening\n")
-	err := http.ListenAndServe(":80", nil)
+	// Load the pod caches while already serving, so that /readyz can report that the backend isn't ready yet
+	go func() {
+		ctx := server.BaseContext()
+		for {
+			err := server.ReloadPodCaches(ctx)
+			if err == nil {
+				fmt.Printf("Loaded pod caches\n")
+				// Then finish what was left pending when the backend last stopped,
+				// and keep the pods' services and ingresses reconciled and cull idle and expired pods until shutting down
+				err = server.ResumeJournal(ctx)
+				if err != nil {
+					fmt.Printf("Error resuming journal: %s\n", err.Error())
+				}
+				go server.RunCuller(ctx)
+				go server.RunExpirer(ctx)
+				server.RunReconciler(ctx)
+				return
+			}
+			fmt.Printf("Error loading pod caches, retrying in %s: %s\n", podCacheRetryInterval, err.Error())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(podCacheRetryInterval):
+			}
+		}
+	}()
+
+	http.HandleFunc("/get_pods", metrics.InstrumentHandler("get_pods", server.SiloOnly(server.ServeGetPods)))
+	http.HandleFunc("/create_pod", metrics.InstrumentHandler("create_pod", server.SiloOnly(server.ServeCreatePod)))
+	http.HandleFunc("/watch_create_pod", metrics.InstrumentHandler("watch_create_pod", server.SiloOnly(server.ServeWatchCreatePod)))
+	http.HandleFunc("/restart_pod", metrics.InstrumentHandler("restart_pod", server.SiloOnly(server.ServeRestartPod)))
+	http.HandleFunc("/extend_pod", metrics.InstrumentHandler("extend_pod", server.SiloOnly(server.ServeExtendPod)))
+	http.HandleFunc("/delete_pod", metrics.InstrumentHandler("delete_pod", server.SiloOnly(server.ServeDeletePod)))
+	http.HandleFunc("/watch_delete_pod", metrics.InstrumentHandler("watch_delete_pod", server.SiloOnly(server.ServeWatchDeletePod)))
+	http.HandleFunc("/get_podip_owner", metrics.InstrumentHandler("get_podip_owner", server.SiloOnly(server.ServeGetPodIPOwner)))
+	http.HandleFunc("/get_pod_logs", metrics.InstrumentHandler("get_pod_logs", server.SiloOnly(server.ServeGetPodLogs)))
+	http.HandleFunc("/pod_terminal", metrics.InstrumentHandler("pod_terminal", server.SiloOnly(server.ServePodTerminal)))
+	http.HandleFunc("/upload_pod_file", metrics.InstrumentHandler("upload_pod_file", server.SiloOnlyUpload(server.ServeUploadPodFile)))
+	http.HandleFunc("/download_pod_file", metrics.InstrumentHandler("download_pod_file", server.SiloOnly(server.ServeDownloadPodFile)))
+	http.HandleFunc("/stream_pod_events", metrics.InstrumentHandler("stream_pod_events", server.SiloOnly(server.ServeStreamPodEvents)))
+	// These act on all users, so only operators should call them
+	http.HandleFunc("/delete_all_user", metrics.InstrumentHandler("delete_all_user", server.AdminOnly(server.ServeDeleteAllUserPods)))
+	http.HandleFunc("/clean_all_unused", metrics.InstrumentHandler("clean_all_unused", server.AdminOnly(server.ServeCleanAllUnused)))
+	http.HandleFunc("/reconcile", metrics.InstrumentHandler("reconcile", server.AdminOnly(server.ServeReconcile)))
+	http.HandleFunc("/cull", metrics.InstrumentHandler("cull", server.AdminOnly(server.ServeCull)))
+
+	// Probed by the kubelet, so neither is authenticated
+	http.HandleFunc("/healthz", server.ServeHealthz)
+	http.HandleFunc("/readyz", server.ServeReadyz)
+	// Scraped by Prometheus, which can't sign requests, so it isn't authenticated
+	http.HandleFunc("/metrics", metrics.Handler)
+
+	// Requests derive from the server's base context, so that open event streams end when it shuts down
+	httpServer := &http.Server{
+		Addr: ":80",
+		BaseContext: func(net.Listener) context.Context {
+			return server.BaseContext()
+		},
+	}
+	go func() {
+		fmt.Printf("Listening\n")
+		err := httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			panic(fmt.Sprintf("Error running http server: %s\n", err.Error()))
+		}
+	}()
+
+	// On SIGTERM, let outstanding creations and deletions finish before exiting,
+	// while still answering requests to watch them
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	received := <-signals
+	fmt.Printf("Received %s\n", received)
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), globalConfig.TimeoutShutdown)
+	server.Shutdown(drainCtx)
+	cancelDrain()
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	err := httpServer.Shutdown(closeCtx)
+	cancelClose()
 	if err != nil {
-		panic(fmt.Sprintf("Error running http server: %s\n", err.Error()))
+		fmt.Printf("Error closing http server: %s\n", err.Error())
 	}
+	k8sClient.Stop()
+	fmt.Printf("Shut down\n")
 }
@@ -0,0 +1,224 @@
+package managed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Number of a pod's most recent events to include in its diagnosis
+const diagnosisMaxEvents = 10
+
+// State of one of a pod's containers as reported by kubernetes
+type ContainerStatus struct {
+	Name string `json:"name"`
+	// waiting, running or terminated, or empty if kubernetes hasn't reported on the container yet
+	State string `json:"state,omitempty"`
+	// e.g. ImagePullBackOff or CrashLoopBackOff while waiting, or OOMKilled when terminated
+	Reason       string `json:"reason,omitempty"`
+	Message      string `json:"message,omitempty"`
+	ExitCode     int32  `json:"exit_code,omitempty"`
+	RestartCount int32  `json:"restart_count"`
+	// Why the previous run of a restarted container terminated, e.g. Error when it's crash looping
+	LastReason   string `json:"last_reason,omitempty"`
+	LastExitCode int32  `json:"last_exit_code,omitempty"`
+}
+
+// A pod condition, e.g. PodScheduled with status False and reason Unschedulable
+type PodConditionStatus struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// An event that kubernetes recorded about a pod, e.g. FailedScheduling or FailedMount
+type PodEvent struct {
+	Type     string `json:"type"`
+	Reason   string `json:"reason"`
+	Message  string `json:"message"`
+	Count    int32  `json:"count,omitempty"`
+	LastSeen string `json:"last_seen,omitempty"`
+}
+
+// What kubernetes reported about a pod when its creation or deletion failed,
+// so that its owner can tell why. If the pod no longer existed, only Events may be set.
+type PodDiagnosis struct {
+	Phase          string               `json:"phase,omitempty"`
+	Deleting       bool                 `json:"deleting,omitempty"`
+	Finalizers     []string             `json:"finalizers,omitempty"`
+	Conditions     []PodConditionStatus `json:"conditions,omitempty"`
+	InitContainers []ContainerStatus    `json:"init_containers,omitempty"`
+	Containers     []ContainerStatus    `json:"containers,omitempty"`
+	Events         []PodEvent           `json:"events,omitempty"`
+}
+
+// Error that a pod's creation or deletion failed with, along with the pod's diagnosis at the time
+type PodFailure struct {
+	Err       error
+	Diagnosis PodDiagnosis
+}
+
+func (f *PodFailure) Error() string {
+	return f.Err.Error()
+}
+
+func (f *PodFailure) Unwrap() error {
+	return f.Err
+}
+
+// Return the diagnosis carried by err, or nil if it doesn't have one
+func DiagnosisForError(err error) *PodDiagnosis {
+	var failure *PodFailure
+	if errors.As(err, &failure) {
+		return &failure.Diagnosis
+	}
+	return nil
+}
+
+// The step that a creation or deletion has reached, to tell which one was unfinished if it times out
+type progress struct {
+	mutex sync.Mutex
+	step  string
+}
+
+func newProgress(step string) *progress {
+	return &progress{step: step}
+}
+
+func (pr *progress) set(step string) {
+	pr.mutex.Lock()
+	pr.step = step
+	pr.mutex.Unlock()
+}
+
+func (pr *progress) get() string {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	return pr.step
+}
+
+// Return an error for a creation or deletion of the pod that timed out at step, e.g. "Pod didn't become ready",
+// with the pod's diagnosis. This uses a context of its own, since the creation or deletion's context is running out.
+func (p *Pod) TimeoutFailure(step string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.GlobalConfig.TimeoutApiCall)
+	defer cancel()
+	return &PodFailure{
+		Err:       fmt.Errorf("%s: %w", step, util.ErrTimedOut),
+		Diagnosis: p.diagnose(ctx),
+	}
+}
+
+// Collect the current state of the pod and its most recent events.
+// Errors are only logged, since the diagnosis is best effort.
+func (p *Pod) diagnose(ctx context.Context) PodDiagnosis {
+	var diagnosis PodDiagnosis
+	opt := metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", p.Object.Name)}
+	podList, err := p.Client.ListPods(ctx, opt)
+	if err != nil {
+		fmt.Printf("Couldn't get pod %s to diagnose it: %s\n", p.Object.Name, err.Error())
+	} else if len(podList.Items) > 0 && (p.Object.UID == "" || podList.Items[0].UID == p.Object.UID) {
+		current := podList.Items[0]
+		diagnosis.Phase = string(current.Status.Phase)
+		diagnosis.Deleting = current.DeletionTimestamp != nil
+		diagnosis.Finalizers = current.Finalizers
+		for _, condition := range current.Status.Conditions {
+			if condition.Status != apiv1.ConditionTrue {
+				diagnosis.Conditions = append(diagnosis.Conditions, newPodConditionStatus(condition))
+			}
+		}
+		diagnosis.InitContainers = containerStatuses(current.Status.InitContainerStatuses)
+		diagnosis.Containers = containerStatuses(current.Status.ContainerStatuses)
+	}
+
+	eventList, err := p.Client.ListPodEvents(ctx, p.Object.Name)
+	if err != nil {
+		fmt.Printf("Couldn't list events of pod %s to diagnose it: %s\n", p.Object.Name, err.Error())
+		return diagnosis
+	}
+	var events []apiv1.Event
+	for _, event := range eventList.Items {
+		// Skip events of an earlier pod with the same name
+		if p.Object.UID != "" && event.InvolvedObject.UID != "" && event.InvolvedObject.UID != p.Object.UID {
+			continue
+		}
+		events = append(events, event)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return eventTime(events[i]).Before(eventTime(events[j]))
+	})
+	if len(events) > diagnosisMaxEvents {
+		events = events[len(events)-diagnosisMaxEvents:]
+	}
+	for _, event := range events {
+		var lastSeen string
+		if t := eventTime(event); !t.IsZero() {
+			lastSeen = t.UTC().Format("2006-01-02T15:04:05Z")
+		}
+		diagnosis.Events = append(diagnosis.Events, PodEvent{
+			Type:     event.Type,
+			Reason:   event.Reason,
+			Message:  event.Message,
+			Count:    event.Count,
+			LastSeen: lastSeen,
+		})
+	}
+	return diagnosis
+}
+
+// Return when the event was last seen, which depends on the API version that recorded it
+func eventTime(event apiv1.Event) time.Time {
+	if !event.LastTimestamp.IsZero() {
+		return event.LastTimestamp.Time
+	}
+	if !event.EventTime.IsZero() {
+		return event.EventTime.Time
+	}
+	return event.CreationTimestamp.Time
+}
+
+func containerStatuses(statuses []apiv1.ContainerStatus) []ContainerStatus {
+	var result []ContainerStatus
+	for _, status := range statuses {
+		result = append(result, newContainerStatus(status))
+	}
+	return result
+}
+
+func newContainerStatus(status apiv1.ContainerStatus) ContainerStatus {
+	container := ContainerStatus{Name: status.Name, RestartCount: status.RestartCount}
+	switch {
+	case status.State.Waiting != nil:
+		container.State = "waiting"
+		container.Reason = status.State.Waiting.Reason
+		container.Message = status.State.Waiting.Message
+	case status.State.Running != nil:
+		container.State = "running"
+	case status.State.Terminated != nil:
+		container.State = "terminated"
+		container.Reason = status.State.Terminated.Reason
+		container.Message = status.State.Terminated.Message
+		container.ExitCode = status.State.Terminated.ExitCode
+	}
+	if last := status.LastTerminationState.Terminated; last != nil {
+		container.LastReason = last.Reason
+		container.LastExitCode = last.ExitCode
+	}
+	return container
+}
+
+func newPodConditionStatus(condition apiv1.PodCondition) PodConditionStatus {
+	return PodConditionStatus{
+		Type:    string(condition.Type),
+		Status:  string(condition.Status),
+		Reason:  condition.Reason,
+		Message: condition.Message,
+	}
+}
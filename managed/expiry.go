@@ -0,0 +1,96 @@
+package managed
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const (
+	// How long the pod may live, in the format of time.Duration, in the manifest.
+	// The backend sets it on the created pod to the lifetime that the pod was given.
+	maxLifetimeAnnotation = "sciencedata.dk/max-lifetime"
+	// When the pod expires, in RFC 3339 format, set by the backend
+	expiresAnnotation = "sciencedata.dk/expires"
+)
+
+// Return lifetime capped at MaxLifetime in the config, where zero means no limit
+func capLifetime(lifetime time.Duration, config util.GlobalConfig) time.Duration {
+	if config.MaxLifetime > 0 && (lifetime == 0 || lifetime > config.MaxLifetime) {
+		return config.MaxLifetime
+	}
+	return lifetime
+}
+
+// Set when target expires, given the lifetime in the create_pod request, if any.
+// Otherwise the lifetime is the one in the manifest, or DefaultLifetime in the config,
+// and it is capped at MaxLifetime in the config. A pod with a lifetime of zero doesn't expire.
+func ApplyLifetime(target *apiv1.Pod, requested time.Duration, config util.GlobalConfig) error {
+	lifetime := config.DefaultLifetime
+	if value, hasKey := target.Annotations[maxLifetimeAnnotation]; hasKey {
+		var err error
+		lifetime, err = time.ParseDuration(value)
+		if err != nil || lifetime < 0 {
+			return errors.New(fmt.Sprintf("Invalid %s annotation %s in manifest", maxLifetimeAnnotation, value))
+		}
+	}
+	if requested > 0 {
+		lifetime = requested
+	}
+	lifetime = capLifetime(lifetime, config)
+	delete(target.Annotations, expiresAnnotation)
+	if lifetime == 0 {
+		return nil
+	}
+	if target.Annotations == nil {
+		target.Annotations = make(map[string]string)
+	}
+	target.Annotations[maxLifetimeAnnotation] = lifetime.String()
+	target.Annotations[expiresAnnotation] = time.Now().Add(lifetime).UTC().Format(time.RFC3339)
+	return nil
+}
+
+// Return when the pod expires, and false if it doesn't
+func (p *Pod) Expires() (time.Time, bool, error) {
+	value, hasKey := p.Object.Annotations[expiresAnnotation]
+	if !hasKey {
+		return time.Time{}, false, nil
+	}
+	expires, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false, errors.New(fmt.Sprintf("Invalid %s annotation %s of pod %s", expiresAnnotation, value, p.Object.Name))
+	}
+	return expires, true, nil
+}
+
+// Return when the pod would expire if it were extended by lifetime from now,
+// or if lifetime is zero, by the lifetime that the pod was given.
+// It is capped at MaxLifetime in the config from now, and is never earlier than the current expiry.
+func (p *Pod) ExtendedExpiry(lifetime time.Duration) (time.Time, error) {
+	if lifetime == 0 {
+		if value, hasKey := p.Object.Annotations[maxLifetimeAnnotation]; hasKey {
+			lifetime, _ = time.ParseDuration(value)
+		}
+		if lifetime <= 0 {
+			return time.Time{}, errors.New(fmt.Sprintf("Pod %s doesn't have a lifetime to extend it by", p.Object.Name))
+		}
+	}
+	expires := time.Now().Add(capLifetime(lifetime, p.GlobalConfig)).Truncate(time.Second)
+	if current, hasExpiry, err := p.Expires(); err == nil && hasExpiry && current.After(expires) {
+		expires = current
+	}
+	return expires, nil
+}
+
+// Return a copy of the pod's object that expires at expires, to update the pod with
+func (p *Pod) WithExpiry(expires time.Time) *apiv1.Pod {
+	target := p.Object.DeepCopy()
+	if target.Annotations == nil {
+		target.Annotations = make(map[string]string)
+	}
+	target.Annotations[expiresAnnotation] = expires.UTC().Format(time.RFC3339)
+	return target
+}
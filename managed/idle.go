@@ -0,0 +1,131 @@
+package managed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Annotations of the idle policy in a pod's manifest.
+// The pod's activity is checked either with a command, run with sh -c in its first container,
+// or with an http GET of port/path on the pod's IP, e.g. 8888/api/status.
+// Either has to give the time of the last activity, see parseLastActivity.
+const (
+	idleCheckCommandAnnotation = "sciencedata.dk/idle-check-command"
+	idleCheckHttpAnnotation    = "sciencedata.dk/idle-check-http"
+	// How long the pod may be idle before it is culled, in the format of time.Duration, instead of IdleTimeout in the config
+	idleTimeoutAnnotation = "sciencedata.dk/idle-timeout"
+)
+
+// Number of bytes of an idle check's output that are read
+const idleCheckByteLimit = 64 * 1024
+
+// Return true if the pod's manifest has an idle check
+func (p *Pod) HasIdleCheck() bool {
+	_, hasCommand := p.Object.Annotations[idleCheckCommandAnnotation]
+	_, hasHttp := p.Object.Annotations[idleCheckHttpAnnotation]
+	return hasCommand || hasHttp
+}
+
+// Return how long the pod may be idle before it is culled, from its manifest or otherwise IdleTimeout in the config.
+// Zero means that the pod isn't culled.
+func (p *Pod) IdleTimeout() (time.Duration, error) {
+	value, hasKey := p.Object.Annotations[idleTimeoutAnnotation]
+	if !hasKey {
+		return p.GlobalConfig.IdleTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid %s annotation %s of pod %s", idleTimeoutAnnotation, value, p.Object.Name))
+	}
+	return timeout, nil
+}
+
+// Ask the pod for the time of its last activity with the idle check in its manifest.
+// Since a new pod may not have reported any activity yet, the time is never before the pod started.
+func (p *Pod) LastActivity(ctx context.Context) (time.Time, error) {
+	var output []byte
+	var err error
+	if command, hasCommand := p.Object.Annotations[idleCheckCommandAnnotation]; hasCommand {
+		output, err = p.idleCheckCommand(ctx, command)
+	} else if endpoint, hasHttp := p.Object.Annotations[idleCheckHttpAnnotation]; hasHttp {
+		output, err = p.idleCheckHttp(ctx, endpoint)
+	} else {
+		return time.Time{}, errors.New(fmt.Sprintf("Pod %s doesn't have an idle check", p.Object.Name))
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	lastActivity, err := parseLastActivity(output)
+	if err != nil {
+		return time.Time{}, errors.New(fmt.Sprintf("Couldn't parse idle check of pod %s: %s", p.Object.Name, err.Error()))
+	}
+	if startTime := p.Object.Status.StartTime; startTime != nil && lastActivity.Before(startTime.Time) {
+		lastActivity = startTime.Time
+	}
+	return lastActivity, nil
+}
+
+func (p *Pod) idleCheckCommand(ctx context.Context, command string) ([]byte, error) {
+	stdout, stderr, err := p.Client.PodExec(ctx, []string{"sh", "-c", command}, p.Object, 0)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't run idle check of pod %s: %s. Stderr: %s", p.Object.Name, err.Error(), stderr.String()))
+	}
+	return stdout.Next(idleCheckByteLimit), nil
+}
+
+func (p *Pod) idleCheckHttp(ctx context.Context, endpoint string) ([]byte, error) {
+	if p.Object.Status.PodIP == "" {
+		return nil, errors.New(fmt.Sprintf("Pod %s doesn't have an IP for its idle check", p.Object.Name))
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.GlobalConfig.TimeoutApiCall)
+	defer cancel()
+	url := fmt.Sprintf("http://%s:%s", p.Object.Status.PodIP, strings.TrimPrefix(endpoint, ":"))
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid idle check %s of pod %s: %s", endpoint, p.Object.Name, err.Error()))
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't get idle check %s of pod %s: %s", url, p.Object.Name, err.Error()))
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Idle check %s of pod %s gave status %d", url, p.Object.Name, response.StatusCode))
+	}
+	return ioutil.ReadAll(io.LimitReader(response.Body, idleCheckByteLimit))
+}
+
+// Parse the output of an idle check, which is either a time in RFC 3339 format or in seconds since the epoch,
+// or a JSON object with such a time as last_activity, like the /api/status of a Jupyter server
+func parseLastActivity(output []byte) (time.Time, error) {
+	value := strings.TrimSpace(string(output))
+	if strings.HasPrefix(value, "{") {
+		var status struct {
+			LastActivity json.RawMessage `json:"last_activity"`
+		}
+		err := json.Unmarshal([]byte(value), &status)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if len(status.LastActivity) == 0 {
+			return time.Time{}, errors.New("JSON doesn't have last_activity")
+		}
+		value = strings.Trim(string(status.LastActivity), `"`)
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))), nil
+	}
+	lastActivity, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, errors.New(fmt.Sprintf("%q is neither a time in RFC 3339 format nor in seconds since the epoch", value))
+	}
+	return lastActivity, nil
+}
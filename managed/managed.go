@@ -2,17 +2,18 @@ package managed
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
 	"github.com/deic.dk/user_pods_k8s_backend/util"
 	apiv1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1"
@@ -52,9 +53,9 @@ func (u *User) GetListOptions() metav1.ListOptions {
 	return opt
 }
 
-func (u *User) ListPods() ([]Pod, error) {
+func (u *User) ListPods(ctx context.Context) ([]Pod, error) {
 	var pods []Pod
-	podList, err := u.Client.ListPods(u.GetListOptions())
+	podList, err := u.Client.ListPods(ctx, u.GetListOptions())
 	if err != nil {
 		return pods, err
 	}
@@ -70,10 +71,10 @@ func (u *User) ListPods() ([]Pod, error) {
 	return pods, nil
 }
 
-func (u *User) OwnsPod(podName string) (bool, error) {
+func (u *User) OwnsPod(ctx context.Context, podName string) (bool, error) {
 	opt := u.GetListOptions()
 	opt.FieldSelector = fmt.Sprintf("metadata.name=%s", podName)
-	podList, err := u.Client.ListPods(opt)
+	podList, err := u.Client.ListPods(ctx, opt)
 	if err != nil {
 		return false, err
 	}
@@ -169,106 +170,120 @@ func (u *User) GetTargetStoragePVC(nfsIP string) *apiv1.PersistentVolumeClaim {
 	}
 }
 
-// Delete the user's storage PV and PVC
-func (u *User) DeleteUserStorage(finished *util.ReadyChannel) error {
+// Delete the user's storage PV and PVC.
+// ctx is also used for the watches that complete finished, which continue after this returns.
+func (u *User) DeleteUserStorage(ctx context.Context, finished *util.Future) error {
 	pvName := u.GetStoragePVName()
 	// Start a watcher for PV deletion,
-	pvChan := util.NewReadyChannel(u.GlobalConfig.TimeoutDelete)
+	pvDeleted := util.NewFuture(u.GlobalConfig.TimeoutDelete)
 	// Then try to delete the PV.
-	err := u.Client.DeletePV(pvName)
+	err := u.Client.DeletePV(ctx, pvName)
 	// If there is an error,
 	if err != nil {
-		// If the error message is that the PV is not found, that's okay. Signal that the PV is in the desired state.
-		if regexp.MustCompile(fmt.Sprintf("\"%s\" not found", pvName)).MatchString(err.Error()) {
-			pvChan.Send(true)
+		// If the PV is not found, that's okay. Signal that the PV is in the desired state.
+		if k8sclient.IsNotFound(err) {
+			pvDeleted.Succeed()
 		} else { // If the error message is something else, there's a problem that should be handled.
+			pvDeleted.Cancel()
 			return err
 		}
 	} else { // if the delete request was issued successfully, then listen log the result
 		go func() {
-			u.Client.WatchDeletePV(pvName, pvChan)
-			if pvChan.Receive() {
+			u.Client.WatchDeletePV(ctx, pvName, pvDeleted)
+			if err := pvDeleted.Wait(); err == nil {
 				fmt.Printf("Deleted PV %s\n", pvName)
 			} else {
-				fmt.Printf("Warning: failed to delete PV %s\n", pvName)
+				fmt.Printf("Warning: failed to delete PV %s: %s\n", pvName, err.Error())
 			}
 		}()
 	}
 
 	// Repeat for the PVC
-	pvcChan := util.NewReadyChannel(u.GlobalConfig.TimeoutDelete)
-	err = u.Client.DeletePVC(pvName)
+	pvcDeleted := util.NewFuture(u.GlobalConfig.TimeoutDelete)
+	err = u.Client.DeletePVC(ctx, pvName)
 	if err != nil {
-		if regexp.MustCompile(fmt.Sprintf("\"%s\" not found", pvName)).MatchString(err.Error()) {
-			pvcChan.Send(true)
+		if k8sclient.IsNotFound(err) {
+			pvcDeleted.Succeed()
 		} else {
+			pvcDeleted.Cancel()
 			return err
 		}
 	} else {
 		go func() {
-			u.Client.WatchDeletePVC(pvName, pvcChan)
-			if pvcChan.Receive() {
+			u.Client.WatchDeletePVC(ctx, pvName, pvcDeleted)
+			if err := pvcDeleted.Wait(); err == nil {
 				fmt.Printf("Deleted PVC %s\n", pvName)
 			} else {
-				fmt.Printf("Warning: failed to delete PVC %s\n", pvName)
+				fmt.Printf("Warning: failed to delete PVC %s: %s\n", pvName, err.Error())
 			}
 		}()
 	}
 
-	// Then combine the channels so `finished` will see when both PV and PVC are deleted
-	util.CombineReadyChannels([]*util.ReadyChannel{pvChan, pvcChan}, finished)
+	// Then combine them so `finished` will see when both PV and PVC are deleted
+	util.CombineFutures([]*util.Future{pvDeleted, pvcDeleted}, finished)
 	return nil
 }
 
-// Check that the PV and PVC for the user's nfs storage exist and create them if not
-func (u *User) CreateUserStorageIfNotExist(ready *util.ReadyChannel, nfsIP string) error {
+// Check that the PV and PVC for the user's nfs storage exist and create them if not.
+// ctx is also used for the watches that complete ready, which continue after this returns.
+func (u *User) CreateUserStorageIfNotExist(ctx context.Context, ready *util.Future, nfsIP string) error {
 	listOptions := u.GetStorageListOptions()
-	PVready := util.NewReadyChannel(u.GlobalConfig.TimeoutCreate)
-	PVCready := util.NewReadyChannel(u.GlobalConfig.TimeoutCreate)
-	PVList, err := u.Client.ListPV(listOptions)
+	PVready := util.NewFuture(u.GlobalConfig.TimeoutCreate)
+	PVCready := util.NewFuture(u.GlobalConfig.TimeoutCreate)
+	// If this returns early, nothing will complete the futures, so release their timers
+	cancelAll := func() {
+		PVready.Cancel()
+		PVCready.Cancel()
+	}
+	PVList, err := u.Client.ListPV(ctx, listOptions)
 	if err != nil {
+		cancelAll()
 		return err
 	}
 	if len(PVList.Items) == 0 {
 		targetPV := u.GetTargetStoragePV(nfsIP)
 		go func() {
-			u.Client.WatchCreatePV(targetPV.Name, PVready)
-			if PVready.Receive() {
+			u.Client.WatchCreatePV(ctx, targetPV.Name, PVready)
+			if err := PVready.Wait(); err == nil {
 				fmt.Printf("Ready PV %s\n", targetPV.Name)
 			} else {
-				fmt.Printf("Warning PV %s didn't reach ready state\n", targetPV.Name)
+				fmt.Printf("Warning PV %s didn't reach ready state: %s\n", targetPV.Name, err.Error())
 			}
 		}()
-		_, err := u.Client.CreatePV(targetPV)
-		if err != nil {
+		_, err := u.Client.CreatePV(ctx, targetPV)
+		// If the PV was created since it was listed, the watch will still see it become ready
+		if err != nil && !k8sclient.IsAlreadyExists(err) {
+			cancelAll()
 			return err
 		}
 	} else {
-		PVready.Send(true)
+		PVready.Succeed()
 	}
 
-	PVCList, err := u.Client.ListPVC(listOptions)
+	PVCList, err := u.Client.ListPVC(ctx, listOptions)
 	if err != nil {
+		cancelAll()
 		return err
 	}
 	if len(PVCList.Items) == 0 {
 		targetPVC := u.GetTargetStoragePVC(nfsIP)
 		go func() {
-			u.Client.WatchCreatePVC(targetPVC.Name, PVCready)
-			if PVCready.Receive() {
+			u.Client.WatchCreatePVC(ctx, targetPVC.Name, PVCready)
+			if err := PVCready.Wait(); err == nil {
 				fmt.Printf("Ready PVC %s\n", targetPVC.Name)
 			} else {
-				fmt.Printf("Warning PVC %s didn't reach ready state\n", targetPVC.Name)
+				fmt.Printf("Warning PVC %s didn't reach ready state: %s\n", targetPVC.Name, err.Error())
 			}
 		}()
-		_, err := u.Client.CreatePVC(targetPVC)
-		if err != nil {
+		_, err := u.Client.CreatePVC(ctx, targetPVC)
+		if err != nil && !k8sclient.IsAlreadyExists(err) {
+			cancelAll()
 			return err
 		}
 	} else {
-		PVCready.Send(true)
+		PVCready.Succeed()
 	}
-	go util.CombineReadyChannels([]*util.ReadyChannel{PVready, PVCready}, ready)
+	util.CombineFutures([]*util.Future{PVready, PVCready}, ready)
 	return nil
 }
 
@@ -297,6 +312,59 @@ type PodInfo struct {
 	SshUrl            string            `json:"ssh_url"`
 	Tokens            map[string]string `json:"tokens"`
 	OtherResourceInfo map[string]string `json:"k8s_pod_info"`
+	NodeName          string            `json:"node_name"`
+	// When the pod will be deleted for exceeding its lifetime, in RFC 3339 format, or empty if it doesn't expire
+	Expires string `json:"expires"`
+	// Conditions and containers tell e.g. why the pod is Pending or which container is crash looping.
+	// ContainerName and ImageName above are only those of the first container.
+	Conditions     []PodConditionStatus `json:"conditions"`
+	InitContainers []ContainerInfo      `json:"init_containers,omitempty"`
+	Containers     []ContainerInfo      `json:"containers"`
+}
+
+// A container in the pod's spec along with its status
+type ContainerInfo struct {
+	ContainerStatus
+	Image    string            `json:"image"`
+	ImageID  string            `json:"image_id"`
+	Ready    bool              `json:"ready"`
+	Requests map[string]string `json:"requests,omitempty"`
+	Limits   map[string]string `json:"limits,omitempty"`
+}
+
+// Return the info of each container in containers, with its status from statuses if kubernetes has reported it
+func containerInfos(containers []apiv1.Container, statuses []apiv1.ContainerStatus) []ContainerInfo {
+	var infos []ContainerInfo
+	for _, container := range containers {
+		info := ContainerInfo{
+			ContainerStatus: ContainerStatus{Name: container.Name},
+			Image:           container.Image,
+			Requests:        resourceStrings(container.Resources.Requests),
+			Limits:          resourceStrings(container.Resources.Limits),
+		}
+		for _, status := range statuses {
+			if status.Name == container.Name {
+				info.ContainerStatus = newContainerStatus(status)
+				info.ImageID = status.ImageID
+				info.Ready = status.Ready
+				break
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Return resources as a map from e.g. "cpu" to "500m", or nil if there are none
+func resourceStrings(resources apiv1.ResourceList) map[string]string {
+	if len(resources) == 0 {
+		return nil
+	}
+	result := make(map[string]string)
+	for name, quantity := range resources {
+		result[string(name)] = quantity.String()
+	}
+	return result
 }
 
 type Pod struct {
@@ -304,7 +372,6 @@ type Pod struct {
 	Owner        User
 	Client       k8sclient.K8sClient
 	GlobalConfig util.GlobalConfig
-	ingressPort  int32
 }
 
 func NewPod(existingPod *apiv1.Pod, client k8sclient.K8sClient, globalConfig util.GlobalConfig) Pod {
@@ -345,6 +412,16 @@ func (p *Pod) GetPodInfo() PodInfo {
 	podInfo.PodIP = p.Object.Status.PodIP
 	podInfo.PodName = p.Object.Name
 	podInfo.Status = fmt.Sprintf("%s:%s", p.Object.Status.Phase, startTimeStr)
+	podInfo.NodeName = p.Object.Spec.NodeName
+	if expires, hasExpiry, err := p.Expires(); err == nil && hasExpiry {
+		podInfo.Expires = expires.UTC().Format(time.RFC3339)
+	}
+	podInfo.Conditions = []PodConditionStatus{}
+	for _, condition := range p.Object.Status.Conditions {
+		podInfo.Conditions = append(podInfo.Conditions, newPodConditionStatus(condition))
+	}
+	podInfo.InitContainers = containerInfos(p.Object.Spec.InitContainers, p.Object.Status.InitContainerStatuses)
+	podInfo.Containers = containerInfos(p.Object.Spec.Containers, p.Object.Status.ContainerStatuses)
 
 	if p.NeedsIngress() {
 		podInfo.Url = fmt.Sprintf("https://%s", p.getIngressHost())
@@ -390,17 +467,17 @@ func (p *Pod) labelSelectOptions() metav1.ListOptions {
 	}
 }
 
-func (p *Pod) ListServices() (*apiv1.ServiceList, error) {
-	return p.Client.ListServices(p.labelSelectOptions())
+func (p *Pod) ListServices(ctx context.Context) (*apiv1.ServiceList, error) {
+	return p.Client.ListServices(ctx, p.labelSelectOptions())
 }
 
-func (p *Pod) ListIngresses() (*netv1.IngressList, error) {
-	return p.Client.ListIngresses(p.labelSelectOptions())
+func (p *Pod) ListIngresses(ctx context.Context) (*netv1.IngressList, error) {
+	return p.Client.ListIngresses(ctx, p.labelSelectOptions())
 }
 
-func (p *Pod) getSshPort() (string, error) {
+func (p *Pod) getSshPort(ctx context.Context) (string, error) {
 	var sshPort int32 = 0
-	serviceList, err := p.ListServices()
+	serviceList, err := p.ListServices(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -426,10 +503,10 @@ func (p *Pod) getSshPort() (string, error) {
 }
 
 // fill p.cache.OtherResourceInfo with information about other k8s resources relevant to the pod
-func (p *Pod) getOtherResourceInfo() map[string]string {
+func (p *Pod) getOtherResourceInfo(ctx context.Context) map[string]string {
 	otherResourceInfo := make(map[string]string)
 	if p.NeedsSshService() {
-		sshPort, err := p.getSshPort()
+		sshPort, err := p.getSshPort(ctx)
 		if err != nil {
 			fmt.Printf("Error while copying ssh port for pod %s: %s\n", p.Object.Name, err.Error())
 		} else {
@@ -486,57 +563,74 @@ func (p *Pod) loadPodCache() (podCache, error) {
 	return cache, nil
 }
 
-func (p *Pod) DeleteAllServices(finished *util.ReadyChannel) error {
-	serviceList, err := p.ListServices()
+func (p *Pod) DeleteAllServices(ctx context.Context, finished *util.Future) error {
+	serviceList, err := p.ListServices(ctx)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Couldn't list services: %s", err.Error()))
 	}
 	if len(serviceList.Items) > 0 {
-		deleteChannels := make([]*util.ReadyChannel, len(serviceList.Items))
-		// For each service, call for deletion and add a watcher channel to the list of deleteChannels
+		deletions := make([]*util.Future, len(serviceList.Items))
+		// For each service, call for deletion and add a watched future to the list of deletions
 		for i, service := range serviceList.Items {
-			ch := util.NewReadyChannel(p.GlobalConfig.TimeoutDelete)
-			deleteChannels[i] = ch
+			service := service
+			deleted := util.NewFuture(p.GlobalConfig.TimeoutDelete)
+			deletions[i] = deleted
 			go func() {
-				p.Client.WatchDeleteService(service.Name, ch)
-				if ch.Receive() {
+				p.Client.WatchDeleteService(ctx, service.Name, deleted)
+				if err := deleted.Wait(); err == nil {
 					fmt.Printf("Deleted SVC %s\n", service.Name)
 				} else {
-					fmt.Printf("Warning: failed to delete SVC %s\n", service.Name)
+					fmt.Printf("Warning: failed to delete SVC %s: %s\n", service.Name, err.Error())
 				}
 			}()
-			p.Client.DeleteService(service.Name)
+			err := p.Client.DeleteService(ctx, service.Name)
+			if err != nil {
+				// If the service is already gone, it's in the desired state
+				if k8sclient.IsNotFound(err) {
+					deleted.Succeed()
+				} else {
+					fmt.Printf("Error deleting SVC %s: %s\n", service.Name, err.Error())
+					deleted.Fail(err)
+				}
+			}
 		}
-		// Then only signal finished when each service has been deleted successfully
-		util.CombineReadyChannels(deleteChannels, finished)
+		// Then only complete finished when each service has been deleted successfully
+		util.CombineFutures(deletions, finished)
 	} else {
-		finished.Send(true)
+		finished.Succeed()
 	}
 	return nil
 }
 
-func (p *Pod) DeleteAllIngresses() error {
-	ingressList, err := p.ListIngresses()
+func (p *Pod) DeleteAllIngresses(ctx context.Context) error {
+	ingressList, err := p.ListIngresses(ctx)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Couldn't list ingresses: %s", err.Error()))
 	}
 	for _, ing := range ingressList.Items {
-		err = p.Client.DeleteIngress(ing.Name)
-		if err != nil {
+		err = p.Client.DeleteIngress(ctx, ing.Name)
+		if err != nil && !k8sclient.IsNotFound(err) {
 			return errors.New(fmt.Sprintf("Failed to delete ingress: %s", err.Error()))
 		}
 	}
 	return nil
 }
 
-func (p *Pod) RunDeleteJobsWhenReady(ready *util.ReadyChannel, finished *util.ReadyChannel) {
+func (p *Pod) RunDeleteJobsWhenReady(ctx context.Context, ready *util.Future, finished *util.Future) {
+	// If the deletion times out, tell the owner what was holding it up
+	progress := newProgress("Pod wasn't deleted")
+	finished.DescribeTimeout(func() error {
+		return p.TimeoutFailure(progress.get())
+	})
+
 	// wait for the signal that delete jobs can begin
-	// If ready.Receive() is false (due to timeout or failure),
-	// then signal false on finished channel, and do not attempt delete jobs
-	if !ready.Receive() {
-		finished.Send(false)
+	// If ready failed (due to timeout or failure),
+	// then fail finished with the same reason, and do not attempt delete jobs
+	if err := ready.Wait(); err != nil {
+		finished.Fail(err)
 		return
 	}
+	progress.set("Delete jobs didn't finish")
 
 	// Delete the cache file if it exists
 	err := os.Remove(p.GetCacheFilename())
@@ -547,47 +641,57 @@ func (p *Pod) RunDeleteJobsWhenReady(ready *util.ReadyChannel, finished *util.Re
 		}
 	}
 
-	// Delete all of the pod's related services
-	err = p.DeleteAllServices(finished)
+	// Delete the ingresses first, since finished is completed once the services are deleted,
+	// which cancels ctx when it is a request's background context
+	err = p.DeleteAllIngresses(ctx)
 	if err != nil {
-		fmt.Printf("Error deleting services: %s", err.Error())
-		finished.Send(false)
+		fmt.Printf("Error deleting ingresses: %s\n", err.Error())
+		finished.Fail(err)
+		return
 	}
 
-	err = p.DeleteAllIngresses()
+	// Delete all of the pod's related services
+	err = p.DeleteAllServices(ctx, finished)
 	if err != nil {
-		fmt.Printf("Error deleting ingresses: %s", err.Error())
-		finished.Send(false)
+		fmt.Printf("Error deleting services: %s\n", err.Error())
+		finished.Fail(err)
 	}
 }
 
-// Wait until each channel in requiredToStartJobs has an input,
-// then if each input is true, attempt to perform all start jobs.
-// send true into finishedStartJobs when all jobs finish successfully,
-// or send false if any step fails
-func (p *Pod) RunStartJobsWhenReady(requiredToStartJobs []*util.ReadyChannel, finishedStartJobs *util.ReadyChannel) {
-	// block this function until a result is read from each channel in requiredToStartJobs
-	ready := util.ReceiveReadyChannels(requiredToStartJobs)
-	if !ready {
-		fmt.Printf("Warning: Pod %s and/or user storage didn't reach ready state. Start jobs not attempted.\n", p.Object.Name)
-		finishedStartJobs.Send(false)
+// Wait until each future in requiredToStartJobs is completed,
+// then if they all succeeded, attempt to perform all start jobs.
+// Complete finishedStartJobs when all jobs finish successfully,
+// or fail it with the reason if any step fails. If it times out, the reason includes the pod's diagnosis.
+func (p *Pod) RunStartJobsWhenReady(ctx context.Context, requiredToStartJobs []*util.Future, finishedStartJobs *util.Future) {
+	progress := newProgress("Pod and/or user storage didn't become ready")
+	finishedStartJobs.DescribeTimeout(func() error {
+		return p.TimeoutFailure(progress.get())
+	})
+
+	// block this function until each future in requiredToStartJobs is completed
+	err := util.WaitFutures(requiredToStartJobs)
+	if err != nil {
+		fmt.Printf("Warning: Pod %s and/or user storage didn't reach ready state: %s. Start jobs not attempted.\n", p.Object.Name, err.Error())
+		finishedStartJobs.Fail(err)
 		return
 	}
 
 	// Ensure no orphaned services or ingresses for deleted pods with this pod's name
-	cleanedOrphanedServices := util.NewReadyChannel(p.GlobalConfig.TimeoutDelete)
-	err := p.DeleteAllServices(cleanedOrphanedServices)
+	progress.set("Removing orphaned services didn't finish")
+	cleanedOrphanedServices := util.NewFuture(p.GlobalConfig.TimeoutDelete)
+	err = p.DeleteAllServices(ctx, cleanedOrphanedServices)
 	if err != nil {
 		fmt.Printf("Error cleaning up orphaned services %s", err.Error())
-		finishedStartJobs.Send(false)
+		cleanedOrphanedServices.Cancel()
+		finishedStartJobs.Fail(err)
 		return
 	}
-	if !cleanedOrphanedServices.Receive() {
+	if err := cleanedOrphanedServices.Wait(); err != nil {
 		fmt.Printf("Couldn't ensure orphaned services were removed for pod %s, didn't continue start jobs", p.Object.Name)
-		finishedStartJobs.Send(false)
+		finishedStartJobs.Fail(fmt.Errorf("Couldn't remove orphaned services: %w", err))
 		return
 	}
-	err = p.DeleteAllIngresses()
+	err = p.DeleteAllIngresses(ctx)
 	if err != nil {
 		fmt.Printf("Error cleaning up orphaned ingresses %s", err.Error())
 	}
@@ -595,26 +699,39 @@ func (p *Pod) RunStartJobsWhenReady(requiredToStartJobs []*util.ReadyChannel, fi
 	// Perform start jobs here
 
 	if p.NeedsSshService() {
-		p.startSshService()
+		progress.set("Starting the ssh service didn't finish")
+		err = p.startSshService(ctx)
+		if err != nil {
+			fmt.Printf("Couldn't start ssh service for pod %s: %s\n", p.Object.Name, err.Error())
+			finishedStartJobs.Fail(fmt.Errorf("Couldn't start ssh service: %w", err))
+			return
+		}
 	}
 
 	if p.NeedsIngress() {
-		p.createIngress()
+		progress.set("Creating the ingress didn't finish")
+		err = p.createIngress(ctx)
+		if err != nil {
+			fmt.Printf("Couldn't create ingress for pod %s: %s\n", p.Object.Name, err.Error())
+			finishedStartJobs.Fail(fmt.Errorf("Couldn't create ingress: %w", err))
+			return
+		}
 	}
 
-	err = p.CreateAndSavePodCache(false)
+	progress.set("Copying tokens from the pod didn't finish")
+	err = p.CreateAndSavePodCache(ctx, false)
 	if err != nil {
 		fmt.Printf("Failed to save pod cache for pod %s: %s\n", p.Object.Name, err.Error())
-		finishedStartJobs.Send(false)
+		finishedStartJobs.Fail(fmt.Errorf("Couldn't save pod cache: %w", err))
 		return
 	}
 
-	finishedStartJobs.Send(true)
+	finishedStartJobs.Succeed()
 }
 
-func (p *Pod) CreateAndSavePodCache(reload bool) error {
-	tokens := p.getAllTokens(reload)
-	otherResourceInfo := p.getOtherResourceInfo()
+func (p *Pod) CreateAndSavePodCache(ctx context.Context, reload bool) error {
+	tokens := p.getAllTokens(ctx, reload)
+	otherResourceInfo := p.getOtherResourceInfo(ctx)
 	return p.savePodCache(
 		podCache{
 			Tokens:            tokens,
@@ -627,7 +744,7 @@ func (p *Pod) CreateAndSavePodCache(reload bool) error {
 // copy the token from the pod held in /tmp/key to the filesystem, ready to be served by getPods.
 // If reload is true, it will only attempt each token once,
 // otherwise, it will try a few times to give the pod time to create /tmp/key after starting
-func (p *Pod) getAllTokens(reload bool) map[string]string {
+func (p *Pod) getAllTokens(ctx context.Context, reload bool) map[string]string {
 	tokenMap := make(map[string]string)
 	keys, has := p.Object.ObjectMeta.Annotations["sciencedata.dk/copy-token"]
 	// If the copy-token annotiation doesn't exist
@@ -642,24 +759,27 @@ func (p *Pod) getAllTokens(reload bool) map[string]string {
 		var token string
 		if reload {
 			// if reloading tokens of pods that should already have created /tmp/key
-			token, err = p.GetToken(key)
+			token, err = p.GetToken(ctx, key)
 			if err != nil {
 				fmt.Printf("Error while refreshing token %s for pod %s: %s\n", key, p.Object.Name, err.Error())
 			}
 		} else {
 			// give a new pod up to 10s to create /tmp/key before giving up
 			for i := 0; i < 10; i++ {
-				token, err = p.GetToken(key)
-				if err != nil {
-					time.Sleep(1 * time.Second)
-				} else {
+				token, err = p.GetToken(ctx, key)
+				if err == nil || ctx.Err() != nil {
 					break
 				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(1 * time.Second):
+				}
 			}
 		}
 		// if it never succeeded, log the last error message
 		if err != nil {
 			fmt.Printf("Error while copying token %s for pod %s: %s\n", key, p.Object.Name, err.Error())
+			metrics.TokenCopyFailures.Inc()
 		} else {
 			// If it got the token successfully, add it to the tokenMap
 			tokenMap[key] = token
@@ -669,10 +789,10 @@ func (p *Pod) getAllTokens(reload bool) map[string]string {
 }
 
 // Try to copy /tmp/"key" in the created pod into /tmp into p.cache.tokens
-func (p *Pod) GetToken(key string) (string, error) {
+func (p *Pod) GetToken(ctx context.Context, key string) (string, error) {
 	var stdout, stderr bytes.Buffer
 	var err error
-	stdout, stderr, err = p.Client.PodExec([]string{"cat", fmt.Sprintf("/tmp/%s", key)}, p.Object, 0)
+	stdout, stderr, err = p.Client.PodExec(ctx, []string{"cat", fmt.Sprintf("/tmp/%s", key)}, p.Object, 0)
 	if err != nil {
 		return "", errors.New(fmt.Sprintf("Couldn't call pod exec for pod %s: %s", p.Object.Name, err.Error()))
 	}
@@ -691,16 +811,37 @@ func (p *Pod) GetToken(key string) (string, error) {
 }
 
 // Start the ssh service required by this pod
-func (p *Pod) startSshService() error {
+func (p *Pod) startSshService(ctx context.Context) error {
 	targetService := p.getTargetSshService()
-	_, err := p.Client.CreateService(targetService)
+	_, err := p.Client.CreateService(ctx, targetService)
 	if err != nil {
+		// If it was already created for this pod, e.g. by a concurrent start job, there's nothing to do
+		if k8sclient.IsAlreadyExists(err) {
+			fmt.Printf("SVC %s already exists\n", targetService.Name)
+			return nil
+		}
 		return err
 	}
 	fmt.Printf("Created SVC %s\n", targetService.Name)
 	return nil
 }
 
+// Get owner references to this pod, so that kubernetes garbage collects the resources created for it along with it.
+// Empty if the pod object has no UID, like the stub of a pod that is already gone.
+func (p *Pod) ownerReferences() []metav1.OwnerReference {
+	if p.Object.UID == "" {
+		return nil
+	}
+	return []metav1.OwnerReference{
+		{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Name:       p.Object.Name,
+			UID:        p.Object.UID,
+		},
+	}
+}
+
 // Get a target service object that will provide ssh port forwarding for this pod
 func (p *Pod) getTargetSshService() *apiv1.Service {
 	return &apiv1.Service{
@@ -709,6 +850,7 @@ func (p *Pod) getTargetSshService() *apiv1.Service {
 			Labels: map[string]string{
 				"createdForPod": p.Object.Name,
 			},
+			OwnerReferences: p.ownerReferences(),
 		},
 		Spec: apiv1.ServiceSpec{
 			Ports: []apiv1.ServicePort{
@@ -727,35 +869,49 @@ func (p *Pod) getTargetSshService() *apiv1.Service {
 
 // Checks whether an ingress should be created for this pod based on the annotation in its manifest
 func (p *Pod) NeedsIngress() bool {
+	_, ok := p.ingressPort()
+	return ok
+}
+
+// Returns the port from the pod's ingress-port annotation and whether it has a valid one
+func (p *Pod) ingressPort() (int32, bool) {
 	portStr, hasKey := p.Object.ObjectMeta.Annotations[ingressPortAnnotation]
-	if hasKey {
-		portInt, err := strconv.ParseInt(portStr, 10, 32)
-		if err != nil {
-			fmt.Printf("Warning: Couldn't parse ingress-port annotation for pod %s, skipping ingress", p.Object.Name)
-			return false
-		}
-		p.ingressPort = int32(portInt)
+	if !hasKey {
+		return 0, false
+	}
+	portInt, err := strconv.ParseInt(portStr, 10, 32)
+	if err != nil {
+		fmt.Printf("Warning: Couldn't parse ingress-port annotation for pod %s, skipping ingress\n", p.Object.Name)
+		return 0, false
 	}
-	return hasKey
+	return int32(portInt), true
 }
 
-func (p *Pod) createIngress() error {
+func (p *Pod) createIngress(ctx context.Context) error {
 	// First create the service that the ingress should route to
 	targetService := p.getTargetHttpService()
-	_, err := p.Client.CreateService(targetService)
+	_, err := p.Client.CreateService(ctx, targetService)
 	if err != nil {
-		return err
+		if !k8sclient.IsAlreadyExists(err) {
+			return err
+		}
+		fmt.Printf("SVC %s already exists\n", targetService.Name)
+	} else {
+		fmt.Printf("Created SVC %s\n", targetService.Name)
 	}
-	fmt.Printf("Created SVC %s\n", targetService.Name)
 
 	// Then create the ingress
 	targetIngress := p.getTargetIngress()
-	_, err = p.Client.CreateIngress(targetIngress)
+	_, err = p.Client.CreateIngress(ctx, targetIngress)
 	if err != nil {
-		fmt.Printf("Ingress error: %s\n", err.Error())
-		return err
+		if !k8sclient.IsAlreadyExists(err) {
+			fmt.Printf("Ingress error: %s\n", err.Error())
+			return err
+		}
+		fmt.Printf("ING %s already exists\n", targetIngress.Name)
+	} else {
+		fmt.Printf("Created ING %s\n", targetIngress.Name)
 	}
-	fmt.Printf("Created ING %s\n", targetIngress.Name)
 
 	return nil
 }
@@ -763,20 +919,22 @@ func (p *Pod) createIngress() error {
 // Get a target service object that will forward http traffic to this pod
 // An ingress will route traffic to it
 func (p *Pod) getTargetHttpService() *apiv1.Service {
+	port, _ := p.ingressPort()
 	return &apiv1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: fmt.Sprintf("%s-http", p.Object.Name),
 			Labels: map[string]string{
 				"createdForPod": p.Object.Name,
 			},
+			OwnerReferences: p.ownerReferences(),
 		},
 		Spec: apiv1.ServiceSpec{
 			Ports: []apiv1.ServicePort{
 				{
 					Name:       "http",
 					Protocol:   apiv1.ProtocolTCP,
-					Port:       p.ingressPort,
-					TargetPort: intstr.FromInt(int(p.ingressPort)),
+					Port:       port,
+					TargetPort: intstr.FromInt(int(port)),
 				},
 			},
 			Type:     apiv1.ServiceTypeClusterIP,
@@ -787,6 +945,7 @@ func (p *Pod) getTargetHttpService() *apiv1.Service {
 
 // Get a target ingress object to route http traffic to this pod
 func (p *Pod) getTargetIngress() *netv1.Ingress {
+	port, _ := p.ingressPort()
 	pathType := netv1.PathTypePrefix
 	return &netv1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
@@ -794,6 +953,7 @@ func (p *Pod) getTargetIngress() *netv1.Ingress {
 			Labels: map[string]string{
 				"createdForPod": p.Object.Name,
 			},
+			OwnerReferences: p.ownerReferences(),
 		},
 		Spec: netv1.IngressSpec{
 			TLS: []netv1.IngressTLS{
@@ -815,7 +975,7 @@ func (p *Pod) getTargetIngress() *netv1.Ingress {
 										Service: &netv1.IngressServiceBackend{
 											Name: fmt.Sprintf("%s-http", p.Object.Name),
 											Port: netv1.ServiceBackendPort{
-												Number: p.ingressPort,
+												Number: port,
 											},
 										},
 									},
@@ -0,0 +1,415 @@
+//go:build cluster
+
+// Tests that need a cluster and the backend running on localhost, see "running tests" in the README
+
+package managed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/testingutil"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	"go.uber.org/goleak"
+	v1 "k8s.io/api/core/v1"
+)
+
+// All tests in this package share one client,
+// so that its informers can be stopped before the leak check
+var sharedClient k8sclient.K8sClient
+var sharedClientOnce sync.Once
+
+func getSharedClient(config util.GlobalConfig) k8sclient.K8sClient {
+	sharedClientOnce.Do(func() {
+		sharedClient = k8sclient.NewK8sClient(config)
+	})
+	return sharedClient
+}
+
+func newUser(uid string) User {
+	config := util.MustLoadGlobalConfig()
+	if uid == "" {
+		uid = config.TestUser
+	}
+	client := getSharedClient(config)
+	return NewUser(uid, client, config)
+}
+
+func TestListPods(t *testing.T) {
+	u := newUser("")
+
+	// Make sure the user has some pods
+	err := testingutil.EnsureUserHasNPods(u.UserID, 3)
+	if err != nil {
+		t.Fatalf("Couldn't create pods for user: %s", err.Error())
+	}
+
+	// Use u.ListPods
+	podList, err := u.ListPods(context.Background())
+	if err != nil {
+		t.Fatalf("Couldn't list user pods")
+	}
+
+	// Then use a manual list from the k8sclient
+	manualPodList, err := u.Client.ListPods(context.Background(), u.GetListOptions())
+	// For each of the manually listed pods,
+	for _, existingPod := range manualPodList.Items {
+		// Look through ListPods and make sure it's there
+		inPodList := false
+		for _, listedPod := range podList {
+			if listedPod.Object.Name == existingPod.Name {
+				inPodList = true
+				break
+			}
+		}
+		if !inPodList {
+			t.Fatalf("Pod %s wasn't listed in User.ListPods", existingPod.Name)
+		}
+	}
+	if len(podList) != len(manualPodList.Items) {
+		t.Fatalf("Mismatched number of user pods listed")
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	u := newUser("")
+
+	// Make sure the user has some pods
+	err := testingutil.EnsureUserHasNPods(u.UserID, 3)
+	if err != nil {
+		t.Fatalf("Couldn't create pods for user: %s", err.Error())
+	}
+
+	// Use u.ListPods
+	podList, err := u.ListPods(context.Background())
+	if err != nil {
+		t.Fatalf("Couldn't list user pods")
+	}
+	if len(podList) == 0 {
+		t.Fatalf("Need to have at least one pod running for this test")
+	}
+	for _, pod := range podList {
+		owns, err := u.OwnsPod(context.Background(), pod.Object.Name)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if !owns {
+			t.Fatalf("User thinks they don't own a pod that they do")
+		}
+	}
+	tryPodNames := []string{"foobar-pod", "user-pods-backend", "user-pods-backend-testing"}
+	for _, name := range tryPodNames {
+		owns, err := u.OwnsPod(context.Background(), name)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if owns {
+			t.Fatalf("User thinks they own pod %s, but they don't", name)
+		}
+	}
+}
+
+func TestCreateDeleteUserStorage(t *testing.T) {
+	u := newUser("foo@bar.baz")
+	finished := util.NewFuture(time.Second)
+	// It should return without error and succeed for a user whose storage doesn't exist
+	err := u.DeleteUserStorage(context.Background(), finished)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := finished.Wait(); err != nil {
+		t.Fatalf("Deletion of nonexistant user storage failed: %s", err.Error())
+	}
+
+	// Create storage for this user
+	ready := util.NewFuture(u.GlobalConfig.TimeoutCreate)
+	err = u.CreateUserStorageIfNotExist(context.Background(), ready, u.GlobalConfig.TestingHost)
+	if err != nil {
+		t.Fatalf("Failed to create user storage %s", err.Error())
+	}
+	if err := ready.Wait(); err != nil {
+		t.Fatalf("Creation of user storage failed: %s", err.Error())
+	}
+
+	// Check that the PV and PVC were created successfully and that they are bound
+	pvcList, err := u.Client.ListPVC(context.Background(), u.GetStorageListOptions())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(pvcList.Items) != 1 {
+		t.Fatalf("There should be exactly 1 pvc listed by the user's storageListOptions, but there are %d", len(pvcList.Items))
+	}
+	if pvcList.Items[0].Name != "user-storage-foo-bar-baz" {
+		t.Fatalf("User PVC has incorrect name: %s", pvcList.Items[0].Name)
+	}
+	if pvcList.Items[0].Status.Phase != v1.ClaimBound {
+		t.Fatalf("Created PVC not bound")
+	}
+
+	pvList, err := u.Client.ListPV(context.Background(), u.GetStorageListOptions())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(pvList.Items) != 1 {
+		t.Fatalf("There should be exactly 1 pv listed by the user's storageListOptions, but there are %d", len(pvList.Items))
+	}
+	if pvList.Items[0].Name != "user-storage-foo-bar-baz" {
+		t.Fatalf("User PVC has incorrect name: %s", pvList.Items[0].Name)
+	}
+	if pvList.Items[0].Status.Phase != v1.VolumeBound {
+		t.Fatalf("Created PV not bound")
+	}
+
+	// Now that the user storage does exist, it should be possible to delete
+	finished = util.NewFuture(u.GlobalConfig.TimeoutDelete)
+	err = u.DeleteUserStorage(context.Background(), finished)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := finished.Wait(); err != nil {
+		t.Fatalf("Deletion of existing user storage failed: %s", err.Error())
+	}
+}
+
+// Make sure that the targetStoragePV and PVC are valid for all usernames
+func TestUserStorageValidity(t *testing.T) {
+	userNames := []string{
+		"foo",
+		"foo@bar",
+		"foo@bar.baz",
+		"foo.bar@bar.baz",
+		"foobar-baz",
+	}
+
+	// Create the storage for each userName
+	var readyList []*util.Future
+	for _, userName := range userNames {
+		u := newUser(userName)
+		ready := util.NewFuture(u.GlobalConfig.TimeoutCreate)
+		err := u.CreateUserStorageIfNotExist(context.Background(), ready, u.GlobalConfig.TestingHost)
+		if err != nil {
+			t.Fatalf("Couldn't create storage for user %s: %s", userName, err.Error())
+		}
+		readyList = append(readyList, ready)
+	}
+	if err := util.WaitFutures(readyList); err != nil {
+		t.Fatalf("Not all user storages were created successfully: %s", err.Error())
+	}
+
+	// Delete the storage for each userName
+	var finishedList []*util.Future
+	for _, userName := range userNames {
+		u := newUser(userName)
+		finished := util.NewFuture(u.GlobalConfig.TimeoutDelete)
+		err := u.DeleteUserStorage(context.Background(), finished)
+		if err != nil {
+			t.Fatalf("Couldn't delete storage for user %s: %s", userName, err.Error())
+		}
+		finishedList = append(finishedList, finished)
+	}
+	if err := util.WaitFutures(finishedList); err != nil {
+		t.Fatalf("Not all user storages were deleted successfully: %s", err.Error())
+	}
+}
+
+func TestPodData(t *testing.T) {
+	u := newUser("")
+	defaultRequests := testingutil.GetStandardPodRequests()
+	err := testingutil.EnsureUserHasEach(u.UserID, defaultRequests)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	podList, err := u.ListPods(context.Background())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	for _, pod := range podList {
+		// check that NeedsSshService and NeedsIngress are correct
+		podType := ""
+		for key := range defaultRequests {
+			if strings.Contains(pod.Object.Name, key) {
+				podType = key
+				break
+			}
+		}
+		// If the pod matches one of the pod types from the default request map,
+		if podType != "" {
+			if pod.NeedsSshService() != defaultRequests[podType].Supplementary.NeedsSsh {
+				t.Fatalf("Pod %s NeedsSshService() returns %t but should be %t", pod.Object.Name, pod.NeedsSshService(), defaultRequests[podType].Supplementary.NeedsSsh)
+			}
+			if pod.NeedsIngress() != defaultRequests[podType].Supplementary.NeedsIngress {
+				t.Fatalf("Pod %s NeedsIngress() returns %t but should be %t", pod.Object.Name, pod.NeedsIngress(), defaultRequests[podType].Supplementary.NeedsIngress)
+			}
+		}
+
+		info := pod.GetPodInfo()
+		if info.PodName != pod.Object.Name {
+			t.Fatalf("Pod %s wrong name", pod.Object.Name)
+		}
+		if info.Owner != u.UserID {
+			t.Fatalf("Pod %s wrong owner", pod.Object.Name)
+		}
+
+		err := checkStartJobSuccess(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestJobs(t *testing.T) {
+	// Make sure the user has one of each of the standard pod types to attempt to rerun jobs
+	u := newUser("")
+	defaultRequests := testingutil.GetStandardPodRequests()
+	err := testingutil.EnsureUserHasEach(u.UserID, defaultRequests)
+	if err != nil {
+		t.Fatalf("Couldn't ensure user had all pods: %s", err.Error())
+	}
+
+	podList, err := u.ListPods(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, pod := range podList {
+		readyToDelete := util.NewFuture(time.Second)
+		readyToDelete.Succeed()
+		finishedDeleteJobs := util.NewFuture(u.GlobalConfig.TimeoutDelete)
+		pod.RunDeleteJobsWhenReady(context.Background(), readyToDelete, finishedDeleteJobs)
+		if err := finishedDeleteJobs.Wait(); err != nil {
+			t.Fatalf("Pod %s failed to complete delete jobs: %s", pod.Object.Name, err.Error())
+		}
+		// Now check that podcache and potential services have been deleted
+		_, err := pod.loadPodCache()
+		if !os.IsNotExist(err) {
+			t.Fatalf("Pod %s loading cache after delete job gets error \"%s\" when should be does not exist", pod.Object.Name, err.Error())
+		}
+		serviceList, err := pod.ListServices(context.Background())
+		if err != nil {
+			t.Fatalf("Pod %s couldn't list services: %s", pod.Object.Name, err.Error())
+		}
+		if len(serviceList.Items) != 0 {
+			t.Fatalf("Pod %s still has remaining services after delete job", pod.Object.Name)
+		}
+
+		var readyToStartJobs []*util.Future
+		finishedStartJobs := util.NewFuture(u.GlobalConfig.TimeoutCreate)
+		pod.RunStartJobsWhenReady(context.Background(), readyToStartJobs, finishedStartJobs)
+		if err := finishedStartJobs.Wait(); err != nil {
+			t.Fatalf("Pod %s didn't finish start jobs: %s", pod.Object.Name, err.Error())
+		}
+
+		err = checkStartJobSuccess(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Now just check podCache deletion and reloading in reload mode
+		// (because RunStartJobsWhenReady allows multiple attempts to get tokens)
+		err = os.Remove(pod.GetCacheFilename())
+		if err != nil {
+			t.Fatalf("Error deleting podcache for pod %s: %s", pod.Object.Name, err.Error())
+		}
+		err = pod.CreateAndSavePodCache(context.Background(), true)
+		if err != nil {
+			t.Fatalf("Error reloading podCache for pod %s: %s", pod.Object.Name, err.Error())
+		}
+		// Check after this last reload
+		err = checkStartJobSuccess(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIngress(t *testing.T) {
+	// Ensure user pods are deleted first
+	u := newUser("")
+	err := testingutil.DeleteAllUserPods(u.UserID)
+	if err != nil {
+		t.Fatalf("Error deleting user pods: %s", err.Error())
+	}
+
+	testingRequests := testingutil.GetTestingPodRequests()
+	podName, err := testingutil.CreatePod(testingRequests["http_hello_world"])
+	if err != nil {
+		t.Fatalf("Couldn't create testing pod: %s", err.Error())
+	}
+
+	finished := util.NewFuture(u.GlobalConfig.TimeoutCreate)
+	err = testingutil.WatchCreatePod(u.UserID, podName, finished)
+	if err != nil {
+		t.Fatalf("Couldn't watch creation of testing pod: %s", err.Error())
+	}
+	if err := finished.Wait(); err != nil {
+		t.Fatalf("Testing pod didn't reach ready state: %s", err.Error())
+	}
+
+	pods, err := u.ListPods(context.Background())
+	if err != nil {
+		t.Fatalf("Couldn't list pods: %s", err.Error())
+	}
+	if len(pods) != 1 {
+		t.Fatalf("The user should have exactly one pod but has %d", len(pods))
+	}
+	testPod := pods[0]
+	t.Logf("Successfully created testing pod, attempting to cURL")
+
+	// Try a few times to make the http request
+	var failed error = nil
+	for i := 0; i < 10; i++ {
+		response, err := http.Get(fmt.Sprintf("https://%s", testPod.getIngressHost()))
+		if err != nil {
+			failed = err
+			t.Logf("Failed %d time(s), waiting a second to try again", i+1)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		defer response.Body.Close()
+		// This can get a 404 while the testing container's starting script is running
+		if response.StatusCode == 200 {
+			failed = nil
+		} else {
+			failed = errors.New(fmt.Sprintf("Http request to testing pod got response code %d", response.StatusCode))
+			t.Logf("Failed %d time(s), waiting a second to try again", i+1)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		body, err := ioutil.ReadAll(response.Body)
+		hello := string(body)
+		if !strings.Contains(hello, "http hello world") {
+			t.Fatalf("Didn't get expected response \"http hello world\", instead got %s", hello)
+		}
+	}
+	if failed != nil {
+		t.Fatal(failed)
+	}
+
+	// Clean up by deleting the testing pod
+	_, err = testingutil.DeletePod(u.UserID, podName)
+	if err != nil {
+		t.Fatalf("Couldn't delete testing pod: %s", err.Error())
+	}
+}
+
+func TestWaitBeforeLeakCheck(t *testing.T) {
+	u := newUser("")
+	u.Client.Stop()
+	// Completed futures leave no goroutines behind, so this only waits for the watches
+	// of creations and deletions that tests started without waiting for them to finish
+	deadline := time.Now().Add(u.GlobalConfig.TimeoutDelete + u.GlobalConfig.TimeoutCreate)
+	for goleak.Find(leakOptions...) != nil && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+}
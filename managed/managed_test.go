@@ -1,32 +1,24 @@
 package managed
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"os"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
-	"github.com/deic.dk/user_pods_k8s_backend/testingutil"
 	"github.com/deic.dk/user_pods_k8s_backend/util"
 	"go.uber.org/goleak"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 )
 
-func newUser(uid string) User {
-	config := util.MustLoadGlobalConfig()
-	if uid == "" {
-		uid = config.TestUser
-	}
-	client := k8sclient.NewK8sClient(config)
-	return NewUser(uid, client, config)
-}
-
 func checkStartJobSuccess(pod Pod) error {
 	info := pod.GetPodInfo()
 	// Check that all keys that should be there are in podInfo
@@ -63,7 +55,7 @@ func checkStartJobSuccess(pod Pod) error {
 			return errors.New(fmt.Sprintf("Pod %s has key %s in tokens, but isn't specified in annotations", pod.Object.Name, key))
 		}
 		// Check whether the value in the podcache matches a newly retrieved key
-		currentValue, err := pod.GetToken(key)
+		currentValue, err := pod.GetToken(context.Background(), key)
 		if err != nil {
 			return errors.New(fmt.Sprintf("Error retrieving token for pod %s: %s", pod.Object.Name, err.Error()))
 		}
@@ -78,7 +70,7 @@ func checkStartJobSuccess(pod Pod) error {
 		return errors.New(fmt.Sprintf("Pod %s has podInfo with(out) sshPort and doesn't (does) need ssh service", pod.Object.Name))
 	}
 	if exists {
-		newlyRetreivedSshPort, err := pod.getSshPort()
+		newlyRetreivedSshPort, err := pod.getSshPort(context.Background())
 		if err != nil {
 			return errors.New(fmt.Sprintf(err.Error()))
 		}
@@ -89,6 +81,53 @@ func checkStartJobSuccess(pod Pod) error {
 	return nil
 }
 
+// Return a user without a client, for tests that don't need a cluster
+func newUserWithoutClient(uid string) User {
+	return NewUser(uid, nil, util.MustLoadGlobalConfig())
+}
+
+// Return the config for a test with the fake client, whose pod caches are kept in a temporary directory
+func fakeConfig(t *testing.T) util.GlobalConfig {
+	config := util.MustLoadGlobalConfig()
+	config.PodCacheDir = t.TempDir()
+	return config
+}
+
+// Return the user with a fake client whose cluster already contains objects.
+// The client is stopped when the test ends.
+func newFakeUser(t *testing.T, config util.GlobalConfig, uid string, objects ...runtime.Object) (User, *k8sclient.FakeK8sClient) {
+	client := k8sclient.NewFakeK8sClient(config, objects...)
+	t.Cleanup(client.Stop)
+	return NewUser(uid, client, config), client
+}
+
+// Return a ready pod of the user that needs an ssh service and an ingress and has a token to copy,
+// like one created from testingutil.FakePodManifest
+func fakeUserPod(config util.GlobalConfig, uid string, name string) *v1.Pod {
+	user, domain, _ := strings.Cut(uid, "@")
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: config.Namespace,
+			UID:       types.UID(name + "-uid"),
+			Labels:    map[string]string{"user": user, "domain": domain},
+			Annotations: map[string]string{
+				"sciencedata.dk/copy-token":   "token",
+				"sciencedata.dk/ingress-port": "8888",
+			},
+		},
+		Spec: v1.PodSpec{Containers: []v1.Container{{
+			Name:  "fake",
+			Image: "fake",
+			Ports: []v1.ContainerPort{{ContainerPort: 22}, {ContainerPort: 8888}},
+		}}},
+		Status: v1.PodStatus{
+			Phase:      v1.PodRunning,
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+		},
+	}
+}
+
 // Test user functions
 func TestNewUser(t *testing.T) {
 	userIDs := []string{
@@ -98,7 +137,7 @@ func TestNewUser(t *testing.T) {
 		"foo.bar@baz",
 	}
 	for _, uid := range userIDs {
-		u := newUser(uid)
+		u := newUserWithoutClient(uid)
 		labels := map[string]string{"user": u.Name, "domain": u.Domain}
 		if u.UserID != util.GetUserIDFromLabels(labels) {
 			t.Fatalf("User contstructed incorrectly with userID %s", uid)
@@ -111,9 +150,9 @@ func TestListOptions(t *testing.T) {
 		input User
 		want  metav1.ListOptions
 	}{
-		{newUser("foo"), metav1.ListOptions{LabelSelector: "user=foo,domain="}},
-		{newUser("foo@bar"), metav1.ListOptions{LabelSelector: "user=foo,domain=bar"}},
-		{newUser("foo@bar.baz"), metav1.ListOptions{LabelSelector: "user=foo,domain=bar.baz"}},
+		{newUserWithoutClient("foo"), metav1.ListOptions{LabelSelector: "user=foo,domain="}},
+		{newUserWithoutClient("foo@bar"), metav1.ListOptions{LabelSelector: "user=foo,domain=bar"}},
+		{newUserWithoutClient("foo@bar.baz"), metav1.ListOptions{LabelSelector: "user=foo,domain=bar.baz"}},
 	}
 	for _, test := range tests {
 		if test.input.GetListOptions() != test.want {
@@ -122,163 +161,303 @@ func TestListOptions(t *testing.T) {
 	}
 }
 
-func TestListPods(t *testing.T) {
-	u := newUser("")
+func TestUserString(t *testing.T) {
+	tests := []struct {
+		input User
+		want  string
+	}{
+		{newUserWithoutClient("foo"), "foo"},
+		{newUserWithoutClient("foo@bar"), "foo-bar"},
+		{newUserWithoutClient("Foo@Bar"), "Foo-Bar"},
+		{newUserWithoutClient("foo@bar.baz"), "foo-bar-baz"},
+		{newUserWithoutClient("foo@bar.baz-baz"), "foo-bar-baz-baz"},
+		{newUserWithoutClient("foo.bar@bar.baz"), "foo-bar-bar-baz"},
+	}
+	for _, test := range tests {
+		if test.input.GetUserString() != test.want {
+			t.Fatalf("Bad list options for userID %s. Got %s, wanted %s", test.input.UserID, test.input.GetUserString(), test.want)
+		}
+	}
+}
 
-	// Make sure the user has some pods
-	err := testingutil.EnsureUserHasNPods(u.UserID, 3)
-	if err != nil {
-		t.Fatalf("Couldn't create pods for user: %s", err.Error())
+func TestPodInfoContainers(t *testing.T) {
+	config := util.MustLoadGlobalConfig()
+	config.PodCacheDir = t.TempDir()
+	object := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "multi-testuser", Labels: map[string]string{"user": "testuser"}},
+		Spec: v1.PodSpec{
+			NodeName: "node1",
+			Containers: []v1.Container{
+				{
+					Name:  "app",
+					Image: "app:latest",
+					Resources: v1.ResourceRequirements{
+						Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("500m")},
+						Limits:   v1.ResourceList{v1.ResourceMemory: resource.MustParse("1Gi")},
+					},
+				},
+				{Name: "sidecar", Image: "sidecar:latest"},
+			},
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			Conditions: []v1.PodCondition{
+				{Type: v1.PodReady, Status: v1.ConditionFalse, Reason: "ContainersNotReady"},
+			},
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "app", Ready: true, ImageID: "docker-pullable://app@sha256:abc", State: v1.ContainerState{Running: &v1.ContainerStateRunning{}}},
+				{
+					Name:                 "sidecar",
+					RestartCount:         4,
+					State:                v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+					LastTerminationState: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{Reason: "Error", ExitCode: 1}},
+				},
+			},
+		},
+	}
+	pod := NewPod(object, nil, config)
+	info := pod.GetPodInfo()
+	if info.NodeName != "node1" {
+		t.Fatalf("PodInfo has node name %s instead of node1", info.NodeName)
+	}
+	if len(info.Conditions) != 1 || info.Conditions[0].Reason != "ContainersNotReady" {
+		t.Fatalf("PodInfo has conditions %+v", info.Conditions)
+	}
+	if len(info.Containers) != 2 {
+		t.Fatalf("PodInfo has %d containers instead of 2", len(info.Containers))
+	}
+	app, sidecar := info.Containers[0], info.Containers[1]
+	if app.State != "running" || !app.Ready || app.ImageID != "docker-pullable://app@sha256:abc" {
+		t.Fatalf("PodInfo has the wrong status for the first container: %+v", app)
+	}
+	if app.Requests["cpu"] != "500m" || app.Limits["memory"] != "1Gi" {
+		t.Fatalf("PodInfo has requests %v and limits %v for the first container", app.Requests, app.Limits)
 	}
+	if sidecar.Image != "sidecar:latest" || sidecar.State != "waiting" || sidecar.Reason != "CrashLoopBackOff" {
+		t.Fatalf("PodInfo has the wrong status for the second container: %+v", sidecar)
+	}
+	if sidecar.RestartCount != 4 || sidecar.LastReason != "Error" || sidecar.LastExitCode != 1 {
+		t.Fatalf("PodInfo doesn't say why the second container restarted: %+v", sidecar)
+	}
+}
 
-	// Use u.ListPods
-	podList, err := u.ListPods()
-	if err != nil {
-		t.Fatalf("Couldn't list user pods")
-	}
-
-	// Then use a manual list from the k8sclient
-	manualPodList, err := u.Client.ListPods(u.GetListOptions())
-	// For each of the manually listed pods,
-	for _, existingPod := range manualPodList.Items {
-		// Look through ListPods and make sure it's there
-		inPodList := false
-		for _, listedPod := range podList {
-			if listedPod.Object.Name == existingPod.Name {
-				inPodList = true
-				break
-			}
+func TestParseLastActivity(t *testing.T) {
+	expected := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	outputs := []string{
+		"2024-01-02T03:04:05Z\n",
+		fmt.Sprintf("%d", expected.Unix()),
+		`{"started": "2024-01-01T00:00:00Z", "last_activity": "2024-01-02T03:04:05.000000Z", "connections": 0}`,
+		fmt.Sprintf(`{"last_activity": %d}`, expected.Unix()),
+	}
+	for _, output := range outputs {
+		lastActivity, err := parseLastActivity([]byte(output))
+		if err != nil {
+			t.Fatalf("Couldn't parse %q: %s", output, err.Error())
 		}
-		if !inPodList {
-			t.Fatalf("Pod %s wasn't listed in User.ListPods", existingPod.Name)
+		if !lastActivity.Equal(expected) {
+			t.Fatalf("Parsed %q as %s instead of %s", output, lastActivity, expected)
 		}
 	}
-	if len(podList) != len(manualPodList.Items) {
-		t.Fatalf("Mismatched number of user pods listed")
+	for _, output := range []string{"", "yesterday", `{"connections": 0}`} {
+		if _, err := parseLastActivity([]byte(output)); err == nil {
+			t.Fatalf("Parsed %q without error", output)
+		}
 	}
 }
 
-func TestOwnership(t *testing.T) {
-	u := newUser("")
+func TestApplyLifetime(t *testing.T) {
+	config := util.MustLoadGlobalConfig()
+	config.DefaultLifetime = 2 * time.Hour
+	config.MaxLifetime = 24 * time.Hour
+	tests := []struct {
+		annotation string
+		requested  time.Duration
+		expected   time.Duration
+	}{
+		{"", 0, 2 * time.Hour},
+		{"30m", 0, 30 * time.Minute},
+		{"30m", time.Hour, time.Hour},
+		{"", 48 * time.Hour, 24 * time.Hour},
+		{"0s", 0, 24 * time.Hour},
+	}
+	for _, test := range tests {
+		target := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "lifetimepod"}}
+		if test.annotation != "" {
+			target.Annotations = map[string]string{maxLifetimeAnnotation: test.annotation}
+		}
+		err := ApplyLifetime(target, test.requested, config)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		pod := NewPod(target, nil, config)
+		expires, hasExpiry, err := pod.Expires()
+		if err != nil || !hasExpiry {
+			t.Fatalf("Pod with lifetime %q and %s requested doesn't expire: %v", test.annotation, test.requested, err)
+		}
+		if lifetime := time.Until(expires); lifetime > test.expected || lifetime < test.expected-time.Minute {
+			t.Fatalf("Pod with lifetime %q and %s requested expires in %s instead of %s", test.annotation, test.requested, lifetime, test.expected)
+		}
 
-	// Make sure the user has some pods
-	err := testingutil.EnsureUserHasNPods(u.UserID, 3)
-	if err != nil {
-		t.Fatalf("Couldn't create pods for user: %s", err.Error())
+		// Extending it by its own lifetime postpones the expiry to that lifetime from now
+		extended, err := pod.ExtendedExpiry(0)
+		if err != nil || time.Until(extended) < test.expected-time.Minute {
+			t.Fatalf("Extending pod with lifetime %s gave %s, %v", test.expected, extended, err)
+		}
+		// while a shorter extension doesn't make it expire any sooner
+		if extended, _ = pod.ExtendedExpiry(time.Second); extended.Before(expires) {
+			t.Fatalf("Extending pod by 1s moved its expiry from %s to %s", expires, extended)
+		}
+		// and a longer one is capped
+		if extended, _ = pod.ExtendedExpiry(100 * time.Hour); time.Until(extended) > config.MaxLifetime {
+			t.Fatalf("Extending pod by 100h wasn't capped at %s: %s", config.MaxLifetime, extended)
+		}
+	}
+
+	// Without any lifetime, a pod doesn't expire
+	config.DefaultLifetime = 0
+	config.MaxLifetime = 0
+	target := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "lifetimepod"}}
+	if err := ApplyLifetime(target, 0, config); err != nil {
+		t.Fatal(err.Error())
+	}
+	pod := NewPod(target, nil, config)
+	if _, hasExpiry, _ := pod.Expires(); hasExpiry {
+		t.Fatal("Pod without a lifetime expires")
 	}
+	if _, err := pod.ExtendedExpiry(0); err == nil {
+		t.Fatal("Extended pod without a lifetime")
+	}
+	target.Annotations = map[string]string{maxLifetimeAnnotation: "soon"}
+	if err := ApplyLifetime(target, 0, config); err == nil {
+		t.Fatal("Applied invalid lifetime annotation without error")
+	}
+}
+
+func TestFakeListPods(t *testing.T) {
+	config := fakeConfig(t)
+	u, _ := newFakeUser(t, config, config.TestUser,
+		fakeUserPod(config, config.TestUser, "first"),
+		fakeUserPod(config, config.TestUser, "second"),
+		fakeUserPod(config, "other@test.user", "other"),
+	)
 
-	// Use u.ListPods
-	podList, err := u.ListPods()
+	podList, err := u.ListPods(context.Background())
 	if err != nil {
-		t.Fatalf("Couldn't list user pods")
+		t.Fatalf("Couldn't list user pods: %s", err.Error())
 	}
-	if len(podList) == 0 {
-		t.Fatalf("Need to have at least one pod running for this test")
+	if len(podList) != 2 {
+		t.Fatalf("User should have 2 pods, but ListPods returned %d", len(podList))
 	}
 	for _, pod := range podList {
-		owns, err := u.OwnsPod(pod.Object.Name)
-		if err != nil {
-			t.Fatalf(err.Error())
+		if pod.Object.Name == "other" {
+			t.Fatal("ListPods returned another user's pod")
 		}
-		if !owns {
-			t.Fatalf("User thinks they don't own a pod that they do")
-		}
-	}
-	tryPodNames := []string{"foobar-pod", "user-pods-backend", "user-pods-backend-testing"}
-	for _, name := range tryPodNames {
-		owns, err := u.OwnsPod(name)
-		if err != nil {
-			t.Fatalf(err.Error())
-		}
-		if owns {
-			t.Fatalf("User thinks they own pod %s, but they don't", name)
+		if pod.Owner.UserID != u.UserID {
+			t.Fatalf("Pod %s has owner %s instead of %s", pod.Object.Name, pod.Owner.UserID, u.UserID)
 		}
 	}
 }
 
-func TestUserString(t *testing.T) {
+func TestFakeOwnership(t *testing.T) {
+	config := fakeConfig(t)
+	u, _ := newFakeUser(t, config, config.TestUser,
+		fakeUserPod(config, config.TestUser, "owned"),
+		fakeUserPod(config, "other@test.user", "other"),
+	)
 	tests := []struct {
-		input User
-		want  string
+		podName string
+		owns    bool
 	}{
-		{newUser("foo"), "foo"},
-		{newUser("foo@bar"), "foo-bar"},
-		{newUser("Foo@Bar"), "Foo-Bar"},
-		{newUser("foo@bar.baz"), "foo-bar-baz"},
-		{newUser("foo@bar.baz-baz"), "foo-bar-baz-baz"},
-		{newUser("foo.bar@bar.baz"), "foo-bar-bar-baz"},
+		{"owned", true},
+		{"other", false},
+		{"foobar-pod", false},
 	}
 	for _, test := range tests {
-		if test.input.GetUserString() != test.want {
-			t.Fatalf("Bad list options for userID %s. Got %s, wanted %s", test.input.UserID, test.input.GetUserString(), test.want)
+		owns, err := u.OwnsPod(context.Background(), test.podName)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if owns != test.owns {
+			t.Fatalf("OwnsPod(%s) returned %t, should be %t", test.podName, owns, test.owns)
 		}
 	}
 }
 
-func TestCreateDeleteUserStorage(t *testing.T) {
-	u := newUser("foo@bar.baz")
-	finished := util.NewReadyChannel(time.Second)
-	// It should return without error and receive true for a user whose storage doesn't exist
-	err := u.DeleteUserStorage(finished)
+func TestFakeCreateDeleteUserStorage(t *testing.T) {
+	u, _ := newFakeUser(t, fakeConfig(t), "foo@bar.baz")
+	finished := util.NewFuture(time.Second)
+	// It should return without error and succeed for a user whose storage doesn't exist
+	err := u.DeleteUserStorage(context.Background(), finished)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	if !finished.Receive() {
-		t.Fatal("Received false for deletion of nonexistant user storage")
+	if err := finished.Wait(); err != nil {
+		t.Fatalf("Deletion of nonexistant user storage failed: %s", err.Error())
 	}
 
-	// Create storage for this user
-	ready := util.NewReadyChannel(u.GlobalConfig.TimeoutCreate)
-	err = u.CreateUserStorageIfNotExist(ready, u.GlobalConfig.TestingHost)
+	ready := util.NewFuture(u.GlobalConfig.TimeoutCreate)
+	err = u.CreateUserStorageIfNotExist(context.Background(), ready, u.GlobalConfig.TestingHost)
 	if err != nil {
 		t.Fatalf("Failed to create user storage %s", err.Error())
 	}
-	if !ready.Receive() {
-		t.Fatal("Received false for creation of user storage")
+	if err := ready.Wait(); err != nil {
+		t.Fatalf("Creation of user storage failed: %s", err.Error())
 	}
 
-	// Check that the PV and PVC were created successfully and that they are bound
-	pvcList, err := u.Client.ListPVC(u.GetStorageListOptions())
+	// The fake cluster binds the PVC, but leaves the PV Available
+	pvcList, err := u.Client.ListPVC(context.Background(), u.GetStorageListOptions())
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	if len(pvcList.Items) != 1 {
-		t.Fatalf("There should be exactly 1 pvc listed by the user's storageListOptions, but there are %d", len(pvcList.Items))
-	}
-	if pvcList.Items[0].Name != "user-storage-foo-bar-baz" {
-		t.Fatalf("User PVC has incorrect name: %s", pvcList.Items[0].Name)
+	if len(pvcList.Items) != 1 || pvcList.Items[0].Name != "user-storage-foo-bar-baz" {
+		t.Fatalf("The user should have exactly the PVC user-storage-foo-bar-baz, has %d", len(pvcList.Items))
 	}
 	if pvcList.Items[0].Status.Phase != v1.ClaimBound {
 		t.Fatalf("Created PVC not bound")
 	}
-
-	pvList, err := u.Client.ListPV(u.GetStorageListOptions())
+	pvList, err := u.Client.ListPV(context.Background(), u.GetStorageListOptions())
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	if len(pvList.Items) != 1 {
-		t.Fatalf("There should be exactly 1 pv listed by the user's storageListOptions, but there are %d", len(pvList.Items))
+	if len(pvList.Items) != 1 || pvList.Items[0].Name != "user-storage-foo-bar-baz" {
+		t.Fatalf("The user should have exactly the PV user-storage-foo-bar-baz, has %d", len(pvList.Items))
 	}
-	if pvList.Items[0].Name != "user-storage-foo-bar-baz" {
-		t.Fatalf("User PVC has incorrect name: %s", pvList.Items[0].Name)
+
+	// Creating it again succeeds without creating another PV or PVC
+	ready = util.NewFuture(u.GlobalConfig.TimeoutCreate)
+	err = u.CreateUserStorageIfNotExist(context.Background(), ready, u.GlobalConfig.TestingHost)
+	if err != nil {
+		t.Fatal(err.Error())
 	}
-	if pvList.Items[0].Status.Phase != v1.VolumeBound {
-		t.Fatalf("Created PV not bound")
+	if err := ready.Wait(); err != nil {
+		t.Fatalf("Creation of existing user storage failed: %s", err.Error())
 	}
 
-	// Now that the user storage does exist, it should be possible to delete
-	finished = util.NewReadyChannel(u.GlobalConfig.TimeoutDelete)
-	err = u.DeleteUserStorage(finished)
+	finished = util.NewFuture(u.GlobalConfig.TimeoutDelete)
+	err = u.DeleteUserStorage(context.Background(), finished)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	if !finished.Receive() {
-		t.Fatal("Received false for deletion of existing user storage")
+	if err := finished.Wait(); err != nil {
+		t.Fatalf("Deletion of existing user storage failed: %s", err.Error())
+	}
+	pvcList, err = u.Client.ListPVC(context.Background(), u.GetStorageListOptions())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pvList, err = u.Client.ListPV(context.Background(), u.GetStorageListOptions())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(pvcList.Items) != 0 || len(pvList.Items) != 0 {
+		t.Fatalf("User still has %d PVCs and %d PVs after deleting their storage", len(pvcList.Items), len(pvList.Items))
 	}
 }
 
 // Make sure that the targetStoragePV and PVC are valid for all usernames
-func TestUserStorageValidity(t *testing.T) {
+func TestFakeUserStorageValidity(t *testing.T) {
+	config := fakeConfig(t)
+	_, client := newFakeUser(t, config, config.TestUser)
 	userNames := []string{
 		"foo",
 		"foo@bar",
@@ -287,230 +466,108 @@ func TestUserStorageValidity(t *testing.T) {
 		"foobar-baz",
 	}
 
-	// Create the storage for each userName
-	var readyList []*util.ReadyChannel
+	var readyList []*util.Future
 	for _, userName := range userNames {
-		u := newUser(userName)
-		ready := util.NewReadyChannel(u.GlobalConfig.TimeoutCreate)
-		err := u.CreateUserStorageIfNotExist(ready, u.GlobalConfig.TestingHost)
+		u := NewUser(userName, client, config)
+		ready := util.NewFuture(config.TimeoutCreate)
+		err := u.CreateUserStorageIfNotExist(context.Background(), ready, config.TestingHost)
 		if err != nil {
 			t.Fatalf("Couldn't create storage for user %s: %s", userName, err.Error())
 		}
 		readyList = append(readyList, ready)
 	}
-	if !util.ReceiveReadyChannels(readyList) {
-		t.Fatalf("Not all user storages were created successfully")
+	if err := util.WaitFutures(readyList); err != nil {
+		t.Fatalf("Not all user storages were created successfully: %s", err.Error())
 	}
 
-	// Delete the storage for each userName
-	var finishedList []*util.ReadyChannel
+	var finishedList []*util.Future
 	for _, userName := range userNames {
-		u := newUser(userName)
-		finished := util.NewReadyChannel(u.GlobalConfig.TimeoutDelete)
-		err := u.DeleteUserStorage(finished)
+		u := NewUser(userName, client, config)
+		finished := util.NewFuture(config.TimeoutDelete)
+		err := u.DeleteUserStorage(context.Background(), finished)
 		if err != nil {
 			t.Fatalf("Couldn't delete storage for user %s: %s", userName, err.Error())
 		}
 		finishedList = append(finishedList, finished)
 	}
-	if !util.ReceiveReadyChannels(finishedList) {
-		t.Fatalf("Not all user storages were created successfully")
+	if err := util.WaitFutures(finishedList); err != nil {
+		t.Fatalf("Not all user storages were deleted successfully: %s", err.Error())
 	}
 }
 
-func TestPodData(t *testing.T) {
-	u := newUser("")
-	defaultRequests := testingutil.GetStandardPodRequests()
-	err := testingutil.EnsureUserHasEach(u.UserID, defaultRequests)
+func TestFakeJobs(t *testing.T) {
+	config := fakeConfig(t)
+	u, client := newFakeUser(t, config, config.TestUser, fakeUserPod(config, config.TestUser, "jobs"))
+	client.SetFile("jobs", "/tmp/token", "faketoken")
+	podList, err := u.ListPods(context.Background())
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatal(err.Error())
 	}
-
-	podList, err := u.ListPods()
-	if err != nil {
-		t.Fatalf(err.Error())
+	if len(podList) != 1 {
+		t.Fatalf("User should have 1 pod, has %d", len(podList))
 	}
+	pod := podList[0]
 
-	for _, pod := range podList {
-		// check that NeedsSshService and NeedsIngress are correct
-		podType := ""
-		for key := range defaultRequests {
-			if strings.Contains(pod.Object.Name, key) {
-				podType = key
-				break
-			}
-		}
-		// If the pod matches one of the pod types from the default request map,
-		if podType != "" {
-			if pod.NeedsSshService() != defaultRequests[podType].Supplementary.NeedsSsh {
-				t.Fatalf("Pod %s NeedsSshService() returns %t but should be %t", pod.Object.Name, pod.NeedsSshService(), defaultRequests[podType].Supplementary.NeedsSsh)
-			}
-			if pod.NeedsIngress() != defaultRequests[podType].Supplementary.NeedsIngress {
-				t.Fatalf("Pod %s NeedsIngress() returns %t but should be %t", pod.Object.Name, pod.NeedsIngress(), defaultRequests[podType].Supplementary.NeedsIngress)
-			}
-		}
-
-		info := pod.GetPodInfo()
-		if info.PodName != pod.Object.Name {
-			t.Fatalf("Pod %s wrong name", pod.Object.Name)
-		}
-		if info.Owner != u.UserID {
-			t.Fatalf("Pod %s wrong owner", pod.Object.Name)
-		}
-
-		err := checkStartJobSuccess(pod)
-		if err != nil {
-			t.Fatal(err)
-		}
+	var readyToStartJobs []*util.Future
+	finishedStartJobs := util.NewFuture(config.TimeoutCreate)
+	pod.RunStartJobsWhenReady(context.Background(), readyToStartJobs, finishedStartJobs)
+	if err := finishedStartJobs.Wait(); err != nil {
+		t.Fatalf("Pod %s didn't finish start jobs: %s", pod.Object.Name, err.Error())
 	}
-}
-
-func TestJobs(t *testing.T) {
-	// Make sure the user has one of each of the standard pod types to attempt to rerun jobs
-	u := newUser("")
-	defaultRequests := testingutil.GetStandardPodRequests()
-	err := testingutil.EnsureUserHasEach(u.UserID, defaultRequests)
-	if err != nil {
-		t.Fatalf("Couldn't ensure user had all pods: %s", err.Error())
+	if err := checkStartJobSuccess(pod); err != nil {
+		t.Fatal(err)
 	}
-
-	podList, err := u.ListPods()
-	if err != nil {
-		t.Fatal(err.Error())
-	}
-
-	for _, pod := range podList {
-		readyToDelete := util.NewReadyChannel(time.Second)
-		readyToDelete.Send(true)
-		finishedDeleteJobs := util.NewReadyChannel(u.GlobalConfig.TimeoutDelete)
-		pod.RunDeleteJobsWhenReady(readyToDelete, finishedDeleteJobs)
-		if !finishedDeleteJobs.Receive() {
-			t.Fatalf("Pod %s failed to complete delete jobs", pod.Object.Name)
-		}
-		// Now check that podcache and potential services have been deleted
-		_, err := pod.loadPodCache()
-		if !os.IsNotExist(err) {
-			t.Fatalf("Pod %s loading cache after delete job gets error \"%s\" when should be does not exist", pod.Object.Name, err.Error())
-		}
-		serviceList, err := pod.ListServices()
-		if err != nil {
-			t.Fatalf("Pod %s couldn't list services: %s", pod.Object.Name, err.Error())
-		}
-		if len(serviceList.Items) != 0 {
-			t.Fatalf("Pod %s still has remaining services after delete job", pod.Object.Name)
-		}
-
-		var readyToStartJobs []*util.ReadyChannel
-		finishedStartJobs := util.NewReadyChannel(u.GlobalConfig.TimeoutCreate)
-		pod.RunStartJobsWhenReady(readyToStartJobs, finishedStartJobs)
-		if !finishedStartJobs.Receive() {
-			t.Fatalf("Pod %s didn't finish start jobs", pod.Object.Name)
-		}
-
-		err = checkStartJobSuccess(pod)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		// Now just check podCache deletion and reloading in reload mode
-		// (because RunStartJobsWhenReady allows multiple attempts to get tokens)
-		err = os.Remove(pod.GetCacheFilename())
-		if err != nil {
-			t.Fatalf("Error deleting podcache for pod %s: %s", pod.Object.Name, err.Error())
-		}
-		err = pod.CreateAndSavePodCache(true)
-		if err != nil {
-			t.Fatalf("Error reloading podCache for pod %s: %s", pod.Object.Name, err.Error())
-		}
-		// Check after this last reload
-		err = checkStartJobSuccess(pod)
-		if err != nil {
-			t.Fatal(err)
-		}
+	if info := pod.GetPodInfo(); info.Tokens["token"] != "faketoken" {
+		t.Fatalf("Pod %s has token %q instead of faketoken", pod.Object.Name, info.Tokens["token"])
 	}
-}
-
-func TestIngress(t *testing.T) {
-	// Ensure user pods are deleted first
-	u := newUser("")
-	err := testingutil.DeleteAllUserPods(u.UserID)
+	ingressList, err := pod.ListIngresses(context.Background())
 	if err != nil {
-		t.Fatalf("Error deleting user pods: %s", err.Error())
+		t.Fatal(err.Error())
 	}
-
-	testingRequests := testingutil.GetTestingPodRequests()
-	podName, err := testingutil.CreatePod(testingRequests["http_hello_world"])
-	if err != nil {
-		t.Fatalf("Couldn't create testing pod: %s", err.Error())
+	if len(ingressList.Items) != 1 || ingressList.Items[0].Spec.Rules[0].Host != pod.getIngressHost() {
+		t.Fatalf("Pod %s should have an ingress for %s, has %+v", pod.Object.Name, pod.getIngressHost(), ingressList.Items)
 	}
 
-	finished := util.NewReadyChannel(u.GlobalConfig.TimeoutCreate)
-	err = testingutil.WatchCreatePod(u.UserID, podName, finished)
+	// Reloading the pod cache copies the tokens again
+	client.SetFile("jobs", "/tmp/token", "newtoken")
+	err = os.Remove(pod.GetCacheFilename())
 	if err != nil {
-		t.Fatalf("Couldn't watch creation of testing pod: %s", err.Error())
+		t.Fatalf("Error deleting podcache for pod %s: %s", pod.Object.Name, err.Error())
 	}
-	if !finished.Receive() {
-		t.Fatalf("Testing pod didn't reach ready state")
-	}
-
-	pods, err := u.ListPods()
+	err = pod.CreateAndSavePodCache(context.Background(), true)
 	if err != nil {
-		t.Fatalf("Couldn't list pods: %s", err.Error())
+		t.Fatalf("Error reloading podCache for pod %s: %s", pod.Object.Name, err.Error())
 	}
-	if len(pods) != 1 {
-		t.Fatalf("The user should have exactly one pod but has %d", len(pods))
+	if err := checkStartJobSuccess(pod); err != nil {
+		t.Fatal(err)
 	}
-	testPod := pods[0]
-	t.Logf("Successfully created testing pod, attempting to cURL")
 
-	// Try a few times to make the http request
-	var failed error = nil
-	for i := 0; i < 10; i++ {
-		response, err := http.Get(fmt.Sprintf("https://%s", testPod.getIngressHost()))
-		if err != nil {
-			failed = err
-			t.Logf("Failed %d time(s), waiting a second to try again", i+1)
-			time.Sleep(1 * time.Second)
-			continue
-		}
-		defer response.Body.Close()
-		// This can get a 404 while the testing container's starting script is running
-		if response.StatusCode == 200 {
-			failed = nil
-		} else {
-			failed = errors.New(fmt.Sprintf("Http request to testing pod got response code %d", response.StatusCode))
-			t.Logf("Failed %d time(s), waiting a second to try again", i+1)
-			time.Sleep(1 * time.Second)
-			continue
-		}
-		body, err := ioutil.ReadAll(response.Body)
-		hello := string(body)
-		if !strings.Contains(hello, "http hello world") {
-			t.Fatalf("Didn't get expected response \"http hello world\", instead got %s", hello)
-		}
+	readyToDelete := util.NewFuture(time.Second)
+	readyToDelete.Succeed()
+	finishedDeleteJobs := util.NewFuture(config.TimeoutDelete)
+	pod.RunDeleteJobsWhenReady(context.Background(), readyToDelete, finishedDeleteJobs)
+	if err := finishedDeleteJobs.Wait(); err != nil {
+		t.Fatalf("Pod %s failed to complete delete jobs: %s", pod.Object.Name, err.Error())
 	}
-	if failed != nil {
-		t.Fatal(failed)
+	_, err = pod.loadPodCache()
+	if !os.IsNotExist(err) {
+		t.Fatalf("Pod %s loading cache after delete job gets error %v when should be does not exist", pod.Object.Name, err)
 	}
-
-	// Clean up by deleting the testing pod
-	_, err = testingutil.DeletePod(u.UserID, podName)
+	serviceList, err := pod.ListServices(context.Background())
 	if err != nil {
-		t.Fatalf("Couldn't delete testing pod: %s", err.Error())
+		t.Fatalf("Pod %s couldn't list services: %s", pod.Object.Name, err.Error())
+	}
+	if len(serviceList.Items) != 0 {
+		t.Fatalf("Pod %s still has remaining services after delete job", pod.Object.Name)
 	}
 }
 
-func TestSleepBeforeLeakCheck(t *testing.T) {
-	t.Log("Start waiting for ReadyChannel goroutines to finish\n")
-	u := newUser("")
-	time.Sleep(u.GlobalConfig.TimeoutDelete + u.GlobalConfig.TimeoutCreate + 30*time.Second)
-	t.Log("Done waiting for ReadyChannel goroutines to finish\n")
+// Goroutines that are expected to outlive the tests
+var leakOptions = []goleak.Option{
+	goleak.IgnoreTopFunction("k8s.io/klog/v2.(*loggingT).flushDaemon"),
+	goleak.IgnoreTopFunction("github.com/docker/spdystream.(*Connection).shutdown"),
 }
 
 func TestMain(m *testing.M) {
-	goleak.VerifyTestMain(
-		m,
-		goleak.IgnoreTopFunction("k8s.io/klog/v2.(*loggingT).flushDaemon"),
-		goleak.IgnoreTopFunction("github.com/docker/spdystream.(*Connection).shutdown"),
-	)
+	goleak.VerifyTestMain(m, leakOptions...)
 }
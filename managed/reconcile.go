@@ -0,0 +1,244 @@
+package managed
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Kinds of companion resources and what reconciliation did to them
+const (
+	KindService      = "Service"
+	KindIngress      = "Ingress"
+	ReconcileCreated = "created"
+	ReconcileUpdated = "updated"
+	ReconcileDeleted = "deleted"
+)
+
+// Label of the services and ingresses created for a pod, whose value is the pod's name
+const createdForPodLabel = "createdForPod"
+
+// A change made, or attempted, to bring a pod's companion resource to its desired state
+type ReconcileAction struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Pod    string `json:"pod"`
+	Action string `json:"action"`
+	// Set if the change failed
+	Error string `json:"error,omitempty"`
+}
+
+func NewReconcileAction(kind string, name string, podName string, action string, err error) ReconcileAction {
+	reconcileAction := ReconcileAction{Kind: kind, Name: name, Pod: podName, Action: action}
+	if err != nil {
+		reconcileAction.Error = err.Error()
+	}
+	return reconcileAction
+}
+
+// Return the services that should exist for the pod, by name
+func (p *Pod) targetServices() map[string]*apiv1.Service {
+	targets := make(map[string]*apiv1.Service)
+	if p.NeedsSshService() {
+		service := p.getTargetSshService()
+		targets[service.Name] = service
+	}
+	if p.NeedsIngress() {
+		service := p.getTargetHttpService()
+		targets[service.Name] = service
+	}
+	return targets
+}
+
+// Return the ingresses that should exist for the pod, by name
+func (p *Pod) targetIngresses() map[string]*netv1.Ingress {
+	targets := make(map[string]*netv1.Ingress)
+	if p.NeedsIngress() {
+		ingress := p.getTargetIngress()
+		targets[ingress.Name] = ingress
+	}
+	return targets
+}
+
+// Return true if existing lacks any of the owner references in target,
+// e.g. because it was created before the backend set them
+func ownerReferencesDrifted(existing []metav1.OwnerReference, target []metav1.OwnerReference) bool {
+	for _, targetRef := range target {
+		found := false
+		for _, ref := range existing {
+			if ref.UID == targetRef.UID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return true
+		}
+	}
+	return false
+}
+
+// Return existing with the references to pods of the same name, like a previous pod, replaced by target
+func withOwnerReferences(existing []metav1.OwnerReference, target []metav1.OwnerReference) []metav1.OwnerReference {
+	if len(target) == 0 {
+		return existing
+	}
+	var updated []metav1.OwnerReference
+	for _, ref := range existing {
+		if ref.Kind == "Pod" && ref.Name == target[0].Name {
+			continue
+		}
+		updated = append(updated, ref)
+	}
+	return append(updated, target...)
+}
+
+// Return true if the fields of existing that the backend sets differ from target
+func serviceDrifted(existing *apiv1.Service, target *apiv1.Service) bool {
+	if existing.Labels[createdForPodLabel] != target.Labels[createdForPodLabel] ||
+		ownerReferencesDrifted(existing.OwnerReferences, target.OwnerReferences) ||
+		existing.Spec.Type != target.Spec.Type ||
+		!equality.Semantic.DeepEqual(existing.Spec.Selector, target.Spec.Selector) ||
+		len(existing.Spec.Ports) != len(target.Spec.Ports) {
+		return true
+	}
+	for i, port := range target.Spec.Ports {
+		existingPort := existing.Spec.Ports[i]
+		if existingPort.Name != port.Name ||
+			existingPort.Protocol != port.Protocol ||
+			existingPort.Port != port.Port ||
+			existingPort.TargetPort != port.TargetPort {
+			return true
+		}
+	}
+	return false
+}
+
+// Return existing with the fields that the backend sets taken from target.
+// Node ports that were already assigned are kept, so that ssh urls stay the same.
+func serviceWithTarget(existing *apiv1.Service, target *apiv1.Service) *apiv1.Service {
+	updated := existing.DeepCopy()
+	if updated.Labels == nil {
+		updated.Labels = make(map[string]string)
+	}
+	updated.Labels[createdForPodLabel] = target.Labels[createdForPodLabel]
+	updated.OwnerReferences = withOwnerReferences(existing.OwnerReferences, target.OwnerReferences)
+	updated.Spec.Type = target.Spec.Type
+	updated.Spec.Selector = target.Spec.Selector
+	nodePorts := make(map[string]int32)
+	for _, port := range existing.Spec.Ports {
+		nodePorts[port.Name] = port.NodePort
+	}
+	updated.Spec.Ports = nil
+	for _, port := range target.Spec.Ports {
+		if target.Spec.Type == apiv1.ServiceTypeNodePort {
+			port.NodePort = nodePorts[port.Name]
+		}
+		updated.Spec.Ports = append(updated.Spec.Ports, port)
+	}
+	return updated
+}
+
+// Return true if the fields of existing that the backend sets differ from target
+func ingressDrifted(existing *netv1.Ingress, target *netv1.Ingress) bool {
+	return existing.Labels[createdForPodLabel] != target.Labels[createdForPodLabel] ||
+		ownerReferencesDrifted(existing.OwnerReferences, target.OwnerReferences) ||
+		!equality.Semantic.DeepEqual(existing.Spec.Rules, target.Spec.Rules) ||
+		!equality.Semantic.DeepEqual(existing.Spec.TLS, target.Spec.TLS)
+}
+
+// Return existing with the fields that the backend sets taken from target
+func ingressWithTarget(existing *netv1.Ingress, target *netv1.Ingress) *netv1.Ingress {
+	updated := existing.DeepCopy()
+	if updated.Labels == nil {
+		updated.Labels = make(map[string]string)
+	}
+	updated.Labels[createdForPodLabel] = target.Labels[createdForPodLabel]
+	updated.OwnerReferences = withOwnerReferences(existing.OwnerReferences, target.OwnerReferences)
+	updated.Spec.Rules = target.Spec.Rules
+	updated.Spec.TLS = target.Spec.TLS
+	return updated
+}
+
+// Compare the pod's services and ingress with the ones it should have,
+// then create the missing ones, update the ones that drifted or lack an owner reference to the pod, and delete the ones it shouldn't have.
+// Returns what was done. If the ssh service changed, the pod's cache is refreshed, since it holds the ssh port.
+func (p *Pod) ReconcileCompanions(ctx context.Context) ([]ReconcileAction, error) {
+	var actions []ReconcileAction
+	serviceList, err := p.ListServices(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't list services of pod %s: %w", p.Object.Name, err)
+	}
+	ingressList, err := p.ListIngresses(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't list ingresses of pod %s: %w", p.Object.Name, err)
+	}
+
+	sshChanged := false
+	targetServices := p.targetServices()
+	for i := range serviceList.Items {
+		existing := &serviceList.Items[i]
+		target, wanted := targetServices[existing.Name]
+		if !wanted {
+			err := p.Client.DeleteService(ctx, existing.Name)
+			if k8sclient.IsNotFound(err) {
+				continue
+			}
+			actions = append(actions, NewReconcileAction(KindService, existing.Name, p.Object.Name, ReconcileDeleted, err))
+			continue
+		}
+		delete(targetServices, existing.Name)
+		if serviceDrifted(existing, target) {
+			_, err := p.Client.UpdateService(ctx, serviceWithTarget(existing, target))
+			actions = append(actions, NewReconcileAction(KindService, existing.Name, p.Object.Name, ReconcileUpdated, err))
+			sshChanged = sshChanged || target.Spec.Type == apiv1.ServiceTypeNodePort
+		}
+	}
+	for name, target := range targetServices {
+		_, err := p.Client.CreateService(ctx, target)
+		if k8sclient.IsAlreadyExists(err) {
+			continue
+		}
+		actions = append(actions, NewReconcileAction(KindService, name, p.Object.Name, ReconcileCreated, err))
+		sshChanged = sshChanged || target.Spec.Type == apiv1.ServiceTypeNodePort
+	}
+
+	targetIngresses := p.targetIngresses()
+	for i := range ingressList.Items {
+		existing := &ingressList.Items[i]
+		target, wanted := targetIngresses[existing.Name]
+		if !wanted {
+			err := p.Client.DeleteIngress(ctx, existing.Name)
+			if k8sclient.IsNotFound(err) {
+				continue
+			}
+			actions = append(actions, NewReconcileAction(KindIngress, existing.Name, p.Object.Name, ReconcileDeleted, err))
+			continue
+		}
+		delete(targetIngresses, existing.Name)
+		if ingressDrifted(existing, target) {
+			_, err := p.Client.UpdateIngress(ctx, ingressWithTarget(existing, target))
+			actions = append(actions, NewReconcileAction(KindIngress, existing.Name, p.Object.Name, ReconcileUpdated, err))
+		}
+	}
+	for name, target := range targetIngresses {
+		_, err := p.Client.CreateIngress(ctx, target)
+		if k8sclient.IsAlreadyExists(err) {
+			continue
+		}
+		actions = append(actions, NewReconcileAction(KindIngress, name, p.Object.Name, ReconcileCreated, err))
+	}
+
+	if sshChanged {
+		err = p.CreateAndSavePodCache(ctx, true)
+		if err != nil {
+			return actions, fmt.Errorf("Couldn't refresh the cache of pod %s: %w", p.Object.Name, err)
+		}
+	}
+	return actions, nil
+}
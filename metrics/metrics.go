@@ -0,0 +1,142 @@
+// Metrics of the backend in the Prometheus text exposition format
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Outcomes of pod creations and deletions
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailed  = "failed"
+	OutcomeTimeout = "timeout"
+)
+
+// Buckets in seconds for request latencies
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Buckets in seconds for the time pods take to become ready, which may include pulling large images
+var timeToReadyBuckets = []float64{1, 2, 5, 10, 20, 30, 60, 120, 180, 300, 600}
+
+var (
+	RequestsTotal = NewCounterVec(
+		"user_pods_http_requests_total",
+		"Number of http requests by handler and response status code.",
+		"handler", "code",
+	)
+	RequestDuration = NewHistogramVec(
+		"user_pods_http_request_duration_seconds",
+		"Time taken to respond to http requests by handler.",
+		requestDurationBuckets,
+		"handler",
+	)
+	PodCreations = NewCounterVec(
+		"user_pods_pod_creations_total",
+		"Number of pod creations that finished, including start jobs, by outcome.",
+		"outcome",
+	)
+	PodDeletions = NewCounterVec(
+		"user_pods_pod_deletions_total",
+		"Number of pod deletions that finished, including delete jobs, by outcome.",
+		"outcome",
+	)
+	PodTimeToReady = NewHistogramVec(
+		"user_pods_pod_time_to_ready_seconds",
+		"Time from requesting a pod from the apiserver until it became ready.",
+		timeToReadyBuckets,
+	)
+	WatchMapSize = NewGaugeVec(
+		"user_pods_watch_map_size",
+		"Number of entries in the server's watch maps, i.e. pods or storage being created or deleted.",
+		"map",
+	)
+	TokenCopyFailures = NewCounterVec(
+		"user_pods_token_copy_failures_total",
+		"Number of tokens that couldn't be copied from pods.",
+	)
+	ReconcileActions = NewCounterVec(
+		"user_pods_reconcile_actions_total",
+		"Number of companion resources of pods that the reconciler created, updated or deleted, by result.",
+		"kind", "action", "result",
+	)
+	IdleChecks = NewCounterVec(
+		"user_pods_idle_checks_total",
+		"Number of idle checks of pods by the culler, by result: active, culled or error.",
+		"result",
+	)
+	PodExpirations = NewCounterVec(
+		"user_pods_expirations_total",
+		"Number of pods deleted for exceeding their lifetime, by result: ok or error.",
+		"result",
+	)
+	APIServerErrors = NewCounterVec(
+		"user_pods_apiserver_errors_total",
+		"Number of failed apiserver calls, including retried attempts, by K8sClient method and error reason.",
+		"method", "reason",
+	)
+)
+
+// Handles the http request to get all metrics
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	registeredMutex.Lock()
+	metrics := append([]metric{}, registered...)
+	registeredMutex.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// ResponseWriter that records the status code, while still letting streaming handlers flush
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, canFlush := r.ResponseWriter.(http.Flusher); canFlush {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, canHijack := r.ResponseWriter.(http.Hijacker)
+	if !canHijack {
+		return nil, nil, errors.New("Response writer doesn't support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// Wrap handler so that its requests are counted and timed under the name handlerName
+func InstrumentHandler(handlerName string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler(recorder, r)
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		RequestsTotal.Inc(handlerName, fmt.Sprint(status))
+		RequestDuration.Observe(time.Since(start).Seconds(), handlerName)
+	}
+}
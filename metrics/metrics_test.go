@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestWrite(t *testing.T) {
+	counter := &CounterVec{newFamily("test_total", "Test counter.", "counter", []string{"method", "reason"})}
+	counter.Inc("DeletePod", "NotFound")
+	counter.Add(2, "CreatePod", `Quoted "reason"`)
+	histogram := &HistogramVec{family: newFamily("test_seconds", "Test histogram.", "histogram", nil), buckets: []float64{0.5, 1}}
+	histogram.Observe(0.2)
+	histogram.Observe(0.7)
+	histogram.Observe(3)
+
+	var buffer bytes.Buffer
+	counter.write(&buffer)
+	histogram.write(&buffer)
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{method="CreatePod",reason="Quoted \"reason\""} 2
+test_total{method="DeletePod",reason="NotFound"} 1
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.5"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 3.9
+test_seconds_count 3
+`
+	if buffer.String() != expected {
+		t.Fatalf("Expected metrics\n%s\ngot\n%s", expected, buffer.String())
+	}
+}
+
+func TestInstrumentHandler(t *testing.T) {
+	handler := InstrumentHandler("test_handler", func(w http.ResponseWriter, r *http.Request) {
+		if _, canFlush := w.(http.Flusher); !canFlush {
+			t.Fatal("Instrumented handlers should still be able to flush")
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/test", nil))
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/test", nil))
+	if count := RequestsTotal.Value("test_handler", "404"); count != 2 {
+		t.Fatalf("Counted %v requests instead of 2", count)
+	}
+	if count := RequestDuration.Count("test_handler"); count != 2 {
+		t.Fatalf("Timed %d requests instead of 2", count)
+	}
+
+	recorder := httptest.NewRecorder()
+	Handler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), `user_pods_http_requests_total{handler="test_handler",code="404"} 2`) {
+		t.Fatalf("Request count is missing from the metrics:\n%s", recorder.Body.String())
+	}
+}
+
+func TestHandlerParses(t *testing.T) {
+	counter := NewCounterVec("test_parse_total", `Test counter with a \ and a
+newline in its help.`, "method", "reason")
+	counter.Inc("DeletePod", "Back\\slash \"quote\"\nnewline")
+	histogram := NewHistogramVec("test_parse_seconds", "Test histogram.", []float64{1, 2}, "handler")
+	histogram.Observe(1.5, "test_handler")
+
+	recorder := httptest.NewRecorder()
+	Handler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(recorder.Body)
+	if err != nil {
+		t.Fatalf("Couldn't parse the metrics: %s", err.Error())
+	}
+
+	counterFamily, exists := families["test_parse_total"]
+	if !exists || counterFamily.GetType() != dto.MetricType_COUNTER || counterFamily.GetHelp() != counter.help {
+		t.Fatalf("Parsed counter %v doesn't match", counterFamily)
+	}
+	labels := counterFamily.Metric[0].Label
+	if labels[0].GetValue() != "DeletePod" || labels[1].GetValue() != "Back\\slash \"quote\"\nnewline" {
+		t.Fatalf("Parsed label values %v don't match", labels)
+	}
+	if value := counterFamily.Metric[0].GetCounter().GetValue(); value != 1 {
+		t.Fatalf("Parsed counter value %v instead of 1", value)
+	}
+
+	histogramFamily, exists := families["test_parse_seconds"]
+	if !exists || histogramFamily.GetType() != dto.MetricType_HISTOGRAM {
+		t.Fatalf("Parsed histogram %v doesn't match", histogramFamily)
+	}
+	parsed := histogramFamily.Metric[0].GetHistogram()
+	if parsed.GetSampleCount() != 1 || parsed.GetSampleSum() != 1.5 {
+		t.Fatalf("Parsed histogram count %d and sum %v instead of 1 and 1.5", parsed.GetSampleCount(), parsed.GetSampleSum())
+	}
+	buckets := parsed.GetBucket()
+	if len(buckets) != 3 || buckets[0].GetCumulativeCount() != 0 || buckets[1].GetCumulativeCount() != 1 || buckets[2].GetCumulativeCount() != 1 {
+		t.Fatalf("Parsed histogram buckets %v don't match", buckets)
+	}
+}
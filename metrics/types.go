@@ -0,0 +1,240 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric that can be written in the Prometheus text exposition format
+type metric interface {
+	write(w io.Writer)
+}
+
+var registered []metric
+var registeredMutex sync.Mutex
+
+func register(m metric) {
+	registeredMutex.Lock()
+	defer registeredMutex.Unlock()
+	registered = append(registered, m)
+}
+
+// Values of one combination of label values
+type series struct {
+	labelValues []string
+	value       float64
+	// Only for histograms: the number of observations in each bucket (not cumulative), their sum and count
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+// Common part of the metric types, a family of series with the same name and label names
+type family struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+	series     map[string]*series
+	mutex      *sync.Mutex
+}
+
+func newFamily(name string, help string, metricType string, labelNames []string) family {
+	var m sync.Mutex
+	return family{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		series:     make(map[string]*series),
+		mutex:      &m,
+	}
+}
+
+// Get the series for labelValues, creating it if it doesn't exist. Must be called with the lock held.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("Metric %s has labels %v, but got values %v", f.name, f.labelNames, labelValues))
+	}
+	key := strings.Join(labelValues, "\x00")
+	s, exists := f.series[key]
+	if !exists {
+		s = &series{labelValues: labelValues}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Return the series sorted by their label values, so that the output is stable. Must be called with the lock held.
+func (f *family) sortedSeries() []*series {
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	sorted := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		sorted = append(sorted, f.series[key])
+	}
+	return sorted
+}
+
+func (f *family) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, helpEscaper.Replace(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.metricType)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Format labels as {name="value",...}, or an empty string if there are none
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, names[i], labelValueEscaper.Replace(values[i]))
+	}
+	return fmt.Sprintf("{%s}", strings.Join(pairs, ","))
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Value that only goes up, like the number of requests, for each combination of label values
+type CounterVec struct {
+	family
+}
+
+func NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{newFamily(name, help, "counter", labelNames)}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic(fmt.Sprintf("Counter %s can't decrease", c.name))
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.get(labelValues).value += value
+}
+
+// Return the current value for labelValues
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.get(labelValues).value
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeHeader(w)
+	for _, s := range c.sortedSeries() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labelNames, s.labelValues), formatValue(s.value))
+	}
+}
+
+// Value that can go up and down, like the number of pods being created, for each combination of label values
+type GaugeVec struct {
+	family
+}
+
+func NewGaugeVec(name string, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{newFamily(name, help, "gauge", labelNames)}
+	register(g)
+	return g
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.get(labelValues).value = value
+}
+
+// Return the current value for labelValues
+func (g *GaugeVec) Value(labelValues ...string) float64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.get(labelValues).value
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.writeHeader(w)
+	for _, s := range g.sortedSeries() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labelNames, s.labelValues), formatValue(s.value))
+	}
+}
+
+// Distribution of observed values, like request durations, in buckets with the given upper bounds,
+// for each combination of label values
+type HistogramVec struct {
+	family
+	buckets []float64
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	h := &HistogramVec{family: newFamily(name, help, "histogram", labelNames), buckets: sorted}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s := h.get(labelValues)
+	if s.bucketCounts == nil {
+		s.bucketCounts = make([]uint64, len(h.buckets))
+	}
+	// Observations above the largest bucket are only counted in +Inf, i.e. the total count
+	i := sort.SearchFloat64s(h.buckets, value)
+	if i < len(h.buckets) {
+		s.bucketCounts[i]++
+	}
+	s.sum += value
+	s.count++
+}
+
+// Return the number of observations for labelValues
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.get(labelValues).count
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.writeHeader(w)
+	bucketLabelNames := append(append([]string{}, h.labelNames...), "le")
+	for _, s := range h.sortedSeries() {
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			if s.bucketCounts != nil {
+				cumulative += s.bucketCounts[i]
+			}
+			labelValues := append(append([]string{}, s.labelValues...), formatValue(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabelNames, labelValues), cumulative)
+		}
+		labelValues := append(append([]string{}, s.labelValues...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabelNames, labelValues), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labelNames, s.labelValues), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labelNames, s.labelValues), s.count)
+	}
+}
@@ -1,17 +1,21 @@
 package podcreator
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
 	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
 	"github.com/deic.dk/user_pods_k8s_backend/util"
 	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/scheme"
 )
@@ -22,6 +26,7 @@ type PodCreator struct {
 	user             managed.User
 	siloIP           string
 	containerEnvVars map[string]map[string]string
+	lifetime         time.Duration
 	client           k8sclient.K8sClient
 	globalConfig     util.GlobalConfig
 }
@@ -30,13 +35,16 @@ type PodCreator struct {
 // PodCreator must be initialized with a valid targetPod, which can then be
 // created by calling CreatePod()
 
-// Initialize a PodCreator with the data it will need to make a pod
+// Initialize a PodCreator with the data it will need to make a pod.
+// lifetime is the one requested for the pod, or zero for that of the manifest or the config.
 // Return without error if it is ready to call CreatePod()
 func NewPodCreator(
+	ctx context.Context,
 	yamlURL string,
 	userID string,
 	siloIP string,
 	containerEnvVars map[string]map[string]string,
+	lifetime time.Duration,
 	client k8sclient.K8sClient,
 	globalConfig util.GlobalConfig,
 ) (PodCreator, error) {
@@ -45,17 +53,46 @@ func NewPodCreator(
 		user:             managed.NewUser(userID, client, globalConfig),
 		siloIP:           siloIP,
 		containerEnvVars: containerEnvVars,
+		lifetime:         lifetime,
 		client:           client,
 		globalConfig:     globalConfig,
 		targetPod:        nil,
 	}
-	err := creator.initTargetPod()
+	err := creator.initTargetPod(ctx)
 	if err != nil {
-		return creator, errors.New(fmt.Sprintf("Couldn't initialize PodCreator with a valid targetPod: %s", err.Error()))
+		return creator, fmt.Errorf("Couldn't initialize PodCreator with a valid targetPod: %w", err)
 	}
 	return creator, nil
 }
 
+// Initialize a PodCreator that creates pod again from its spec under the same name, e.g. to restart it after it was deleted.
+// It keeps the pod's annotations, so it expires when the pod would have.
+// The fields that kubernetes filled in when scheduling the pod are cleared, so that it is scheduled again.
+func NewFromPod(pod managed.Pod, siloIP string) PodCreator {
+	existing := pod.Object.DeepCopy()
+	targetPod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        existing.Name,
+			Labels:      existing.Labels,
+			Annotations: existing.Annotations,
+		},
+		Spec: existing.Spec,
+	}
+	targetPod.Spec.NodeName = ""
+	return PodCreator{
+		targetPod:    targetPod,
+		user:         pod.Owner,
+		siloIP:       siloIP,
+		client:       pod.Client,
+		globalConfig: pod.GlobalConfig,
+	}
+}
+
+// Return a copy of the pod that CreatePod creates
+func (pc *PodCreator) TargetPod() *apiv1.Pod {
+	return pc.targetPod.DeepCopy()
+}
+
 // Return the user's siloIP in the subnet where data can be accessed by the pods.
 func (pc *PodCreator) getSiloIPDataNet() string {
 	return strings.Replace(pc.siloIP, "10.0.", "10.2.", 1)
@@ -80,7 +117,7 @@ func (pc *PodCreator) getMandatoryEnvVars() map[string]string {
 }
 
 // Retrieve the yaml manifest and parse it into a pod API object to attempt to create
-func (pc *PodCreator) initTargetPod() error {
+func (pc *PodCreator) initTargetPod(ctx context.Context) error {
 	if pc.targetPod != nil {
 		return errors.New("PodCreator already initialized with a targetPod")
 	}
@@ -88,16 +125,16 @@ func (pc *PodCreator) initTargetPod() error {
 	pc.targetPod = &targetPod
 
 	// Get the manifest
-	yaml, err := pc.getYaml()
+	yaml, err := pc.getYaml(ctx)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Couldn't get manifest: %s", err.Error()))
+		return fmt.Errorf("Couldn't get manifest: %w", err)
 	}
 
 	// Convert it from []byte -> runtime.Object -> unstructured -> apiv1.Pod
 	deserializer := scheme.Codecs.UniversalDeserializer()
 	object, _, err := deserializer.Decode([]byte(yaml), nil, nil)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Couldn't deserialize manifest: %s", err.Error()))
+		return k8sclient.NewError(k8sclient.ReasonInvalid, fmt.Sprintf("Couldn't deserialize manifest: %s", err.Error()))
 	}
 	unstructuredPod, err := runtime.DefaultUnstructuredConverter.ToUnstructured(object)
 	if err != nil {
@@ -106,7 +143,7 @@ func (pc *PodCreator) initTargetPod() error {
 	// Fill out targetPodObject with the data from the manifest
 	err = runtime.DefaultUnstructuredConverter.FromUnstructured(unstructuredPod, pc.targetPod)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Couldn't parse manifest as apiv1.Pod: %s", err.Error()))
+		return k8sclient.NewError(k8sclient.ReasonInvalid, fmt.Sprintf("Couldn't parse manifest as apiv1.Pod: %s", err.Error()))
 	}
 
 	// Fill in values in targetPodObject according to the request
@@ -116,7 +153,7 @@ func (pc *PodCreator) initTargetPod() error {
 	// Fill in the correct settings to pull the image from a local repository if necessary
 	pc.applyRegistrySettings()
 	// Find and set a unique podName in the format pod.metadata.name-user-domain-x
-	err = pc.applyCreatePodName()
+	err = pc.applyCreatePodName(ctx)
 	if err != nil {
 		return err
 	}
@@ -124,33 +161,42 @@ func (pc *PodCreator) initTargetPod() error {
 	if err != nil {
 		return err
 	}
+	// Set when the pod expires, if it does
+	err = managed.ApplyLifetime(pc.targetPod, pc.lifetime, pc.globalConfig)
+	if err != nil {
+		return k8sclient.NewError(k8sclient.ReasonInvalid, err.Error())
+	}
 
 	return nil
 }
 
 // Retrieve the yaml manifest from a URL matching the whitelist
-func (pc *PodCreator) getYaml() (string, error) {
+func (pc *PodCreator) getYaml(ctx context.Context) (string, error) {
 	allowed, err := regexp.MatchString(pc.globalConfig.WhitelistManifestRegex, pc.yamlURL)
 	if err != nil {
 		return "", err
 	}
 	if !allowed {
-		return "", errors.New(fmt.Sprintf("YamlURL %s not matched to whitelist", pc.yamlURL))
+		return "", k8sclient.NewError(k8sclient.ReasonForbidden, fmt.Sprintf("YamlURL %s not matched to whitelist", pc.yamlURL))
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, pc.yamlURL, nil)
+	if err != nil {
+		return "", k8sclient.NewError(k8sclient.ReasonInvalid, fmt.Sprintf("Could not make request for manifest from given url %s: %s", pc.yamlURL, err.Error()))
 	}
-	response, err := http.Get(pc.yamlURL)
+	response, err := http.DefaultClient.Do(request)
 	if err != nil {
-		return "", errors.New(fmt.Sprintf("Could not fetch manifest from given url %s: %s", pc.yamlURL, err.Error()))
+		return "", k8sclient.NewError(k8sclient.ReasonUnavailable, fmt.Sprintf("Could not fetch manifest from given url %s: %s", pc.yamlURL, err.Error()))
 	}
 	defer response.Body.Close()
 
 	// if the GET status isn't "200 OK"
 	if response.StatusCode != 200 {
-		return "", errors.New(fmt.Sprintf("Didn't find a file at the given url: %s", pc.yamlURL))
+		return "", k8sclient.NewError(k8sclient.ReasonNotFound, fmt.Sprintf("Didn't find a file at the given url: %s", pc.yamlURL))
 	}
 
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return "", errors.New(fmt.Sprintf("Could not parse manifest from given url %s: %s", pc.yamlURL, err.Error()))
+		return "", k8sclient.NewError(k8sclient.ReasonUnavailable, fmt.Sprintf("Could not read manifest from given url %s: %s", pc.yamlURL, err.Error()))
 	}
 
 	return string(body), nil
@@ -222,11 +268,11 @@ func (pc *PodCreator) applyRegistrySettings() {
 	}
 }
 
-func (pc *PodCreator) applyCreatePodName() error {
+func (pc *PodCreator) applyCreatePodName(ctx context.Context) error {
 	basePodName := fmt.Sprintf("%s-%s", pc.targetPod.Name, pc.user.GetUserString())
-	existingPodList, err := pc.user.ListPods()
+	existingPodList, err := pc.user.ListPods(ctx)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Couldn't list pods to find a unique pod name: %s", err.Error()))
+		return fmt.Errorf("Couldn't list pods to find a unique pod name: %w", err)
 	}
 	podName := basePodName
 	var nameInUse bool
@@ -253,7 +299,7 @@ func (pc *PodCreator) applyCreatePodName() error {
 		podName = fmt.Sprintf("%s-%d", basePodName, i)
 	}
 	// if all 10 names are in use,
-	return errors.New(fmt.Sprintf("Couldn't find a unique name for %s-(1-9), all are in use", basePodName))
+	return k8sclient.NewError(k8sclient.ReasonConflict, fmt.Sprintf("Couldn't find a unique name for %s-(1-9), all are in use", basePodName))
 }
 
 // Dynamically generate the pod.Spec.Volume entry for an unsatisfied pod.Spec.Container[].VolumeMount
@@ -278,7 +324,8 @@ func (pc *PodCreator) getCreatePodSpecVolume(volumeMount apiv1.VolumeMount) (api
 			},
 		}, nil
 	default:
-		return apiv1.Volume{}, errors.New(
+		return apiv1.Volume{}, k8sclient.NewError(
+			k8sclient.ReasonInvalid,
 			fmt.Sprintf("Not known how to dynamically create an entry for this volume mount %+v", volumeMount),
 		)
 	}
@@ -314,41 +361,48 @@ func (pc *PodCreator) applyCreatePodVolumes() error {
 
 // Call the kubernetes API for creation of the PodCreator's targetPod
 // Create and return a managed.Pod object corresponding to the created pod
-// Use the ready channel to let the parent know when the pod's start jobs are complete
-func (pc *PodCreator) CreatePod(ready *util.ReadyChannel) (managed.Pod, error) {
+// Use the ready future to let the parent know when the pod's start jobs are complete, or why they failed.
+// ctx is used for the watches and start jobs that continue after this returns,
+// so it shouldn't be cancelled when the request that called for creation is answered.
+func (pc *PodCreator) CreatePod(ctx context.Context, ready *util.Future) (managed.Pod, error) {
 	var pod managed.Pod
 	if pc.targetPod == nil {
 		return pod, errors.New("PodCreater wasn't initialized with a targetPod, cannot create empty target.")
 	}
 
-	storageReady := util.NewReadyChannel(pc.globalConfig.TimeoutCreate)
+	storageReady := util.NewFuture(pc.globalConfig.TimeoutCreate)
 	if pc.requiresUserStorage() {
-		pc.user.CreateUserStorageIfNotExist(storageReady, pc.siloIP)
+		err := pc.user.CreateUserStorageIfNotExist(ctx, storageReady, pc.siloIP)
+		if err != nil {
+			storageReady.Fail(err)
+			return pod, fmt.Errorf("Couldn't create storage for user %s: %w", pc.user.UserID, err)
+		}
 	} else {
-		storageReady.Send(true)
+		storageReady.Succeed()
 	}
 
-	podReady := util.NewReadyChannel(pc.globalConfig.TimeoutCreate)
+	podReady := util.NewFuture(pc.globalConfig.TimeoutCreate)
+	requested := time.Now()
 	go func() {
-		pc.client.WatchCreatePod(pc.targetPod.Name, podReady)
-		if podReady.Receive() {
+		pc.client.WatchCreatePod(ctx, pc.targetPod.Name, podReady)
+		if err := podReady.Wait(); err == nil {
+			metrics.PodTimeToReady.Observe(time.Since(requested).Seconds())
 			fmt.Printf("Ready pod %s\n", pc.targetPod.Name)
 		} else {
-			fmt.Printf("Warning: pod %s didn't reach ready state\n", pc.targetPod.Name)
+			fmt.Printf("Warning: pod %s didn't reach ready state: %s\n", pc.targetPod.Name, err.Error())
 		}
 	}()
 
-	createdPod, err := pc.client.CreatePod(pc.targetPod)
+	createdPod, err := pc.client.CreatePod(ctx, pc.targetPod)
 	if err != nil {
-		return pod, errors.New(fmt.Sprintf("Call to create pod %s failed: %s", pc.targetPod.Name, err.Error()))
+		podReady.Fail(err)
+		// Wrap err so that callers can still tell e.g. a name conflict from a forbidden request
+		return pod, fmt.Errorf("Call to create pod %s failed: %w", pc.targetPod.Name, err)
 	}
 	pod = managed.NewPod(createdPod, pc.client, pc.globalConfig)
 
-	startJobWaitChans := make([]*util.ReadyChannel, 2)
-	startJobWaitChans[0] = storageReady
-	startJobWaitChans[1] = podReady
-
-	go pod.RunStartJobsWhenReady(startJobWaitChans, ready)
+	requiredToStartJobs := []*util.Future{storageReady, podReady}
+	go pod.RunStartJobsWhenReady(ctx, requiredToStartJobs, ready)
 	return pod, nil
 }
 
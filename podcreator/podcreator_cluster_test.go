@@ -0,0 +1,182 @@
+//go:build cluster
+
+// Tests that need a cluster and the backend running on localhost, see "running tests" in the README
+
+package podcreator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/testingutil"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	"go.uber.org/goleak"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// All tests in this package share one client,
+// so that its informers can be stopped before the leak check
+var sharedClient k8sclient.K8sClient
+var sharedClientOnce sync.Once
+
+func getSharedClient(config util.GlobalConfig) k8sclient.K8sClient {
+	sharedClientOnce.Do(func() {
+		sharedClient = k8sclient.NewK8sClient(config)
+	})
+	return sharedClient
+}
+
+func newUser() managed.User {
+	config := util.MustLoadGlobalConfig()
+	client := getSharedClient(config)
+	return managed.NewUser(config.TestUser, client, config)
+}
+
+func echoEnvVarInPod(pod managed.Pod, envVar string, nContainer int) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+	var err error
+	stdout, stderr, err = pod.Client.PodExec(context.Background(), []string{"sh", "-c", fmt.Sprintf("echo $%s", envVar)}, pod.Object, nContainer)
+	errBytes := stderr.Bytes()
+	if err != nil {
+		return "", string(errBytes), err
+	}
+	outBytes := stdout.Bytes()
+	return string(outBytes), string(errBytes), nil
+}
+
+func TestPodCreation(t *testing.T) {
+	// First delete all of the testUser's pods
+	u := newUser()
+	t.Log("Deleting all testUser pods")
+	err := testingutil.DeleteAllUserPods(u.UserID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Then attempt to create two of each of the standard pod types
+	defaultRequests := testingutil.GetStandardPodRequests()
+	for _, defaultRequest := range defaultRequests {
+		for i := 0; i < 2; i++ {
+			request := defaultRequest
+			// If this is the second pod of this type, add some envVars to the request
+			if i == 1 {
+				for container, vars := range request.Settings {
+					for key, value := range vars {
+						request.Settings[container][key] = fmt.Sprintf("%s-extra-with-$pecialchars/\\.'#@:æøå*\\$@.", value)
+					}
+				}
+			}
+
+			pc, err := NewPodCreator(context.Background(), request.YamlURL, u.UserID, u.GlobalConfig.TestingHost, request.Settings, 0, u.Client, u.GlobalConfig)
+			if err != nil {
+				t.Fatalf("Could't initialize podcreator for %s", err.Error())
+			}
+			if pc.targetPod == nil {
+				t.Fatal("Didn't initialize targetPod")
+			}
+
+			err = checkEnvironmentVars(*pc.targetPod, request, pc.getMandatoryEnvVars())
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			// check targetPod name
+			podNameRegex := regexp.MustCompile(fmt.Sprintf("[a-z]+-%s(-\\d)?", u.GetUserString()))
+			if !podNameRegex.MatchString(pc.targetPod.Name) {
+				t.Fatalf("targetPod name %s doesn't match regex", pc.targetPod.Name)
+			}
+			listOpt := metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", pc.targetPod.Name)}
+			podList, err := u.Client.ListPods(context.Background(), listOpt)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if len(podList.Items) != 0 {
+				t.Fatalf("targetPod name %s is already taken in the namespace", pc.targetPod.Name)
+			}
+
+			// Attempt to create
+			ready := util.NewFuture(u.GlobalConfig.TimeoutCreate)
+			_, err = pc.CreatePod(context.Background(), ready)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if err := ready.Wait(); err != nil {
+				t.Fatalf("Pod %s didn't reach ready: %s", pc.targetPod.Name, err.Error())
+			}
+
+			// Check that pod exists
+			podList, err = u.Client.ListPods(context.Background(), listOpt)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if len(podList.Items) != 1 {
+				t.Fatalf("Pod %s doesn't exist after creation", pc.targetPod.Name)
+			}
+
+			// Check that pc.recquiresUserStorage behaves correctly for this pod
+			storageRequired := false
+			for _, volume := range podList.Items[0].Spec.Volumes {
+				if volume.Name == "sciencedata" {
+					storageRequired = true
+					break
+				}
+			}
+			if storageRequired != pc.requiresUserStorage() {
+				t.Fatalf("requiresUserStorage returns %t when storageRequired is %t", pc.requiresUserStorage(), storageRequired)
+			}
+		}
+	}
+}
+
+func TestRegistrySettings(t *testing.T) {
+	// Initialize a default podCreator
+
+	u := newUser()
+	u.GlobalConfig.LocalRegistrySecret = "testingregistrysecret"
+	u.GlobalConfig.LocalRegistryURL = "testingregistryurl"
+	defaultRequests := testingutil.GetStandardPodRequests()
+	// take the first of the default requests
+	var request testingutil.CreatePodRequest
+	for _, r := range defaultRequests {
+		request = r
+		break
+	}
+	pc, err := NewPodCreator(context.Background(), request.YamlURL, u.UserID, u.GlobalConfig.TestingHost, request.Settings, 0, u.Client, u.GlobalConfig)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Reinitialize the registry settings of the podCreator's targetPod
+	// Set imagePullSecrets to an empty list
+	pc.targetPod.Spec.ImagePullSecrets = []v1.LocalObjectReference{}
+	// Name the image for the first container to come from a local registry
+	pc.targetPod.Spec.Containers[0].Image = "LOCALREGISTRY/foobar"
+
+	// Now see whether applyRegistrySettings behaves correctly
+	pc.applyRegistrySettings()
+	if pc.targetPod.Spec.ImagePullSecrets[0].Name != "testingregistrysecret" {
+		t.Fatalf("applyRegistrySettings didn't successfully add the secret.")
+	}
+	if pc.targetPod.Spec.Containers[0].Image != "testingregistryurl/foobar" {
+		t.Fatalf("applyRegistrySettings didn't successfully rewrite the registry url.")
+	}
+}
+
+func TestWaitBeforeLeakCheck(t *testing.T) {
+	u := newUser()
+	u.Client.Stop()
+	// Completed futures leave no goroutines behind, so this only waits for the watches
+	// of creations and deletions that tests started without waiting for them to finish
+	deadline := time.Now().Add(u.GlobalConfig.TimeoutDelete + u.GlobalConfig.TimeoutCreate)
+	for goleak.Find(leakOptions...) != nil && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+}
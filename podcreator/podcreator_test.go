@@ -1,12 +1,11 @@
 package podcreator
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"regexp"
 	"testing"
-	"time"
 
 	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
 	"github.com/deic.dk/user_pods_k8s_backend/managed"
@@ -17,10 +16,18 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func newUser() managed.User {
+// Return the config for a test with the fake client, whose pod caches are kept in a temporary directory
+func fakeConfig(t *testing.T) util.GlobalConfig {
 	config := util.MustLoadGlobalConfig()
-	client := k8sclient.NewK8sClient(config)
-	return managed.NewUser(config.TestUser, client, config)
+	config.PodCacheDir = t.TempDir()
+	return config
+}
+
+// Return the test user with a fake client, which is stopped when the test ends
+func newFakeUser(t *testing.T, config util.GlobalConfig) (managed.User, *k8sclient.FakeK8sClient) {
+	client := k8sclient.NewFakeK8sClient(config)
+	t.Cleanup(client.Stop)
+	return managed.NewUser(config.TestUser, client, config), client
 }
 
 func checkEnvironmentVars(pod v1.Pod, request testingutil.CreatePodRequest, mandatoryEnvVars map[string]string) error {
@@ -75,129 +82,117 @@ func checkEnvironmentVars(pod v1.Pod, request testingutil.CreatePodRequest, mand
 	return nil
 }
 
-func echoEnvVarInPod(pod managed.Pod, envVar string, nContainer int) (string, string, error) {
-	var stdout, stderr bytes.Buffer
-	var err error
-	stdout, stderr, err = pod.Client.PodExec([]string{"sh", "-c", fmt.Sprintf("echo $%s", envVar)}, pod.Object, nContainer)
-	errBytes := stderr.Bytes()
-	if err != nil {
-		return "", string(errBytes), err
-	}
-	outBytes := stdout.Bytes()
-	return string(outBytes), string(errBytes), nil
-}
-
-func TestPodCreation(t *testing.T) {
-	// First delete all of the testUser's pods
-	u := newUser()
-	t.Log("Deleting all testUser pods")
-	err := testingutil.DeleteAllUserPods(u.UserID)
-	if err != nil {
-		t.Fatal(err.Error())
-	}
-
-	// Then attempt to create two of each of the standard pod types
-	defaultRequests := testingutil.GetStandardPodRequests()
-	for _, defaultRequest := range defaultRequests {
-		for i := 0; i < 2; i++ {
-			request := defaultRequest
-			// If this is the second pod of this type, add some envVars to the request
-			if i == 1 {
-				for container, vars := range request.Settings {
-					for key, value := range vars {
-						request.Settings[container][key] = fmt.Sprintf("%s-extra-with-$pecialchars/\\.'#@:æøå*\\$@.", value)
-					}
-				}
-			}
-
-			pc, err := NewPodCreator(request.YamlURL, u.UserID, u.GlobalConfig.TestingHost, request.Settings, u.Client, u.GlobalConfig)
-			if err != nil {
-				t.Fatalf("Could't initialize podcreator for %s", err.Error())
-			}
-			if pc.targetPod == nil {
-				t.Fatal("Didn't initialize targetPod")
-			}
-
-			err = checkEnvironmentVars(*pc.targetPod, request, pc.getMandatoryEnvVars())
-			if err != nil {
-				t.Fatal(err.Error())
-			}
-
-			// check targetPod name
-			podNameRegex := regexp.MustCompile(fmt.Sprintf("[a-z]+-%s(-\\d)?", u.GetUserString()))
-			if !podNameRegex.MatchString(pc.targetPod.Name) {
-				t.Fatalf("targetPod name %s doesn't match regex", pc.targetPod.Name)
-			}
-			listOpt := metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", pc.targetPod.Name)}
-			podList, err := u.Client.ListPods(listOpt)
-			if err != nil {
-				t.Fatal(err.Error())
-			}
-			if len(podList.Items) != 0 {
-				t.Fatalf("targetPod name %s is already taken in the namespace", pc.targetPod.Name)
-			}
+// testingutil.FakePodManifest with an environment variable that requests can set
+const fakeEnvPodManifest = `apiVersion: v1
+kind: Pod
+metadata:
+  name: fake
+  annotations:
+    sciencedata.dk/copy-token: token
+spec:
+  containers:
+  - name: fake
+    image: fake
+    env:
+    - name: EXTRA
+      value: ""
+    volumeMounts:
+    - name: sciencedata
+      mountPath: /root/data
+`
+
+func TestFakePodCreation(t *testing.T) {
+	manifestServer, config := testingutil.ServeManifest(fakeEnvPodManifest, fakeConfig(t))
+	defer manifestServer.Close()
+	u, client := newFakeUser(t, config)
+	yamlURL := fmt.Sprintf("%s/fake.yaml", manifestServer.URL)
+
+	// Create two pods from the manifest, the second with some envVars
+	for i := 0; i < 2; i++ {
+		request := testingutil.CreatePodRequest{YamlURL: yamlURL, UserID: u.UserID, Settings: map[string]map[string]string{"fake": {"EXTRA": "extra"}}}
+		if i == 1 {
+			request.Settings["fake"]["EXTRA"] = "extra-with-$pecialchars/\\.'#@:æøå*\\$@."
+		}
+		pc, err := NewPodCreator(context.Background(), request.YamlURL, u.UserID, config.TestingHost, request.Settings, 0, u.Client, config)
+		if err != nil {
+			t.Fatalf("Could't initialize podcreator for %s", err.Error())
+		}
+		if pc.targetPod == nil {
+			t.Fatal("Didn't initialize targetPod")
+		}
+		err = checkEnvironmentVars(*pc.targetPod, request, pc.getMandatoryEnvVars())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
 
-			// Attempt to create
-			ready := util.NewReadyChannel(u.GlobalConfig.TimeoutCreate)
-			_, err = pc.CreatePod(ready)
-			if err != nil {
-				t.Fatal(err.Error())
-			}
-			if !ready.Receive() {
-				t.Fatalf("Pod %s didn't reach ready", pc.targetPod.Name)
-			}
+		// The second pod gets a suffix, since the first one has the name already
+		podNameRegex := regexp.MustCompile(fmt.Sprintf("^fake-%s(-\\d)?$", u.GetUserString()))
+		if !podNameRegex.MatchString(pc.targetPod.Name) {
+			t.Fatalf("targetPod name %s doesn't match regex", pc.targetPod.Name)
+		}
+		listOpt := metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", pc.targetPod.Name)}
+		podList, err := u.Client.ListPods(context.Background(), listOpt)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(podList.Items) != 0 {
+			t.Fatalf("targetPod name %s is already taken in the namespace", pc.targetPod.Name)
+		}
 
-			// Check that pod exists
-			podList, err = u.Client.ListPods(listOpt)
-			if err != nil {
-				t.Fatal(err.Error())
-			}
-			if len(podList.Items) != 1 {
-				t.Fatalf("Pod %s doesn't exist after creation", pc.targetPod.Name)
-			}
+		client.SetFile(pc.targetPod.Name, "/tmp/token", "faketoken")
+		ready := util.NewFuture(config.TimeoutCreate)
+		_, err = pc.CreatePod(context.Background(), ready)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ready.Wait(); err != nil {
+			t.Fatalf("Pod %s didn't reach ready: %s", pc.targetPod.Name, err.Error())
+		}
 
-			// Check that pc.recquiresUserStorage behaves correctly for this pod
-			storageRequired := false
-			for _, volume := range podList.Items[0].Spec.Volumes {
-				if volume.Name == "sciencedata" {
-					storageRequired = true
-					break
-				}
-			}
-			if storageRequired != pc.requiresUserStorage() {
-				t.Fatalf("requiresUserStorage returns %t when storageRequired is %t", pc.requiresUserStorage(), storageRequired)
+		podList, err = u.Client.ListPods(context.Background(), listOpt)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(podList.Items) != 1 {
+			t.Fatalf("Pod %s doesn't exist after creation", pc.targetPod.Name)
+		}
+		storageRequired := false
+		for _, volume := range podList.Items[0].Spec.Volumes {
+			if volume.Name == "sciencedata" {
+				storageRequired = true
+				break
 			}
 		}
+		if !storageRequired || !pc.requiresUserStorage() {
+			t.Fatalf("Pod %s mounts sciencedata, but has the volume %t and requiresUserStorage returns %t", pc.targetPod.Name, storageRequired, pc.requiresUserStorage())
+		}
+	}
+	pvcList, err := u.Client.ListPVC(context.Background(), u.GetStorageListOptions())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(pvcList.Items) != 1 {
+		t.Fatalf("The user's pods should share one PVC, but there are %d", len(pvcList.Items))
 	}
 }
 
-func TestRegistrySettings(t *testing.T) {
-	// Initialize a default podCreator
-
-	u := newUser()
-	u.GlobalConfig.LocalRegistrySecret = "testingregistrysecret"
-	u.GlobalConfig.LocalRegistryURL = "testingregistryurl"
-	defaultRequests := testingutil.GetStandardPodRequests()
-	// take the first of the default requests
-	var request testingutil.CreatePodRequest
-	for _, r := range defaultRequests {
-		request = r
-		break
-	}
-	pc, err := NewPodCreator(request.YamlURL, u.UserID, u.GlobalConfig.TestingHost, request.Settings, u.Client, u.GlobalConfig)
+func TestFakeRegistrySettings(t *testing.T) {
+	manifestServer, config := testingutil.ServeManifest(testingutil.FakePodManifest, fakeConfig(t))
+	defer manifestServer.Close()
+	config.LocalRegistrySecret = "testingregistrysecret"
+	config.LocalRegistryURL = "testingregistryurl"
+	u, _ := newFakeUser(t, config)
+	pc, err := NewPodCreator(context.Background(), fmt.Sprintf("%s/fake.yaml", manifestServer.URL), u.UserID, config.TestingHost, nil, 0, u.Client, config)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
 
 	// Reinitialize the registry settings of the podCreator's targetPod
-	// Set imagePullSecrets to an empty list
 	pc.targetPod.Spec.ImagePullSecrets = []v1.LocalObjectReference{}
-	// Name the image for the first container to come from a local registry
 	pc.targetPod.Spec.Containers[0].Image = "LOCALREGISTRY/foobar"
 
-	// Now see whether applyRegistrySettings behaves correctly
 	pc.applyRegistrySettings()
-	if pc.targetPod.Spec.ImagePullSecrets[0].Name != "testingregistrysecret" {
+	if len(pc.targetPod.Spec.ImagePullSecrets) == 0 || pc.targetPod.Spec.ImagePullSecrets[0].Name != "testingregistrysecret" {
 		t.Fatalf("applyRegistrySettings didn't successfully add the secret.")
 	}
 	if pc.targetPod.Spec.Containers[0].Image != "testingregistryurl/foobar" {
@@ -205,17 +200,12 @@ func TestRegistrySettings(t *testing.T) {
 	}
 }
 
-func TestSleepBeforeLeakCheck(t *testing.T) {
-	t.Log("Start waiting for ReadyChannel goroutines to finish\n")
-	u := newUser()
-	time.Sleep(u.GlobalConfig.TimeoutDelete + u.GlobalConfig.TimeoutCreate + 30*time.Second)
-	t.Log("Done waiting for ReadyChannel goroutines to finish\n")
+// Goroutines that are expected to outlive the tests
+var leakOptions = []goleak.Option{
+	goleak.IgnoreTopFunction("k8s.io/klog/v2.(*loggingT).flushDaemon"),
+	goleak.IgnoreTopFunction("github.com/docker/spdystream.(*Connection).shutdown"),
 }
 
 func TestMain(m *testing.M) {
-	goleak.VerifyTestMain(
-		m,
-		goleak.IgnoreTopFunction("k8s.io/klog/v2.(*loggingT).flushDaemon"),
-		goleak.IgnoreTopFunction("github.com/docker/spdystream.(*Connection).shutdown"),
-	)
+	goleak.VerifyTestMain(m, leakOptions...)
 }
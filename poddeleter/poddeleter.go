@@ -1,6 +1,7 @@
 package poddeleter
 
 import (
+	"context"
 	"errors"
 	"fmt"
 
@@ -19,9 +20,9 @@ type PodDeleter struct {
 	initialized  bool
 }
 
-func NewPodDeleter(podName string, userID string, client k8sclient.K8sClient, globalConfig util.GlobalConfig) (PodDeleter, error) {
+func NewPodDeleter(ctx context.Context, podName string, userID string, client k8sclient.K8sClient, globalConfig util.GlobalConfig) (PodDeleter, error) {
 	deleter := PodDeleter{podName: podName, userID: userID, client: client, globalConfig: globalConfig, initialized: false}
-	err := deleter.initPodObject()
+	err := deleter.initPodObject(ctx)
 	if err != nil {
 		return deleter, err
 	}
@@ -32,43 +33,54 @@ func NewFromPod(pod managed.Pod) PodDeleter {
 	return PodDeleter{podName: pod.Object.Name, userID: pod.Owner.UserID, client: pod.Client, Pod: pod, globalConfig: pod.GlobalConfig, initialized: true}
 }
 
-func (pd *PodDeleter) initPodObject() error {
+func (pd *PodDeleter) initPodObject(ctx context.Context) error {
 	listOptions := metav1.ListOptions{
 		FieldSelector: fmt.Sprintf("metadata.name=%s", pd.podName),
 	}
-	podList, err := pd.client.ListPods(listOptions)
+	podList, err := pd.client.ListPods(ctx, listOptions)
 	if err != nil {
 		return err
 	}
+	// A pod owned by another user gives the same error as one that doesn't exist,
+	// so that the user can't tell them apart
+	notFound := k8sclient.NewError(k8sclient.ReasonNotFound, fmt.Sprintf("Didn't find pod %s owned by user %s", pd.podName, pd.userID))
 	if len(podList.Items) < 1 {
-		return errors.New(fmt.Sprintf("Didn't find pod by name %s", pd.podName))
+		return notFound
 	}
 	pod := managed.NewPod(&podList.Items[0], pd.client, pd.globalConfig)
 	if pod.Owner.UserID != pd.userID {
-		return errors.New(fmt.Sprintf("Pod %s not owned by user %s", pd.podName, pd.userID))
+		return notFound
 	}
 	pd.Pod = pod
 	pd.initialized = true
 	return nil
 }
 
-func (pd *PodDeleter) DeletePod(finished *util.ReadyChannel) error {
+// Call for deletion of the pod, then run its delete jobs once it's gone.
+// ctx is used for the watch and delete jobs that continue after this returns,
+// so it shouldn't be cancelled when the request that called for deletion is answered.
+func (pd *PodDeleter) DeletePod(ctx context.Context, finished *util.Future) error {
 	if !pd.initialized {
 		return errors.New("PodDeleter can't DeletePod, not initialized with a pod object")
 	}
-	podDeleted := util.NewReadyChannel(pd.globalConfig.TimeoutDelete)
+	podDeleted := util.NewFuture(pd.globalConfig.TimeoutDelete)
 	go func() {
-		pd.client.WatchDeletePod(pd.podName, podDeleted)
-		if podDeleted.Receive() {
+		pd.client.WatchDeletePod(ctx, pd.podName, podDeleted)
+		if err := podDeleted.Wait(); err == nil {
 			fmt.Printf("Deleted pod %s\n", pd.podName)
 		} else {
-			fmt.Printf("Warning: failed to delete pod %s\n", pd.podName)
+			fmt.Printf("Warning: failed to delete pod %s: %s\n", pd.podName, err.Error())
 		}
 	}()
-	err := pd.client.DeletePod(pd.podName)
-	if err != nil {
+	err := pd.client.DeletePod(ctx, pd.podName)
+	if k8sclient.IsNotFound(err) {
+		// The pod is already gone, so the delete jobs can still run
+		fmt.Printf("Pod %s was already deleted\n", pd.podName)
+		podDeleted.Succeed()
+	} else if err != nil {
+		podDeleted.Fail(err)
 		return err
 	}
-	go pd.Pod.RunDeleteJobsWhenReady(podDeleted, finished)
+	go pd.Pod.RunDeleteJobsWhenReady(ctx, podDeleted, finished)
 	return nil
 }
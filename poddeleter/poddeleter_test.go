@@ -1,216 +1,144 @@
 package poddeleter
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"os"
 	"strings"
 	"testing"
-	"time"
 
 	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
-	"github.com/deic.dk/user_pods_k8s_backend/managed"
-	"github.com/deic.dk/user_pods_k8s_backend/testingutil"
 	"github.com/deic.dk/user_pods_k8s_backend/util"
 	"go.uber.org/goleak"
+	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
-func newUser() managed.User {
+// Return a fake client whose cluster contains a pod of the test user named podName with its ssh service,
+// and the config for it, with pod caches in a temporary directory. The client is stopped when the test ends.
+func newFakeClientWithPod(t *testing.T, podName string) (*k8sclient.FakeK8sClient, util.GlobalConfig) {
 	config := util.MustLoadGlobalConfig()
-	client := k8sclient.NewK8sClient(config)
-	return managed.NewUser(config.TestUser, client, config)
+	config.PodCacheDir = t.TempDir()
+	user, domain, _ := strings.Cut(config.TestUser, "@")
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        podName,
+			Namespace:   config.Namespace,
+			Labels:      map[string]string{"user": user, "domain": domain},
+			Annotations: map[string]string{"sciencedata.dk/copy-token": "token"},
+		},
+		Spec: apiv1.PodSpec{Containers: []apiv1.Container{{
+			Name:  "fake",
+			Image: "fake",
+			Ports: []apiv1.ContainerPort{{ContainerPort: 22}},
+		}}},
+		Status: apiv1.PodStatus{Phase: apiv1.PodRunning},
+	}
+	service := &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-ssh", podName),
+			Namespace: config.Namespace,
+			Labels:    map[string]string{"createdForPod": podName},
+		},
+		Spec: apiv1.ServiceSpec{
+			Ports: []apiv1.ServicePort{{Name: "ssh", Port: 22, TargetPort: intstr.FromInt(22), NodePort: 30022}},
+			Type:  apiv1.ServiceTypeNodePort,
+		},
+	}
+	client := k8sclient.NewFakeK8sClient(config, pod, service)
+	client.SetFile(podName, "/tmp/token", "faketoken")
+	t.Cleanup(client.Stop)
+	return client, config
 }
 
-func ensureUserHasEach(requests map[string]testingutil.CreatePodRequest) error {
-	u := newUser()
-	userPodList, err := u.ListPods()
-	if err != nil {
-		return errors.New(fmt.Sprintf("Couldn't list user pods %s", err.Error()))
-	}
-	var chanList []*util.ReadyChannel
-	// For each of the standard pod types,
-	for podType, request := range requests {
-		hasPod := false
-		// Look through the test user's PodList to see if one exists already
-		for _, pod := range userPodList {
-			if strings.Contains(pod.Object.Name, podType) {
-				hasPod = true
-				break
-			}
+func TestFakeFailDeletePods(t *testing.T) {
+	client, config := newFakeClientWithPod(t, "faildelete")
+	tryUserIDs := []string{"fail@user", "", "fail", "fail@user.id"}
+	for _, tryUserID := range tryUserIDs {
+		failPodDeleter, err := NewPodDeleter(context.Background(), "faildelete", tryUserID, client, config)
+		if err == nil {
+			t.Fatalf("Initialized podDeleter without failure when using userID %q", tryUserID)
 		}
-		// If they don't already have one, then create it
-		if !hasPod {
-			podName, err := testingutil.CreatePod(request)
-			if err != nil {
-				return err
-			}
-			finished := util.NewReadyChannel(u.GlobalConfig.TimeoutCreate)
-			go testingutil.WatchCreatePod(u.UserID, podName, finished)
-			chanList = append(chanList, finished)
+		finished := util.NewFuture(config.TimeoutDelete)
+		err = failPodDeleter.DeletePod(context.Background(), finished)
+		if err == nil {
+			t.Fatalf("podDeleter that wasn't initialized correctly didn't return error when calling DeletePod")
 		}
 	}
-	if !util.ReceiveReadyChannels(chanList) {
-		return errors.New("Not all pods created for testing reached ready state")
+
+	opt := metav1.ListOptions{FieldSelector: "metadata.name=faildelete"}
+	podList, err := client.ListPods(context.Background(), opt)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(podList.Items) != 1 {
+		t.Fatal("Pod faildelete was deleted by a podDeleter with the wrong userID")
 	}
-	return nil
 }
 
-func TestFailDeletePods(t *testing.T) {
-	// Make sure the user has one of each of the standard pod types to attempt to delete
-	u := newUser()
-	defaultRequests := testingutil.GetStandardPodRequests()
-	err := testingutil.EnsureUserHasEach(u.UserID, defaultRequests)
+func TestFakeDeletePod(t *testing.T) {
+	client, config := newFakeClientWithPod(t, "deleteme")
+	pd, err := NewPodDeleter(context.Background(), "deleteme", config.TestUser, client, config)
 	if err != nil {
-		t.Fatalf("Couldn't ensure user had all pods: %s", err.Error())
+		t.Fatalf("Couldn't initialize pod deleter %s", err.Error())
 	}
-
-	// Then attempt to delete one with an incorrect userID
-	podList, err := u.ListPods()
+	if pd.Pod.Object.Name != "deleteme" {
+		t.Fatalf("Incorrect pod in podDeleter %s, expected deleteme", pd.Pod.Object.Name)
+	}
+	// Give the pod a pod cache like its start jobs would
+	err = pd.Pod.CreateAndSavePodCache(context.Background(), true)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	var podToDelete managed.Pod
-	// Range over defaultRequests just to take the first key
-	for podType, _ := range defaultRequests {
-		found := false
-		for _, pod := range podList {
-			if strings.Contains(pod.Object.Name, podType) {
-				found = true
-				podToDelete = pod
-				break
-			}
-		}
-		if !found {
-			t.Fatalf("Couldn't find pod of type %s after it should have been created", podType)
-		}
-		break
+	if _, err := os.Stat(pd.Pod.GetCacheFilename()); err != nil {
+		t.Fatalf("Pod cache wasn't saved: %s", err.Error())
 	}
-	t.Logf("Making incorret attempts to delete pod %s", podToDelete.Object.Name)
-
-	tryUserIDs := []string{"fail@user", "", "fail", "fail@user.id"}
-	for _, tryUserID := range tryUserIDs {
-		failPodDeleter, err := NewPodDeleter(podToDelete.Object.Name, tryUserID, u.Client, u.GlobalConfig)
-		if err == nil {
-			t.Fatalf("Initialized podDeleter without failure when using incorrect userID")
-		}
-		finished := util.NewReadyChannel(u.GlobalConfig.TimeoutDelete)
-		err = failPodDeleter.DeletePod(finished)
-		if err == nil {
-			t.Fatalf("podDeleter that wasn't initialized correctly didn't return error when calling DeletePod")
-		}
+	serviceList, err := pd.Pod.ListServices(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(serviceList.Items) != 1 {
+		t.Fatalf("Pod deleteme should have 1 service, has %d", len(serviceList.Items))
 	}
-}
 
-func TestDeletePod(t *testing.T) {
-	// Make sure the user has one of each of the standard pod types to attempt to delete
-	u := newUser()
-	defaultRequests := testingutil.GetStandardPodRequests()
-	err := testingutil.EnsureUserHasEach(u.UserID, defaultRequests)
+	finished := util.NewFuture(config.TimeoutDelete)
+	err = pd.DeletePod(context.Background(), finished)
 	if err != nil {
-		t.Fatalf("Couldn't ensure user had all pods: %s", err.Error())
+		t.Fatal(err.Error())
+	}
+	if err := finished.Wait(); err != nil {
+		t.Fatalf("Pod deleteme didn't delete: %s", err.Error())
 	}
 
-	// Then delete one of each of the user's pods for each of the standard pod types,
-	// first create the slice of podsToDelete by finding one of each type in the
-	// user's podList
-	podList, err := u.ListPods()
+	opt := metav1.ListOptions{FieldSelector: "metadata.name=deleteme"}
+	podList, err := client.ListPods(context.Background(), opt)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	var podsToDelete []managed.Pod
-	for podType := range defaultRequests {
-		found := false
-		for _, pod := range podList {
-			if strings.Contains(pod.Object.Name, podType) {
-				found = true
-				podsToDelete = append(podsToDelete, pod)
-				break
-			}
-		}
-		if !found {
-			t.Fatalf("Error, user should have a pod of type %s but doesn't", podType)
-		}
+	if len(podList.Items) != 0 {
+		t.Fatalf("Pod deleteme still exists after deletion")
 	}
-
-	// Then delete them all
-	for _, pod := range podsToDelete {
-		pd, err := NewPodDeleter(pod.Object.Name, u.UserID, u.Client, u.GlobalConfig)
-		if err != nil {
-			t.Fatalf("Couldn't initialize pod deleter %s", err.Error())
-		}
-		if pd.Pod.Object.Name != pod.Object.Name {
-			t.Fatalf("Incorrect pod in podDeleter %s, expected %s", pd.Pod.Object.Name, pod.Object.Name)
-		}
-
-		// Make sure pod exists
-		opt := metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", pod.Object.Name)}
-		manualPodList, err := u.Client.ListPods(opt)
-		if err != nil {
-			t.Fatal(err.Error())
-		}
-		if len(manualPodList.Items) != 1 {
-			t.Fatalf("Should be 1 pod %s, but there are %d", pod.Object.Name, len(manualPodList.Items))
-		}
-
-		// Get a list of its services
-		serviceList, err := pd.Pod.ListServices()
-		if err != nil {
-			t.Fatal(err.Error())
-		}
-
-		// Call for deletion
-		finished := util.NewReadyChannel(u.GlobalConfig.TimeoutDelete)
-		err = pd.DeletePod(finished)
-		if err != nil {
-			t.Fatal(err.Error())
-		}
-		// Wait for deletion
-		if !finished.Receive() {
-			t.Fatalf("Pod %s didn't delete", pod.Object.Name)
-		}
-
-		// Check deletion
-		manualPodList, err = u.Client.ListPods(opt)
-		if err != nil {
-			t.Fatal(err.Error())
-		}
-		if len(manualPodList.Items) != 0 {
-			t.Fatalf("Should be 1 pod %s, but there are %d", pod.Object.Name, len(manualPodList.Items))
-		}
-
-		// Check that delete jobs were successful
-		// First that tokenFile was deleted
-		tokenFile := fmt.Sprintf("/tmp/tokens/%s", pod.Object.Name)
-		_, err = os.Stat(tokenFile)
-		if !os.IsNotExist(err) {
-			t.Fatalf("token file %s still exists", tokenFile)
-		}
-		// Then that services were deleted
-		for _, svc := range serviceList.Items {
-			opt := metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", svc.Name)}
-			manualSvcList, err := u.Client.ListServices(opt)
-			if err != nil {
-				t.Fatal(err.Error())
-			}
-			if len(manualSvcList.Items) != 0 {
-				t.Fatalf("Service %s wasn't deleted", svc.Name)
-			}
-		}
+	// Check that delete jobs were successful
+	_, err = os.Stat(pd.Pod.GetCacheFilename())
+	if !os.IsNotExist(err) {
+		t.Fatalf("Pod cache %s still exists", pd.Pod.GetCacheFilename())
+	}
+	serviceList, err = pd.Pod.ListServices(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(serviceList.Items) != 0 {
+		t.Fatalf("Service %s wasn't deleted", serviceList.Items[0].Name)
 	}
 }
 
-func TestSleepBeforeLeakCheck(t *testing.T) {
-	t.Log("Start waiting for ReadyChannel goroutines to finish\n")
-	u := newUser()
-	time.Sleep(u.GlobalConfig.TimeoutDelete + u.GlobalConfig.TimeoutCreate + 30*time.Second)
-	t.Log("Done waiting for ReadyChannel goroutines to finish\n")
+// Goroutines that are expected to outlive the tests
+var leakOptions = []goleak.Option{
+	goleak.IgnoreTopFunction("k8s.io/klog/v2.(*loggingT).flushDaemon"),
+	goleak.IgnoreTopFunction("github.com/docker/spdystream.(*Connection).shutdown"),
 }
 
 func TestMain(m *testing.M) {
-	goleak.VerifyTestMain(
-		m,
-		goleak.IgnoreTopFunction("k8s.io/klog/v2.(*loggingT).flushDaemon"),
-		goleak.IgnoreTopFunction("github.com/docker/spdystream.(*Connection).shutdown"),
-	)
+	goleak.VerifyTestMain(m, leakOptions...)
 }
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/deic.dk/user_pods_k8s_backend/auth"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+)
+
+// Key for the ID of the key that a request was signed with in the request's context
+type keyIDContextKey struct{}
+
+// Load the keys in globalConfig.AuthKeyDir and return a Verifier for them.
+// Without AuthKeyDir, the backend refuses to start unless AuthDisabled is set,
+// in which case nil is returned and requests aren't authenticated.
+func newVerifier(globalConfig util.GlobalConfig) *auth.Verifier {
+	if globalConfig.AuthKeyDir == "" {
+		if !globalConfig.AuthDisabled {
+			panic("authKeyDir isn't set. Set authDisabled to serve requests without authentication.")
+		}
+		fmt.Printf("Warning: authDisabled is set, so requests aren't authenticated\n")
+		return nil
+	}
+	keys, err := auth.LoadKeys(globalConfig.AuthKeyDir)
+	if err != nil {
+		panic(err.Error())
+	}
+	siloKeys := 0
+	for keyID := range keys {
+		if keyID == auth.AdminKeyID {
+			continue
+		}
+		if _, isSilo := siloAddresses(globalConfig)[keyID]; !isSilo {
+			fmt.Printf("Warning: key %s doesn't match a hostname in hostnameList and is ignored\n", keyID)
+			delete(keys, keyID)
+			continue
+		}
+		siloKeys++
+	}
+	fmt.Printf("Loaded keys for %d silos, admin key: %t\n", siloKeys, keys[auth.AdminKeyID] != nil)
+	return auth.NewVerifier(keys, globalConfig.AuthMaxSkew)
+}
+
+// Return a map of silo hostnames to their addresses, the reverse of HostnameMap
+func siloAddresses(globalConfig util.GlobalConfig) map[string]string {
+	addresses := make(map[string]string)
+	for _, entry := range globalConfig.HostnameList {
+		addresses[entry.Hostname] = entry.Address
+	}
+	return addresses
+}
+
+// Wrap handler so that it only serves requests signed with the key of a silo or the admin key
+func (s *Server) SiloOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return s.authenticate(handler, false, auth.MaxBodyBytes)
+}
+
+// Wrap handler like SiloOnly, but allow a request body of up to FileTransferByteLimit for file uploads
+func (s *Server) SiloOnlyUpload(handler http.HandlerFunc) http.HandlerFunc {
+	return s.authenticate(handler, false, int64(s.GlobalConfig.FileTransferByteLimit))
+}
+
+// Wrap handler so that it only serves requests signed with the admin key
+func (s *Server) AdminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return s.authenticate(handler, true, auth.MaxBodyBytes)
+}
+
+func (s *Server) authenticate(handler http.HandlerFunc, adminOnly bool, maxBodyBytes int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.verifier == nil {
+			handler(w, r)
+			return
+		}
+		keyID, err := s.verifier.VerifyLimit(r, maxBodyBytes)
+		// Removes the spooled body of an upload
+		defer r.Body.Close()
+		if err != nil {
+			writeError(w, requestID(w, r), &authError{
+				status:  http.StatusUnauthorized,
+				message: fmt.Sprintf("Unauthenticated request to %s from %s: %s", r.URL.Path, r.RemoteAddr, err.Error()),
+			})
+			return
+		}
+		if adminOnly && keyID != auth.AdminKeyID {
+			writeError(w, requestID(w, r), &authError{
+				status:  http.StatusForbidden,
+				message: fmt.Sprintf("%s is only allowed with the admin key, not with the key of %s", r.URL.Path, keyID),
+			})
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), keyIDContextKey{}, keyID)))
+	}
+}
+
+// Return the address of the silo that signed r, or false if it wasn't signed by a silo
+func (s *Server) authenticatedSiloAddress(r *http.Request) (string, bool) {
+	keyID, signed := r.Context().Value(keyIDContextKey{}).(string)
+	if !signed {
+		return "", false
+	}
+	address, isSilo := s.siloAddresses[keyID]
+	return address, isSilo
+}
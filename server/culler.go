@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// File in PodCacheDir where each culled pod is recorded as a line of JSON.
+// It starts with a dot, so that cleanAllUnused doesn't take it for a podcache.
+const cullRecordFilename = ".culled"
+
+// A pod that the culler deleted for being idle
+type CulledPod struct {
+	PodName      string    `json:"pod_name"`
+	UserID       string    `json:"user_id"`
+	LastActivity time.Time `json:"last_activity"`
+	IdleTimeout  string    `json:"idle_timeout"`
+	Culled       time.Time `json:"culled"`
+	// Set if the deletion couldn't be called for
+	Error string `json:"error,omitempty"`
+}
+
+// What a pass of the culler found and did
+type CullReport struct {
+	Started     time.Time   `json:"started"`
+	PodsChecked int         `json:"pods_checked"`
+	Culled      []CulledPod `json:"culled"`
+	Errors      []string    `json:"errors,omitempty"`
+}
+
+func (r *CullReport) addError(err error) {
+	fmt.Printf("Error: Culler: %s\n", err.Error())
+	metrics.IdleChecks.Inc("error")
+	r.Errors = append(r.Errors, err.Error())
+}
+
+// Append culled to the record of culled pods. Failing to do so is only logged, since the pod is deleted anyway.
+func (s *Server) recordCulledPod(culled CulledPod) {
+	data, err := json.Marshal(culled)
+	if err != nil {
+		fmt.Printf("Error: Couldn't record culled pod %s: %s\n", culled.PodName, err.Error())
+		return
+	}
+	file, err := os.OpenFile(filepath.Join(s.GlobalConfig.PodCacheDir, cullRecordFilename), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err == nil {
+		_, err = file.Write(append(data, '\n'))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Printf("Error: Couldn't record culled pod %s: %s\n", culled.PodName, err.Error())
+	}
+}
+
+// Ask each settled user pod with an idle check in its manifest for its activity,
+// and delete the ones that have been idle for longer than their idle timeout, like a deletion requested by their owner
+func (s *Server) cull(ctx context.Context) CullReport {
+	s.cullMutex.Lock()
+	defer s.cullMutex.Unlock()
+	report := CullReport{Started: time.Now(), Culled: []CulledPod{}}
+	podList, err := s.Client.ListPods(ctx, metav1.ListOptions{})
+	if err != nil {
+		report.addError(fmt.Errorf("Couldn't list pods: %w", err))
+		return report
+	}
+	for i := range podList.Items {
+		if util.GetUserIDFromLabels(podList.Items[i].Labels) == "" {
+			continue
+		}
+		pod := managed.NewPod(&podList.Items[i], s.Client, s.GlobalConfig)
+		if !pod.HasIdleCheck() || !s.isSettled(&pod) {
+			continue
+		}
+		idleTimeout, err := pod.IdleTimeout()
+		if err != nil {
+			report.addError(err)
+			continue
+		}
+		if idleTimeout == 0 {
+			continue
+		}
+		report.PodsChecked++
+		lastActivity, err := pod.LastActivity(ctx)
+		if err != nil {
+			report.addError(err)
+			continue
+		}
+		if time.Since(lastActivity) <= idleTimeout {
+			metrics.IdleChecks.Inc("active")
+			continue
+		}
+
+		fmt.Printf("Culling pod %s of user %s, idle since %s\n", pod.Object.Name, pod.Owner.UserID, lastActivity.Format(time.RFC3339))
+		culled := CulledPod{
+			PodName:      pod.Object.Name,
+			UserID:       pod.Owner.UserID,
+			LastActivity: lastActivity,
+			IdleTimeout:  idleTimeout.String(),
+			Culled:       time.Now(),
+		}
+		finished := util.NewFuture(s.GlobalConfig.TimeoutDelete)
+		_, err = s.deletePod(ctx, DeletePodRequest{UserID: pod.Owner.UserID, PodName: pod.Object.Name}, finished)
+		if err != nil {
+			culled.Error = err.Error()
+			report.addError(fmt.Errorf("Couldn't delete idle pod %s: %w", pod.Object.Name, err))
+		} else {
+			metrics.IdleChecks.Inc("culled")
+		}
+		s.recordCulledPod(culled)
+		report.Culled = append(report.Culled, culled)
+	}
+	if len(report.Culled) > 0 || len(report.Errors) > 0 {
+		fmt.Printf("Checked %d pods for idleness: %d culled, %d errors\n", report.PodsChecked, len(report.Culled), len(report.Errors))
+	}
+	return report
+}
+
+// Cull idle pods every IdleCheckInterval until ctx is done. Passes are skipped while the server is shutting down.
+func (s *Server) RunCuller(ctx context.Context) {
+	ticker := time.NewTicker(s.GlobalConfig.IdleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.checkAcceptingJobs() == nil {
+			s.cull(ctx)
+		}
+	}
+}
+
+// Handles the http request to cull idle pods right away, responding with the report
+func (s *Server) ServeCull(w http.ResponseWriter, r *http.Request) {
+	id := requestID(w, r)
+	fmt.Printf("cull request [%s] from IP %s\n", id, s.getRemoteIP(r))
+	err := s.checkAcceptingJobs()
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+	report := s.cull(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
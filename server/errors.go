@@ -0,0 +1,122 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+)
+
+// Machine-readable codes in error responses, so that the frontend can tell users what went wrong
+const (
+	CodeInvalidRequest = "invalid_request"
+	CodeUnauthorized   = "unauthorized"
+	CodeForbidden      = "forbidden"
+	CodeNotFound       = "not_found"
+	CodeAlreadyExists  = "already_exists"
+	CodeConflict       = "conflict"
+	CodeRateLimited    = "rate_limited"
+	CodeTimeout        = "timeout"
+	CodeUnavailable    = "unavailable"
+	CodeInternal       = "internal_error"
+)
+
+// Header for the ID that identifies a request in the backend's logs.
+// If the client sets it, e.g. to correlate with the frontend's logs, that ID is used.
+const requestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[-a-zA-Z0-9_.]{1,64}$`)
+
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+// Return the ID of request r, from its X-Request-ID header if valid, or a new random one,
+// and set it in the response header
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID.MatchString(id) {
+		buffer := make([]byte, 8)
+		_, err := rand.Read(buffer)
+		if err != nil {
+			fmt.Printf("Warning: couldn't generate request ID: %s\n", err.Error())
+		}
+		id = hex.EncodeToString(buffer)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return id
+}
+
+// Error for a request that isn't authenticated, or isn't allowed with the key it was signed with
+type authError struct {
+	status  int
+	message string
+}
+
+func (e *authError) Error() string {
+	return e.message
+}
+
+// Return the error code and http status to respond with when a request failed with err
+func codeAndStatusForError(err error) (string, int) {
+	var authErr *authError
+	if errors.As(err, &authErr) {
+		if authErr.status == http.StatusForbidden {
+			return CodeForbidden, http.StatusForbidden
+		}
+		return CodeUnauthorized, http.StatusUnauthorized
+	}
+	switch k8sclient.ReasonForError(err) {
+	case k8sclient.ReasonInvalid:
+		return CodeInvalidRequest, http.StatusBadRequest
+	case k8sclient.ReasonForbidden:
+		return CodeForbidden, http.StatusForbidden
+	case k8sclient.ReasonNotFound:
+		return CodeNotFound, http.StatusNotFound
+	case k8sclient.ReasonAlreadyExists:
+		return CodeAlreadyExists, http.StatusConflict
+	case k8sclient.ReasonConflict:
+		return CodeConflict, http.StatusConflict
+	case k8sclient.ReasonTooManyRequests:
+		return CodeRateLimited, http.StatusTooManyRequests
+	case k8sclient.ReasonTimeout, k8sclient.ReasonCanceled:
+		return CodeTimeout, http.StatusServiceUnavailable
+	case k8sclient.ReasonUnavailable:
+		return CodeUnavailable, http.StatusServiceUnavailable
+	default:
+		return CodeInternal, http.StatusInternalServerError
+	}
+}
+
+// Log err and respond with its status and an ErrorResponse.
+// Errors that weren't classified are internal, so their messages aren't passed on to the client,
+// which can instead refer to the request ID that is logged with them.
+func writeError(w http.ResponseWriter, requestID string, err error) {
+	code, status := codeAndStatusForError(err)
+	fmt.Printf("Error [%s] %s: %s\n", requestID, code, err.Error())
+	message := err.Error()
+	if code == CodeInternal {
+		message = "Internal error in the backend"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Error: ErrorDetail{Code: code, Message: message, RequestID: requestID},
+	})
+}
+
+// Return an error for a request body that couldn't be decoded or has an invalid user_id
+func invalidRequestError(message string) error {
+	return k8sclient.NewError(k8sclient.ReasonInvalid, message)
+}
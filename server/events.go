@@ -0,0 +1,321 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	apiv1 "k8s.io/api/core/v1"
+	watch "k8s.io/apimachinery/pkg/watch"
+)
+
+// Stages of a pod's lifecycle that are streamed to its owner
+const (
+	EventCreating      = "creating"
+	EventScheduled     = "scheduled"
+	EventImagePulling  = "image_pulling"
+	EventReady         = "ready"
+	EventStartJobsDone = "start_jobs_done"
+	EventDeleting      = "deleting"
+	EventDeleted       = "deleted"
+	EventFailed        = "failed"
+)
+
+// Number of events buffered for each stream. A client that falls this far behind is disconnected.
+const eventStreamBufferSize = 256
+
+// Interval of comments sent to keep idle streams from being closed by proxies
+const eventStreamHeartbeat = 30 * time.Second
+
+type StreamPodEventsRequest struct {
+	UserID   string `json:"user_id"`
+	RemoteIP string
+}
+
+type PodEvent struct {
+	PodName string    `json:"pod_name"`
+	Event   string    `json:"event"`
+	Reason  string    `json:"reason,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Buffered events for one client's stream
+type eventStream struct {
+	events chan PodEvent
+	// closed if the client fell behind and events were dropped
+	overflowed   chan struct{}
+	overflowOnce *sync.Once
+}
+
+func newEventStream() *eventStream {
+	var once sync.Once
+	return &eventStream{
+		events:       make(chan PodEvent, eventStreamBufferSize),
+		overflowed:   make(chan struct{}),
+		overflowOnce: &once,
+	}
+}
+
+// Add event to the stream without blocking, so that a slow client can't hold up the sender
+func (e *eventStream) send(event PodEvent) {
+	select {
+	case e.events <- event:
+	default:
+		e.overflow()
+	}
+}
+
+// Close the stream because it's missing events
+func (e *eventStream) overflow() {
+	e.overflowOnce.Do(func() {
+		close(e.overflowed)
+	})
+}
+
+// Distributes the events that the server itself knows about, like start jobs finishing,
+// to the streams of the pods' owners
+type podEventBroker struct {
+	// streams[userID] is the set of streams open for that user
+	streams map[string]map[*eventStream]bool
+	mutex   *sync.Mutex
+}
+
+func newPodEventBroker() *podEventBroker {
+	var m sync.Mutex
+	return &podEventBroker{
+		streams: make(map[string]map[*eventStream]bool),
+		mutex:   &m,
+	}
+}
+
+func (b *podEventBroker) subscribe(userID string) *eventStream {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	stream := newEventStream()
+	streams, exists := b.streams[userID]
+	if !exists {
+		streams = make(map[*eventStream]bool)
+		b.streams[userID] = streams
+	}
+	streams[stream] = true
+	return stream
+}
+
+func (b *podEventBroker) unsubscribe(userID string, stream *eventStream) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.streams[userID], stream)
+	if len(b.streams[userID]) == 0 {
+		delete(b.streams, userID)
+	}
+}
+
+func (b *podEventBroker) publish(userID string, podName string, event string, reason string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for stream := range b.streams[userID] {
+		stream.send(PodEvent{PodName: podName, Event: event, Reason: reason, Time: time.Now()})
+	}
+}
+
+// Publish the event for an entry being added to or removed from the watch map mapName.
+// err is what the entry's finished future completed with when it was removed.
+func (s *Server) publishWatchMapEvent(key string, entry watchMapEntry, mapName watchMapName, added bool, err error) {
+	switch mapName {
+	case CreatingPods:
+		if added {
+			s.events.publish(entry.authCheck, key, EventCreating, "")
+		} else if err == nil {
+			s.events.publish(entry.authCheck, key, EventStartJobsDone, "")
+		} else {
+			s.events.publish(entry.authCheck, key, EventFailed, fmt.Sprintf("Pod didn't become ready or its start jobs failed: %s", err.Error()))
+		}
+	case DeletingPods:
+		// Deleted is published when the pod disappears from the informer cache
+		if added {
+			s.events.publish(entry.authCheck, key, EventDeleting, "")
+		} else if err != nil {
+			s.events.publish(entry.authCheck, key, EventFailed, fmt.Sprintf("Pod wasn't deleted or its delete jobs failed: %s", err.Error()))
+		}
+	}
+}
+
+// Return the stage of pod's lifecycle as one of the Event constants, and the reason if it failed.
+// Returns an empty stage for a pod that is pending but not yet scheduled.
+func podStage(pod *apiv1.Pod) (string, string) {
+	if pod.Status.Phase == apiv1.PodFailed {
+		return EventFailed, fmt.Sprintf("%s %s", pod.Status.Reason, pod.Status.Message)
+	}
+	creatingContainers := false
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Waiting == nil {
+			continue
+		}
+		switch status.State.Waiting.Reason {
+		case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "CreateContainerConfigError", "CrashLoopBackOff":
+			return EventFailed, fmt.Sprintf("Container %s: %s %s", status.Name, status.State.Waiting.Reason, status.State.Waiting.Message)
+		case "ContainerCreating", "PodInitializing":
+			creatingContainers = true
+		}
+	}
+	scheduled := false
+	for _, condition := range pod.Status.Conditions {
+		if condition.Status != apiv1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case apiv1.PodReady:
+			return EventReady, ""
+		case apiv1.PodScheduled:
+			scheduled = true
+		}
+	}
+	// Containers are mostly waiting for their images to be pulled while they are being created
+	if creatingContainers {
+		return EventImagePulling, ""
+	}
+	if scheduled {
+		return EventScheduled, ""
+	}
+	return "", ""
+}
+
+// Keeps the last stage sent for each pod, so that a stage is only sent when it changes
+type podStageTracker map[string]string
+
+// Return the event for pod if its stage changed, or false
+func (t podStageTracker) update(eventType watch.EventType, pod *apiv1.Pod) (PodEvent, bool) {
+	stage, reason := podStage(pod)
+	if eventType == watch.Deleted {
+		stage, reason = EventDeleted, ""
+	}
+	if stage == "" || t[pod.Name] == stage {
+		return PodEvent{}, false
+	}
+	t[pod.Name] = stage
+	if stage == EventDeleted {
+		delete(t, pod.Name)
+	}
+	return PodEvent{PodName: pod.Name, Event: stage, Reason: reason, Time: time.Now()}, true
+}
+
+// Start streaming the events of the user's pods to stream, starting with their current stages,
+// until ctx is done
+func (s *Server) streamPodEvents(ctx context.Context, user managed.User, stream *eventStream) error {
+	// Start watching before listing, so that no change is missed in between
+	watcher, err := s.Client.WatchPods(ctx, user.GetListOptions())
+	if err != nil {
+		return err
+	}
+	podList, err := user.ListPods(ctx)
+	if err != nil {
+		watcher.Stop()
+		return err
+	}
+	s.mutex.Lock()
+	for podName, entry := range s.CreatingPods {
+		if entry.authCheck == user.UserID {
+			stream.send(PodEvent{PodName: podName, Event: EventCreating, Time: time.Now()})
+		}
+	}
+	for podName, entry := range s.DeletingPods {
+		if entry.authCheck == user.UserID {
+			stream.send(PodEvent{PodName: podName, Event: EventDeleting, Time: time.Now()})
+		}
+	}
+	s.mutex.Unlock()
+	tracker := make(podStageTracker)
+	for _, pod := range podList {
+		if event, changed := tracker.update(watch.Added, pod.Object); changed {
+			stream.send(event)
+		}
+	}
+
+	// The watch is stopped when ctx is done, which closes the result channel
+	go func() {
+		for event := range watcher.ResultChan() {
+			pod, isPod := event.Object.(*apiv1.Pod)
+			if !isPod {
+				continue
+			}
+			if podEvent, changed := tracker.update(event.Type, pod); changed {
+				stream.send(podEvent)
+			}
+		}
+		// The watch only ends before ctx is done if it fell behind, and then the stream is missing events
+		if ctx.Err() == nil {
+			stream.overflow()
+		}
+	}()
+	return nil
+}
+
+// Handles the http request to stream the lifecycle events of the user's pods as server-sent events
+func (s *Server) ServeStreamPodEvents(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	id := requestID(w, r)
+	var request StreamPodEventsRequest
+	err := decodeRequest(r, &request)
+	request.RemoteIP = s.getRemoteIP(r)
+	fmt.Printf("streamPodEvents request [%s]: %+v\n", id, request)
+	if err == nil {
+		err = checkUserID(request.UserID)
+	}
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+	flusher, canFlush := w.(http.Flusher)
+	if !canFlush {
+		writeError(w, id, errors.New("Response writer doesn't support streaming"))
+		return
+	}
+
+	// Subscribe to the server's events before the pods' current state is sent, so that none are missed
+	stream := s.events.subscribe(request.UserID)
+	defer s.events.unsubscribe(request.UserID, stream)
+	user := managed.NewUser(request.UserID, s.Client, s.GlobalConfig)
+	err = s.streamPodEvents(ctx, user, stream)
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	heartbeat := time.NewTicker(eventStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stream.overflowed:
+			fmt.Printf("Warning [%s]: closing event stream for user %s, which fell behind\n", id, request.UserID)
+			return
+		case event := <-stream.events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				fmt.Printf("Error [%s] encoding event %+v: %s\n", id, event, err.Error())
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Event, data)
+			if err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			_, err = fmt.Fprintf(w, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
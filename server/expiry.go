@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type ExtendPodRequest struct {
+	UserID  string `json:"user_id"`
+	PodName string `json:"pod_name"`
+	// How long from now the pod should live, in the format of time.Duration.
+	// If empty, the pod is extended by the lifetime it was created with.
+	Lifetime string `json:"lifetime"`
+}
+
+type ExtendPodResponse struct {
+	// When the pod now expires, in RFC 3339 format
+	Expires string `json:"expires"`
+}
+
+// Parse a lifetime given in a request, which is zero if it is empty
+func parseLifetime(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	lifetime, err := time.ParseDuration(value)
+	if err != nil || lifetime <= 0 {
+		return 0, invalidRequestError(fmt.Sprintf("Lifetime %s isn't a positive duration like 2h", value))
+	}
+	return lifetime, nil
+}
+
+// Postpone the expiry of the user's pod, which is capped at MaxLifetime from now
+func (s *Server) extendPod(ctx context.Context, request ExtendPodRequest) (ExtendPodResponse, error) {
+	var response ExtendPodResponse
+	lifetime, err := parseLifetime(request.Lifetime)
+	if err != nil {
+		return response, err
+	}
+	pod, exists, err := s.getUserPod(ctx, request.PodName, request.UserID)
+	if err == nil && !exists {
+		err = k8sclient.NewError(k8sclient.ReasonNotFound, fmt.Sprintf("Didn't find pod %s owned by user %s", request.PodName, request.UserID))
+	}
+	if err != nil {
+		return response, err
+	}
+	_, hasExpiry, err := pod.Expires()
+	if err != nil {
+		return response, err
+	}
+	if !hasExpiry {
+		return response, invalidRequestError(fmt.Sprintf("Pod %s doesn't expire", request.PodName))
+	}
+	expires, err := pod.ExtendedExpiry(lifetime)
+	if err != nil {
+		return response, invalidRequestError(err.Error())
+	}
+	_, err = s.Client.UpdatePod(ctx, pod.WithExpiry(expires))
+	if err != nil {
+		return response, fmt.Errorf("Couldn't extend pod %s: %w", request.PodName, err)
+	}
+	fmt.Printf("Extended pod %s until %s\n", request.PodName, expires.Format(time.RFC3339))
+	response.Expires = expires.UTC().Format(time.RFC3339)
+	return response, nil
+}
+
+// Handles the http request to extend the lifetime of one of the user's pods
+func (s *Server) ServeExtendPod(w http.ResponseWriter, r *http.Request) {
+	id := requestID(w, r)
+	var request ExtendPodRequest
+	err := decodeRequest(r, &request)
+	fmt.Printf("extendPod request [%s]: %+v\n", id, request)
+	if err == nil {
+		err = checkUserID(request.UserID)
+	}
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+
+	response, err := s.extendPod(r.Context(), request)
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Delete each user pod that has expired, like a deletion requested by its owner.
+// Pods that are being created, restarted or deleted are left until that is done.
+// Return the names of the pods whose deletion was called for.
+func (s *Server) deleteExpiredPods(ctx context.Context) []string {
+	var deleted []string
+	podList, err := s.Client.ListPods(ctx, metav1.ListOptions{})
+	if err != nil {
+		fmt.Printf("Error: Couldn't list pods to find expired ones: %s\n", err.Error())
+		return deleted
+	}
+	now := time.Now()
+	for i := range podList.Items {
+		object := &podList.Items[i]
+		if util.GetUserIDFromLabels(object.Labels) == "" || object.DeletionTimestamp != nil {
+			continue
+		}
+		pod := managed.NewPod(object, s.Client, s.GlobalConfig)
+		expires, hasExpiry, err := pod.Expires()
+		if err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			continue
+		}
+		if !hasExpiry || expires.After(now) {
+			continue
+		}
+		s.mutex.Lock()
+		_, creating := s.CreatingPods[object.Name]
+		_, deleting := s.DeletingPods[object.Name]
+		s.mutex.Unlock()
+		if creating || deleting {
+			continue
+		}
+
+		fmt.Printf("Deleting pod %s of user %s, which expired at %s\n", object.Name, pod.Owner.UserID, expires.Format(time.RFC3339))
+		finished := util.NewFuture(s.GlobalConfig.TimeoutDelete)
+		_, err = s.deletePod(ctx, DeletePodRequest{UserID: pod.Owner.UserID, PodName: object.Name}, finished)
+		if err != nil {
+			fmt.Printf("Error: Couldn't delete expired pod %s: %s\n", object.Name, err.Error())
+			metrics.PodExpirations.Inc("error")
+			continue
+		}
+		metrics.PodExpirations.Inc("ok")
+		deleted = append(deleted, object.Name)
+	}
+	return deleted
+}
+
+// Delete expired pods every ExpiryCheckInterval until ctx is done. Passes are skipped while the server is shutting down.
+func (s *Server) RunExpirer(ctx context.Context) {
+	ticker := time.NewTicker(s.GlobalConfig.ExpiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.checkAcceptingJobs() == nil {
+			s.deleteExpiredPods(ctx)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// Number of bytes of tar's stderr that are kept to tell why a transfer failed
+const fileTransferStderrLimit = 4096
+
+// Query of upload_pod_file and download_pod_file, since the body of an upload is the file itself
+type PodFileRequest struct {
+	UserID  string
+	PodName string
+	// The container to transfer to or from, which defaults to the pod's first container
+	Container string
+	// Absolute path in the container. For an upload, the file to write, or with Extract, the directory to extract into.
+	// For a download, the file or directory to archive.
+	Path string
+	// Whether the uploaded body is a tar archive to extract rather than the content of a single file
+	Extract  bool
+	RemoteIP string
+}
+
+type UploadPodFileResponse struct {
+	// Number of bytes of the uploaded body
+	Bytes int64 `json:"bytes"`
+}
+
+// Error for a download that exceeds FileTransferByteLimit
+var errDownloadTooLarge = errors.New("Download exceeded the byte limit")
+
+// Parse a PodFileRequest from the query of r
+func (s *Server) podFileRequest(r *http.Request) PodFileRequest {
+	query := r.URL.Query()
+	return PodFileRequest{
+		UserID:    query.Get("user_id"),
+		PodName:   query.Get("pod_name"),
+		Container: query.Get("container"),
+		Path:      query.Get("path"),
+		Extract:   query.Get("extract") == "true",
+		RemoteIP:  s.getRemoteIP(r),
+	}
+}
+
+// Return an error if the request isn't valid, and clean its path
+func (s *Server) checkPodFileRequest(request *PodFileRequest) error {
+	err := checkUserID(request.UserID)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(request.Path, "/") {
+		return invalidRequestError(fmt.Sprintf("Path %s isn't absolute", request.Path))
+	}
+	request.Path = path.Clean(request.Path)
+	return s.checkAcceptingJobs()
+}
+
+// io.Writer that keeps the first limit bytes written to it and discards the rest
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// Return the error for a transfer whose tar command failed with err.
+// If tar itself ran and failed, e.g. because the path doesn't exist, its stderr tells why.
+func transferError(err error, stderr string, description string) error {
+	var exitErr utilexec.ExitError
+	if !errors.As(err, &exitErr) {
+		return fmt.Errorf("%s: %w", description, err)
+	}
+	message := fmt.Sprintf("%s: %s", description, strings.TrimSpace(stderr))
+	if strings.Contains(stderr, "No such file or directory") {
+		return k8sclient.NewError(k8sclient.ReasonNotFound, message)
+	}
+	return invalidRequestError(message)
+}
+
+// Return a reader of a tar archive with a single regular file, whose content of size bytes is read from content as the archive is read
+func singleFileArchive(name string, content io.Reader, size int64) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		archive := tar.NewWriter(writer)
+		err := archive.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     size,
+			ModTime:  time.Now(),
+		})
+		if err == nil {
+			_, err = io.Copy(archive, content)
+		}
+		if err == nil {
+			err = archive.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader
+}
+
+// io.Reader of a request body that fails if the body ends before size bytes, so that tar doesn't take a truncated upload for a complete one
+type exactReader struct {
+	body      io.Reader
+	remaining int64
+}
+
+func (r *exactReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.body.Read(p)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Write body, which has size bytes, into the container of the user's pod by extracting it with tar,
+// so that the image only needs tar, like for kubectl cp. The body is streamed into tar's stdin rather than held in memory.
+// Its size must be known, so that an upload over the limit is refused before anything is written.
+func (s *Server) uploadPodFile(ctx context.Context, request PodFileRequest, body io.Reader, size int64) (UploadPodFileResponse, error) {
+	var response UploadPodFileResponse
+	if !request.Extract && request.Path == "/" {
+		return response, invalidRequestError("Path of an uploaded file can't be /")
+	}
+	limit := int64(s.GlobalConfig.FileTransferByteLimit)
+	if size < 0 {
+		return response, invalidRequestError("Upload has no Content-Length")
+	}
+	if size > limit {
+		return response, invalidRequestError(fmt.Sprintf("Upload is larger than the limit of %d bytes", limit))
+	}
+	pod, nContainer, err := s.getUserPodContainer(ctx, request.PodName, request.UserID, request.Container)
+	if err != nil {
+		return response, err
+	}
+
+	dir := request.Path
+	var archive io.Reader = &exactReader{body: body, remaining: size}
+	if !request.Extract {
+		dir = path.Dir(request.Path)
+		fileArchive := singleFileArchive(path.Base(request.Path), archive, size)
+		// Stops the archive's writer if tar exits before reading all of it
+		defer fileArchive.Close()
+		archive = fileArchive
+	}
+
+	stderr := &limitedBuffer{limit: fileTransferStderrLimit}
+	err = s.Client.PodExecStream(ctx, []string{"tar", "-x", "-f", "-", "-C", dir}, pod.Object, nContainer, remotecommand.StreamOptions{
+		Stdin:  archive,
+		Stderr: stderr,
+	})
+	if err != nil {
+		return response, transferError(err, stderr.String(), fmt.Sprintf("Couldn't upload to %s in pod %s", request.Path, request.PodName))
+	}
+	response.Bytes = size
+	return response, nil
+}
+
+// Handles the request to upload a file, or a tar archive to extract, into a container of the user's pod.
+// The parameters are in the query, and the body is the file or archive.
+func (s *Server) ServeUploadPodFile(w http.ResponseWriter, r *http.Request) {
+	id := requestID(w, r)
+	request := s.podFileRequest(r)
+	fmt.Printf("uploadPodFile request [%s]: %+v\n", id, request)
+	err := s.checkPodFileRequest(&request)
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+
+	response, err := s.uploadPodFile(r.Context(), request, r.Body, r.ContentLength)
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// io.Writer that passes a download on to the response, which is only started with the first write,
+// so that a download that fails before tar writes anything still gets an error response
+type downloadWriter struct {
+	w        http.ResponseWriter
+	filename string
+	limit    int64
+	written  int64
+	started  bool
+	exceeded bool
+	// Cancels the exec stream once the limit is exceeded
+	cancel context.CancelFunc
+}
+
+func (d *downloadWriter) Write(p []byte) (int, error) {
+	if d.written+int64(len(p)) > d.limit {
+		d.exceeded = true
+		d.cancel()
+		return 0, errDownloadTooLarge
+	}
+	d.start()
+	n, err := d.w.Write(p)
+	d.written += int64(n)
+	return n, err
+}
+
+func (d *downloadWriter) start() {
+	if d.started {
+		return
+	}
+	d.started = true
+	d.w.Header().Set("Content-Type", "application/x-tar")
+	d.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", d.filename))
+	d.w.WriteHeader(http.StatusOK)
+}
+
+// Handles the request to download a file or directory from a container of the user's pod as a tar archive.
+// It is a GET request with the parameters in the query.
+func (s *Server) ServeDownloadPodFile(w http.ResponseWriter, r *http.Request) {
+	id := requestID(w, r)
+	request := s.podFileRequest(r)
+	fmt.Printf("downloadPodFile request [%s]: %+v\n", id, request)
+	err := s.checkPodFileRequest(&request)
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+	pod, nContainer, err := s.getUserPodContainer(r.Context(), request.PodName, request.UserID, request.Container)
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+
+	dir, name := path.Dir(request.Path), path.Base(request.Path)
+	filename := fmt.Sprintf("%s.tar", name)
+	if request.Path == "/" {
+		name = "."
+		filename = "root.tar"
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	output := &downloadWriter{w: w, filename: filename, limit: int64(s.GlobalConfig.FileTransferByteLimit), cancel: cancel}
+	stderr := &limitedBuffer{limit: fileTransferStderrLimit}
+	// -- keeps tar from taking a name that starts with - as an option
+	err = s.Client.PodExecStream(ctx, []string{"tar", "-c", "-f", "-", "-C", dir, "--", name}, pod.Object, nContainer, remotecommand.StreamOptions{
+		Stdout: output,
+		Stderr: stderr,
+	})
+	var exitErr utilexec.ExitError
+	switch {
+	case output.exceeded && !output.started:
+		writeError(w, id, invalidRequestError(fmt.Sprintf("Download of %s is larger than the limit of %d bytes", request.Path, output.limit)))
+	case output.exceeded:
+		// The status was already sent, so the only way to tell the client that the archive is incomplete is to abort the response
+		fmt.Printf("Download [%s] of %s from pod %s exceeded the limit of %d bytes, aborting\n", id, request.Path, request.PodName, output.limit)
+		panic(http.ErrAbortHandler)
+	case err == nil:
+		output.start()
+	case !output.started:
+		writeError(w, id, transferError(err, stderr.String(), fmt.Sprintf("Couldn't download %s from pod %s", request.Path, request.PodName)))
+	case errors.As(err, &exitErr):
+		// tar ends the archive even if it couldn't read some files, e.g. for lack of permission
+		fmt.Printf("Download [%s] of %s from pod %s is missing files: %s\n", id, request.Path, request.PodName, strings.TrimSpace(stderr.String()))
+	default:
+		fmt.Printf("Error [%s] downloading %s from pod %s, aborting: %s\n", id, request.Path, request.PodName, err.Error())
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Time that each readiness check may take before it counts as failed
+const readinessCheckTimeout = 5 * time.Second
+
+type ReadyzResponse struct {
+	Ready bool `json:"ready"`
+	// Checks[name] is "ok" or the reason the check failed
+	Checks map[string]string `json:"checks"`
+}
+
+// Record that the pod caches were loaded, so that the server can be ready
+func (s *Server) setPodCachesLoaded() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.podCachesLoaded = true
+}
+
+func (s *Server) checkPodCachesLoaded() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.podCachesLoaded {
+		return errors.New("Pod caches haven't been loaded yet")
+	}
+	return nil
+}
+
+// Return an error if a file can't be written to PodCacheDir.
+// The file's name starts with a dot, so that cleanAllUnused doesn't take it for an orphaned podcache.
+func (s *Server) checkPodCacheDir() error {
+	file, err := ioutil.TempFile(s.GlobalConfig.PodCacheDir, ".readyz-")
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't write to podCacheDir: %s", err.Error()))
+	}
+	file.Close()
+	err = os.Remove(file.Name())
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't remove %s: %s", file.Name(), err.Error()))
+	}
+	return nil
+}
+
+// Run the readiness checks and return whether all of them passed, and the result of each
+func (s *Server) readyz(ctx context.Context) ReadyzResponse {
+	ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+	defer cancel()
+	checks := map[string]func() error{
+		"shutdown":    s.checkAcceptingJobs,
+		"podCaches":   s.checkPodCachesLoaded,
+		"podCacheDir": s.checkPodCacheDir,
+		"apiserver": func() error {
+			return s.Client.CheckAPIServer(ctx)
+		},
+	}
+	response := ReadyzResponse{Ready: true, Checks: make(map[string]string)}
+	for name, check := range checks {
+		err := check()
+		if err != nil {
+			response.Ready = false
+			response.Checks[name] = err.Error()
+		} else {
+			response.Checks[name] = "ok"
+		}
+	}
+	return response
+}
+
+// Handles the liveness probe. The backend is alive as long as it serves http requests,
+// since restarting it doesn't help when a dependency is unavailable.
+func (s *Server) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "ok\n")
+}
+
+// Handles the readiness probe, which fails until the pod caches are loaded,
+// whenever the apiserver or PodCacheDir can't be reached, and once the server is shutting down
+func (s *Server) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	response := s.readyz(r.Context())
+	status := http.StatusOK
+	if !response.Ready {
+		fmt.Printf("Warning: not ready: %+v\n", response.Checks)
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
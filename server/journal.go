@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/poddeleter"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Directory in PodCacheDir for the journal. It starts with a dot, so that cleanAllUnused doesn't take it for a podcache.
+const journalDirName = ".journal"
+
+// The pending operation of an entry in one of the watch maps, persisted so that it can be resumed after a restart
+type journalEntry struct {
+	// Name of the watch map, one of the watchMapName labels
+	Map string `json:"map"`
+	// Pod name for CreatingPods and DeletingPods, user name for DeletingStorage
+	Key     string    `json:"key"`
+	UserID  string    `json:"user_id"`
+	Started time.Time `json:"started"`
+	// Set for a restart in CreatingPods, which is resumed by creating the pod again
+	Restart *restartSpec `json:"restart,omitempty"`
+}
+
+func (s *Server) journalDir() string {
+	return filepath.Join(s.GlobalConfig.PodCacheDir, journalDirName)
+}
+
+func (s *Server) journalFilename(key string, mapName watchMapName) string {
+	return filepath.Join(s.journalDir(), fmt.Sprintf("%s-%s", mapName.label(), key))
+}
+
+// Persist the operation that entry in mapName is waiting for.
+// Failing to do so is only logged, since the operation itself can still succeed.
+func (s *Server) writeJournalEntry(key string, entry watchMapEntry, mapName watchMapName) {
+	data, err := json.Marshal(journalEntry{Map: mapName.label(), Key: key, UserID: entry.authCheck, Started: entry.started, Restart: entry.restart})
+	if err == nil {
+		err = os.MkdirAll(s.journalDir(), 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(s.journalFilename(key, mapName), data, 0600)
+	}
+	if err != nil {
+		fmt.Printf("Error: Couldn't add %s in %s to the journal: %s\n", key, mapName.label(), err.Error())
+	}
+}
+
+func (s *Server) removeJournalEntry(key string, mapName watchMapName) {
+	err := os.Remove(s.journalFilename(key, mapName))
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error: Couldn't remove %s in %s from the journal: %s\n", key, mapName.label(), err.Error())
+	}
+}
+
+// Return the entries in the journal
+func (s *Server) readJournal() ([]journalEntry, error) {
+	files, err := ioutil.ReadDir(s.journalDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.New(fmt.Sprintf("Couldn't read journal: %s", err.Error()))
+	}
+	var entries []journalEntry
+	for _, file := range files {
+		filename := filepath.Join(s.journalDir(), file.Name())
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			// Leave it for the next start, since it may be readable then
+			fmt.Printf("Error: Couldn't read journal entry %s: %s\n", file.Name(), err.Error())
+			continue
+		}
+		var entry journalEntry
+		err = json.Unmarshal(data, &entry)
+		if err != nil || entry.Key == "" || entry.UserID == "" {
+			fmt.Printf("Error: Removing invalid journal entry %s\n", file.Name())
+			os.Remove(filename)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Resume the operations that were still pending in the journal when the backend last stopped.
+// Pods that were being created get their start jobs once they are ready,
+// or are deleted if they weren't ready within TimeoutCreate, and deletions are called for again.
+// Pods that were being restarted are created again if the new pod wasn't created yet.
+// An entry that fails to resume is logged and left in the journal, and the remaining entries are still resumed.
+func (s *Server) ResumeJournal(ctx context.Context) error {
+	entries, err := s.readJournal()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, entry := range entries {
+		var err error
+		fmt.Printf("Resuming %s %s of user %s from the journal, started at %s\n", entry.Map, entry.Key, entry.UserID, entry.Started)
+		switch entry.Map {
+		case CreatingPods.label():
+			if entry.Restart != nil {
+				err = s.resumeRestartPod(ctx, entry)
+			} else {
+				err = s.resumeCreatePod(ctx, entry)
+			}
+		case DeletingPods.label():
+			err = s.resumeDeletePod(ctx, entry)
+		case DeletingStorage.label():
+			s.removeJournalEntry(entry.Key, DeletingStorage)
+			s.deleteStorageIfUnused(ctx, managed.NewUser(entry.UserID, s.Client, s.GlobalConfig), entry.Started)
+		default:
+			err = errors.New(fmt.Sprintf("unknown watch map %s", entry.Map))
+		}
+		if err != nil {
+			fmt.Printf("Error: Couldn't resume %s %s from the journal: %s\n", entry.Map, entry.Key, err.Error())
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.New(fmt.Sprintf("Couldn't resume %d of %d journal entries", failed, len(entries)))
+	}
+	return nil
+}
+
+func (s *Server) resumeCreatePod(ctx context.Context, entry journalEntry) error {
+	pod, exists, err := s.getUserPod(ctx, entry.Key, entry.UserID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		fmt.Printf("Pod %s no longer exists, dropping it from the journal\n", entry.Key)
+		s.removeJournalEntry(entry.Key, CreatingPods)
+		return nil
+	}
+	stage, _ := podStage(pod.Object)
+	ready := stage == EventReady
+	remaining := time.Until(entry.Started.Add(s.GlobalConfig.TimeoutCreate))
+	if !ready && remaining <= 0 {
+		fmt.Printf("Pod %s wasn't ready within timeoutCreate, deleting it\n", entry.Key)
+		s.removeJournalEntry(entry.Key, CreatingPods)
+		finished := util.NewFuture(s.GlobalConfig.TimeoutDelete)
+		_, err = s.deletePod(ctx, DeletePodRequest{PodName: entry.Key, UserID: entry.UserID}, finished)
+		return err
+	}
+
+	// Run the start jobs once the pod is ready, like after creating it
+	finished := util.NewFuture(s.GlobalConfig.TimeoutCreate)
+	backgroundCtx := s.backgroundContext(s.GlobalConfig.TimeoutCreate, finished)
+	var podReady *util.Future
+	if ready {
+		podReady = util.NewFuture(s.GlobalConfig.TimeoutCreate)
+		podReady.Succeed()
+	} else {
+		podReady = util.NewFuture(remaining)
+		// podReady times out before finished, so it carries the diagnosis
+		podReady.DescribeTimeout(func() error {
+			return pod.TimeoutFailure("Pod didn't become ready")
+		})
+		go s.Client.WatchCreatePod(backgroundCtx, entry.Key, podReady)
+	}
+	go pod.RunStartJobsWhenReady(backgroundCtx, []*util.Future{podReady}, finished)
+	s.addToWatchMaps(entry.Key, watchMapEntry{finished: finished, authCheck: entry.UserID, started: entry.Started}, CreatingPods)
+	go func() {
+		if finished.Wait() != nil && s.baseCtx.Err() == nil {
+			s.deletePodIfFailedCreate(entry.Key, CreatePodRequest{UserID: entry.UserID})
+		}
+	}()
+	return nil
+}
+
+// Resume a restart. If the new pod was already created, its start jobs are resumed like after any other creation.
+// Otherwise the old pod is deleted again if it's still there, and the pod is created again once it's gone.
+func (s *Server) resumeRestartPod(ctx context.Context, entry journalEntry) error {
+	if entry.Restart.Pod == nil || entry.Restart.Pod.Name != entry.Key {
+		return errors.New(fmt.Sprintf("journal entry of restart of pod %s doesn't have its spec", entry.Key))
+	}
+	pod, exists, err := s.getUserPod(ctx, entry.Key, entry.UserID)
+	if err != nil {
+		return err
+	}
+	if exists && pod.Object.UID != entry.Restart.OldUID {
+		return s.resumeCreatePod(ctx, entry)
+	}
+	if !exists {
+		// The old pod is gone, but its delete jobs may not have finished, and they only need its name and labels
+		pod = managed.NewPod(entry.Restart.Pod.DeepCopy(), s.Client, s.GlobalConfig)
+	}
+	finished := util.NewFuture(s.GlobalConfig.TimeoutDelete + s.GlobalConfig.TimeoutCreate)
+	err = s.runRestart(entry.UserID, pod, entry.Restart, entry.Started, finished)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := finished.Wait(); err != nil && s.baseCtx.Err() == nil {
+			fmt.Printf("Warning: failed to restart pod %s: %s\n", entry.Key, err.Error())
+			s.deletePodIfFailedRestart(entry.Key, CreatePodRequest{UserID: entry.UserID, RemoteIP: entry.Restart.SiloIP}, err)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) resumeDeletePod(ctx context.Context, entry journalEntry) error {
+	user := managed.NewUser(entry.UserID, s.Client, s.GlobalConfig)
+	pod, exists, err := s.getUserPod(ctx, entry.Key, entry.UserID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		// The pod is gone, but its delete jobs may not have finished,
+		// and they only need its name
+		pod = managed.NewPod(
+			&apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: entry.Key, Namespace: s.GlobalConfig.Namespace}},
+			s.Client,
+			s.GlobalConfig,
+		)
+		pod.Owner = user
+	}
+	finished := util.NewFuture(s.GlobalConfig.TimeoutDelete)
+	deleter := poddeleter.NewFromPod(pod)
+	err = deleter.DeletePod(s.backgroundContext(s.GlobalConfig.TimeoutDelete, finished), finished)
+	if err != nil && !k8sclient.IsNotFound(err) {
+		finished.Fail(err)
+		return err
+	}
+	s.addToWatchMaps(entry.Key, watchMapEntry{finished: finished, authCheck: entry.UserID, started: entry.Started}, DeletingPods)
+	s.deleteStorageIfUnused(ctx, user, time.Time{})
+	return nil
+}
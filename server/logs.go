@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type GetPodLogsRequest struct {
+	UserID  string `json:"user_id"`
+	PodName string `json:"pod_name"`
+	// The container to get the logs of, which can be left empty for a pod with one container
+	Container string `json:"container"`
+	// If set, only this many of the last lines
+	TailLines *int64 `json:"tail_lines"`
+	// If set, only lines logged after this time, in RFC 3339 format
+	SinceTime string `json:"since_time"`
+	// Get the logs of the previous run of a restarted container, e.g. to see why it crashed
+	Previous bool `json:"previous"`
+	// If set, at most this many bytes, which can't be more than LogByteLimit
+	LimitBytes int64 `json:"limit_bytes"`
+	RemoteIP   string
+}
+
+type GetPodLogsResponse struct {
+	Logs string `json:"logs"`
+	// true if the logs were cut off at the byte limit
+	Truncated bool `json:"truncated"`
+}
+
+// Get the logs of the user's pod, as long as the user owns it
+func (s *Server) getPodLogs(ctx context.Context, request GetPodLogsRequest) (GetPodLogsResponse, error) {
+	var response GetPodLogsResponse
+	opt := &apiv1.PodLogOptions{Container: request.Container, Previous: request.Previous}
+	if request.TailLines != nil {
+		if *request.TailLines < 0 {
+			return response, invalidRequestError("tail_lines can't be negative")
+		}
+		opt.TailLines = request.TailLines
+	}
+	if request.SinceTime != "" {
+		since, err := time.Parse(time.RFC3339, request.SinceTime)
+		if err != nil {
+			return response, invalidRequestError(fmt.Sprintf("Couldn't parse since_time %s: %s", request.SinceTime, err.Error()))
+		}
+		sinceTime := metav1.NewTime(since)
+		opt.SinceTime = &sinceTime
+	}
+	limit := int64(s.GlobalConfig.LogByteLimit)
+	if request.LimitBytes > 0 && request.LimitBytes < limit {
+		limit = request.LimitBytes
+	}
+	// Ask for one more byte than the limit to tell whether the logs were cut off
+	limitBytes := limit + 1
+	opt.LimitBytes = &limitBytes
+
+	pod, nContainer, err := s.getUserPodContainer(ctx, request.PodName, request.UserID, request.Container)
+	if err != nil {
+		return response, err
+	}
+	opt.Container = pod.Object.Spec.Containers[nContainer].Name
+
+	logs, err := s.Client.GetPodLogs(ctx, request.PodName, opt)
+	if err != nil {
+		return response, fmt.Errorf("Couldn't get logs of pod %s: %w", request.PodName, err)
+	}
+	if int64(len(logs)) > limit {
+		logs = logs[:limit]
+		response.Truncated = true
+	}
+	response.Logs = string(logs)
+	return response, nil
+}
+
+func (s *Server) ServeGetPodLogs(w http.ResponseWriter, r *http.Request) {
+	id := requestID(w, r)
+	var request GetPodLogsRequest
+	err := decodeRequest(r, &request)
+	request.RemoteIP = s.getRemoteIP(r)
+	fmt.Printf("getPodLogs request [%s]: %+v\n", id, request)
+	if err == nil {
+		err = checkUserID(request.UserID)
+	}
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+
+	response, err := s.getPodLogs(r.Context(), request)
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
+)
+
+// Return the name of mapName used as the label of its metrics
+func (mapName watchMapName) label() string {
+	switch mapName {
+	case CreatingPods:
+		return "creating_pods"
+	case DeletingPods:
+		return "deleting_pods"
+	case DeletingStorage:
+		return "deleting_storage"
+	default:
+		return "unknown"
+	}
+}
+
+// Update the size metric of the watch map mapName. Must be called with s.mutex held.
+func (s *Server) updateWatchMapSize(mapName watchMapName) {
+	var size int
+	switch mapName {
+	case CreatingPods:
+		size = len(s.CreatingPods)
+	case DeletingPods:
+		size = len(s.DeletingPods)
+	case DeletingStorage:
+		size = len(s.DeletingStorage)
+	}
+	metrics.WatchMapSize.Set(float64(size), mapName.label())
+}
+
+// Count the outcome of the pod creation or deletion that an entry in mapName was waiting for,
+// given what its finished future completed with
+func recordWatchMapOutcome(mapName watchMapName, err error) {
+	outcome := metrics.OutcomeSuccess
+	if errors.Is(err, context.DeadlineExceeded) {
+		outcome = metrics.OutcomeTimeout
+	} else if err != nil {
+		outcome = metrics.OutcomeFailed
+	}
+	switch mapName {
+	case CreatingPods:
+		metrics.PodCreations.Inc(outcome)
+	case DeletingPods:
+		metrics.PodDeletions.Inc(outcome)
+	}
+}
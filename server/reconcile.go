@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// What a reconciliation pass found and did
+type ReconcileReport struct {
+	Started     time.Time                 `json:"started"`
+	PodsChecked int                       `json:"pods_checked"`
+	Actions     []managed.ReconcileAction `json:"actions"`
+	Errors      []string                  `json:"errors,omitempty"`
+}
+
+func (r *ReconcileReport) addActions(actions []managed.ReconcileAction) {
+	for _, action := range actions {
+		result := "ok"
+		if action.Error != "" {
+			result = "error"
+			fmt.Printf("Error: Reconciler couldn't %s %s %s for pod %s: %s\n", action.Action, action.Kind, action.Name, action.Pod, action.Error)
+		} else {
+			fmt.Printf("Reconciler %s %s %s for pod %s\n", action.Action, action.Kind, action.Name, action.Pod)
+		}
+		metrics.ReconcileActions.Inc(action.Kind, action.Action, result)
+		r.Actions = append(r.Actions, action)
+	}
+}
+
+func (r *ReconcileReport) addError(err error) {
+	fmt.Printf("Error: Reconciler: %s\n", err.Error())
+	r.Errors = append(r.Errors, err.Error())
+}
+
+// Return true if the pod is settled, i.e. ready and not being created or deleted,
+// so that reconciling its companion resources doesn't interfere with its start or delete jobs
+func (s *Server) isSettled(pod *managed.Pod) bool {
+	if pod.Object.DeletionTimestamp != nil {
+		return false
+	}
+	if stage, _ := podStage(pod.Object); stage != EventReady {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, creating := s.CreatingPods[pod.Object.Name]
+	_, deleting := s.DeletingPods[pod.Object.Name]
+	return !creating && !deleting
+}
+
+// Return true if the companion resource created for podName is orphaned,
+// i.e. the pod doesn't exist and isn't being created or deleted, whose jobs take care of it.
+// The pod is looked up right before deleting the resource rather than in the pod list of the pass,
+// since it may have been created in the meantime.
+// The watch maps are checked after the lookup, because a pod is added to CreatingPods before it's created.
+func (s *Server) isOrphaned(ctx context.Context, podName string) (bool, error) {
+	podList, err := s.Client.ListPods(ctx, metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", podName)})
+	if err != nil {
+		return false, fmt.Errorf("Couldn't look up pod %s: %w", podName, err)
+	}
+	if len(podList.Items) > 0 {
+		return false, nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, creating := s.CreatingPods[podName]
+	_, deleting := s.DeletingPods[podName]
+	return !creating && !deleting, nil
+}
+
+// Bring the services and ingresses of all settled user pods to their desired state,
+// and delete the ones whose pods are gone
+func (s *Server) reconcile(ctx context.Context) ReconcileReport {
+	s.reconcileMutex.Lock()
+	defer s.reconcileMutex.Unlock()
+	report := ReconcileReport{Started: time.Now(), Actions: []managed.ReconcileAction{}}
+	podList, err := s.Client.ListPods(ctx, metav1.ListOptions{})
+	if err != nil {
+		report.addError(fmt.Errorf("Couldn't list pods: %w", err))
+		return report
+	}
+	for i := range podList.Items {
+		if util.GetUserIDFromLabels(podList.Items[i].Labels) == "" {
+			continue
+		}
+		pod := managed.NewPod(&podList.Items[i], s.Client, s.GlobalConfig)
+		if !s.isSettled(&pod) {
+			continue
+		}
+		report.PodsChecked++
+		actions, err := pod.ReconcileCompanions(ctx)
+		report.addActions(actions)
+		if err != nil {
+			report.addError(err)
+		}
+	}
+
+	serviceList, err := s.Client.ListServices(ctx, metav1.ListOptions{LabelSelector: "createdForPod"})
+	if err != nil {
+		report.addError(fmt.Errorf("Couldn't list services: %w", err))
+	} else {
+		for _, service := range serviceList.Items {
+			podName := service.Labels["createdForPod"]
+			orphaned, err := s.isOrphaned(ctx, podName)
+			if err != nil {
+				report.addError(err)
+				continue
+			}
+			if orphaned {
+				err := s.Client.DeleteService(ctx, service.Name)
+				report.addActions([]managed.ReconcileAction{managed.NewReconcileAction(managed.KindService, service.Name, podName, managed.ReconcileDeleted, err)})
+			}
+		}
+	}
+	ingressList, err := s.Client.ListIngresses(ctx, metav1.ListOptions{LabelSelector: "createdForPod"})
+	if err != nil {
+		report.addError(fmt.Errorf("Couldn't list ingresses: %w", err))
+	} else {
+		for _, ingress := range ingressList.Items {
+			podName := ingress.Labels["createdForPod"]
+			orphaned, err := s.isOrphaned(ctx, podName)
+			if err != nil {
+				report.addError(err)
+				continue
+			}
+			if orphaned {
+				err := s.Client.DeleteIngress(ctx, ingress.Name)
+				report.addActions([]managed.ReconcileAction{managed.NewReconcileAction(managed.KindIngress, ingress.Name, podName, managed.ReconcileDeleted, err)})
+			}
+		}
+	}
+	if len(report.Actions) > 0 || len(report.Errors) > 0 {
+		fmt.Printf("Reconciled %d pods: %d actions, %d errors\n", report.PodsChecked, len(report.Actions), len(report.Errors))
+	}
+	return report
+}
+
+// Reconcile right away, which also migrates companion resources created without owner references,
+// then every ReconcileInterval until ctx is done. Passes are skipped while the server is shutting down.
+func (s *Server) RunReconciler(ctx context.Context) {
+	ticker := time.NewTicker(s.GlobalConfig.ReconcileInterval)
+	defer ticker.Stop()
+	for {
+		if s.checkAcceptingJobs() == nil {
+			s.reconcile(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Handles the http request to reconcile right away, responding with the report
+func (s *Server) ServeReconcile(w http.ResponseWriter, r *http.Request) {
+	id := requestID(w, r)
+	fmt.Printf("reconcile request [%s] from IP %s\n", id, s.getRemoteIP(r))
+	err := s.checkAcceptingJobs()
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+	report := s.reconcile(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/podcreator"
+	"github.com/deic.dk/user_pods_k8s_backend/poddeleter"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type RestartPodRequest struct {
+	UserID   string `json:"user_id"`
+	PodName  string `json:"pod_name"`
+	RemoteIP string
+}
+
+type RestartPodResponse struct {
+	Requested bool `json:"requested"`
+}
+
+// What a restart needs to be resumed from the journal after the old pod was deleted
+type restartSpec struct {
+	// UID of the pod being replaced, to tell it apart from the new pod with the same name
+	OldUID types.UID `json:"old_uid"`
+	// The pod to create again, from podcreator.NewFromPod
+	Pod    *apiv1.Pod `json:"pod"`
+	SiloIP string     `json:"silo_ip"`
+}
+
+// Delete the user's pod, then create it again from the same spec under the same name, so that its ingress host stays the same,
+// and run its start jobs, which copy its new tokens. finished is completed once the new pod's start jobs are done.
+// The restart is in CreatingPods from the start, so that it can be watched with watch_create_pod,
+// and so that the user's storage isn't deleted while the pod is gone.
+// The pod's companion resources are deleted along with it and created again for the new pod,
+// since their owner references point to the old pod's UID, which kubernetes garbage collects them for.
+func (s *Server) restartPod(ctx context.Context, request RestartPodRequest, finished *util.Future) (RestartPodResponse, error) {
+	response := RestartPodResponse{Requested: false}
+	s.mutex.Lock()
+	_, creating := s.CreatingPods[request.PodName]
+	_, deleting := s.DeletingPods[request.PodName]
+	s.mutex.Unlock()
+	if creating || deleting {
+		err := k8sclient.NewError(k8sclient.ReasonConflict, fmt.Sprintf("pod %s is already being created, restarted or deleted", request.PodName))
+		finished.Fail(err)
+		return response, err
+	}
+	pod, exists, err := s.getUserPod(ctx, request.PodName, request.UserID)
+	if err == nil && !exists {
+		err = k8sclient.NewError(k8sclient.ReasonNotFound, fmt.Sprintf("Didn't find pod %s owned by user %s", request.PodName, request.UserID))
+	}
+	if err != nil {
+		finished.Fail(err)
+		return response, err
+	}
+	creator := podcreator.NewFromPod(pod, request.RemoteIP)
+	restart := &restartSpec{OldUID: pod.Object.UID, Pod: creator.TargetPod(), SiloIP: request.RemoteIP}
+	err = s.runRestart(request.UserID, pod, restart, time.Time{}, finished)
+	if err != nil {
+		return response, err
+	}
+	response.Requested = true
+	return response, nil
+}
+
+// The error a restart fails with if it stopped before the new pod was created,
+// in which case the old pod is either still there or being deleted, and mustn't be deleted again
+type restartNotCreatedError struct {
+	error
+}
+
+func (e restartNotCreatedError) Unwrap() error {
+	return e.error
+}
+
+// Delete oldPod, and once it's gone, create restart.Pod under the same name.
+// The restart is added to CreatingPods and the journal before oldPod is deleted,
+// so that if the backend stops in between, the pod is still created again when the journal is resumed.
+func (s *Server) runRestart(userID string, oldPod managed.Pod, restart *restartSpec, started time.Time, finished *util.Future) error {
+	podName := restart.Pod.Name
+	creator := podcreator.NewFromPod(managed.NewPod(restart.Pod.DeepCopy(), s.Client, s.GlobalConfig), restart.SiloIP)
+	deleter := poddeleter.NewFromPod(oldPod)
+	s.addToWatchMaps(podName, watchMapEntry{finished: finished, authCheck: userID, started: started, restart: restart}, CreatingPods)
+
+	// Let the deletion, creation and start jobs outlive the request
+	backgroundCtx := s.backgroundContext(s.GlobalConfig.TimeoutDelete+s.GlobalConfig.TimeoutCreate, finished)
+	deleted := util.NewFuture(s.GlobalConfig.TimeoutDelete)
+	err := deleter.DeletePod(backgroundCtx, deleted)
+	if err != nil {
+		finished.Fail(err)
+		return err
+	}
+	go func() {
+		if err := deleted.Wait(); err != nil {
+			finished.Fail(restartNotCreatedError{fmt.Errorf("Couldn't delete pod %s to restart it: %w", podName, err)})
+			return
+		}
+		// If the user deleted the pod in the meantime, don't bring it back
+		s.mutex.Lock()
+		_, deleting := s.DeletingPods[podName]
+		s.mutex.Unlock()
+		if deleting {
+			finished.Fail(restartNotCreatedError{k8sclient.NewError(k8sclient.ReasonCanceled, fmt.Sprintf("Pod %s was deleted while restarting", podName))})
+			return
+		}
+		_, err := creator.CreatePod(backgroundCtx, finished)
+		if err != nil {
+			finished.Fail(err)
+		}
+	}()
+	return nil
+}
+
+// Handles the http request to restart one of the user's pods
+func (s *Server) ServeRestartPod(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := requestID(w, r)
+	var request RestartPodRequest
+	err := decodeRequest(r, &request)
+	request.RemoteIP = s.getRemoteIP(r)
+	fmt.Printf("restartPod request [%s]: %+v\n", id, request)
+	if err == nil {
+		err = checkUserID(request.UserID)
+	}
+	if err == nil {
+		err = s.checkAcceptingJobs()
+	}
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+
+	finished := util.NewFuture(s.GlobalConfig.TimeoutDelete + s.GlobalConfig.TimeoutCreate)
+	response, err := s.restartPod(ctx, request, finished)
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+	go func() {
+		if err := finished.Wait(); err == nil {
+			fmt.Printf("Restarted pod %s\n", request.PodName)
+		} else {
+			fmt.Printf("Warning: failed to restart pod %s: %s\n", request.PodName, err.Error())
+			s.deletePodIfFailedRestart(request.PodName, CreatePodRequest{UserID: request.UserID, RemoteIP: request.RemoteIP}, err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Like after a failed creation, delete the new pod if it didn't finish its start jobs.
+// If the restart failed before the new pod was created, there's nothing to delete.
+func (s *Server) deletePodIfFailedRestart(podName string, createRequest CreatePodRequest, err error) error {
+	var notCreated restartNotCreatedError
+	if errors.As(err, &notCreated) {
+		return nil
+	}
+	return s.deletePodIfFailedCreate(podName, createRequest)
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/deic.dk/user_pods_k8s_backend/auth"
 	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
 	"github.com/deic.dk/user_pods_k8s_backend/managed"
 	"github.com/deic.dk/user_pods_k8s_backend/podcreator"
@@ -32,7 +34,9 @@ type CreatePodRequest struct {
 	UserID  string `json:"user_id"`
 	//Settings[container_name][env_var_name] = env_var_value
 	ContainerEnvVars map[string]map[string]string `json:"settings"`
-	RemoteIP         string
+	// How long the pod should live, in the format of time.Duration, instead of the lifetime in the manifest or config
+	Lifetime string `json:"lifetime"`
+	RemoteIP string
 }
 
 type CreatePodResponse struct {
@@ -44,8 +48,11 @@ type WatchCreatePodRequest struct {
 	UserID  string `json:"user_id"`
 }
 
+// If the creation failed, Reason says why, and if it timed out, Diagnosis has what kubernetes reported about the pod
 type WatchCreatePodResponse struct {
-	Ready bool `json:"ready"`
+	Ready     bool                  `json:"ready"`
+	Reason    string                `json:"reason,omitempty"`
+	Diagnosis *managed.PodDiagnosis `json:"diagnosis,omitempty"`
 }
 
 type DeletePodRequest struct {
@@ -63,8 +70,11 @@ type WatchDeletePodRequest struct {
 	UserID  string `json:"user_id"`
 }
 
+// If the deletion failed, Reason says why, and if it timed out, Diagnosis has what kubernetes reported about the pod
 type WatchDeletePodResponse struct {
-	Deleted bool `json:"deleted"`
+	Deleted   bool                  `json:"deleted"`
+	Reason    string                `json:"reason,omitempty"`
+	Diagnosis *managed.PodDiagnosis `json:"diagnosis,omitempty"`
 }
 
 type DeleteAllPodsRequest struct {
@@ -82,8 +92,12 @@ type GetPodIPOwnerRequest struct {
 }
 
 type watchMapEntry struct {
-	authCheck    string
-	readyChannel *util.ReadyChannel
+	authCheck string
+	finished  *util.Future
+	// When the operation started, set by addToWatchMaps if it's zero
+	started time.Time
+	// Set for a restart in CreatingPods, so that it's journaled with what's needed to finish it
+	restart *restartSpec
 }
 
 type Server struct {
@@ -93,6 +107,21 @@ type Server struct {
 	DeletingPods    map[string]watchMapEntry
 	DeletingStorage map[string]watchMapEntry
 	mutex           *sync.Mutex
+	events          *podEventBroker
+	// nil if requests aren't authenticated
+	verifier      *auth.Verifier
+	siloAddresses map[string]string
+	// Set once ReloadPodCaches succeeded, guarded by mutex
+	podCachesLoaded bool
+	// Set once Shutdown was called, guarded by mutex
+	shuttingDown bool
+	// Held during a reconciliation pass, so that passes don't overlap
+	reconcileMutex *sync.Mutex
+	// Held during a pass of the culler, so that passes don't cull the same pod twice
+	cullMutex *sync.Mutex
+	// Background jobs derive from baseCtx, so that they are stopped when the server shuts down
+	baseCtx    context.Context
+	cancelBase context.CancelFunc
 }
 
 type watchMapName int
@@ -105,7 +134,8 @@ const (
 )
 
 func New(client k8sclient.K8sClient, globalConfig util.GlobalConfig) *Server {
-	var m sync.Mutex
+	var m, reconcileMutex, cullMutex sync.Mutex
+	baseCtx, cancelBase := context.WithCancel(context.Background())
 	return &Server{
 		Client:          client,
 		GlobalConfig:    globalConfig,
@@ -113,15 +143,27 @@ func New(client k8sclient.K8sClient, globalConfig util.GlobalConfig) *Server {
 		DeletingPods:    make(map[string]watchMapEntry),
 		DeletingStorage: make(map[string]watchMapEntry),
 		mutex:           &m,
+		events:          newPodEventBroker(),
+		verifier:        newVerifier(globalConfig),
+		siloAddresses:   siloAddresses(globalConfig),
+		reconcileMutex:  &reconcileMutex,
+		cullMutex:       &cullMutex,
+		baseCtx:         baseCtx,
+		cancelBase:      cancelBase,
 	}
 }
 
 // Add an entry to the specified watchMap (e.g. `s.CreatingPods`) for the given key.
-// As soon as a value is ready in `entry.readyChannel`, the entry will be removed from the map.
+// As soon as `entry.finished` is completed, the entry will be removed from the map.
+// Both are published as events to the streams of the pod's owner,
+// and the entry is kept in the journal until then, so that it can be resumed after a restart.
 func (s *Server) addToWatchMaps(key string, entry watchMapEntry, mapName watchMapName) {
+	if entry.started.IsZero() {
+		entry.started = time.Now()
+	}
+	s.writeJournalEntry(key, entry, mapName)
 	// Thread-safe add `key` to the map of events to wait for
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
 	switch mapName {
 	case CreatingPods:
 		s.CreatingPods[key] = entry
@@ -130,12 +172,20 @@ func (s *Server) addToWatchMaps(key string, entry watchMapEntry, mapName watchMa
 	case DeletingStorage:
 		s.DeletingStorage[key] = entry
 	}
+	s.updateWatchMapSize(mapName)
+	s.publishWatchMapEvent(key, entry, mapName, true, nil)
+	s.mutex.Unlock()
 
-	// Then watch for the finished signal, and once finished, remove `key` from the map
-	go func() {
-		entry.readyChannel.Receive()
+	// Then once finished is completed, remove `key` from the map.
+	// This is called right away if it already is, so it must be registered without holding s.mutex.
+	entry.finished.OnComplete(func(err error) {
+		// Keep the journal entry of an operation that was stopped by shutting down, so that it's resumed after restarting
+		if err == nil || s.baseCtx.Err() == nil {
+			s.removeJournalEntry(key, mapName)
+		}
 		s.mutex.Lock()
 		defer s.mutex.Unlock()
+		defer s.publishWatchMapEvent(key, entry, mapName, false, err)
 		switch mapName {
 		case CreatingPods:
 			delete(s.CreatingPods, key)
@@ -144,12 +194,30 @@ func (s *Server) addToWatchMaps(key string, entry watchMapEntry, mapName watchMa
 		case DeletingStorage:
 			delete(s.DeletingStorage, key)
 		}
-	}()
+		s.updateWatchMapSize(mapName)
+		recordWatchMapOutcome(mapName, err)
+	})
+}
+
+// Return a context for jobs that continue after the request that started them has been answered,
+// so that they aren't cancelled along with the request.
+// It is cancelled once finished is completed, after timeout, or when the server shuts down.
+func (s *Server) backgroundContext(timeout time.Duration, finished *util.Future) context.Context {
+	ctx, cancel := context.WithTimeout(s.baseCtx, timeout)
+	finished.OnComplete(func(error) {
+		cancel()
+	})
+	return ctx
 }
 
 // Gets the IP of the source that made the request, either r.RemoteAddr,
 // or if it was forwarded, the first address in the X-Forwarded-For header
+// If the request was signed by a silo, the silo's address from the config is used instead,
+// so that a silo can't act on behalf of another by forging the header.
 func (s *Server) getRemoteIP(r *http.Request) string {
+	if address, isSilo := s.authenticatedSiloAddress(r); isSilo {
+		return address
+	}
 	// When running this behind a manual reverse proxy, r.RemoteAddr is just the proxy's IP addr,
 	// and X-Forward-For header should contain the silo's IP address.
 	// This may be different with ingress.
@@ -200,12 +268,63 @@ func validUserID(userID string) bool {
 	return r.MatchString(userID)
 }
 
+// Decode the JSON body of r into request
+func decodeRequest(r *http.Request, request interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(request)
+	if err != nil {
+		return invalidRequestError(fmt.Sprintf("Couldn't decode request body: %s", err.Error()))
+	}
+	return nil
+}
+
+// Return an error if userID isn't valid
+func checkUserID(userID string) error {
+	if !validUserID(userID) {
+		return invalidRequestError(fmt.Sprintf("Invalid user_id %s", userID))
+	}
+	return nil
+}
+
+// Return the user's pod with podName, or false if it doesn't exist
+func (s *Server) getUserPod(ctx context.Context, podName string, userID string) (managed.Pod, bool, error) {
+	podList, err := s.Client.ListPods(ctx, metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", podName)})
+	if err != nil {
+		return managed.Pod{}, false, err
+	}
+	if len(podList.Items) == 0 {
+		return managed.Pod{}, false, nil
+	}
+	pod := managed.NewPod(&podList.Items[0], s.Client, s.GlobalConfig)
+	if pod.Owner.UserID != userID {
+		return managed.Pod{}, false, nil
+	}
+	return pod, true, nil
+}
+
+// Return the user's pod with podName and the index of its container with the given name, or of its first container if the name is empty.
+// A pod owned by another user gives the same error as one that doesn't exist.
+func (s *Server) getUserPodContainer(ctx context.Context, podName string, userID string, container string) (managed.Pod, int, error) {
+	pod, exists, err := s.getUserPod(ctx, podName, userID)
+	if err != nil {
+		return managed.Pod{}, 0, err
+	}
+	if !exists {
+		return managed.Pod{}, 0, k8sclient.NewError(k8sclient.ReasonNotFound, fmt.Sprintf("Didn't find pod %s owned by user %s", podName, userID))
+	}
+	for i, podContainer := range pod.Object.Spec.Containers {
+		if container == "" || podContainer.Name == container {
+			return pod, i, nil
+		}
+	}
+	return managed.Pod{}, 0, invalidRequestError(fmt.Sprintf("Pod %s doesn't have a container %s", podName, container))
+}
+
 // Fills in a getPodsResponse with information about all the pods owned by the user.
 // If the username string is empty, use all pods in the namespace.
-func (s *Server) getPods(request GetPodsRequest) (GetPodsResponse, error) {
+func (s *Server) getPods(ctx context.Context, request GetPodsRequest) (GetPodsResponse, error) {
 	var response GetPodsResponse
 	user := managed.NewUser(request.UserID, s.Client, s.GlobalConfig)
-	podList, err := user.ListPods()
+	podList, err := user.ListPods(ctx)
 	if err != nil {
 		return response, err
 	}
@@ -231,61 +350,70 @@ func (s *Server) getPods(request GetPodsRequest) (GetPodsResponse, error) {
 
 // Handles the http request to get info about the user's pods
 func (s *Server) ServeGetPods(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := requestID(w, r)
 	// parse the request
 	var request GetPodsRequest
-	decoder := json.NewDecoder(r.Body)
-	decoder.Decode(&request)
+	err := decodeRequest(r, &request)
 	request.RemoteIP = s.getRemoteIP(r)
-	fmt.Printf("getPods request: %+v\n", request)
+	fmt.Printf("getPods request [%s]: %+v\n", id, request)
+	if err == nil {
+		err = checkUserID(request.UserID)
+	}
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
 
-	// Default to an error status and empty response
-	status := http.StatusBadRequest
-	var response GetPodsResponse
-	// If the input is valid
-	if validUserID(request.UserID) {
-		// get the list of pod info
-		r, err := s.getPods(request)
-		if err != nil {
-			fmt.Printf("Error calling GetPods: %s", err.Error())
-		} else { // If it was successful, set the status and response
-			status = http.StatusOK
-			response = r
-		}
+	// get the list of pod info
+	response, err := s.getPods(ctx, request)
+	if err != nil {
+		writeError(w, id, fmt.Errorf("Error calling GetPods: %w", err))
+		return
 	}
 
 	// write the response
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
+	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
 
 // Makes a PodCreator to request that kubernetes create the pod.
 // Returns the pod's name without error if the request was made without error,
 // Then quietly waits for the pod to reach Ready state and runs start jobs.
-func (s *Server) createPod(request CreatePodRequest, finished *util.ReadyChannel) (CreatePodResponse, error) {
+func (s *Server) createPod(ctx context.Context, request CreatePodRequest, finished *util.Future) (CreatePodResponse, error) {
 	var response CreatePodResponse
+	lifetime, err := parseLifetime(request.Lifetime)
+	if err != nil {
+		finished.Fail(err)
+		return response, err
+	}
 	// make podCreator
 	creator, err := podcreator.NewPodCreator(
+		ctx,
 		request.YamlURL,
 		request.UserID,
 		request.RemoteIP,
 		request.ContainerEnvVars,
+		lifetime,
 		s.Client,
 		s.GlobalConfig,
 	)
 	if err != nil {
+		finished.Fail(err)
 		return response, err
 	}
 
-	// create pod
-	pod, err := creator.CreatePod(finished)
+	// create pod, letting the watches and start jobs outlive the request
+	pod, err := creator.CreatePod(s.backgroundContext(s.GlobalConfig.TimeoutCreate, finished), finished)
 	if err != nil {
+		finished.Fail(err)
 		return response, err
 	}
-	// If creation was requested successfully, add the readyChannel to the server's watchMap
+	// If creation was requested successfully, add the finished future to the server's watchMap
 	s.addToWatchMaps(
 		pod.Object.Name,
-		watchMapEntry{readyChannel: finished, authCheck: request.UserID},
+		watchMapEntry{finished: finished, authCheck: request.UserID},
 		CreatingPods,
 	)
 
@@ -296,48 +424,49 @@ func (s *Server) createPod(request CreatePodRequest, finished *util.ReadyChannel
 
 // Handles the http request to create a pod for the user
 func (s *Server) ServeCreatePod(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := requestID(w, r)
 	// Parse the POSTed request JSON and log the request
 	var request CreatePodRequest
-	decoder := json.NewDecoder(r.Body)
-	decoder.Decode(&request)
+	err := decodeRequest(r, &request)
 	request.RemoteIP = s.getRemoteIP(r)
-	fmt.Printf("createPod request: %+v\n", request)
+	fmt.Printf("createPod request [%s]: %+v\n", id, request)
+	if err == nil {
+		err = checkUserID(request.UserID)
+	}
+	if err == nil {
+		err = s.checkAcceptingJobs()
+	}
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
 
-	// Default to an error status and empty response
-	status := http.StatusBadRequest
-	var response CreatePodResponse
-	// If the input is valid
-	if validUserID(request.UserID) {
-		// Call for pod creation
-		finished := util.NewReadyChannel(s.GlobalConfig.TimeoutCreate)
-		r, err := s.createPod(request, finished)
-		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
+	// Call for pod creation
+	finished := util.NewFuture(s.GlobalConfig.TimeoutCreate)
+	response, err := s.createPod(ctx, request, finished)
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+	// Wait for the result of creation, log the result, and call for deletion
+	// if something went wrong
+	go func() {
+		if err := finished.Wait(); err == nil {
+			fmt.Printf("Completed start jobs for Pod %s\n", response.PodName)
 		} else {
-			// If the creation call was sucessful, set the response and status
-			status = http.StatusOK
-			response = r
-			// Wait for the result of creation, log the result, and call for deletion
-			// if something went wrong
-			go func() {
-				if finished.Receive() {
-					fmt.Printf("Completed start jobs for Pod %s\n", response.PodName)
-				} else {
-					fmt.Printf("Warning: failed to create pod %s or complete start jobs\n", response.PodName)
-					s.deletePodIfFailedCreate(response.PodName, request)
-				}
-			}()
+			fmt.Printf("Warning: failed to create pod %s or complete start jobs: %s\n", response.PodName, err.Error())
+			s.deletePodIfFailedCreate(response.PodName, request)
 		}
-	}
+	}()
 
 	// write the response
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
+	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
-
 }
 
-func (s *Server) watchCreatePod(request WatchCreatePodRequest) (WatchCreatePodResponse, error) {
+func (s *Server) watchCreatePod(ctx context.Context, request WatchCreatePodRequest) (WatchCreatePodResponse, error) {
 	response := WatchCreatePodResponse{Ready: false}
 	// Thread-safe read in case a channel is added/removed concurrently
 	s.mutex.Lock()
@@ -350,14 +479,25 @@ func (s *Server) watchCreatePod(request WatchCreatePodRequest) (WatchCreatePodRe
 				fmt.Sprintf("Requested userID %s does not match pod's owner %s", request.UserID, entry.authCheck),
 			)
 		}
-		// Respond when there is a value in the ready channel
-		response.Ready = entry.readyChannel.Receive()
+		// Respond when the creation is finished, or stop waiting if the request is cancelled
+		select {
+		case <-entry.finished.Done():
+		case <-ctx.Done():
+			return response, errors.New(fmt.Sprintf("Stopped watching pod %s: %s", request.PodName, ctx.Err().Error()))
+		}
+		// Only the owner gets this far, so it's safe to tell them why it failed
+		if err := entry.finished.Err(); err != nil {
+			response.Reason = err.Error()
+			response.Diagnosis = managed.DiagnosisForError(err)
+		} else {
+			response.Ready = true
+		}
 		return response, nil
 	}
 
 	// If there was no entry for this pod in `s.CreatingPods`, return true iff the pod exists and is owned by the user.
 	u := managed.NewUser(request.UserID, s.Client, s.GlobalConfig)
-	owned, err := u.OwnsPod(request.PodName)
+	owned, err := u.OwnsPod(ctx, request.PodName)
 	if err != nil {
 		return response, err
 	}
@@ -366,16 +506,18 @@ func (s *Server) watchCreatePod(request WatchCreatePodRequest) (WatchCreatePodRe
 }
 
 func (s *Server) ServeWatchCreatePod(w http.ResponseWriter, r *http.Request) {
+	id := requestID(w, r)
 	var request WatchCreatePodRequest
 	decoder := json.NewDecoder(r.Body)
 	decoder.Decode(&request)
-	fmt.Printf("watchCreatePod request %+v\n", request)
+	fmt.Printf("watchCreatePod request [%s]: %+v\n", id, request)
 
-	response, err := s.watchCreatePod(request)
+	response, err := s.watchCreatePod(r.Context(), request)
 	// If there is an error, it may be internal, or it may be a user requesting for a pod they don't own.
-	// To avoid giving the user information about pods they don't own, return `false` without error in either case.
+	// To avoid giving the user information about pods they don't own, return `false` without error in either case,
+	// rather than an ErrorResponse like the other handlers.
 	if err != nil {
-		fmt.Printf("Error watching pod: %s\n", err.Error())
+		fmt.Printf("Error [%s] watching pod: %s\n", id, err.Error())
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -383,8 +525,8 @@ func (s *Server) ServeWatchCreatePod(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func (s *Server) userHasRemainingPods(u managed.User) bool {
-	podList, err := u.ListPods()
+func (s *Server) userHasRemainingPods(ctx context.Context, u managed.User) bool {
+	podList, err := u.ListPods(ctx)
 	if err != nil {
 		fmt.Printf("Error, couldn't list pods for user %s: %s\n", u.UserID, err.Error())
 		return false
@@ -400,6 +542,18 @@ func (s *Server) userHasRemainingPods(u managed.User) bool {
 			return true
 		}
 	}
+	// A pod that is being restarted needs the storage, even while it doesn't exist
+	for _, entry := range s.CreatingPods {
+		select {
+		case <-entry.finished.Done():
+			// A failed creation, whose pod is about to be deleted
+			continue
+		default:
+		}
+		if entry.authCheck == u.UserID {
+			return true
+		}
+	}
 	return false
 }
 
@@ -412,112 +566,126 @@ func (s *Server) deletePodIfFailedCreate(podName string, createRequest CreatePod
 	}
 	fmt.Printf("Attempting to delete pod %s because it didn't reach desired state", podName)
 
-	// Call for deletion
-	finished := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
-	_, err := s.deletePod(request, finished)
+	// Call for deletion. This isn't part of a request, so only the per-call timeouts and shutdown apply
+	finished := util.NewFuture(s.GlobalConfig.TimeoutDelete)
+	_, err := s.deletePod(s.baseCtx, request, finished)
 	if err != nil {
 		fmt.Printf("Error: Failed deleting pod %s after it failed creation: %s\n", podName, err.Error())
 		return err
 	}
 
 	// Wait and see whether it succeeded
-	if !finished.Receive() {
-		errorMessage := fmt.Sprintf("Error: Pod %s failed to reach deleted state. Deletion was triggered by failure to reach created state.\n", podName)
+	if err := finished.Wait(); err != nil {
+		errorMessage := fmt.Sprintf("Error: Pod %s failed to reach deleted state: %s. Deletion was triggered by failure to reach created state.\n", podName, err.Error())
 		fmt.Print(errorMessage)
 		return errors.New(errorMessage)
 	}
 	return nil
 }
 
-func (s *Server) deletePod(request DeletePodRequest, finished *util.ReadyChannel) (DeletePodResponse, error) {
+func (s *Server) deletePod(ctx context.Context, request DeletePodRequest, finished *util.Future) (DeletePodResponse, error) {
 	response := DeletePodResponse{Requested: false}
 	s.mutex.Lock()
 	_, podIsBeingDeleted := s.DeletingPods[request.PodName]
 	s.mutex.Unlock()
 	if podIsBeingDeleted {
-		finished.Send(false)
-		return response, errors.New(fmt.Sprintf("pod %s is already being deleted", request.PodName))
+		err := k8sclient.NewError(k8sclient.ReasonConflict, fmt.Sprintf("pod %s is already being deleted", request.PodName))
+		finished.Fail(err)
+		return response, err
 	}
 
 	// Try to initialize a podDeleter (this will check that the username matches)
-	deleter, err := poddeleter.NewPodDeleter(request.PodName, request.UserID, s.Client, s.GlobalConfig)
+	deleter, err := poddeleter.NewPodDeleter(ctx, request.PodName, request.UserID, s.Client, s.GlobalConfig)
 	if err != nil {
-		finished.Send(false)
-		return response, errors.New(fmt.Sprintf("Error starting pod deletion for %s: %s", request.PodName, err.Error()))
+		err = fmt.Errorf("Error starting pod deletion for %s: %w", request.PodName, err)
+		finished.Fail(err)
+		return response, err
 	}
-	// Attempt to call for deletion
-	err = deleter.DeletePod(finished)
+	// Attempt to call for deletion, letting the watch and delete jobs outlive the request
+	err = deleter.DeletePod(s.backgroundContext(s.GlobalConfig.TimeoutDelete, finished), finished)
 	if err != nil {
-		finished.Send(false)
+		finished.Fail(err)
 		return response, err
 	}
 	// If that was successful, the server should keep track that this pod is deleting
 	s.addToWatchMaps(
 		request.PodName,
-		watchMapEntry{readyChannel: finished, authCheck: request.UserID},
+		watchMapEntry{finished: finished, authCheck: request.UserID},
 		DeletingPods)
 
 	// Then if the user doesn't have remaining pods, call for deletion of their storage,
 	// If this fails, log the error, but don't tell the user, because at this point their pod will be deleted.
-	if !s.userHasRemainingPods(deleter.Pod.Owner) {
-		// Check whether the user's storage is already being deleted
-		s.mutex.Lock()
-		_, cleaningStorage := s.DeletingStorage[deleter.Pod.Owner.Name]
-		s.mutex.Unlock()
-		// If it's not already being deleted, then call for deletion
-		if !cleaningStorage {
-			cleanedStorage := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
-			err = deleter.Pod.Owner.DeleteUserStorage(cleanedStorage)
-			if err != nil {
-				fmt.Printf("Error: Couldn't call for deletion of user storage for %s: %s\n", deleter.Pod.Owner.UserID, err.Error())
-			} else {
-				s.addToWatchMaps(
-					deleter.Pod.Owner.Name,
-					watchMapEntry{readyChannel: cleanedStorage},
-					DeletingStorage)
-			}
-		}
-	}
+	s.deleteStorageIfUnused(ctx, deleter.Pod.Owner, time.Time{})
 
 	response.Requested = true
 	return response, nil
 }
 
+// Call for deletion of the user's storage if they don't have remaining pods and it isn't already being deleted.
+// started is when the deletion was first called for if it's being resumed, or zero.
+// Errors are only logged, since the pod deletions that call this have already succeeded.
+func (s *Server) deleteStorageIfUnused(ctx context.Context, user managed.User, started time.Time) {
+	if s.userHasRemainingPods(ctx, user) {
+		return
+	}
+	// Check whether the user's storage is already being deleted
+	s.mutex.Lock()
+	_, cleaningStorage := s.DeletingStorage[user.Name]
+	s.mutex.Unlock()
+	// If it's not already being deleted, then call for deletion
+	if cleaningStorage {
+		return
+	}
+	cleanedStorage := util.NewFuture(s.GlobalConfig.TimeoutDelete)
+	err := user.DeleteUserStorage(s.backgroundContext(s.GlobalConfig.TimeoutDelete, cleanedStorage), cleanedStorage)
+	if err != nil {
+		fmt.Printf("Error: Couldn't call for deletion of user storage for %s: %s\n", user.UserID, err.Error())
+		cleanedStorage.Fail(err)
+		return
+	}
+	s.addToWatchMaps(
+		user.Name,
+		watchMapEntry{finished: cleanedStorage, authCheck: user.UserID, started: started},
+		DeletingStorage)
+}
+
 func (s *Server) ServeDeletePod(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := requestID(w, r)
 	// Parse the POSTed request JSON and log the request
 	var request DeletePodRequest
-	decoder := json.NewDecoder(r.Body)
-	decoder.Decode(&request)
+	err := decodeRequest(r, &request)
 	request.RemoteIP = s.getRemoteIP(r)
-	fmt.Printf("deletePod request: %+v\n", request)
-
-	// Default to an error status and empty response
-	status := http.StatusBadRequest
-	var response DeletePodResponse
-	// If the input is valid
-	if validUserID(request.UserID) {
-		// Call for pod deletion
-		finished := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
-		r, err := s.deletePod(request, finished)
-		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-		} else {
-			// If the delete request was successful, set the response and status
-			status = http.StatusOK
-			response = r
-		}
+	fmt.Printf("deletePod request [%s]: %+v\n", id, request)
+	if err == nil {
+		err = checkUserID(request.UserID)
+	}
+	if err == nil {
+		err = s.checkAcceptingJobs()
+	}
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+
+	// Call for pod deletion
+	finished := util.NewFuture(s.GlobalConfig.TimeoutDelete)
+	response, err := s.deletePod(ctx, request, finished)
+	if err != nil {
+		writeError(w, id, err)
+		return
 	}
 
 	// write the response
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
+	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
 
 // Watch for the deletion of the pod with name `request.PodName`,
 // Return with `response.Deleted` false iff:
-// (the ready channel retuns false, or (there is no s.DeletingPods entry and the user owns a pod with that podName))
-func (s *Server) watchDeletePod(request WatchDeletePodRequest) (WatchDeletePodResponse, error) {
+// (the deletion failed, or (there is no s.DeletingPods entry and the user owns a pod with that podName))
+func (s *Server) watchDeletePod(ctx context.Context, request WatchDeletePodRequest) (WatchDeletePodResponse, error) {
 	// Default true, so that if there is no entry in `s.DeletingPods`, there's no difference between
 	// the pod not existing and the pod existing with a different owner than `request.UserID`
 	response := WatchDeletePodResponse{Deleted: true}
@@ -531,12 +699,22 @@ func (s *Server) watchDeletePod(request WatchDeletePodRequest) (WatchDeletePodRe
 				fmt.Sprintf("Requested userID %s does not match pod's owner %s", request.UserID, entry.authCheck),
 			)
 		}
-		response.Deleted = entry.readyChannel.Receive()
+		select {
+		case <-entry.finished.Done():
+		case <-ctx.Done():
+			return response, errors.New(fmt.Sprintf("Stopped watching deletion of pod %s: %s", request.PodName, ctx.Err().Error()))
+		}
+		// Only the owner gets this far, so it's safe to tell them why it failed
+		if err := entry.finished.Err(); err != nil {
+			response.Deleted = false
+			response.Reason = err.Error()
+			response.Diagnosis = managed.DiagnosisForError(err)
+		}
 		return response, nil
 	}
 
 	u := managed.NewUser(request.UserID, s.Client, s.GlobalConfig)
-	owned, err := u.OwnsPod(request.PodName)
+	owned, err := u.OwnsPod(ctx, request.PodName)
 	if err != nil {
 		return response, err
 	}
@@ -546,14 +724,16 @@ func (s *Server) watchDeletePod(request WatchDeletePodRequest) (WatchDeletePodRe
 }
 
 func (s *Server) ServeWatchDeletePod(w http.ResponseWriter, r *http.Request) {
+	id := requestID(w, r)
 	var request WatchDeletePodRequest
 	decoder := json.NewDecoder(r.Body)
 	decoder.Decode(&request)
-	fmt.Printf("watchDeletePod request %+v\n", request)
+	fmt.Printf("watchDeletePod request [%s]: %+v\n", id, request)
 
-	response, err := s.watchDeletePod(request)
+	// As in ServeWatchCreatePod, errors are only logged, so that they don't tell about pods the user doesn't own
+	response, err := s.watchDeletePod(r.Context(), request)
 	if err != nil {
-		fmt.Printf("Error while watching for pod deletion: %s\n", err.Error())
+		fmt.Printf("Error [%s] while watching for pod deletion: %s\n", id, err.Error())
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -561,15 +741,19 @@ func (s *Server) ServeWatchDeletePod(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func (s *Server) deleteAllUserPods(userID string, finished *util.ReadyChannel) error {
+// Call for deletion of all of the user's pods and storage.
+// ctx is only used for listing, since the deletions are tracked in the server's watch maps
+// and continue even if the request is cancelled.
+func (s *Server) deleteAllUserPods(ctx context.Context, userID string, finished *util.Future) error {
 	user := managed.NewUser(userID, s.Client, s.GlobalConfig)
 	// Get a list of managed.Pod objects for all of the user's pods
-	podList, err := user.ListPods()
+	podList, err := user.ListPods(ctx)
 	if err != nil {
+		finished.Fail(err)
 		return err
 	}
 
-	var chanList []*util.ReadyChannel
+	var deletions []*util.Future
 	// For each pod,
 	for _, pod := range podList {
 		// Check that it isn't already being deleted
@@ -582,74 +766,92 @@ func (s *Server) deleteAllUserPods(userID string, finished *util.ReadyChannel) e
 
 		// Then initialize a deleter and call for the pod's deletion
 		deleter := poddeleter.NewFromPod(pod)
-		ch := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
-		err := deleter.DeletePod(ch)
+		deleted := util.NewFuture(s.GlobalConfig.TimeoutDelete)
+		err := deleter.DeletePod(s.backgroundContext(s.GlobalConfig.TimeoutDelete, deleted), deleted)
 		// If something went wrong, log it
 		if err != nil {
 			fmt.Printf("Error calling deletion of pod %s: %s\n", pod.Object.Name, err.Error())
+			deleted.Fail(err)
 			continue
 		}
-		chanList = append(chanList, ch)
+		deletions = append(deletions, deleted)
 		// If the delete call was made successfully, then add the pod to `s.DeletingPods`,
 		s.addToWatchMaps(
 			pod.Object.Name,
-			watchMapEntry{readyChannel: ch, authCheck: userID},
+			watchMapEntry{finished: deleted, authCheck: userID},
 			DeletingPods)
 	}
 
 	// Finally, remove the user's storage PV and PVC
-	cleanedStorage := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
-	err = user.DeleteUserStorage(cleanedStorage)
+	cleanedStorage := util.NewFuture(s.GlobalConfig.TimeoutDelete)
+	err = user.DeleteUserStorage(s.backgroundContext(s.GlobalConfig.TimeoutDelete, cleanedStorage), cleanedStorage)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Couldn't call for deletion of user storage for %s: %s", userID, err.Error()))
+		err = fmt.Errorf("Couldn't call for deletion of user storage for %s: %w", userID, err)
+		cleanedStorage.Fail(err)
+		finished.Fail(err)
+		return err
 	}
 	s.addToWatchMaps(
 		user.Name,
-		watchMapEntry{readyChannel: cleanedStorage},
+		watchMapEntry{finished: cleanedStorage, authCheck: userID},
 		DeletingStorage)
-	chanList = append(chanList, cleanedStorage)
-	go util.CombineReadyChannels(chanList, finished)
+	deletions = append(deletions, cleanedStorage)
+	util.CombineFutures(deletions, finished)
 	return nil
 }
 
 func (s *Server) ServeDeleteAllUserPods(w http.ResponseWriter, r *http.Request) {
+	id := requestID(w, r)
 	// Parse the POSTed request JSON and log the request
 	var request DeleteAllPodsRequest
-	decoder := json.NewDecoder(r.Body)
-	decoder.Decode(&request)
+	err := decodeRequest(r, &request)
 	request.RemoteIP = s.getRemoteIP(r)
-	fmt.Printf("deleteAllUserPods request: %+v\n", request)
+	fmt.Printf("deleteAllUserPods request [%s]: %+v\n", id, request)
+	if err == nil {
+		err = checkUserID(request.UserID)
+	}
+	if err == nil {
+		err = s.checkAcceptingJobs()
+	}
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
 
-	// Default to an error status and empty response
-	status := http.StatusBadRequest
 	var response DeleteAllPodsResponse
-	if validUserID(request.UserID) {
-		// give a long enough timout that it will accommodate slowly deleting PV/PVC in worst case
-		finished := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete + 30*time.Second)
-		err := s.deleteAllUserPods(request.UserID, finished)
-		if err != nil {
-			response.Deleted = false
-			fmt.Printf("Error: %s\n", err.Error())
-		} else {
-			// if the request was made without error, set the status
-			status = http.StatusOK
-			// wait for the result, and set the response to whether all objects were deleted
-			response.Deleted = finished.Receive()
-		}
+	// give a long enough timout that it will accommodate slowly deleting PV/PVC in worst case
+	finished := util.NewFuture(s.GlobalConfig.TimeoutDelete + 30*time.Second)
+	err = s.deleteAllUserPods(r.Context(), request.UserID, finished)
+	if err != nil {
+		writeError(w, id, err)
+		return
 	}
+	// wait for the result, and set the response to whether all objects were deleted
+	select {
+	case <-finished.Done():
+	case <-r.Context().Done():
+		fmt.Printf("Stopped waiting for deletion of all pods of user %s: %s\n", request.UserID, r.Context().Err().Error())
+		return
+	}
+	response.Deleted = finished.Err() == nil
 
 	// write the response
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
+	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
 
-func (s *Server) cleanAllUnused(finished *util.ReadyChannel) error {
-	var taskChannelList []*util.ReadyChannel
+// Delete orphaned services, user storage and pod caches.
+// ctx is only used for listing, the deletions continue even if the request is cancelled.
+func (s *Server) cleanAllUnused(ctx context.Context, finished *util.Future) error {
+	var tasks []*util.Future
 
 	// Clean orphaned services.
+	// Services with an owner reference are garbage collected along with their pod,
+	// but those created before the backend set owner references only have the label.
 	// Find all the services that were created for a pod.
 	serviceList, err := s.Client.ListServices(
+		ctx,
 		metav1.ListOptions{LabelSelector: "createdForPod"},
 	)
 	if err != nil {
@@ -657,11 +859,13 @@ func (s *Server) cleanAllUnused(finished *util.ReadyChannel) error {
 	}
 	// For all of the services that belong to a pod,
 	for _, service := range serviceList.Items {
+		service := service
 		podName, exists := service.Labels["createdForPod"]
 		if !exists {
 			return errors.New(fmt.Sprintf("Service %s didn't have createdForPod label", service.Name))
 		}
 		podList, err := s.Client.ListPods(
+			ctx,
 			metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", podName)},
 		)
 		if err != nil {
@@ -669,24 +873,31 @@ func (s *Server) cleanAllUnused(finished *util.ReadyChannel) error {
 		}
 		// If the pod that the service was created for no longer exists, then delete the service
 		if len(podList.Items) == 0 {
-			ch := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
-			taskChannelList = append(taskChannelList, ch)
+			deleted := util.NewFuture(s.GlobalConfig.TimeoutDelete)
+			tasks = append(tasks, deleted)
+			deleteCtx := s.backgroundContext(s.GlobalConfig.TimeoutDelete, deleted)
 			// Make a watcher that will announce its deletion
 			go func() {
-				s.Client.WatchDeleteService(service.Name, ch)
-				if ch.Receive() {
+				s.Client.WatchDeleteService(deleteCtx, service.Name, deleted)
+				if err := deleted.Wait(); err == nil {
 					fmt.Printf("Deleted SVC %s\n", service.Name)
 				} else {
-					fmt.Printf("Warning: failed to delete SVC %s\n", service.Name)
+					fmt.Printf("Warning: failed to delete SVC %s: %s\n", service.Name, err.Error())
 				}
 			}()
-			s.Client.DeleteService(service.Name)
+			err := s.Client.DeleteService(deleteCtx, service.Name)
+			if k8sclient.IsNotFound(err) {
+				deleted.Succeed()
+			} else if err != nil {
+				fmt.Printf("Error: Couldn't delete SVC %s: %s\n", service.Name, err.Error())
+				deleted.Fail(err)
+			}
 		}
 	}
 
 	// Clean orphaned user storage.
 	// Check for all PVCs (not PVs!) because they are namespaced
-	pvcList, err := s.Client.ListPVC(metav1.ListOptions{})
+	pvcList, err := s.Client.ListPVC(ctx, metav1.ListOptions{})
 	if err != nil {
 		return err
 	}
@@ -695,18 +906,19 @@ func (s *Server) cleanAllUnused(finished *util.ReadyChannel) error {
 		// If the pvc is for user storage
 		if strings.Contains(pvc.Name, "user-storage") {
 			u := managed.NewUser(util.GetUserIDFromLabels(pvc.Labels), s.Client, s.GlobalConfig)
-			userPodList, err := u.ListPods()
+			userPodList, err := u.ListPods(ctx)
 			if err != nil {
 				return err
 			}
 			// If the user who owns this PVC doesn't have any pods, then delete the storage
 			if len(userPodList) == 0 {
-				ch := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
-				err := u.DeleteUserStorage(ch)
+				cleanedStorage := util.NewFuture(s.GlobalConfig.TimeoutDelete)
+				err := u.DeleteUserStorage(s.backgroundContext(s.GlobalConfig.TimeoutDelete, cleanedStorage), cleanedStorage)
 				if err != nil {
+					cleanedStorage.Fail(err)
 					return err
 				}
-				taskChannelList = append(taskChannelList, ch)
+				tasks = append(tasks, cleanedStorage)
 			}
 		}
 	}
@@ -723,7 +935,12 @@ func (s *Server) cleanAllUnused(finished *util.ReadyChannel) error {
 	}
 	// For each file in tokenDir, check if it belongs to a pod that doesn't exist
 	for _, fileName := range fileNames {
+		// Pod names can't start with a dot, so these are other files like the readiness check's
+		if strings.HasPrefix(fileName, ".") {
+			continue
+		}
 		podList, err := s.Client.ListPods(
+			ctx,
 			metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", fileName)},
 		)
 		if err != nil {
@@ -737,40 +954,52 @@ func (s *Server) cleanAllUnused(finished *util.ReadyChannel) error {
 			}
 		}
 	}
-	go util.CombineReadyChannels(taskChannelList, finished)
+	util.CombineFutures(tasks, finished)
 
 	return nil
 }
 
 func (s *Server) ServeCleanAllUnused(w http.ResponseWriter, r *http.Request) {
+	id := requestID(w, r)
 	remoteIP := s.getRemoteIP(r)
-	fmt.Printf("Clean all request from IP %s", remoteIP)
+	fmt.Printf("Clean all request [%s] from IP %s\n", id, remoteIP)
 	// Could limit this to a whitelisted IP range
+	err := s.checkAcceptingJobs()
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
 
-	finished := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete + 30*time.Second)
-	err := s.cleanAllUnused(finished)
-	status := http.StatusOK
+	finished := util.NewFuture(s.GlobalConfig.TimeoutDelete + 30*time.Second)
+	err = s.cleanAllUnused(r.Context(), finished)
 	if err != nil {
-		fmt.Printf("Error during cleanAllUnused: %s\n", err.Error())
-		status = http.StatusBadRequest
-	} else {
-		if !finished.Receive() {
-			fmt.Printf("Warning: cleanAllUnused didn't finish successfully\n")
-			status = http.StatusBadRequest
-		}
+		finished.Cancel()
+		writeError(w, id, fmt.Errorf("Error during cleanAllUnused: %w", err))
+		return
+	}
+	select {
+	case <-finished.Done():
+	case <-r.Context().Done():
+		fmt.Printf("Stopped waiting for cleanAllUnused: %s\n", r.Context().Err().Error())
+		return
+	}
+	if err := finished.Err(); err != nil {
+		fmt.Printf("cleanAllUnused didn't finish successfully: %s\n", err.Error())
+		writeError(w, id, k8sclient.NewError(k8sclient.ReasonUnavailable, "cleanAllUnused didn't finish successfully"))
+		return
 	}
 
 	// write the response
-	w.WriteHeader(status)
+	w.WriteHeader(http.StatusOK)
 }
 
-func (s *Server) getPodIPOwner(request GetPodIPOwnerRequest) string {
+func (s *Server) getPodIPOwner(ctx context.Context, request GetPodIPOwnerRequest) string {
 	listOptions := metav1.ListOptions{FieldSelector: fmt.Sprintf("status.podIP=%s", request.PodIP)}
 	// Try every 0.5s up to 4.5s
 	// With an ubuntu image in the testcluster, this works after ~0.7s, so 4.5s should be sufficient
 	// while still less than the default timeout of cURL
 	for i := 0; i < 9; i++ {
-		podList, err := s.Client.ListPods(listOptions)
+		podList, err := s.Client.ListPods(ctx, listOptions)
 		if err != nil {
 			fmt.Printf("Error listing pods for getPodIPOwner, requested IP %s: %s", request.PodIP, err.Error())
 			return ""
@@ -778,42 +1007,44 @@ func (s *Server) getPodIPOwner(request GetPodIPOwnerRequest) string {
 		if len(podList.Items) > 0 {
 			return util.GetUserIDFromLabels(podList.Items[0].Labels)
 		}
-		time.Sleep(500 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			return ""
+		case <-time.After(500 * time.Millisecond):
+		}
 	}
 	return ""
 }
 
 func (s *Server) ServeGetPodIPOwner(w http.ResponseWriter, r *http.Request) {
+	id := requestID(w, r)
 	remoteIP := s.getRemoteIP(r)
 	ipList, has := r.URL.Query()["ip"]
 	if !has {
-		fmt.Printf("Warning: getPodIPOwner request from %s without specified IP\n", remoteIP)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, id, invalidRequestError(fmt.Sprintf("getPodIPOwner request from %s without specified IP", remoteIP)))
 		return
 	}
 	ip := ipList[0]
 	parsedIP := net.ParseIP(ip)
 	if parsedIP == nil {
-		fmt.Printf("Warning: getPodIPOwner request from %s with invalid IP %s\n", remoteIP, ip)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, id, invalidRequestError(fmt.Sprintf("getPodIPOwner request from %s with invalid IP %s", remoteIP, ip)))
 		return
 	}
 	if !s.GlobalConfig.PodSubnet.Contains(parsedIP) {
-		fmt.Printf("Warning: getPodIPOwner request from %s with IP outside pod subnet %s\n", remoteIP, ip)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, id, invalidRequestError(fmt.Sprintf("getPodIPOwner request from %s with IP outside pod subnet %s", remoteIP, ip)))
 		return
 	}
 	request := GetPodIPOwnerRequest{
 		RemoteIP: remoteIP,
 		PodIP:    ip,
 	}
-	userID := s.getPodIPOwner(request)
+	userID := s.getPodIPOwner(r.Context(), request)
 	fmt.Printf("getPodIPOwner request %+v, owned by %s\n", request, userID)
 	fmt.Fprintf(w, userID)
 }
 
-func (s *Server) ReloadPodCaches() error {
-	allPodList, err := s.Client.ListPods(metav1.ListOptions{})
+func (s *Server) ReloadPodCaches(ctx context.Context) error {
+	allPodList, err := s.Client.ListPods(ctx, metav1.ListOptions{})
 	if err != nil {
 		return errors.New(fmt.Sprintf("Couldn't list pods: %s", err.Error()))
 	}
@@ -824,10 +1055,11 @@ func (s *Server) ReloadPodCaches() error {
 			continue
 		}
 		pod := managed.NewPod(&podObject, s.Client, s.GlobalConfig)
-		err := pod.CreateAndSavePodCache(true)
+		err := pod.CreateAndSavePodCache(ctx, true)
 		if err != nil {
 			return errors.New(fmt.Sprintf("Failed to save podcache for pod %s: %s", podObject.Name, err.Error()))
 		}
 	}
+	s.setPodCachesLoaded()
 	return nil
 }
@@ -1,47 +1,56 @@
 package server
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
-	"regexp"
+	"path"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/deic.dk/user_pods_k8s_backend/auth"
 	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
 	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
+	"github.com/deic.dk/user_pods_k8s_backend/podcreator"
 	"github.com/deic.dk/user_pods_k8s_backend/testingutil"
 	"github.com/deic.dk/user_pods_k8s_backend/util"
 	"go.uber.org/goleak"
+	"golang.org/x/net/websocket"
 	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
 )
 
-func echoEnvVarInPod(pod managed.Pod, envVar string) (string, string, error) {
-	var stdout, stderr bytes.Buffer
-	var err error
-	stdout, stderr, err = pod.Client.PodExec([]string{"sh", "-c", fmt.Sprintf("echo %s", envVar)}, pod.Object, 0)
-	errBytes := stderr.Bytes()
-	if err != nil {
-		return "", string(errBytes), err
-	}
-	outBytes := stdout.Bytes()
-	return string(outBytes), string(errBytes), nil
-}
-
 func userPVAndPVCExist(u managed.User) (bool, error) {
-	pvList, err := u.Client.ListPV(u.GetStorageListOptions())
+	pvList, err := u.Client.ListPV(context.Background(), u.GetStorageListOptions())
 	if err != nil {
 		return false, err
 	}
 	if len(pvList.Items) != 1 {
 		return false, nil
 	}
-	pvcList, err := u.Client.ListPVC(u.GetStorageListOptions())
+	pvcList, err := u.Client.ListPVC(context.Background(), u.GetStorageListOptions())
 	if err != nil {
 		return false, err
 	}
@@ -52,14 +61,14 @@ func userPVAndPVCExist(u managed.User) (bool, error) {
 }
 
 func userPVOrPVCExist(u managed.User) (bool, error) {
-	pvList, err := u.Client.ListPV(u.GetStorageListOptions())
+	pvList, err := u.Client.ListPV(context.Background(), u.GetStorageListOptions())
 	if err != nil {
 		return false, err
 	}
 	if len(pvList.Items) > 0 {
 		return true, nil
 	}
-	pvcList, err := u.Client.ListPVC(u.GetStorageListOptions())
+	pvcList, err := u.Client.ListPVC(context.Background(), u.GetStorageListOptions())
 	if err != nil {
 		return false, err
 	}
@@ -69,34 +78,6 @@ func userPVOrPVCExist(u managed.User) (bool, error) {
 	return false, nil
 }
 
-func exampleSshService(podName string) *apiv1.Service {
-	return &apiv1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: fmt.Sprintf("%s-ssh", podName),
-			Labels: map[string]string{
-				"createdForPod": podName,
-			},
-		},
-		Spec: apiv1.ServiceSpec{
-			Ports: []apiv1.ServicePort{
-				{
-					Name:       "ssh",
-					Protocol:   apiv1.ProtocolTCP,
-					Port:       22,
-					TargetPort: intstr.FromInt(22),
-				},
-			},
-			Type: apiv1.ServiceTypeNodePort,
-		},
-	}
-}
-
-func newServer() *Server {
-	config := util.MustLoadGlobalConfig()
-	client := k8sclient.NewK8sClient(config)
-	return New(client, config)
-}
-
 func dummyHttpRequest(forwarded string, remoteAddr string) *http.Request {
 	request := &http.Request{}
 	request.Header = make(map[string][]string)
@@ -107,8 +88,62 @@ func dummyHttpRequest(forwarded string, remoteAddr string) *http.Request {
 	return request
 }
 
+// Return the config for a test with the fake client, whose pod caches are kept in a temporary directory
+func fakeConfig(t *testing.T) util.GlobalConfig {
+	config := util.MustLoadGlobalConfig()
+	config.PodCacheDir = t.TempDir()
+	return config
+}
+
+// Return a server with a fake client whose cluster already contains objects.
+// The server's background jobs and the client are stopped when the test ends.
+func newFakeServer(t *testing.T, config util.GlobalConfig, objects ...runtime.Object) (*Server, *k8sclient.FakeK8sClient) {
+	client := k8sclient.NewFakeK8sClient(config, objects...)
+	s := New(client, config)
+	t.Cleanup(func() {
+		s.cancelBase()
+		client.Stop()
+	})
+	return s, client
+}
+
+// Return an ExecFunc for the fake client that answers every command in a pod with stdout(pod),
+// e.g. the token that the start jobs copy
+func fakeExec(stdout func(pod *apiv1.Pod) string) func(context.Context, []string, *apiv1.Pod, int) (bytes.Buffer, bytes.Buffer, error) {
+	return func(ctx context.Context, command []string, pod *apiv1.Pod, nContainer int) (bytes.Buffer, bytes.Buffer, error) {
+		var output, stderr bytes.Buffer
+		output.WriteString(stdout(pod))
+		return output, stderr, nil
+	}
+}
+
+// Return a pod of the test user that needs an ssh service and an ingress, like one created from FakePodManifest
+func fakeUserPod(config util.GlobalConfig, name string, ready bool) *apiv1.Pod {
+	user, domain, _ := strings.Cut(config.TestUser, "@")
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   config.Namespace,
+			UID:         types.UID(name + "-uid"),
+			Labels:      map[string]string{"user": user, "domain": domain},
+			Annotations: map[string]string{"sciencedata.dk/ingress-port": "8888"},
+		},
+		Spec: apiv1.PodSpec{Containers: []apiv1.Container{{
+			Name:  "fake",
+			Image: "fake",
+			Ports: []apiv1.ContainerPort{{ContainerPort: 22}, {ContainerPort: 8888}},
+		}}},
+		Status: apiv1.PodStatus{Phase: apiv1.PodPending},
+	}
+	if ready {
+		pod.Status.Phase = apiv1.PodRunning
+		pod.Status.Conditions = []apiv1.PodCondition{{Type: apiv1.PodReady, Status: apiv1.ConditionTrue}}
+	}
+	return pod
+}
+
 func TestRemoteIP(t *testing.T) {
-	s := newServer()
+	s, _ := newFakeServer(t, fakeConfig(t))
 	tests := []struct {
 		input  *http.Request
 		output string
@@ -137,826 +172,1514 @@ func TestRemoteIP(t *testing.T) {
 	}
 }
 
-func TestDeleteAllUserPods(t *testing.T) {
-	s := newServer()
-	// First ensure that the user has at least 2 pods to delete
-	err := testingutil.EnsureUserHasNPods(s.GlobalConfig.TestUser, 2)
+func TestFakeLifecycle(t *testing.T) {
+	manifestServer, config := testingutil.ServeManifest(testingutil.FakePodManifest, fakeConfig(t))
+	defer manifestServer.Close()
+	s, client := newFakeServer(t, config)
+	client.ExecFunc = fakeExec(func(*apiv1.Pod) string { return "faketoken" })
+	u := managed.NewUser(config.TestUser, s.Client, s.GlobalConfig)
+
+	// Create the pod and wait for the start jobs
+	createRequest := CreatePodRequest{
+		YamlURL:  fmt.Sprintf("%s/fake.yaml", manifestServer.URL),
+		UserID:   config.TestUser,
+		RemoteIP: config.TestingHost,
+	}
+	created := util.NewFuture(config.TimeoutCreate)
+	createResponse, err := s.createPod(context.Background(), createRequest, created)
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatal(err.Error())
+	}
+	if created.Wait() != nil {
+		t.Fatalf("Pod %s didn't finish start jobs", createResponse.PodName)
 	}
 
-	// Make sure the user storage exists
-	u := managed.NewUser(s.GlobalConfig.TestUser, s.Client, s.GlobalConfig)
+	// Check that the storage and the start jobs' resources exist
 	storageExists, err := userPVAndPVCExist(u)
 	if err != nil {
-		t.Fatalf("Couldn't check storage exists: %s", err.Error())
+		t.Fatal(err.Error())
 	}
 	if !storageExists {
-		t.Fatal("User storage doesn't exist when it should")
+		t.Fatal("User storage wasn't created")
 	}
-
-	t.Logf("User has at least two pods and their storage PV and PVC exist. Attempting deleteAllUserPods")
-
-	// Now call delete all Pods and ensure that it works
-	deleteAllRequest := DeleteAllPodsRequest{UserID: s.GlobalConfig.TestUser}
-	finished := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete + 30*time.Second)
-	err = s.deleteAllUserPods(deleteAllRequest.UserID, finished)
+	podList, err := u.ListPods(context.Background())
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-
-	// Make sure they were all deleted successfully
-	if finished.Receive() {
-		t.Log("Deleted all user pods and storage successfully")
-	} else {
-		t.Fatal("Failed to delete all user pods and storage")
+	if len(podList) != 1 || podList[0].Object.Name != createResponse.PodName {
+		t.Fatalf("User should have exactly the pod %s", createResponse.PodName)
 	}
-	// Now that they're finished, s.DeletingPods should be empty
-	s.mutex.Lock()
-	for key, _ := range s.DeletingPods {
-		t.Fatalf("key %s still exists in DeletingPods map after all pods were finished deleting", key)
+	pod := podList[0]
+	serviceList, err := pod.ListServices(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(serviceList.Items) != 2 {
+		t.Fatalf("Pod %s should have an ssh and an http service, but has %d services", pod.Object.Name, len(serviceList.Items))
+	}
+	ingressList, err := pod.ListIngresses(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(ingressList.Items) != 1 {
+		t.Fatalf("Pod %s should have 1 ingress, but has %d", pod.Object.Name, len(ingressList.Items))
+	}
+	info := pod.GetPodInfo()
+	if info.Tokens["token"] != "faketoken" {
+		t.Fatalf("Pod %s has token %s in its podInfo, should be faketoken", pod.Object.Name, info.Tokens["token"])
+	}
+	if info.SshUrl == "" {
+		t.Fatalf("Pod %s doesn't have an ssh url", pod.Object.Name)
 	}
-	s.mutex.Unlock()
 
-	// Make sure that the test user has no remaining pods
-	podList, err := u.ListPods()
+	// Delete the pod and wait for the delete jobs
+	deleted := util.NewFuture(config.TimeoutDelete)
+	_, err = s.deletePod(context.Background(), DeletePodRequest{PodName: pod.Object.Name, UserID: config.TestUser}, deleted)
 	if err != nil {
-		t.Fatalf("Couldn't list pods: %s", err.Error())
+		t.Fatal(err.Error())
+	}
+	if deleted.Wait() != nil {
+		t.Fatalf("Pod %s didn't finish deleting", pod.Object.Name)
+	}
+	podList, err = u.ListPods(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
 	}
 	if len(podList) != 0 {
-		var podNameList []string
-		for _, pod := range podList {
-			podNameList = append(podNameList, pod.Object.Name)
-		}
-		podNames := strings.Join(podNameList, ", ")
-		t.Fatalf("All of the user's pods should have been deleted, but %s remain", podNames)
+		t.Fatalf("User still has %d pods after deletion", len(podList))
+	}
+	serviceList, err = pod.ListServices(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(serviceList.Items) != 0 {
+		t.Fatalf("Pod %s still has services after deletion", pod.Object.Name)
 	}
 
-	// Make sure the user storage no longer exists
+	// Since that was the user's last pod, their storage should be deleted too
+	s.mutex.Lock()
+	entry, cleaningStorage := s.DeletingStorage[u.Name]
+	s.mutex.Unlock()
+	if cleaningStorage && entry.finished.Wait() != nil {
+		t.Fatal("User storage wasn't deleted")
+	}
 	storageExists, err = userPVOrPVCExist(u)
 	if err != nil {
-		t.Fatalf("Couldn't check storage exists: %s", err.Error())
+		t.Fatal(err.Error())
 	}
 	if storageExists {
-		t.Fatal("User storage does exist when it shouldn't")
+		t.Fatal("User storage still exists after deleting the user's last pod")
 	}
+}
 
-	// Make sure that there are no pod caches left for pods the user previously owned
-	dir, err := os.Open(s.GlobalConfig.PodCacheDir)
-	if err != nil {
-		t.Fatalf("Couldn't open token directory: %s", err.Error())
+func TestFakeWatchCreateCancel(t *testing.T) {
+	manifestServer, config := testingutil.ServeManifest(testingutil.FakePodManifest, fakeConfig(t))
+	defer manifestServer.Close()
+	s, client := newFakeServer(t, config)
+	// Keep the pod from becoming ready during the test
+	client.EventDelay = config.TimeoutCreate
+
+	createRequest := CreatePodRequest{
+		YamlURL:  fmt.Sprintf("%s/fake.yaml", manifestServer.URL),
+		UserID:   config.TestUser,
+		RemoteIP: config.TestingHost,
 	}
-	fileNames, err := dir.Readdirnames(0)
+	created := util.NewFuture(config.TimeoutCreate)
+	createResponse, err := s.createPod(context.Background(), createRequest, created)
 	if err != nil {
-		t.Fatalf("Couldn't read file names from token directory: %s", err.Error())
+		t.Fatal(err.Error())
 	}
-	searchExp := regexp.MustCompile(u.GetUserString())
-	for _, name := range fileNames {
-		if searchExp.MatchString(name) {
-			t.Fatalf("File %s exists and should have been cleaned by deleteAllUserPods", name)
-		}
+
+	// A watch_create_pod request that is cancelled should return right away
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	response, err := s.watchCreatePod(ctx, WatchCreatePodRequest{PodName: createResponse.PodName, UserID: config.TestUser})
+	if err == nil {
+		t.Fatal("Cancelled watchCreatePod should return an error")
+	}
+	if response.Ready {
+		t.Fatal("Cancelled watchCreatePod returned ready")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("watchCreatePod took %s to return after its request was cancelled", time.Since(start))
+	}
+	// Cancelling the watch request mustn't cancel the creation itself
+	s.mutex.Lock()
+	_, creating := s.CreatingPods[createResponse.PodName]
+	s.mutex.Unlock()
+	if !creating {
+		t.Fatalf("Pod %s stopped creating when a watch request was cancelled", createResponse.PodName)
 	}
-	t.Logf("All user pods were deleted, there are no pod caches matching the username, and the PV and PVC were deleted")
+
+	// Stop the creation, which would otherwise run until timeoutCreate
+	stopNow, stop := context.WithCancel(context.Background())
+	stop()
+	s.Shutdown(stopNow)
+	created.Wait()
 }
 
-func TestStandardPodCreation(t *testing.T) {
-	s := newServer()
-	// Double check that the user doesn't have any pods
-	u := managed.NewUser(s.GlobalConfig.TestUser, s.Client, s.GlobalConfig)
-	podList, err := u.ListPods()
-	if err != nil {
-		t.Fatal(err.Error())
+func TestFakeErrorResponses(t *testing.T) {
+	config := fakeConfig(t)
+	otherUsersPod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "otheruserspod",
+			Namespace: config.Namespace,
+			Labels:    map[string]string{"user": "otheruser"},
+		},
+		Spec: apiv1.PodSpec{Containers: []apiv1.Container{{Name: "fake", Image: "fake"}}},
 	}
-	// If there are some remaining, then call deleteAllUserPods
-	if len(podList) != 0 {
-		deleteAllRequest := DeleteAllPodsRequest{UserID: s.GlobalConfig.TestUser}
-		finished := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete + 30*time.Second)
-		err = s.deleteAllUserPods(deleteAllRequest.UserID, finished)
+	s, _ := newFakeServer(t, config, otherUsersPod)
+	s.addToWatchMaps("deleting", watchMapEntry{finished: util.NewFuture(time.Second), authCheck: config.TestUser}, DeletingPods)
+
+	tests := []struct {
+		description string
+		body        string
+		status      int
+		code        string
+	}{
+		{"invalid json", `{"user_id": `, http.StatusBadRequest, CodeInvalidRequest},
+		{"invalid user_id", `{"user_id": "-", "pod_name": "foo"}`, http.StatusBadRequest, CodeInvalidRequest},
+		{"pod that doesn't exist", fmt.Sprintf(`{"user_id": "%s", "pod_name": "doesnotexist"}`, config.TestUser), http.StatusNotFound, CodeNotFound},
+		{"pod owned by another user", fmt.Sprintf(`{"user_id": "%s", "pod_name": "otheruserspod"}`, config.TestUser), http.StatusNotFound, CodeNotFound},
+		{"pod that is already being deleted", fmt.Sprintf(`{"user_id": "%s", "pod_name": "deleting"}`, config.TestUser), http.StatusConflict, CodeConflict},
+	}
+	var notFoundMessages []string
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "/delete_pod", strings.NewReader(test.body))
+		request.Header.Set("X-Request-ID", "test-request")
+		recorder := httptest.NewRecorder()
+		s.ServeDeletePod(recorder, request)
+		if recorder.Code != test.status {
+			t.Fatalf("Deleting %s gave status %d instead of %d", test.description, recorder.Code, test.status)
+		}
+		var response ErrorResponse
+		err := json.NewDecoder(recorder.Body).Decode(&response)
 		if err != nil {
-			t.Fatal(err.Error())
+			t.Fatalf("Couldn't decode error response for %s: %s", test.description, err.Error())
+		}
+		if response.Error.Code != test.code || response.Error.RequestID != "test-request" {
+			t.Fatalf("Deleting %s gave error response %+v", test.description, response)
 		}
-		// Make sure they were all deleted successfully
-		if finished.Receive() {
-			t.Log("Deleted all user pods and storage successfully")
-		} else {
-			t.Fatal("Failed to delete all user pods and storage")
+		if recorder.Header().Get("X-Request-ID") != "test-request" {
+			t.Fatalf("Response to deleting %s doesn't have the request ID header", test.description)
 		}
+		if test.code == CodeNotFound {
+			notFoundMessages = append(notFoundMessages, strings.ReplaceAll(response.Error.Message, "otheruserspod", "doesnotexist"))
+		}
+	}
+	// A pod owned by another user must be indistinguishable from one that doesn't exist
+	if notFoundMessages[0] != notFoundMessages[1] {
+		t.Fatalf("Error messages tell pods owned by other users apart: %s and %s", notFoundMessages[0], notFoundMessages[1])
 	}
 
-	// For each of the default requests, try to create and watch two pods through the server's functions
-	defaultRequests := testingutil.GetStandardPodRequests()
-	for _, request := range defaultRequests {
-		for i := 0; i < 2; i++ {
-			createRequest := CreatePodRequest{
-				YamlURL:          request.YamlURL,
-				UserID:           request.UserID,
-				ContainerEnvVars: request.Settings,
-				RemoteIP:         s.GlobalConfig.TestingHost,
-			}
-			finished := util.NewReadyChannel(s.GlobalConfig.TimeoutCreate)
-			createResponse, err := s.createPod(createRequest, finished)
-			podName := createResponse.PodName
+	// The watch endpoints still answer with 200 and the default response
+	request := httptest.NewRequest("POST", "/watch_create_pod", strings.NewReader(fmt.Sprintf(`{"user_id": "%s", "pod_name": "otheruserspod"}`, config.TestUser)))
+	recorder := httptest.NewRecorder()
+	s.ServeWatchCreatePod(recorder, request)
+	var watchResponse WatchCreatePodResponse
+	err := json.NewDecoder(recorder.Body).Decode(&watchResponse)
+	if err != nil || recorder.Code != http.StatusOK || watchResponse.Ready {
+		t.Fatalf("watch_create_pod for another user's pod gave status %d and %+v", recorder.Code, watchResponse)
+	}
+}
+
+func TestFakeAuthentication(t *testing.T) {
+	config := fakeConfig(t)
+	config.AuthKeyDir = t.TempDir()
+	silo := config.HostnameList[0]
+	keys := map[string]string{silo.Hostname: "silo-key-0123456789", auth.AdminKeyID: "admin-key-0123456789"}
+	for keyID, key := range keys {
+		err := os.WriteFile(fmt.Sprintf("%s/%s", config.AuthKeyDir, keyID), []byte(key), 0600)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	s, _ := newFakeServer(t, config)
+
+	var remoteIP string
+	siloHandler := s.SiloOnly(func(w http.ResponseWriter, r *http.Request) {
+		remoteIP = s.getRemoteIP(r)
+	})
+	adminHandler := s.AdminOnly(func(w http.ResponseWriter, r *http.Request) {})
+	newRequest := func(keyID string) *http.Request {
+		body := []byte(`{}`)
+		request := httptest.NewRequest("POST", "/test", bytes.NewReader(body))
+		// A silo's signed request mustn't be able to claim another silo's address
+		request.Header.Set("X-Forwarded-For", "10.0.0.99")
+		if keyID != "" {
+			err := auth.Sign(request, body, keyID, []byte(keys[keyID]))
 			if err != nil {
 				t.Fatal(err.Error())
 			}
+		}
+		return request
+	}
 
-			// There should be an entry in CreatingPods until this finishes
-			// Check by making a channel to receive from finished.Receive() for the select statement
-			// so that if finished.Receive() returns before the select statement is reached, the default won't run.
-			ch := make(chan bool, 1)
-			go func() { ch <- finished.Receive() }()
-			select {
-			case <-ch:
-				t.Logf("Pod %s was already created successfully before the CreatingPods entry could be checked", podName)
-			default:
-				s.mutex.Lock()
-				_, exists := s.CreatingPods[podName]
-				s.mutex.Unlock()
-				if !exists {
-					t.Fatalf("CreatingPods entry was absent for pod %s", podName)
-				}
-			}
+	tests := []struct {
+		description string
+		handler     http.HandlerFunc
+		keyID       string
+		status      int
+	}{
+		{"unsigned request", siloHandler, "", http.StatusUnauthorized},
+		{"silo request", siloHandler, silo.Hostname, http.StatusOK},
+		{"admin request to a silo endpoint", siloHandler, auth.AdminKeyID, http.StatusOK},
+		{"silo request to an admin endpoint", adminHandler, silo.Hostname, http.StatusForbidden},
+		{"admin request", adminHandler, auth.AdminKeyID, http.StatusOK},
+	}
+	for _, test := range tests {
+		remoteIP = ""
+		recorder := httptest.NewRecorder()
+		test.handler(recorder, newRequest(test.keyID))
+		if recorder.Code != test.status {
+			t.Fatalf("%s gave status %d instead of %d", test.description, recorder.Code, test.status)
+		}
+		if test.keyID == silo.Hostname && test.status == http.StatusOK && remoteIP != silo.Address {
+			t.Fatalf("%s had remote IP %s instead of the silo's address %s", test.description, remoteIP, silo.Address)
+		}
+	}
+}
 
-			// Test watchCreatePod
-			watchRequest := WatchCreatePodRequest{
-				PodName: podName,
-				UserID:  request.UserID,
-			}
-			response, err := s.watchCreatePod(watchRequest)
-			if err != nil {
-				t.Fatalf("Error while watching for pod %s creation: %s", podName, err.Error())
+func TestFakeAuthRequired(t *testing.T) {
+	config := util.MustLoadGlobalConfig()
+	if !config.AuthDisabled {
+		t.Fatal("BACKEND_AUTHDISABLED didn't set authDisabled")
+	}
+	config.AuthKeyDir = ""
+	config.AuthDisabled = false
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Server started without authKeyDir or authDisabled")
+		}
+	}()
+	newVerifier(config)
+}
+
+func TestFakePodEventStream(t *testing.T) {
+	manifestServer, config := testingutil.ServeManifest(testingutil.FakePodManifest, fakeConfig(t))
+	defer manifestServer.Close()
+	s, client := newFakeServer(t, config)
+	client.ExecFunc = fakeExec(func(*apiv1.Pod) string { return "faketoken" })
+	streamServer := httptest.NewServer(http.HandlerFunc(s.ServeStreamPodEvents))
+	defer streamServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body := fmt.Sprintf(`{"user_id": "%s"}`, config.TestUser)
+	request, err := http.NewRequestWithContext(ctx, "POST", streamServer.URL, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Stream responded with status %d and content type %s", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+	events := make(chan PodEvent)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
 			}
-			if response.Ready != finished.Receive() {
-				t.Fatalf("watchCreatePod response for pod %s is %t while the ready channel got %t", podName, response.Ready, finished.Receive())
+			var event PodEvent
+			if json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event) == nil {
+				events <- event
 			}
-			// Make sure the CreatingPods entry is now empty
-			time.Sleep(time.Second)
-			s.mutex.Lock()
-			_, entryStillExists := s.CreatingPods[podName]
-			s.mutex.Unlock()
-			if entryStillExists {
-				t.Fatalf("CreatingPods entry for pod %s still exists after creation finished", podName)
+		}
+	}()
+	// Wait for the given event of the pod, ignoring others
+	waitFor := func(podName string, expected string) {
+		timeout := time.After(config.TimeoutCreate)
+		for {
+			select {
+			case event, open := <-events:
+				if !open {
+					t.Fatalf("Stream closed before %s", expected)
+				}
+				if event.Event == EventFailed {
+					t.Fatalf("Pod %s failed: %s", event.PodName, event.Reason)
+				}
+				if event.PodName == podName && event.Event == expected {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("Didn't get %s event for pod %s", expected, podName)
 			}
 		}
 	}
-}
-
-func TestGetPods(t *testing.T) {
-	s := newServer()
-	u := managed.NewUser(s.GlobalConfig.TestUser, s.Client, s.GlobalConfig)
 
-	// Make sure the user has at least two of each of the standard pods
-	err := testingutil.EnsureUserHasNPods(s.GlobalConfig.TestUser, 2*len(testingutil.GetStandardPodRequests()))
+	createRequest := CreatePodRequest{
+		YamlURL:  fmt.Sprintf("%s/fake.yaml", manifestServer.URL),
+		UserID:   config.TestUser,
+		RemoteIP: config.TestingHost,
+	}
+	created := util.NewFuture(config.TimeoutCreate)
+	createResponse, err := s.createPod(context.Background(), createRequest, created)
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatal(err.Error())
+	}
+	podName := createResponse.PodName
+	for _, expected := range []string{EventCreating, EventReady, EventStartJobsDone} {
+		waitFor(podName, expected)
 	}
 
-	// Now call getPods
-	request := GetPodsRequest{UserID: s.GlobalConfig.TestUser, RemoteIP: s.GlobalConfig.TestingHost}
-	response, err := s.getPods(request)
+	deleted := util.NewFuture(config.TimeoutDelete)
+	_, err = s.deletePod(context.Background(), DeletePodRequest{PodName: podName, UserID: config.TestUser}, deleted)
 	if err != nil {
-		t.Fatalf("getPods failed %s", err.Error())
+		t.Fatal(err.Error())
 	}
-	// List the pods
-	userPodList, err := u.ListPods()
-	if err != nil {
-		t.Fatalf("Couldn't list user pods %s", err.Error())
+	for _, expected := range []string{EventDeleting, EventDeleted} {
+		waitFor(podName, expected)
 	}
+	deleted.Wait()
+}
 
-	// For each listed pod, ensure that it's present in the response
-	if len(userPodList) != len(response) {
-		t.Fatalf("%d pods were listed by the kubernetes API while %d pods are described by getPods", len(userPodList), len(response))
-	}
-	for _, existingPod := range userPodList {
-		var entry managed.PodInfo
-		for _, describedPod := range response {
-			if describedPod.PodName == existingPod.Object.Name {
-				entry = describedPod
-				break
-			}
+func TestFakeWatchMapMetrics(t *testing.T) {
+	config := fakeConfig(t)
+	s, _ := newFakeServer(t, config)
+
+	outcomes := []string{metrics.OutcomeSuccess, metrics.OutcomeFailed, metrics.OutcomeTimeout}
+	before := make(map[string]float64)
+	for _, outcome := range outcomes {
+		before[outcome] = metrics.PodCreations.Value(outcome)
+	}
+	// Hold the finished signals back until the watch map's size has been checked
+	succeeded := util.NewFuture(config.TimeoutCreate)
+	failed := util.NewFuture(config.TimeoutCreate)
+	timedOut := util.NewFuture(100 * time.Millisecond)
+	s.addToWatchMaps("succeeded", watchMapEntry{finished: succeeded, authCheck: config.TestUser}, CreatingPods)
+	s.addToWatchMaps("failed", watchMapEntry{finished: failed, authCheck: config.TestUser}, CreatingPods)
+	s.addToWatchMaps("timed-out", watchMapEntry{finished: timedOut, authCheck: config.TestUser}, CreatingPods)
+	if size := metrics.WatchMapSize.Value("creating_pods"); size != 3 {
+		t.Fatalf("CreatingPods size metric was %v instead of 3", size)
+	}
+	succeeded.Succeed()
+	failed.Fail(errors.New("Start jobs failed"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mutex.Lock()
+		remaining := len(s.CreatingPods)
+		s.mutex.Unlock()
+		if remaining == 0 {
+			break
 		}
-		if entry.PodName == "" {
-			t.Fatalf("Pod %s wasn't listed in the getPods response", existingPod.Object.Name)
+		if time.Now().After(deadline) {
+			t.Fatalf("%d entries were never removed from CreatingPods", remaining)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if size := metrics.WatchMapSize.Value("creating_pods"); size != 0 {
+		t.Fatalf("CreatingPods size metric was %v after all entries were removed", size)
+	}
+	for _, outcome := range outcomes {
+		if counted := metrics.PodCreations.Value(outcome) - before[outcome]; counted != 1 {
+			t.Fatalf("Counted %v pod creations with outcome %s instead of 1", counted, outcome)
 		}
 	}
 }
 
-func TestDeletePod(t *testing.T) {
-	s := newServer()
-	u := managed.NewUser(s.GlobalConfig.TestUser, s.Client, s.GlobalConfig)
+func TestFakeReadiness(t *testing.T) {
+	config := fakeConfig(t)
+	s, client := newFakeServer(t, config)
 
-	err := testingutil.EnsureUserHasNPods(s.GlobalConfig.TestUser, 2*len(testingutil.GetStandardPodRequests()))
+	// Not ready until the pod caches are loaded
+	response := s.readyz(context.Background())
+	if response.Ready || response.Checks["podCaches"] == "ok" {
+		t.Fatalf("Ready before loading pod caches: %+v", response.Checks)
+	}
+	err := s.ReloadPodCaches(context.Background())
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatal(err.Error())
 	}
-
-	// Now there should be at least two pods. Pick the first one to delete
-	userPodList, err := u.ListPods()
+	response = s.readyz(context.Background())
+	if !response.Ready {
+		t.Fatalf("Not ready after loading pod caches: %+v", response.Checks)
+	}
+	// The readiness check's file mustn't be left behind in PodCacheDir
+	files, err := ioutil.ReadDir(config.PodCacheDir)
 	if err != nil {
-		t.Fatalf("Couldn't list user pods %s", err.Error())
+		t.Fatal(err.Error())
 	}
-	if len(userPodList) < 2 {
-		t.Fatal("User should have at least 2 pods but doesn't")
+	if len(files) != 0 {
+		t.Fatalf("%d files were left in PodCacheDir", len(files))
 	}
-	podName := userPodList[0].Object.Name
 
-	// Attempt to delete with a mismatched podName and userID
-	t.Logf("Attempting to delete a pod not owned by the user")
-	deleteRequest := DeletePodRequest{
-		UserID:   fmt.Sprintf("%s-extrastring", s.GlobalConfig.TestUser),
-		PodName:  podName,
-		RemoteIP: s.GlobalConfig.TestingHost,
+	// Not ready while the apiserver is unavailable
+	client.Clientset.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewServiceUnavailable("unavailable")
+	})
+	recorder := httptest.NewRecorder()
+	s.ServeReadyz(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Readyz responded with %d while the apiserver was unavailable", recorder.Code)
 	}
-	finished := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
-	_, err = s.deletePod(deleteRequest, finished)
-	if err == nil {
-		t.Fatal("deletePod returned without error when the specified pod wasn't owned by the user")
+	recorder = httptest.NewRecorder()
+	s.ServeHealthz(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Healthz responded with %d", recorder.Code)
 	}
-	if finished.Receive() {
-		t.Fatal("finish channel received true after delete pod should have failed")
+
+	// Not ready when PodCacheDir can't be written to
+	s.GlobalConfig.PodCacheDir = filepath.Join(config.PodCacheDir, "missing")
+	response = s.readyz(context.Background())
+	if response.Checks["podCacheDir"] == "ok" {
+		t.Fatal("PodCacheDir check passed for a directory that doesn't exist")
 	}
+}
+
+func TestFakeShutdown(t *testing.T) {
+	config := fakeConfig(t)
+	s, client := newFakeServer(t, config)
 
-	t.Logf("Confirmed that the user has at least two pods. Attempting to delete %s", podName)
-	// Call for deletion
-	deleteRequest = DeletePodRequest{
-		UserID:   s.GlobalConfig.TestUser,
-		PodName:  podName,
-		RemoteIP: s.GlobalConfig.TestingHost,
+	creating := util.NewFuture(config.TimeoutCreate)
+	s.addToWatchMaps("creating", watchMapEntry{finished: creating, authCheck: config.TestUser}, CreatingPods)
+	shutDown := make(chan struct{})
+	go func() {
+		s.Shutdown(context.Background())
+		close(shutDown)
+	}()
+
+	// New creations are refused while the outstanding one is drained
+	deadline := time.Now().Add(5 * time.Second)
+	for s.checkAcceptingJobs() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Server didn't start shutting down")
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
-	finished = util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
-	_, err = s.deletePod(deleteRequest, finished)
-	if err != nil {
-		t.Fatalf("Error calling deletePod: %s", err.Error())
+	body := fmt.Sprintf(`{"user_id": "%s", "yaml_url": "https://example.com/pod.yaml"}`, config.TestUser)
+	recorder := httptest.NewRecorder()
+	s.ServeCreatePod(recorder, httptest.NewRequest("POST", "/create_pod", strings.NewReader(body)))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("create_pod responded with %d while shutting down", recorder.Code)
+	}
+	select {
+	case <-shutDown:
+		t.Fatal("Shutdown returned before the outstanding creation finished")
+	case <-s.BaseContext().Done():
+		t.Fatal("Base context was cancelled before the outstanding creation finished")
+	case <-time.After(200 * time.Millisecond):
 	}
 
-	// There should be an entry in DeletingPods until this finishes
-	// Check by making a channel for a select statement
-	ch := make(chan bool, 1)
-	go func() { ch <- finished.Receive() }()
+	creating.Succeed()
 	select {
-	case <-ch:
-		t.Logf("Pod %s was already deleted before the DeletingPods entry could be checked", podName)
-	default:
-		s.mutex.Lock()
-		_, exists := s.DeletingPods[podName]
-		s.mutex.Unlock()
-		if !exists {
-			t.Fatalf("DeletingPods entry was absent for pod %s", podName)
-		}
+	case <-shutDown:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown didn't return after the outstanding creation finished")
+	}
+	if s.BaseContext().Err() == nil {
+		t.Fatal("Base context wasn't cancelled after shutting down")
 	}
 
-	// Make sure it was deleted
-	if !finished.Receive() {
-		t.Fatal("Pod wasn't deleted correctly")
+	// Shutdown gives up on jobs that don't finish before its deadline
+	s = New(client, config)
+	s.addToWatchMaps("stuck", watchMapEntry{finished: util.NewFuture(config.TimeoutCreate), authCheck: config.TestUser}, CreatingPods)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	s.Shutdown(ctx)
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("Shutdown took %s with a deadline of 200ms", time.Since(start))
+	}
+	if s.BaseContext().Err() == nil {
+		t.Fatal("Base context wasn't cancelled after giving up on draining")
 	}
+}
 
-	// Make sure the DeletingPods entry is now empty
+func TestFakeResumeJournal(t *testing.T) {
+	config := fakeConfig(t)
+	// Journal entries left by a backend that stopped while both pods were being created,
+	// one of which has since become ready and the other one never did
+	stopped, client := newFakeServer(t, config, fakeUserPod(config, "readypod", true), fakeUserPod(config, "stuckpod", false))
+	stopped.writeJournalEntry("readypod", watchMapEntry{authCheck: config.TestUser, started: time.Now()}, CreatingPods)
+	stopped.writeJournalEntry(
+		"stuckpod",
+		watchMapEntry{authCheck: config.TestUser, started: time.Now().Add(-2 * config.TimeoutCreate)},
+		CreatingPods,
+	)
+
+	s := New(client, config)
+	err := s.ResumeJournal(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
 	s.mutex.Lock()
-	_, entryStillExists := s.DeletingPods[podName]
+	creating, isCreating := s.CreatingPods["readypod"]
+	deleting, isDeleting := s.DeletingPods["stuckpod"]
 	s.mutex.Unlock()
-	if entryStillExists {
-		t.Fatal("DeletingPods entry still exists after deletion finished")
-	}
-	t.Logf("deletePod behaved correctly with at least one pod remaining")
-
-	if !s.userHasRemainingPods(u) {
-		t.Fatal("userHasRemainingPods should be true at this point")
+	if !isCreating || creating.finished.Wait() != nil {
+		t.Fatal("Start jobs of the ready pod weren't finished")
 	}
-
-	t.Logf("Now deleting all but one pod")
-	// Now delete pods until only one remains, so we can be sure that the PV and PVC are deleted in the end
-	userPodList, err = u.ListPods()
+	u := managed.NewUser(config.TestUser, client, config)
+	pods, err := u.ListPods(context.Background())
 	if err != nil {
-		t.Fatalf("Couldn't list user pods %s", err.Error())
+		t.Fatal(err.Error())
 	}
-	var waitChanList []*util.ReadyChannel
-	for i := 0; i < len(userPodList)-1; i++ {
-		// Call for deletion
-		deleteRequest := DeletePodRequest{
-			UserID:   s.GlobalConfig.TestUser,
-			PodName:  userPodList[i].Object.Name,
-			RemoteIP: s.GlobalConfig.TestingHost,
+	for _, pod := range pods {
+		if pod.Object.Name != "readypod" {
+			continue
 		}
-		finished := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
-		_, err = s.deletePod(deleteRequest, finished)
+		serviceList, err := pod.ListServices(context.Background())
 		if err != nil {
-			t.Fatalf("Error calling deletePod: %s", err.Error())
+			t.Fatal(err.Error())
+		}
+		if len(serviceList.Items) != 2 {
+			t.Fatalf("Ready pod has %d services after resuming its start jobs instead of 2", len(serviceList.Items))
 		}
-		waitChanList = append(waitChanList, finished)
 	}
-	// Wait until they all finish deletion and make sure they were all successful
-	if !util.ReceiveReadyChannels(waitChanList) {
-		t.Fatal("Not all pods were deleted successfully")
+	if !isDeleting || deleting.finished.Wait() != nil {
+		t.Fatal("Pod that wasn't ready within timeoutCreate wasn't deleted")
 	}
 
-	// Now there should be one pod, so the user storage should still exist.
-	storageExists, err := userPVAndPVCExist(u)
-	if err != nil {
-		t.Fatalf("Couldn't list PV and PVC %s", err.Error())
-	}
-	if !storageExists {
-		t.Fatal("User storage was deleted by deletePod when the user has pods remaining")
-	}
-	if !s.userHasRemainingPods(u) {
-		t.Fatal("userHasRemainingPods should be true at this point")
+	// Once finished, the operations are removed from the journal
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, err := s.readJournal()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Journal still has entries %+v", entries)
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
-	t.Logf("Now the user has only one pod, PV and PVC exist.")
+}
+
+func TestFakeResumeJournalAfterFailure(t *testing.T) {
+	config := fakeConfig(t)
+	s, _ := newFakeServer(t, config, fakeUserPod(config, "stuckpod", false))
 
-	// Now delete the user's final pod
-	userPodList, err = u.ListPods()
+	// An entry that can't be resumed doesn't keep the later ones from being resumed
+	data, err := json.Marshal(journalEntry{Map: "unknown", Key: "apod", UserID: config.TestUser, Started: time.Now()})
 	if err != nil {
-		t.Fatalf("Couldn't list user pods %s", err.Error())
-	}
-	if len(userPodList) != 1 {
-		t.Fatalf("User should only have 1 pod left but has %d", len(userPodList))
+		t.Fatal(err.Error())
 	}
-	deleteRequest = DeletePodRequest{
-		UserID:   s.GlobalConfig.TestUser,
-		PodName:  userPodList[0].Object.Name,
-		RemoteIP: s.GlobalConfig.TestingHost,
+	err = os.MkdirAll(s.journalDir(), 0700)
+	if err != nil {
+		t.Fatal(err.Error())
 	}
-	finished = util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
-	_, err = s.deletePod(deleteRequest, finished)
+	err = ioutil.WriteFile(filepath.Join(s.journalDir(), "aaa-unknown"), data, 0600)
 	if err != nil {
-		t.Fatalf("Error calling deletePod: %s", err.Error())
+		t.Fatal(err.Error())
+	}
+	s.writeJournalEntry(
+		"stuckpod",
+		watchMapEntry{authCheck: config.TestUser, started: time.Now().Add(-2 * config.TimeoutCreate)},
+		CreatingPods,
+	)
+
+	err = s.ResumeJournal(context.Background())
+	if err == nil {
+		t.Fatal("Resuming an unknown journal entry didn't fail")
 	}
 	s.mutex.Lock()
-	storageCleanedEntry, storageCleanedChannelExists := s.DeletingStorage[u.Name]
+	deleting, isDeleting := s.DeletingPods["stuckpod"]
 	s.mutex.Unlock()
-	if storageCleanedChannelExists {
-		// If the storageCleanedChannel does exist, then receive to check that the storage is cleaned
-		if !storageCleanedEntry.readyChannel.Receive() {
-			t.Fatal("storageCleanedChannel didn't receive true when deleting the user's last pod")
-		}
-	} else {
-		// If the channel didn't exist, then the user storage should have already been deleted,
-		// so proceed immediately to check it.
-		t.Logf("storageCleanedChannel was removed from the server.DeletingStorage by the time this check was called")
-	}
-	// Check that the PV and PVC were deleted
-	storageStillExists, err := userPVOrPVCExist(u)
-	if err != nil {
-		t.Fatalf("Couldn't check for PV or PVC %s", err.Error())
+	if !isDeleting || deleting.finished.Wait() != nil {
+		t.Fatal("Entry after the failing one wasn't resumed")
 	}
-	if storageStillExists {
-		t.Fatal("User PV or PVC exists, but the storageClean readyChannel has already sent")
+}
+
+func TestFakeReconcile(t *testing.T) {
+	config := fakeConfig(t)
+	orphanLabels := map[string]string{"createdForPod": "gonepod"}
+	orphanService := &apiv1.Service{ObjectMeta: metav1.ObjectMeta{Name: "gonepod-http", Namespace: config.Namespace, Labels: orphanLabels}}
+	orphanIngress := &netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "gonepod-ingress", Namespace: config.Namespace, Labels: orphanLabels}}
+	// An http service created before owner references were set, whose port was since changed by hand
+	driftedService := &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "readypod-http", Namespace: config.Namespace, Labels: map[string]string{"createdForPod": "readypod"}},
+		Spec: apiv1.ServiceSpec{
+			Type:  apiv1.ServiceTypeClusterIP,
+			Ports: []apiv1.ServicePort{{Name: "http", Protocol: apiv1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt(80)}},
+		},
 	}
+	s, client := newFakeServer(t, config, fakeUserPod(config, "readypod", true), orphanService, orphanIngress, driftedService)
 
-	// Make sure the pod was deleted successfully
-	if !finished.Receive() {
-		t.Fatal("Pod didn't finish deleting")
+	report := s.reconcile(context.Background())
+	if len(report.Errors) != 0 {
+		t.Fatalf("Reconciling failed: %v", report.Errors)
 	}
-	if s.userHasRemainingPods(u) {
-		t.Fatal("userHasRemainingPods should be false at this point")
+	expected := map[string]string{
+		"readypod-ssh":     managed.ReconcileCreated,
+		"readypod-http":    managed.ReconcileUpdated,
+		"readypod-ingress": managed.ReconcileCreated,
+		"gonepod-http":     managed.ReconcileDeleted,
+		"gonepod-ingress":  managed.ReconcileDeleted,
 	}
-	t.Logf("Last pod and user storage were cleaned successfully")
-
-	t.Logf("Attempting to call deletePod for a pod that doesn't exist")
-	deleteRequest = DeletePodRequest{
-		UserID:   s.GlobalConfig.TestUser,
-		PodName:  "foobar-pod",
-		RemoteIP: s.GlobalConfig.TestingHost,
+	if len(report.Actions) != len(expected) {
+		t.Fatalf("Reconciling made %d changes instead of %d: %+v", len(report.Actions), len(expected), report.Actions)
 	}
-	finished = util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
-	_, err = s.deletePod(deleteRequest, finished)
-	if err == nil {
-		t.Fatal("No error when calling deletePod on a pod that doesn't exist")
+	for _, action := range report.Actions {
+		if expected[action.Name] != action.Action || action.Error != "" {
+			t.Fatalf("Unexpected reconcile action %+v", action)
+		}
 	}
-	if finished.Receive() {
-		t.Fatal("Finished channel received true after deletePod should have failed")
+
+	// Once the informers have caught up, there should be nothing left to do
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		report = s.reconcile(context.Background())
+		if len(report.Actions) == 0 && len(report.Errors) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Reconciling again still made changes: %+v, errors: %v", report.Actions, report.Errors)
+		}
+		time.Sleep(50 * time.Millisecond)
 	}
-}
 
-func TestWatchers(t *testing.T) {
-	s := newServer()
-	defaultRequests := testingutil.GetStandardPodRequests()
-	var podTypes []string
-	for key, _ := range defaultRequests {
-		podTypes = append(podTypes, key)
+	// All of the pod's companions, including the one that existed before, should now be owned by it
+	services, err := client.ListServices(context.Background(), metav1.ListOptions{LabelSelector: "createdForPod=readypod"})
+	if err != nil {
+		t.Fatalf("Couldn't list services: %s", err.Error())
 	}
-	// take the first default pod type
-	defaultRequest := defaultRequests[podTypes[0]]
-	createRequest := CreatePodRequest{
-		YamlURL:          defaultRequest.YamlURL,
-		UserID:           defaultRequest.UserID,
-		ContainerEnvVars: defaultRequest.Settings,
-		RemoteIP:         s.GlobalConfig.TestingHost,
+	ingresses, err := client.ListIngresses(context.Background(), metav1.ListOptions{LabelSelector: "createdForPod=readypod"})
+	if err != nil {
+		t.Fatalf("Couldn't list ingresses: %s", err.Error())
+	}
+	owners := make(map[string][]metav1.OwnerReference)
+	for _, service := range services.Items {
+		owners[service.Name] = service.OwnerReferences
+	}
+	for _, ingress := range ingresses.Items {
+		owners[ingress.Name] = ingress.OwnerReferences
+	}
+	for _, name := range []string{"readypod-ssh", "readypod-http", "readypod-ingress"} {
+		refs, exists := owners[name]
+		if !exists {
+			t.Fatalf("%s doesn't exist", name)
+		}
+		if len(refs) != 1 || refs[0].Kind != "Pod" || refs[0].UID != types.UID("readypod-uid") {
+			t.Fatalf("%s has owner references %+v instead of the pod readypod", name, refs)
+		}
 	}
+}
+
+func TestFakeIsOrphaned(t *testing.T) {
+	config := fakeConfig(t)
+	s, client := newFakeServer(t, config)
 
-	// Start the pod
-	finished := util.NewReadyChannel(s.GlobalConfig.TimeoutCreate)
-	response, err := s.createPod(createRequest, finished)
+	// A pod created after a pass listed the pods still keeps its companions
+	_, err := client.CreatePod(context.Background(), fakeUserPod(config, "newpod", false))
 	if err != nil {
-		t.Fatalf("Couldn't call for pod creation %s", err.Error())
+		t.Fatal(err.Error())
+	}
+	orphaned, err := s.isOrphaned(context.Background(), "newpod")
+	if err != nil || orphaned {
+		t.Fatalf("Companions of a pod that exists are orphaned: %t, %v", orphaned, err)
 	}
+	s.addToWatchMaps("creatingpod", watchMapEntry{finished: util.NewFuture(config.TimeoutCreate), authCheck: config.TestUser}, CreatingPods)
+	orphaned, err = s.isOrphaned(context.Background(), "creatingpod")
+	if err != nil || orphaned {
+		t.Fatalf("Companions of a pod that is being created are orphaned: %t, %v", orphaned, err)
+	}
+	orphaned, err = s.isOrphaned(context.Background(), "gonepod")
+	if err != nil || !orphaned {
+		t.Fatalf("Companions of a pod that doesn't exist aren't orphaned: %t, %v", orphaned, err)
+	}
+}
 
-	t.Logf("Calling watchCreatePod with both correct and incorrect username")
-	correctCreateRequest := WatchCreatePodRequest{PodName: response.PodName, UserID: createRequest.UserID}
-	incorrectCreateRequest := WatchCreatePodRequest{PodName: response.PodName, UserID: fmt.Sprintf("%s-extra", createRequest.UserID)}
-	errChan := make(chan error, 2)
-	go func() {
-		response, err := s.watchCreatePod(correctCreateRequest)
-		if err != nil {
-			errChan <- errors.New(fmt.Sprintf("Error while watching for pod creation %s", err.Error()))
+func TestFakeCreateFailureReason(t *testing.T) {
+	config := fakeConfig(t)
+	config.TimeoutCreate = time.Second
+	manifestServer, config := testingutil.ServeManifest(testingutil.FakePodManifest, config)
+	defer manifestServer.Close()
+	s, client := newFakeServer(t, config)
+	// Create pods that can't pull their image, along with the event that says so
+	tracker := client.Clientset.Tracker()
+	client.Clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*apiv1.Pod).DeepCopy()
+		pod.UID = types.UID(pod.Name + "-uid")
+		pod.Status = apiv1.PodStatus{
+			Phase: apiv1.PodPending,
+			ContainerStatuses: []apiv1.ContainerStatus{{
+				Name:  pod.Spec.Containers[0].Name,
+				State: apiv1.ContainerState{Waiting: &apiv1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "Back-off pulling image"}},
+			}},
 		}
-		if !response.Ready {
-			errChan <- errors.New(fmt.Sprintf("Got false when watching for pod creation when it should have returned true"))
+		if err := tracker.Create(action.GetResource(), pod, action.GetNamespace()); err != nil {
+			return true, nil, err
 		}
-		errChan <- nil
-	}()
-	go func() {
-		response, err := s.watchCreatePod(incorrectCreateRequest)
-		if err == nil {
-			errChan <- errors.New(fmt.Sprintf("Didn't get error when watching for pod creating with incorrect user"))
+		event := &apiv1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: fmt.Sprintf("%s.pull", pod.Name), Namespace: action.GetNamespace()},
+			InvolvedObject: apiv1.ObjectReference{Kind: "Pod", Name: pod.Name, UID: pod.UID},
+			Type:           apiv1.EventTypeWarning,
+			Reason:         "Failed",
+			Message:        "Failed to pull image \"fake\"",
+			Count:          3,
+			LastTimestamp:  metav1.Now(),
 		}
-		if response.Ready {
-			errChan <- errors.New(fmt.Sprintf("Got true when watching for pod creation with the incorrect userID"))
-		}
-		errChan <- nil
-	}()
-	// Now if both behaved correctly, there should be two `nil` errors
-	for i := 0; i < 2; i++ {
-		err := <-errChan
-		if err != nil {
-			t.Fatal(err.Error())
+		if err := tracker.Create(apiv1.SchemeGroupVersion.WithResource("events"), event, action.GetNamespace()); err != nil {
+			return true, nil, err
 		}
+		return true, pod, nil
+	})
+
+	createRequest := CreatePodRequest{
+		YamlURL:  fmt.Sprintf("%s/fake.yaml", manifestServer.URL),
+		UserID:   config.TestUser,
+		RemoteIP: config.TestingHost,
+	}
+	created := util.NewFuture(config.TimeoutCreate)
+	createResponse, err := s.createPod(context.Background(), createRequest, created)
+	if err != nil {
+		t.Fatal(err.Error())
 	}
 
-	// Make sure the pod started and start jobs ran successfully
-	if !finished.Receive() {
-		t.Fatal("Pod didn't reach ready state with completed start jobs")
+	// Another user isn't told anything about the pod
+	response, err := s.watchCreatePod(context.Background(), WatchCreatePodRequest{PodName: createResponse.PodName, UserID: "other@test.user"})
+	if err == nil || response.Reason != "" || response.Diagnosis != nil {
+		t.Fatalf("watchCreatePod told another user about the pod: %+v", response)
 	}
 
-	// Now that it's finished, try watching it again, first with the correct user:
-	// Should have no error and return true
-	watchCreateResponse, err := s.watchCreatePod(correctCreateRequest)
+	// The owner is told why the creation timed out
+	response, err = s.watchCreatePod(context.Background(), WatchCreatePodRequest{PodName: createResponse.PodName, UserID: config.TestUser})
 	if err != nil {
-		t.Fatalf("Error while watching for pod creation %s", err.Error())
+		t.Fatal(err.Error())
 	}
-	if !watchCreateResponse.Ready {
-		t.Fatal("Got false when watching for pod creation when it should have returned true")
+	if response.Ready || !created.TimedOut() {
+		t.Fatalf("Creation of pod %s that couldn't pull its image didn't time out", createResponse.PodName)
 	}
-	// and then with the incorrect user:
-	// Should have error and return false
-	watchCreateResponse, err = s.watchCreatePod(incorrectCreateRequest)
-	if err != nil {
-		t.Logf("Got an error in watchCreatePod after creation with the incorrect user %s", err.Error())
+	if !strings.Contains(response.Reason, "didn't become ready") {
+		t.Fatalf("Reason %q doesn't say that the pod didn't become ready", response.Reason)
+	}
+	diagnosis := response.Diagnosis
+	if diagnosis == nil {
+		t.Fatal("Timed out creation had no diagnosis")
 	}
-	if watchCreateResponse.Ready {
-		t.Fatal("Got true when watching for pod creation with the incorrect userID")
+	if diagnosis.Phase != string(apiv1.PodPending) || len(diagnosis.Containers) != 1 || diagnosis.Containers[0].Reason != "ImagePullBackOff" {
+		t.Fatalf("Diagnosis didn't have the pending pod's container state: %+v", diagnosis)
 	}
+	if len(diagnosis.Events) != 1 || diagnosis.Events[0].Reason != "Failed" || diagnosis.Events[0].Count != 3 {
+		t.Fatalf("Diagnosis didn't have the pod's event: %+v", diagnosis.Events)
+	}
+}
 
-	t.Logf("Attempting to watch for pod deletion")
-	deleteRequest := DeletePodRequest{PodName: response.PodName, UserID: createRequest.UserID}
-	finishedDeleting := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
-	_, err = s.deletePod(deleteRequest, finishedDeleting)
+func TestFakePodLogs(t *testing.T) {
+	config := fakeConfig(t)
+	s, _ := newFakeServer(t, config, fakeUserPod(config, "logpod", true))
 
-	t.Logf("Calling watchDeletePod with both correct and incorrect username")
-	correctDeleteRequest := WatchDeletePodRequest{PodName: response.PodName, UserID: createRequest.UserID}
-	errChan = make(chan error, 2)
-	go func() {
-		response, err := s.watchDeletePod(correctDeleteRequest)
-		if err != nil {
-			errChan <- errors.New(fmt.Sprintf("Error while watching for pod deletion %s", err.Error()))
-		}
-		if !response.Deleted {
-			errChan <- errors.New(fmt.Sprintf("Got false when watching for pod deletion when it should have returned true"))
-		}
-		errChan <- nil
-	}()
-	err = <-errChan
+	// The fake clientset answers every request for logs with "fake logs"
+	response, err := s.getPodLogs(context.Background(), GetPodLogsRequest{UserID: config.TestUser, PodName: "logpod"})
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	// Can't check that an incorrect delete request gets the appropriate error, because it can't guarantee that
-	// the pod won't already have been deleted by the time it gets there
-
-	// Make sure the pod was deleted successfully
-	if !finished.Receive() {
-		t.Fatal("Pod wasn't successfully deleted")
+	if response.Logs != "fake logs" || response.Truncated {
+		t.Fatalf("Got logs %q (truncated %t) instead of the pod's logs", response.Logs, response.Truncated)
 	}
 
-	// Now that it's finished, try watching it again
-	// Because it's deleted now, the username can't matter
-	watchDeleteResponse, err := s.watchDeletePod(correctDeleteRequest)
+	// Logs are cut off at the requested limit
+	response, err = s.getPodLogs(context.Background(), GetPodLogsRequest{UserID: config.TestUser, PodName: "logpod", LimitBytes: 4})
 	if err != nil {
-		t.Fatalf("Error while watching for pod deletion %s", err.Error())
+		t.Fatal(err.Error())
 	}
-	if !watchDeleteResponse.Deleted {
-		t.Fatal("Got false when watching for pod deletion when it should have returned true")
+	if response.Logs != "fake" || !response.Truncated {
+		t.Fatalf("Got logs %q (truncated %t) with a limit of 4 bytes", response.Logs, response.Truncated)
+	}
+
+	// Another user's pod can't be told apart from one that doesn't exist
+	_, err = s.getPodLogs(context.Background(), GetPodLogsRequest{UserID: "other@test.user", PodName: "logpod"})
+	if !k8sclient.IsNotFound(err) {
+		t.Fatalf("Getting logs of another user's pod should fail with not found, got %v", err)
+	}
+
+	_, err = s.getPodLogs(context.Background(), GetPodLogsRequest{UserID: config.TestUser, PodName: "logpod", SinceTime: "yesterday"})
+	if k8sclient.ReasonForError(err) != k8sclient.ReasonInvalid {
+		t.Fatalf("Invalid since_time should fail as invalid, got %v", err)
 	}
 }
 
-func TestCleanAllUnused(t *testing.T) {
-	s := newServer()
+func TestFakePodTerminal(t *testing.T) {
+	config := fakeConfig(t)
+	s, client := newFakeServer(t, config, fakeUserPod(config, "termpod", true))
+	// Echo the terminal's first size and then its input, until stdin is closed
+	client.StreamExecFunc = func(ctx context.Context, command []string, pod *apiv1.Pod, nContainer int, options remotecommand.StreamOptions) error {
+		if !options.Tty || options.Stdin == nil || options.TerminalSizeQueue == nil {
+			return errors.New("Terminal wasn't opened with a TTY, stdin and a size queue")
+		}
+		size := options.TerminalSizeQueue.Next()
+		if size == nil {
+			return errors.New("No terminal size")
+		}
+		fmt.Fprintf(options.Stdout, "%dx%d\n", size.Width, size.Height)
+		_, err := io.Copy(options.Stdout, options.Stdin)
+		return err
+	}
+	httpServer := httptest.NewServer(http.HandlerFunc(s.ServePodTerminal))
+	defer httpServer.Close()
+	terminalURL := func(userID string) string {
+		return fmt.Sprintf("ws%s/pod_terminal?user_id=%s&pod_name=termpod", strings.TrimPrefix(httpServer.URL, "http"), userID)
+	}
 
-	// Ensure the testuser has some pods and their services that shouldn't be affected by cleanAllUnused
-	defaultRequests := testingutil.GetStandardPodRequests()
-	err := testingutil.EnsureUserHasEach(s.GlobalConfig.TestUser, defaultRequests)
+	siloOrigin := fmt.Sprintf("https://%s/", config.HostnameList[0].Hostname)
+
+	// Another user can't open a terminal in the pod
+	if ws, err := websocket.Dial(terminalURL("other"), "", siloOrigin); err == nil {
+		ws.Close()
+		t.Fatal("Another user opened a terminal in the pod")
+	}
+	// Nor can a page that isn't on a silo
+	if ws, err := websocket.Dial(terminalURL(config.TestUser), "", "https://example.com/"); err == nil {
+		ws.Close()
+		t.Fatal("A terminal was opened from another origin")
+	}
+
+	ws, err := websocket.Dial(terminalURL(config.TestUser), "", siloOrigin)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-
-	// Make some junk user storage, services, and podcaches
-	testUsernames := []string{"foo@bar", "foo@bar.baz", "foo"}
-	readyChannels := make([]*util.ReadyChannel, len(testUsernames))
-	for i, user := range testUsernames {
-		u := managed.NewUser(user, s.Client, s.GlobalConfig)
-		ready := util.NewReadyChannel(s.GlobalConfig.TimeoutCreate)
-		err := u.CreateUserStorageIfNotExist(ready, s.GlobalConfig.TestingHost)
-		if err != nil {
-			t.Fatalf("Couldn't create storage for user %s, %s", user, err.Error())
-		}
-		readyChannels[i] = ready
+	defer ws.Close()
+	err = websocket.JSON.Send(ws, TerminalMessage{Type: "resize", Cols: 80, Rows: 24})
+	if err == nil {
+		err = websocket.JSON.Send(ws, TerminalMessage{Type: "stdin", Data: "hello\n"})
+	}
+	if err != nil {
+		t.Fatal(err.Error())
 	}
-	if !util.ReceiveReadyChannels(readyChannels) {
-		t.Fatal("Not all storages were created")
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var output string
+	for output != "80x24\nhello\n" {
+		var frame []byte
+		if err := websocket.Message.Receive(ws, &frame); err != nil {
+			t.Fatalf("Terminal output was %q when receiving failed: %s", output, err.Error())
+		}
+		output += string(frame)
 	}
+}
 
-	testPodNames := []string{"coolpod-1", "example-pod-foo-bar"}
-	var testServices []*apiv1.Service
-	for _, name := range testPodNames {
-		// make the podcache
-		filename := fmt.Sprintf("%s/%s", s.GlobalConfig.PodCacheDir, name)
-		file, err := os.Create(filename)
-		if err != nil {
-			t.Fatalf("Couldn't create file %s, %s", filename, err.Error())
+func TestFakePodFiles(t *testing.T) {
+	config := fakeConfig(t)
+	config.FileTransferByteLimit = 64 * 1024
+	s, client := newFakeServer(t, config, fakeUserPod(config, "filepod", true))
+	// Emulate tar in the container, with files[path] = content as its filesystem.
+	// Like tar, it takes any argument before -- that starts with - as an option.
+	files := make(map[string]string)
+	var mutex sync.Mutex
+	client.StreamExecFunc = func(ctx context.Context, command []string, pod *apiv1.Pod, nContainer int, options remotecommand.StreamOptions) error {
+		if len(command) < 6 || command[0] != "tar" {
+			return errors.New(fmt.Sprintf("Unexpected command %v", command))
 		}
-		file.Close()
-		if err != nil {
-			t.Fatalf("Couldn't close file %s, %s", filename, err.Error())
+		var dir string
+		var names []string
+		for i := 2; i < len(command); i++ {
+			switch {
+			case command[i] == "--":
+				names = append(names, command[i+1:]...)
+				i = len(command)
+			case command[i] == "-f" || command[i] == "-C":
+				i++
+				if command[i-1] == "-C" {
+					dir = command[i]
+				}
+			case strings.HasPrefix(command[i], "-"):
+				fmt.Fprintf(options.Stderr, "tar: unrecognized option '%s'\n", command[i])
+				return utilexec.CodeExitError{Err: errors.New("command terminated with exit code 2"), Code: 2}
+			default:
+				names = append(names, command[i])
+			}
 		}
-		// make the service
-		service := exampleSshService(name)
-		testServices = append(testServices, service)
-		_, err = s.Client.CreateService(service)
-		if err != nil {
-			t.Fatalf("Couldn't create service %s, %s", service.Name, err.Error())
+		mutex.Lock()
+		defer mutex.Unlock()
+		if command[1] == "-x" {
+			reader := tar.NewReader(options.Stdin)
+			for {
+				header, err := reader.Next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				content, err := ioutil.ReadAll(reader)
+				if err != nil {
+					return err
+				}
+				files[path.Join(dir, header.Name)] = string(content)
+			}
 		}
+		if len(names) != 1 {
+			return errors.New(fmt.Sprintf("Unexpected command %v", command))
+		}
+		content, exists := files[path.Join(dir, names[0])]
+		if !exists {
+			fmt.Fprintf(options.Stderr, "tar: %s: Cannot stat: No such file or directory\n", names[0])
+			return utilexec.CodeExitError{Err: errors.New("command terminated with exit code 2"), Code: 2}
+		}
+		writer := tar.NewWriter(options.Stdout)
+		err := writer.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: names[0], Mode: 0644, Size: int64(len(content))})
+		if err == nil {
+			_, err = writer.Write([]byte(content))
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		return err
+	}
+	httpServer := httptest.NewServer(http.HandlerFunc(s.ServeDownloadPodFile))
+	defer httpServer.Close()
+	query := func(userID string, podPath string) string {
+		return url.Values{"user_id": {userID}, "pod_name": {"filepod"}, "path": {podPath}}.Encode()
+	}
+	uploadLength := func(userID string, podPath string, content string, length int64) int {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/upload_pod_file?"+query(userID, podPath), strings.NewReader(content))
+		request.ContentLength = length
+		s.ServeUploadPodFile(recorder, request)
+		return recorder.Code
+	}
+	upload := func(userID string, podPath string, content string) int {
+		return uploadLength(userID, podPath, content, int64(len(content)))
+	}
+	download := func(userID string, podPath string) (*http.Response, error) {
+		return http.Get(fmt.Sprintf("%s/download_pod_file?%s", httpServer.URL, query(userID, podPath)))
 	}
 
-	finished := util.NewReadyChannel(3 * s.GlobalConfig.TimeoutDelete)
-	err = s.cleanAllUnused(finished)
-	if err != nil {
-		t.Fatalf(err.Error())
+	if status := upload(config.TestUser, "/home/user/../user/hello.txt", "hello"); status != http.StatusOK {
+		t.Fatalf("Upload gave status %d", status)
+	}
+	if files["/home/user/hello.txt"] != "hello" {
+		t.Fatalf("Uploaded file wasn't extracted into the container, files are %v", files)
+	}
+	if status := upload("other@test.user", "/home/user/other.txt", "hello"); status != http.StatusNotFound {
+		t.Fatalf("Upload into another user's pod gave status %d instead of not found", status)
+	}
+	if status := upload(config.TestUser, "/home/user/large.txt", strings.Repeat("x", config.FileTransferByteLimit+1)); status != http.StatusBadRequest {
+		t.Fatalf("Upload over the limit gave status %d", status)
+	}
+	if _, exists := files["/home/user/large.txt"]; exists {
+		t.Fatal("Upload over the limit was written into the container")
 	}
-	if !finished.Receive() {
-		t.Fatal("Didn't finish cleanAllUnused successfully")
+	if status := uploadLength(config.TestUser, "/home/user/chunked.txt", "hello", -1); status != http.StatusBadRequest {
+		t.Fatalf("Upload without a length gave status %d", status)
+	}
+	if status := uploadLength(config.TestUser, "/home/user/short.txt", "hello", 10); status == http.StatusOK {
+		t.Fatal("Upload that ended before its length succeeded")
+	}
+	if _, exists := files["/home/user/short.txt"]; exists {
+		t.Fatal("Truncated upload was written into the container")
 	}
 
-	t.Log("Checking whether all were deleted")
+	response, err := download(config.TestUser, "/home/user/hello.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	reader := tar.NewReader(response.Body)
+	header, err := reader.Next()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	content, err := ioutil.ReadAll(reader)
+	response.Body.Close()
+	if err != nil || header.Name != "hello.txt" || string(content) != "hello" {
+		t.Fatalf("Downloaded %s with content %q (%v) instead of hello.txt", header.Name, string(content), err)
+	}
 
-	// Check user storage
-	for _, user := range testUsernames {
-		u := managed.NewUser(user, s.Client, s.GlobalConfig)
-		pvList, err := s.Client.ListPV(u.GetStorageListOptions())
+	// Files named like options of tar are downloaded like any other
+	for _, name := range []string{"--to-command=cat", "-T"} {
+		if status := upload(config.TestUser, "/home/user/"+name, name); status != http.StatusOK {
+			t.Fatalf("Upload of %s gave status %d", name, status)
+		}
+		response, err := download(config.TestUser, "/home/user/"+name)
 		if err != nil {
 			t.Fatal(err.Error())
 		}
-		if len(pvList.Items) != 0 {
-			t.Fatalf("PV %s wasn't deleted", pvList.Items[0].Name)
+		if response.StatusCode != http.StatusOK {
+			response.Body.Close()
+			t.Fatalf("Download of %s gave status %d", name, response.StatusCode)
 		}
-		pvcList, err := s.Client.ListPVC(u.GetStorageListOptions())
+		reader := tar.NewReader(response.Body)
+		header, err := reader.Next()
 		if err != nil {
 			t.Fatal(err.Error())
 		}
-		if len(pvcList.Items) != 0 {
-			t.Fatalf("PVC %s wasn't deleted", pvcList.Items[0].Name)
+		content, err := ioutil.ReadAll(reader)
+		response.Body.Close()
+		if err != nil || header.Name != name || string(content) != name {
+			t.Fatalf("Downloaded %s with content %q (%v) instead of %s", header.Name, string(content), err, name)
 		}
 	}
 
-	// Check podcaches
-	for _, podName := range testPodNames {
-		filename := fmt.Sprintf("%s/%s", s.GlobalConfig.PodCacheDir, podName)
-		_, err := os.Stat(filename)
-		if !os.IsNotExist(err) {
-			t.Fatalf("Podcache %s was not deleted", filename)
-		}
-	}
-
-	// Check services
-	for _, service := range testServices {
-		svcList, err := s.Client.ListServices(
-			metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", service.Name)},
-		)
+	for _, userID := range []string{"other@test.user", config.TestUser} {
+		response, err := download(userID, "/home/user/missing.txt")
 		if err != nil {
 			t.Fatal(err.Error())
 		}
-		if len(svcList.Items) != 0 {
-			t.Fatalf("Service %s was not deleted", svcList.Items[0].Name)
+		response.Body.Close()
+		if response.StatusCode != http.StatusNotFound {
+			t.Fatalf("Download of a missing file by %s gave status %d", userID, response.StatusCode)
 		}
 	}
 
-	// Check that all the user's pods and their related parts still exist
-	u := managed.NewUser(s.GlobalConfig.TestUser, s.Client, s.GlobalConfig)
-	storageOkay, err := userPVAndPVCExist(u)
+	// A download over the limit is aborted once it has started, so that it can't be mistaken for a complete archive
+	mutex.Lock()
+	files["/home/user/large.txt"] = strings.Repeat("x", config.FileTransferByteLimit)
+	mutex.Unlock()
+	response, err = download(config.TestUser, "/home/user/large.txt")
+	if err == nil {
+		_, err = ioutil.ReadAll(response.Body)
+		response.Body.Close()
+	}
+	if err == nil {
+		t.Fatal("Download over the limit wasn't aborted")
+	}
+}
+
+func TestFakeRestartPod(t *testing.T) {
+	manifestServer, config := testingutil.ServeManifest(testingutil.FakePodManifest, fakeConfig(t))
+	defer manifestServer.Close()
+	s, client := newFakeServer(t, config)
+	var tokenMutex sync.Mutex
+	token := "firsttoken"
+	client.ExecFunc = fakeExec(func(*apiv1.Pod) string {
+		tokenMutex.Lock()
+		defer tokenMutex.Unlock()
+		return token
+	})
+	u := managed.NewUser(config.TestUser, s.Client, s.GlobalConfig)
+
+	created := util.NewFuture(config.TimeoutCreate)
+	createResponse, err := s.createPod(context.Background(), CreatePodRequest{
+		YamlURL:  fmt.Sprintf("%s/fake.yaml", manifestServer.URL),
+		UserID:   config.TestUser,
+		RemoteIP: config.TestingHost,
+	}, created)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	if !storageOkay {
-		t.Fatal("testUser storage not present after cleanAllUnused")
+	if created.Wait() != nil {
+		t.Fatalf("Pod %s didn't finish start jobs", createResponse.PodName)
 	}
-	podList, err := u.ListPods()
+	pod, _, err := s.getUserPod(context.Background(), createResponse.PodName, config.TestUser)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	for podType, _ := range defaultRequests {
-		found := false
-		var thisPod managed.Pod
-		for _, pod := range podList {
-			if strings.Contains(pod.Object.Name, podType) {
-				found = true
-				thisPod = pod
-			}
-		}
-		if !found {
-			t.Fatalf("Pod of type %s not found after cleanAllUnused", podType)
-		}
-		podName := thisPod.Object.Name
-
-		// check podcache
-		filename := fmt.Sprintf("%s/%s", s.GlobalConfig.PodCacheDir, podName)
-		_, err := os.Stat(filename)
-		if err != nil {
-			t.Fatalf("podcache error for testUser pod %s after cleanAllUnused %s", podName, err.Error())
-		}
 
-		// check services
-		if thisPod.NeedsSshService() {
-			podSvcList, err := thisPod.ListServices()
-			if err != nil {
-				t.Fatal(err.Error())
-			}
-			found := false
-			for _, svc := range podSvcList.Items {
-				if svc.Name == fmt.Sprintf("%s-ssh", podName) {
-					found = true
-					break
-				}
-			}
-			if !found {
-				t.Fatalf("Pod %s needs ssh service, but its ssh service wasn't present after cleanAllUnused", podName)
-			}
-		}
+	// Another user can't restart the pod
+	restarted := util.NewFuture(config.TimeoutDelete + config.TimeoutCreate)
+	_, err = s.restartPod(context.Background(), RestartPodRequest{UserID: "other@test.user", PodName: createResponse.PodName}, restarted)
+	if !k8sclient.IsNotFound(err) {
+		t.Fatalf("Restarting another user's pod should fail with not found, got %v", err)
 	}
 
-	// delete the testUser pods to clean up
-	deleteAllRequest := DeleteAllPodsRequest{UserID: s.GlobalConfig.TestUser}
-	finished = util.NewReadyChannel(s.GlobalConfig.TimeoutDelete + 30*time.Second)
-	err = s.deleteAllUserPods(deleteAllRequest.UserID, finished)
+	tokenMutex.Lock()
+	token = "secondtoken"
+	tokenMutex.Unlock()
+	restarted = util.NewFuture(config.TimeoutDelete + config.TimeoutCreate)
+	response, err := s.restartPod(context.Background(), RestartPodRequest{
+		UserID:   config.TestUser,
+		PodName:  createResponse.PodName,
+		RemoteIP: config.TestingHost,
+	}, restarted)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	// Make sure they were all deleted successfully
-	if finished.Receive() {
-		t.Log("Deleted all user pods and storage successfully")
-	} else {
-		t.Fatal("Failed to delete all user pods and storage")
+	if !response.Requested {
+		t.Fatal("Restart wasn't requested")
+	}
+	// The user has no other pods, but their storage must survive the restart
+	s.deleteStorageIfUnused(context.Background(), u, time.Time{})
+	if err := restarted.Wait(); err != nil {
+		t.Fatalf("Pod %s didn't restart: %s", createResponse.PodName, err.Error())
 	}
-}
 
-func TestReloadCache(t *testing.T) {
-	s := newServer()
-	// First ensure that the user has each of the standard pods
-	defaultRequests := testingutil.GetStandardPodRequests()
-	err := testingutil.EnsureUserHasEach(s.GlobalConfig.TestUser, defaultRequests)
+	podList, err := u.ListPods(context.Background())
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatal(err.Error())
+	}
+	if len(podList) != 1 || podList[0].Object.Name != createResponse.PodName {
+		t.Fatalf("User should have exactly the pod %s after restarting it", createResponse.PodName)
+	}
+	newPod := podList[0]
+	if newPod.Object.Status.PodIP == pod.Object.Status.PodIP {
+		t.Fatalf("Pod %s has the same IP %s after restarting, so it wasn't recreated", newPod.Object.Name, newPod.Object.Status.PodIP)
+	}
+	info := newPod.GetPodInfo()
+	if info.Tokens["token"] != "secondtoken" {
+		t.Fatalf("Pod %s has token %s after restarting, should be secondtoken", newPod.Object.Name, info.Tokens["token"])
+	}
+	ingressList, err := newPod.ListIngresses(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(ingressList.Items) != 1 || ingressList.Items[0].Spec.Rules[0].Host != fmt.Sprintf("%s.%s", createResponse.PodName, config.IngressDomain) {
+		t.Fatalf("Pod %s should have its ingress with the same host after restarting, has %+v", newPod.Object.Name, ingressList.Items)
+	}
+	storageExists, err := userPVAndPVCExist(u)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !storageExists {
+		t.Fatal("User storage was deleted while restarting the user's pod")
 	}
 
-	// Then delete their podCaches
-	u := managed.NewUser(s.GlobalConfig.TestUser, s.Client, s.GlobalConfig)
-	podList, err := u.ListPods()
+	// Clean up, so that the leak check doesn't wait for the pod's storage
+	deleted := util.NewFuture(config.TimeoutDelete)
+	_, err = s.deletePod(context.Background(), DeletePodRequest{PodName: createResponse.PodName, UserID: config.TestUser}, deleted)
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatal(err.Error())
+	}
+	if deleted.Wait() != nil {
+		t.Fatalf("Pod %s didn't finish deleting", createResponse.PodName)
 	}
+}
 
-	for _, pod := range podList {
-		// Delete the cache file
-		err := os.Remove(pod.GetCacheFilename())
-		if err != nil {
-			t.Fatalf("Error deleting podcache for pod %s: %s", pod.Object.Name, err.Error())
-		}
+func TestFakeResumeRestart(t *testing.T) {
+	config := fakeConfig(t)
+	// Journal entries left by a backend that stopped while restarting two pods,
+	// one of which it hadn't deleted yet, and the other of which it had deleted but not created again
+	stopped, client := newFakeServer(t, config, fakeUserPod(config, "oldpod", true))
+	restarts := make(map[string]*restartSpec)
+	for _, object := range []*apiv1.Pod{fakeUserPod(config, "oldpod", true), fakeUserPod(config, "gonepod", true)} {
+		creator := podcreator.NewFromPod(managed.NewPod(object, client, config), config.TestingHost)
+		restarts[object.Name] = &restartSpec{OldUID: object.UID, Pod: creator.TargetPod(), SiloIP: config.TestingHost}
+		stopped.writeJournalEntry(object.Name, watchMapEntry{authCheck: config.TestUser, started: time.Now(), restart: restarts[object.Name]}, CreatingPods)
 	}
 
-	// Reload the podCaches
-	err = s.ReloadPodCaches()
+	s := New(client, config)
+	err := s.ResumeJournal(context.Background())
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-
-	// Check that all podCaches are there again
-	for _, pod := range podList {
-		_, err := os.Open(pod.GetCacheFilename())
+	s.mutex.Lock()
+	entries := make(map[string]watchMapEntry)
+	for name := range restarts {
+		entries[name] = s.CreatingPods[name]
+	}
+	s.mutex.Unlock()
+	for name, restart := range restarts {
+		entry := entries[name]
+		if entry.finished == nil {
+			t.Fatalf("Restart of %s wasn't resumed", name)
+		}
+		if err := entry.finished.Wait(); err != nil {
+			t.Fatalf("Restart of %s failed: %s", name, err.Error())
+		}
+		pod, exists, err := s.getUserPod(context.Background(), name, config.TestUser)
 		if err != nil {
-			t.Fatalf("Error loading podCache for pod %s: %s", pod.Object.Name, err.Error())
+			t.Fatal(err.Error())
+		}
+		if !exists || pod.Object.UID == restart.OldUID {
+			t.Fatalf("Pod %s wasn't created again", name)
 		}
 	}
 }
 
-func TestValidUser(t *testing.T) {
-	tests := []struct {
-		userID string
-		valid  bool
-	}{
-		{"foo@bar@baz", false},
-		{"foO@bar", false},
-		{"foo", true},
-		{"foo@bar", true},
-		{"foo@bar.baz", true},
-		{"foo@bar.baz-baz", true},
-		{"foo-bar.baz@foo.bar-baz", true},
-		{"foo.bar@bar.baz", true},
-		{"foo@", false},
-		{"foo.", false},
-		{".foo", false},
-		{"-foo", false},
-	}
-	for _, test := range tests {
-		if validUserID(test.userID) != test.valid {
-			t.Fatalf("validUserID fails for userID %s: %t and %t", test.userID, validUserID(test.userID), test.valid)
+func TestFakeRestartPodNotCreated(t *testing.T) {
+	config := fakeConfig(t)
+	config.TimeoutDelete = time.Second
+	s, client := newFakeServer(t, config, fakeUserPod(config, "stuckpod", true), fakeUserPod(config, "deletedpod", true))
+	var deletesMutex sync.Mutex
+	deletes := make(map[string]int)
+	var userDeleted *util.Future
+	client.Clientset.PrependReactor("delete", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		name := action.(k8stesting.DeleteAction).GetName()
+		deletesMutex.Lock()
+		deletes[name]++
+		deletesMutex.Unlock()
+		if name == "deletedpod" {
+			// The user deletes the pod while it's being deleted to restart it
+			s.addToWatchMaps(name, watchMapEntry{finished: userDeleted, authCheck: config.TestUser}, DeletingPods)
+			return false, nil, nil
 		}
+		// Accept the deletion without removing the pod, like when a finalizer holds it up
+		return true, nil, nil
+	})
 
-		requests := testingutil.GetStandardPodRequests()
-		var request testingutil.CreatePodRequest
-		// Set `request` to the first available in the default requests
-		for _, defaultRequest := range requests {
-			request = defaultRequest
-			break
-		}
+	// If the old pod's deletion times out, the old pod must be left alone
+	restarted := util.NewFuture(config.TimeoutDelete + config.TimeoutCreate)
+	_, err := s.restartPod(context.Background(), RestartPodRequest{UserID: config.TestUser, PodName: "stuckpod", RemoteIP: config.TestingHost}, restarted)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = restarted.Wait()
+	if err == nil {
+		t.Fatal("Restart of stuckpod should fail when its deletion times out")
+	}
+	s.deletePodIfFailedRestart("stuckpod", CreatePodRequest{UserID: config.TestUser, RemoteIP: config.TestingHost}, err)
+	deletesMutex.Lock()
+	stuckDeletes := deletes["stuckpod"]
+	deletesMutex.Unlock()
+	if stuckDeletes != 1 {
+		t.Fatalf("stuckpod should be deleted once by the restart, was deleted %d times", stuckDeletes)
+	}
+	_, exists, err := s.getUserPod(context.Background(), "stuckpod", config.TestUser)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !exists {
+		t.Fatal("stuckpod was removed after its restart failed")
+	}
+
+	// If the user deletes the pod during the restart, it isn't created again, nor deleted as a failed creation
+	userDeleted = util.NewFuture(config.TimeoutDelete)
+	defer userDeleted.Succeed()
+	restarted = util.NewFuture(config.TimeoutDelete + config.TimeoutCreate)
+	_, err = s.restartPod(context.Background(), RestartPodRequest{UserID: config.TestUser, PodName: "deletedpod", RemoteIP: config.TestingHost}, restarted)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = restarted.Wait()
+	if k8sclient.ReasonForError(err) != k8sclient.ReasonCanceled {
+		t.Fatalf("Restart of deletedpod should be canceled, got %v", err)
+	}
+	var notCreated restartNotCreatedError
+	if !errors.As(err, &notCreated) {
+		t.Fatalf("Restart of deletedpod should fail before creating the pod, got %v", err)
+	}
+	_, exists, err = s.getUserPod(context.Background(), "deletedpod", config.TestUser)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if exists {
+		t.Fatal("deletedpod was created again after the user deleted it")
+	}
+}
 
-		// Try to create a pod with this userID
-		request.UserID = test.userID
-		podName, err := testingutil.CreatePod(request)
-		// There should be an error iff this test.userID is valid
-		if (err == nil) != test.valid {
-			t.Fatalf("CreatePod had (didn't have) an error with the (in)valid userID %s", test.userID)
+func TestFakeCuller(t *testing.T) {
+	config := fakeConfig(t)
+	config.IdleTimeout = time.Hour
+	idleSince := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	// A Jupyter-like status endpoint for the pod checked over http
+	statusServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/status" {
+			http.NotFound(w, r)
+			return
 		}
+		fmt.Fprintf(w, `{"last_activity": "%s"}`, idleSince.Format(time.RFC3339))
+	}))
+	defer statusServer.Close()
+	statusURL, err := url.Parse(statusServer.URL)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
 
-		// Try to list this user's pods
-		_, err = testingutil.GetPodNames(test.userID)
-		if (err == nil) != test.valid {
-			t.Fatalf("GetPods had (didn't have) an error with the (in)valid userID %s", test.userID)
+	idlePod := fakeUserPod(config, "idlepod", true)
+	idlePod.Annotations["sciencedata.dk/idle-check-command"] = "cat /tmp/last_activity"
+	idlePod.Annotations["sciencedata.dk/idle-timeout"] = "1h"
+	activePod := fakeUserPod(config, "activepod", true)
+	activePod.Annotations["sciencedata.dk/idle-check-command"] = "cat /tmp/last_activity"
+	// Idle, but with culling turned off in its manifest
+	exemptPod := fakeUserPod(config, "exemptpod", true)
+	exemptPod.Annotations["sciencedata.dk/idle-check-command"] = "cat /tmp/last_activity"
+	exemptPod.Annotations["sciencedata.dk/idle-timeout"] = "0s"
+	// Idle, but without an idle check
+	uncheckedPod := fakeUserPod(config, "uncheckedpod", true)
+	httpPod := fakeUserPod(config, "httppod", true)
+	httpPod.Annotations["sciencedata.dk/idle-check-http"] = fmt.Sprintf("%s/api/status", statusURL.Port())
+	httpPod.Status.PodIP = statusURL.Hostname()
+
+	s, client := newFakeServer(t, config, idlePod, activePod, exemptPod, uncheckedPod, httpPod)
+	client.ExecFunc = fakeExec(func(pod *apiv1.Pod) string {
+		if pod.Name == "activepod" {
+			return fmt.Sprintf("%d\n", time.Now().Unix())
 		}
+		return idleSince.Format(time.RFC3339)
+	})
+
+	report := s.cull(context.Background())
+	if len(report.Errors) != 0 {
+		t.Fatalf("Culling failed: %v", report.Errors)
+	}
+	if report.PodsChecked != 3 {
+		t.Fatalf("Culler checked %d pods instead of 3", report.PodsChecked)
+	}
+	culled := make(map[string]CulledPod)
+	for _, pod := range report.Culled {
+		culled[pod.PodName] = pod
+	}
+	if len(culled) != 2 || culled["idlepod"].PodName == "" || culled["httppod"].PodName == "" {
+		t.Fatalf("Culler culled %+v instead of idlepod and httppod", report.Culled)
+	}
+	if !culled["httppod"].LastActivity.Equal(idleSince) || culled["httppod"].UserID != config.TestUser {
+		t.Fatalf("Unexpected culled pod %+v", culled["httppod"])
+	}
 
-		// Try to delete the pod
-		_, err = testingutil.DeletePod(test.userID, podName)
-		if (err == nil) != test.valid {
-			t.Fatalf("DeletePod had (didn't have) an error with the (in)valid userID %s", test.userID)
+	// The culled pods are deleted like any other pod.
+	// Look up all of their deletions before waiting on one, since the others may finish in the meantime.
+	s.mutex.Lock()
+	deletions := make(map[string]watchMapEntry)
+	for podName := range culled {
+		if entry, deleting := s.DeletingPods[podName]; deleting {
+			deletions[podName] = entry
 		}
+	}
+	s.mutex.Unlock()
+	for podName := range culled {
+		entry, deleting := deletions[podName]
+		if !deleting {
+			t.Fatalf("Culled pod %s isn't being deleted", podName)
+		}
+		if err := entry.finished.Wait(); err != nil {
+			t.Fatalf("Deleting culled pod %s failed: %s", podName, err.Error())
+		}
+	}
+	podList, err := client.ListPods(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(podList.Items) != 3 {
+		t.Fatalf("%d pods are left instead of 3", len(podList.Items))
+	}
+	for _, pod := range podList.Items {
+		if culled[pod.Name].PodName != "" {
+			t.Fatalf("Culled pod %s still exists", pod.Name)
+		}
+	}
 
-		// Try to delete all the user's pods
-		err = testingutil.DeleteAllUserPods(test.userID)
-		if (err == nil) != test.valid {
-			t.Fatalf("DeleteAllUserPods had (didn't have) an error with the (in)valid userID %s", test.userID)
+	record, err := ioutil.ReadFile(filepath.Join(config.PodCacheDir, cullRecordFilename))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(string(record)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Record of culled pods has %d lines instead of 2: %s", len(lines), record)
+	}
+	for _, line := range lines {
+		var recorded CulledPod
+		err = json.Unmarshal([]byte(line), &recorded)
+		if err != nil || culled[recorded.PodName].PodName == "" {
+			t.Fatalf("Unexpected record of culled pod %s", line)
 		}
 	}
+
+	// With the idle pods gone, there's nothing more to cull
+	report = s.cull(context.Background())
+	if len(report.Errors) != 0 || len(report.Culled) != 0 || report.PodsChecked != 1 {
+		t.Fatalf("Unexpected second cull %+v", report)
+	}
 }
 
-func TestGetPodIPOwner(t *testing.T) {
-	s := newServer()
-	otherUserID := "misc@test.user"
-	err := testingutil.EnsureUserHasNPods(s.GlobalConfig.TestUser, 1)
-	if err != nil {
-		t.Fatalf("Couldn't ensure user has pods: %s", err.Error())
+func TestFakePodExpiry(t *testing.T) {
+	config := fakeConfig(t)
+	config.DefaultLifetime = 0
+	config.MaxLifetime = 2 * time.Hour
+	manifestServer, config := testingutil.ServeManifest(testingutil.FakePodManifest, config)
+	defer manifestServer.Close()
+	expiredPod := fakeUserPod(config, "expiredpod", true)
+	expiredPod.Annotations["sciencedata.dk/expires"] = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	// Made before lifetimes, so it doesn't expire
+	keptPod := fakeUserPod(config, "keptpod", true)
+	s, client := newFakeServer(t, config, expiredPod, keptPod)
+	client.ExecFunc = fakeExec(func(*apiv1.Pod) string { return "faketoken" })
+	createRequest := CreatePodRequest{
+		YamlURL:  fmt.Sprintf("%s/fake.yaml", manifestServer.URL),
+		UserID:   config.TestUser,
+		RemoteIP: config.TestingHost,
+		Lifetime: "soon",
+	}
+	_, err := s.createPod(context.Background(), createRequest, util.NewFuture(config.TimeoutCreate))
+	if k8sclient.ReasonForError(err) != k8sclient.ReasonInvalid {
+		t.Fatalf("Creating a pod with an invalid lifetime should fail as invalid, got %v", err)
 	}
-	err = testingutil.EnsureUserHasNPods(otherUserID, 1)
+
+	// A requested lifetime is capped at MaxLifetime
+	createRequest.Lifetime = "5h"
+	created := util.NewFuture(config.TimeoutCreate)
+	createResponse, err := s.createPod(context.Background(), createRequest, created)
 	if err != nil {
-		t.Fatalf("Couldn't ensure user has pods: %s", err.Error())
+		t.Fatal(err.Error())
+	}
+	if created.Wait() != nil {
+		t.Fatalf("Pod %s didn't finish start jobs", createResponse.PodName)
 	}
-	testPods := func(userID string) {
-		u := managed.NewUser(userID, s.Client, s.GlobalConfig)
-		podList, err := u.ListPods()
+	podName := createResponse.PodName
+	getExpires := func(podName string) time.Time {
+		pod, exists, err := s.getUserPod(context.Background(), podName, config.TestUser)
+		if err != nil || !exists {
+			t.Fatalf("Couldn't get pod %s: %v", podName, err)
+		}
+		expires, err := time.Parse(time.RFC3339, pod.GetPodInfo().Expires)
 		if err != nil {
-			t.Fatalf("Couldn't list pods: %s", err.Error())
+			t.Fatalf("Pod %s doesn't report when it expires: %s", podName, err.Error())
 		}
-		for _, pod := range podList {
-			ip := pod.Object.Status.PodIP
-			localRequest := GetPodIPOwnerRequest{
-				PodIP:    ip,
-				RemoteIP: s.GlobalConfig.TestingHost,
-			}
-			returnedUserID := s.getPodIPOwner(localRequest)
-			if returnedUserID != userID {
-				t.Fatalf("Pod %s has IP %s and owner %s but server.getPodIPOwner returned %s", pod.Object.Name, ip, userID, returnedUserID)
-			}
+		return expires
+	}
+	expires := getExpires(podName)
+	if lifetime := time.Until(expires); lifetime > config.MaxLifetime || lifetime < config.MaxLifetime-time.Minute {
+		t.Fatalf("Pod %s expires in %s instead of %s", podName, lifetime, config.MaxLifetime)
+	}
+
+	// Another user can't extend the pod, and pods without a lifetime can't be extended
+	_, err = s.extendPod(context.Background(), ExtendPodRequest{UserID: "other@test.user", PodName: podName})
+	if !k8sclient.IsNotFound(err) {
+		t.Fatalf("Extending another user's pod should fail with not found, got %v", err)
+	}
+	_, err = s.extendPod(context.Background(), ExtendPodRequest{UserID: config.TestUser, PodName: "keptpod"})
+	if k8sclient.ReasonForError(err) != k8sclient.ReasonInvalid {
+		t.Fatalf("Extending a pod that doesn't expire should fail as invalid, got %v", err)
+	}
+	// A shorter lifetime doesn't make the pod expire sooner
+	extendResponse, err := s.extendPod(context.Background(), ExtendPodRequest{UserID: config.TestUser, PodName: podName, Lifetime: "1h"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if extendResponse.Expires != expires.UTC().Format(time.RFC3339) {
+		t.Fatalf("Extending pod %s by 1h moved its expiry from %s to %s", podName, expires, extendResponse.Expires)
+	}
+	// Without a lifetime, it is extended by the one it was created with, starting now
+	time.Sleep(time.Second)
+	extendResponse, err = s.extendPod(context.Background(), ExtendPodRequest{UserID: config.TestUser, PodName: podName})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	extended, err := time.Parse(time.RFC3339, extendResponse.Expires)
+	if err != nil || !extended.After(expires) {
+		t.Fatalf("Extending pod %s moved its expiry from %s to %s", podName, expires, extendResponse.Expires)
+	}
+	// get_pods reports the new expiry once the informers have caught up
+	deadline := time.Now().Add(5 * time.Second)
+	for !getExpires(podName).Equal(extended) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Pod %s still expires at %s instead of %s", podName, getExpires(podName), extended)
 		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Only the expired pod is deleted, like any other pod
+	deleted := s.deleteExpiredPods(context.Background())
+	if len(deleted) != 1 || deleted[0] != "expiredpod" {
+		t.Fatalf("Deleted %v instead of the expired pod", deleted)
+	}
+	s.mutex.Lock()
+	entry, deleting := s.DeletingPods["expiredpod"]
+	s.mutex.Unlock()
+	if !deleting {
+		t.Fatal("Expired pod isn't being deleted")
 	}
-	testPods(s.GlobalConfig.TestUser)
-	testPods(otherUserID)
+	if err := entry.finished.Wait(); err != nil {
+		t.Fatalf("Deleting expired pod failed: %s", err.Error())
+	}
+	if deleted = s.deleteExpiredPods(context.Background()); len(deleted) != 0 {
+		t.Fatalf("Deleted %v after the expired pod was gone", deleted)
+	}
+
+	finished := util.NewFuture(config.TimeoutDelete)
+	_, err = s.deletePod(context.Background(), DeletePodRequest{UserID: config.TestUser, PodName: podName}, finished)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	finished.Wait()
 }
 
-func TestSleepBeforeLeakCheck(t *testing.T) {
-	t.Log("Start waiting for ReadyChannel goroutines to finish\n")
-	s := newServer()
-	time.Sleep(s.GlobalConfig.TimeoutDelete + s.GlobalConfig.TimeoutCreate + 30*time.Second)
-	t.Log("Done waiting for ReadyChannel goroutines to finish\n")
+// Goroutines that are expected to outlive the tests
+var leakOptions = []goleak.Option{
+	goleak.IgnoreTopFunction("k8s.io/klog/v2.(*loggingT).flushDaemon"),
+	goleak.IgnoreTopFunction("github.com/docker/spdystream.(*Connection).shutdown"),
 }
 
 func TestMain(m *testing.M) {
-	goleak.VerifyTestMain(
-		m,
-		goleak.IgnoreTopFunction("k8s.io/klog/v2.(*loggingT).flushDaemon"),
-		goleak.IgnoreTopFunction("github.com/docker/spdystream.(*Connection).shutdown"),
-	)
+	// Tests that need authentication set their own authKeyDir
+	os.Setenv("BACKEND_AUTHDISABLED", "true")
+	goleak.VerifyTestMain(m, leakOptions...)
 }
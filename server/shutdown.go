@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+)
+
+// Interval of checking whether the watch maps have drained during shutdown
+const drainPollInterval = 100 * time.Millisecond
+
+// Return the context that the server's background jobs derive from,
+// which is cancelled once Shutdown has drained them or given up
+func (s *Server) BaseContext() context.Context {
+	return s.baseCtx
+}
+
+// Return an Unavailable error if the server is shutting down and doesn't accept new creations or deletions
+func (s *Server) checkAcceptingJobs() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.shuttingDown {
+		return k8sclient.NewError(k8sclient.ReasonUnavailable, "The backend is shutting down")
+	}
+	return nil
+}
+
+// Return the number of entries in the watch maps. Must be called with s.mutex held.
+func (s *Server) outstandingJobs() int {
+	return len(s.CreatingPods) + len(s.DeletingPods) + len(s.DeletingStorage)
+}
+
+// Stop accepting new creations and deletions, and wait until those in the watch maps finish or ctx is done.
+// Whatever is still unfinished is logged, then the server's base context is cancelled,
+// stopping the remaining background jobs and open event streams.
+func (s *Server) Shutdown(ctx context.Context) {
+	s.mutex.Lock()
+	s.shuttingDown = true
+	outstanding := s.outstandingJobs()
+	s.mutex.Unlock()
+	fmt.Printf("Shutting down, waiting for %d outstanding creations and deletions\n", outstanding)
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for outstanding > 0 {
+		select {
+		case <-ctx.Done():
+			s.logUnfinishedJobs()
+			s.cancelBase()
+			return
+		case <-ticker.C:
+		}
+		s.mutex.Lock()
+		outstanding = s.outstandingJobs()
+		s.mutex.Unlock()
+	}
+	fmt.Printf("All creations and deletions finished\n")
+	s.cancelBase()
+}
+
+// Log each entry that is still in the watch maps. They stay in the journal, so they are resumed after the next startup.
+func (s *Server) logUnfinishedJobs() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for podName, entry := range s.CreatingPods {
+		fmt.Printf("Error: Shutting down before pod %s of user %s was ready and its start jobs finished\n", podName, entry.authCheck)
+	}
+	for podName, entry := range s.DeletingPods {
+		fmt.Printf("Error: Shutting down before pod %s of user %s was deleted and its delete jobs finished\n", podName, entry.authCheck)
+	}
+	for userName := range s.DeletingStorage {
+		fmt.Printf("Error: Shutting down before the storage of user %s was deleted\n", userName)
+	}
+}
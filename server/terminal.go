@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Command run by pod_terminal if the request doesn't give one, which prefers bash over sh
+var defaultTerminalCommand = []string{"/bin/sh", "-c", "if command -v bash >/dev/null; then exec bash; else exec sh; fi"}
+
+// Message sent by the client of a terminal session as a text frame,
+// either input with type stdin and data, or a new terminal size with type resize, cols and rows
+type TerminalMessage struct {
+	Type string `json:"type"`
+	Data string `json:"data,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+}
+
+// Message sent to the client as a text frame when the session ends, with the reason if the command failed.
+// The terminal's output is sent as binary frames, so that it isn't mangled where a frame splits a character.
+type TerminalExitMessage struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// remotecommand.TerminalSizeQueue that holds the latest size from the client until the exec stream asks for it
+type terminalSizeQueue struct {
+	sizes chan remotecommand.TerminalSize
+	done  <-chan struct{}
+}
+
+func newTerminalSizeQueue(ctx context.Context) *terminalSizeQueue {
+	return &terminalSizeQueue{sizes: make(chan remotecommand.TerminalSize, 1), done: ctx.Done()}
+}
+
+// Queue size, replacing a size that the exec stream hasn't asked for yet
+func (q *terminalSizeQueue) push(size remotecommand.TerminalSize) {
+	for {
+		select {
+		case q.sizes <- size:
+			return
+		default:
+		}
+		select {
+		case <-q.sizes:
+		default:
+		}
+	}
+}
+
+// Block until there is a new size, or return nil once the session is over
+func (q *terminalSizeQueue) Next() *remotecommand.TerminalSize {
+	select {
+	case size := <-q.sizes:
+		return &size
+	case <-q.done:
+		return nil
+	}
+}
+
+// io.Writer that sends what is written to the websocket as binary frames
+type terminalOutput struct {
+	ws *websocket.Conn
+}
+
+func (o *terminalOutput) Write(p []byte) (int, error) {
+	err := websocket.Message.Send(o.ws, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Check that the websocket request comes from a page of one of the silos in HostnameList,
+// so that another site can't open a terminal with the cookies of a user who visits it.
+// Requests without an Origin header are refused as well, since the silos' proxies pass on the browser's.
+func (s *Server) checkTerminalOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin == nil {
+		return errors.New("Missing Origin header")
+	}
+	if _, isSilo := s.siloAddresses[origin.Hostname()]; !isSilo {
+		return errors.New(fmt.Sprintf("Origin %s isn't a silo in hostnameList", origin.String()))
+	}
+	config.Origin = origin
+	return nil
+}
+
+// Handles the websocket request to open an interactive terminal in a container of the user's pod.
+// The request is a GET with user_id, pod_name and optionally container and command (repeated for each word) in the query.
+func (s *Server) ServePodTerminal(w http.ResponseWriter, r *http.Request) {
+	id := requestID(w, r)
+	query := r.URL.Query()
+	userID := query.Get("user_id")
+	podName := query.Get("pod_name")
+	container := query.Get("container")
+	command := query["command"]
+	fmt.Printf("podTerminal request [%s]: user %s, pod %s, container %s, command %v\n", id, userID, podName, container, command)
+	err := checkUserID(userID)
+	if err == nil {
+		err = s.checkAcceptingJobs()
+	}
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+
+	// Check ownership before upgrading, so that the client gets an ordinary error response
+	pod, nContainer, err := s.getUserPodContainer(r.Context(), podName, userID, container)
+	if err != nil {
+		writeError(w, id, err)
+		return
+	}
+	if len(command) == 0 {
+		command = defaultTerminalCommand
+	}
+
+	// Browsers don't apply the same-origin policy to websockets, so check the Origin header on top of the signature.
+	// A request that fails the check gets 403 forbidden instead of being upgraded.
+	websocket.Server{Handshake: s.checkTerminalOrigin, Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+		// The request's context is cancelled when the backend shuts down
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		stdin, stdinWriter := io.Pipe()
+		// Unblock the client's input once the command has exited
+		defer stdin.Close()
+		sizes := newTerminalSizeQueue(ctx)
+
+		// Pass the client's messages on to the command until the client disconnects
+		go func() {
+			defer stdinWriter.Close()
+			for {
+				var message TerminalMessage
+				err := websocket.JSON.Receive(ws, &message)
+				if err != nil {
+					// The command gets EOF on stdin, but a shell ignoring it shouldn't keep the session open
+					cancel()
+					return
+				}
+				switch message.Type {
+				case "stdin":
+					_, err = stdinWriter.Write([]byte(message.Data))
+					if err != nil {
+						return
+					}
+				case "resize":
+					sizes.push(remotecommand.TerminalSize{Width: message.Cols, Height: message.Rows})
+				}
+			}
+		}()
+
+		err := s.Client.PodExecStream(ctx, command, pod.Object, nContainer, remotecommand.StreamOptions{
+			Stdin:             stdin,
+			Stdout:            &terminalOutput{ws: ws},
+			Tty:               true,
+			TerminalSizeQueue: sizes,
+		})
+		exit := TerminalExitMessage{Type: "exit"}
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("Error [%s] in terminal of pod %s: %s\n", id, podName, err.Error())
+			exit.Reason = err.Error()
+		}
+		websocket.JSON.Send(ws, exit)
+		fmt.Printf("podTerminal [%s] closed\n", id)
+	}}.ServeHTTP(w, r)
+}
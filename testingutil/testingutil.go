@@ -7,8 +7,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"regexp"
 	"strings"
 
+	"github.com/deic.dk/user_pods_k8s_backend/auth"
 	"github.com/deic.dk/user_pods_k8s_backend/util"
 )
 
@@ -65,6 +68,33 @@ type reducedPodInfo struct {
 
 type getPodNamesResponse []reducedPodInfo
 
+// Post body to path on the backend running on localhost.
+// If the config sets authKeyDir, the request is signed like a silo would,
+// with the key of the testing host's silo, or with the admin key if admin is true.
+func post(path string, body []byte, admin bool) (*http.Response, error) {
+	request, err := http.NewRequest("POST", fmt.Sprintf("http://localhost%s", path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	config := util.MustLoadGlobalConfig()
+	if config.AuthKeyDir != "" {
+		keys, err := auth.LoadKeys(config.AuthKeyDir)
+		if err != nil {
+			return nil, err
+		}
+		keyID := config.HostnameMap[config.TestingHost]
+		if admin {
+			keyID = auth.AdminKeyID
+		}
+		err = auth.Sign(request, body, keyID, keys[keyID])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return http.DefaultClient.Do(request)
+}
+
 func CreatePod(request CreatePodRequest) (string, error) {
 	// Construct the request
 	requestBody, err := json.Marshal(&request)
@@ -73,7 +103,7 @@ func CreatePod(request CreatePodRequest) (string, error) {
 	}
 
 	// Send the request
-	response, err := http.Post("http://localhost/create_pod", "application/json", bytes.NewReader(requestBody))
+	response, err := post("/create_pod", requestBody, false)
 	if err != nil {
 		return "", err
 	}
@@ -98,32 +128,46 @@ func CreatePod(request CreatePodRequest) (string, error) {
 	return podName, nil
 }
 
-func WatchCreatePod(userID string, podName string, finished *util.ReadyChannel) error {
+// Call watch_create_pod and complete finished with the result.
+// If the request itself fails, finished fails with the same error.
+func WatchCreatePod(userID string, podName string, finished *util.Future) error {
+	ready, err := watchCreatePod(userID, podName)
+	if err != nil {
+		finished.Fail(err)
+		return err
+	}
+	if ready {
+		finished.Succeed()
+	} else {
+		finished.Fail(errors.New(fmt.Sprintf("Pod %s didn't reach ready state", podName)))
+	}
+	return nil
+}
+
+func watchCreatePod(userID string, podName string) (bool, error) {
 	requestBody, err := json.Marshal(&watchCreatePodRequest{
 		UserID:  userID,
 		PodName: podName,
 	})
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	response, err := http.Post("http://localhost/watch_create_pod", "application/json", bytes.NewReader(requestBody))
+	response, err := post("/watch_create_pod", requestBody, false)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer response.Body.Close()
 	responseBody, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return err
+		return false, err
 	}
 	var unmarshalled watchCreatePodResponse
 	err = json.Unmarshal(responseBody, &unmarshalled)
 	if err != nil {
-		return err
+		return false, err
 	}
-	finished.Send(unmarshalled.Ready)
-
-	return nil
+	return unmarshalled.Ready, nil
 }
 
 func DeleteAllUserPods(userID string) error {
@@ -134,7 +178,7 @@ func DeleteAllUserPods(userID string) error {
 	}
 
 	// Send the request
-	response, err := http.Post("http://localhost/delete_all_user", "application/json", bytes.NewReader(requestBody))
+	response, err := post("/delete_all_user", requestBody, true)
 	if err != nil {
 		return err
 	}
@@ -169,7 +213,7 @@ func DeletePod(userID string, podName string) (bool, error) {
 	}
 
 	// Send the request
-	response, err := http.Post("http://localhost/delete_pod", "application/json", bytes.NewReader(requestBody))
+	response, err := post("/delete_pod", requestBody, false)
 	if err != nil {
 		return false, err
 	}
@@ -245,7 +289,7 @@ func GetPodNames(userID string) ([]string, error) {
 	}
 
 	// Send the request
-	response, err := http.Post("http://localhost/get_pods", "application/json", bytes.NewReader(requestBody))
+	response, err := post("/get_pods", requestBody, false)
 	if err != nil {
 		return podNames, err
 	}
@@ -286,7 +330,7 @@ func EnsureUserHasNPods(userID string, n int) error {
 		podTypes = append(podTypes, key)
 	}
 
-	var readyChannels []*util.ReadyChannel
+	var readyList []*util.Future
 	// As long as the user has too few pods, create one of the standard ones
 	for i := startingNumOfPods; i < n; i++ {
 		// Cycle through each of the podTypes in the defaultRequests
@@ -297,13 +341,13 @@ func EnsureUserHasNPods(userID string, n int) error {
 		if err != nil {
 			return errors.New(fmt.Sprintf("Failed while creating %s pod: %s", podType, err.Error()))
 		}
-		ready := util.NewReadyChannel(config.TimeoutCreate)
+		ready := util.NewFuture(config.TimeoutCreate)
 		go WatchCreatePod(userID, podName, ready)
-		readyChannels = append(readyChannels, ready)
+		readyList = append(readyList, ready)
 	}
-	// Wait for all readyChannels to receive true
-	if !util.ReceiveReadyChannels(readyChannels) {
-		return errors.New("Not all pods reached ready state")
+	// Wait for all of the pods to be ready
+	if err := util.WaitFutures(readyList); err != nil {
+		return errors.New(fmt.Sprintf("Not all pods reached ready state: %s", err.Error()))
 	}
 
 	// Double check that the right number of pods exists now
@@ -324,7 +368,7 @@ func EnsureUserHasEach(userID string, requests map[string]CreatePodRequest) erro
 		return errors.New(fmt.Sprintf("Couldn't get_pods %s", err.Error()))
 	}
 
-	var readyChannels []*util.ReadyChannel
+	var readyList []*util.Future
 	// For each of the requests, check that one exists and create it if not
 	for podType, request := range requests {
 		hasPod := false
@@ -341,14 +385,45 @@ func EnsureUserHasEach(userID string, requests map[string]CreatePodRequest) erro
 			if err != nil {
 				return errors.New(fmt.Sprintf("Failed while creating %s pod: %s", podType, err.Error()))
 			}
-			ready := util.NewReadyChannel(config.TimeoutCreate)
+			ready := util.NewFuture(config.TimeoutCreate)
 			go WatchCreatePod(userID, podName, ready)
-			readyChannels = append(readyChannels, ready)
+			readyList = append(readyList, ready)
 		}
 	}
-	// Wait for all readyChannels to receive true
-	if !util.ReceiveReadyChannels(readyChannels) {
-		return errors.New("Not all pods reached ready state")
+	// Wait for all of the pods to be ready
+	if err := util.WaitFutures(readyList); err != nil {
+		return errors.New(fmt.Sprintf("Not all pods reached ready state: %s", err.Error()))
 	}
 	return nil
 }
+
+// Manifest for testing against k8sclient.FakeK8sClient.
+// The pod needs user storage, an ssh service and an ingress, and has a token to copy.
+const FakePodManifest = `apiVersion: v1
+kind: Pod
+metadata:
+  name: fake
+  annotations:
+    sciencedata.dk/copy-token: token
+    sciencedata.dk/ingress-port: "8888"
+spec:
+  containers:
+  - name: fake
+    image: fake
+    ports:
+    - containerPort: 22
+    - containerPort: 8888
+    volumeMounts:
+    - name: sciencedata
+      mountPath: /root/data
+`
+
+// Serve manifest over http on localhost so that a PodCreator can fetch it without network access.
+// Returns the server, which should be closed by the caller, and config with a whitelist allowing the server's URL.
+func ServeManifest(manifest string, config util.GlobalConfig) (*httptest.Server, util.GlobalConfig) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(manifest))
+	}))
+	config.WhitelistManifestRegex = fmt.Sprintf("^%s", regexp.QuoteMeta(server.URL))
+	return server, config
+}
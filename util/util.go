@@ -2,6 +2,8 @@ package util
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -17,81 +19,209 @@ import (
 
 const configFilename = "config.yaml"
 const environmentPrefix = "backend"
+const defaultTimeoutApiCall = 30 * time.Second
+const defaultRetryMaxAttempts = 4
+const defaultRetryInitialBackoff = 200 * time.Millisecond
+const defaultRetryMaxBackoff = 5 * time.Second
+const defaultAuthMaxSkew = 5 * time.Minute
+const defaultReconcileInterval = 5 * time.Minute
+const defaultLogByteLimit = 1024 * 1024
+const defaultFileTransferByteLimit = 100 * 1024 * 1024
+const defaultIdleCheckInterval = 10 * time.Minute
+const defaultExpiryCheckInterval = time.Minute
 
-// type for signalling whether one-off events have completed successfully within a timeout
-type ReadyChannel struct {
-	ch          chan bool
-	receivedYet bool
-	firstValue  bool
-	mutex       *sync.Mutex
-}
-
-// Return a new safeBoolChannel whith the timeout counting down
-func NewReadyChannel(timeout time.Duration) *ReadyChannel {
-	ch := make(chan bool, 1)
-	var m sync.Mutex
-	rc := &ReadyChannel{
-		ch:          ch,
-		receivedYet: false,
-		firstValue:  false,
-		mutex:       &m,
-	}
-	go func() {
-		time.Sleep(timeout)
-		rc.Send(false)
-	}()
-	return rc
-}
-
-// Attempt to send value into the ReadyChannel's channel.
-// If the buffer is already full, this will do nothing.
-func (t *ReadyChannel) Send(value bool) {
-	select {
-	case t.ch <- value:
-	default:
+// Error that a Future completes with if it isn't completed before its timeout.
+// It matches context.DeadlineExceeded, so it is classified like other timeouts.
+var ErrTimedOut = fmt.Errorf("Timed out: %w", context.DeadlineExceeded)
+
+// Error that a Future completes with if it is failed without a reason
+var ErrFailed = errors.New("Failed")
+
+// type for signalling whether one-off events have completed successfully within a timeout, and if not, why.
+// Like a context, it is done once, and then Err() returns nil on success or the reason it failed.
+type Future struct {
+	done chan struct{}
+	once sync.Once
+	// mutex guards the fields below
+	mutex           sync.Mutex
+	err             error
+	timer           *time.Timer
+	callbacks       []func(error)
+	describeTimeout func() error
+}
+
+// Return a new Future that fails with ErrTimedOut unless it is completed within timeout.
+// The timer is stopped on completion, so no goroutine is left waiting for it.
+func NewFuture(timeout time.Duration) *Future {
+	f := &Future{done: make(chan struct{})}
+	f.mutex.Lock()
+	f.timer = time.AfterFunc(timeout, f.timeout)
+	f.mutex.Unlock()
+	return f
+}
+
+// Complete f with err, unless it was already completed, and run the callbacks waiting for it
+func (f *Future) complete(err error) {
+	f.once.Do(func() {
+		f.finish(err)
+	})
+}
+
+func (f *Future) finish(err error) {
+	f.mutex.Lock()
+	f.err = err
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	callbacks := f.callbacks
+	f.callbacks = nil
+	close(f.done)
+	f.mutex.Unlock()
+	for _, callback := range callbacks {
+		callback(err)
+	}
+}
+
+// Called by the timer to fail f with ErrTimedOut, or the error returned by describeTimeout if it is set
+func (f *Future) timeout() {
+	f.mutex.Lock()
+	describe := f.describeTimeout
+	f.mutex.Unlock()
+	if describe == nil {
+		f.complete(ErrTimedOut)
+		return
+	}
+	// describe runs inside once.Do, so that completing f some other way in the meantime
+	// waits for the description instead of replacing it with a less informative error
+	f.once.Do(func() {
+		err := describe()
+		if err == nil {
+			err = ErrTimedOut
+		}
+		f.finish(err)
+	})
+}
+
+// Set describe to be called if f times out, to return the error that f fails with instead of ErrTimedOut,
+// e.g. with what was holding it up. The error should wrap ErrTimedOut so that it is still classified as a timeout,
+// and if describe returns nil, ErrTimedOut is used.
+// describe may block briefly, during which other attempts to complete f wait,
+// so it mustn't complete or wait for f itself.
+func (f *Future) DescribeTimeout(describe func() error) {
+	f.mutex.Lock()
+	f.describeTimeout = describe
+	f.mutex.Unlock()
+}
+
+// Complete f successfully. If it was already completed, this will do nothing.
+func (f *Future) Succeed() {
+	f.complete(nil)
+}
+
+// Complete f with err as the reason it failed, or ErrFailed if err is nil.
+// If it was already completed, this will do nothing.
+func (f *Future) Fail(err error) {
+	if err == nil {
+		err = ErrFailed
 	}
+	f.complete(err)
+}
+
+// Fail f with context.Canceled, e.g. because the event it stands for won't happen anymore
+func (f *Future) Cancel() {
+	f.complete(context.Canceled)
 }
 
-// Return the first value that was input to t.Send().
-// If there hasn't been one yet, block until there is one.
-func (t *ReadyChannel) Receive() bool {
-	// use the ReadyChannel's mutex to block other goroutines where t.Receive is called until this returns
-	t.mutex.Lock()
-	defer func() {
-		t.mutex.Unlock()
-	}()
+// Return a channel that is closed once f is completed
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Return nil if f isn't completed yet or completed successfully, and otherwise the reason it failed
+func (f *Future) Err() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.err
+}
+
+// Block until f is completed, then return nil if it succeeded or the reason it failed
+func (f *Future) Wait() error {
+	<-f.done
+	return f.Err()
+}
+
+// Return true if f failed because it timed out, either by its own timeout or a context deadline that failed it.
+// If it isn't completed yet, block until it is.
+func (f *Future) TimedOut() bool {
+	return errors.Is(f.Wait(), context.DeadlineExceeded)
+}
 
-	// if a value has been received from this ReadyChannel, return that value
-	if t.receivedYet {
-		return t.firstValue
+// Call callback with the result of f once it is completed, without starting a goroutine.
+// If f is already completed, callback is called right away.
+// Callbacks run in the goroutine that completes f, so they should be quick.
+func (f *Future) OnComplete(callback func(error)) {
+	f.mutex.Lock()
+	select {
+	case <-f.done:
+		err := f.err
+		f.mutex.Unlock()
+		callback(err)
+	default:
+		f.callbacks = append(f.callbacks, callback)
+		f.mutex.Unlock()
 	}
-	// otherwise, this is the first time Receive is called
-	// block until the first value is ready in the channel, which will either be from t.Send() or the timeout
-	value := <-t.ch
+}
 
-	// set t.firstValue to true so that subsequent t.Receive() will return value immediately
-	t.receivedYet = true
-	t.firstValue = value
-	return value
+// Return a context derived from parent that is cancelled once f is completed,
+// so that the work towards f stops when it succeeds, fails or times out
+func (f *Future) Context(parent context.Context) context.Context {
+	ctx, cancel := context.WithCancel(parent)
+	f.OnComplete(func(error) {
+		cancel()
+	})
+	return ctx
 }
 
-// Block until an input was received from each channel in inputChannels,
-// then send output <- input0 && input 1 && input2...
-func CombineReadyChannels(inputChannels []*ReadyChannel, outputChannel *ReadyChannel) {
-	output := ReceiveReadyChannels(inputChannels)
-	outputChannel.Send(output)
+// Complete output once all of the inputs are completed,
+// successfully if they all succeeded, and otherwise with the error of the first input that failed in order.
+// This doesn't block, since it's driven by the inputs' completion.
+func CombineFutures(inputs []*Future, output *Future) {
+	if len(inputs) == 0 {
+		output.Succeed()
+		return
+	}
+	var mutex sync.Mutex
+	remaining := len(inputs)
+	for _, input := range inputs {
+		input.OnComplete(func(error) {
+			mutex.Lock()
+			remaining -= 1
+			allCompleted := remaining == 0
+			mutex.Unlock()
+			if !allCompleted {
+				return
+			}
+			for _, input := range inputs {
+				if err := input.Err(); err != nil {
+					output.Fail(err)
+					return
+				}
+			}
+			output.Succeed()
+		})
+	}
 }
 
-func ReceiveReadyChannels(inputChannels []*ReadyChannel) bool {
-	output := true
-	for _, ch := range inputChannels {
-		// Block until able to receive from each channel,
-		// if any are false, then the output is false
-		if !ch.Receive() {
-			output = false
+// Block until all of the inputs are completed, then return nil if they all succeeded,
+// and otherwise the error of the first input that failed in order
+func WaitFutures(inputs []*Future) error {
+	var firstErr error
+	for _, input := range inputs {
+		if err := input.Wait(); err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
-	return output
+	return firstErr
 }
 
 func GetUserIDFromLabels(labels map[string]string) string {
@@ -119,10 +249,17 @@ type GlobalConfig struct {
 	DefaultRestartPolicy   apiv1.RestartPolicy
 	TimeoutCreate          time.Duration
 	TimeoutDelete          time.Duration
+	TimeoutApiCall         time.Duration
+	TimeoutShutdown        time.Duration
+	RetryMaxAttempts       int
+	RetryInitialBackoff    time.Duration
+	RetryMaxBackoff        time.Duration
 	Namespace              string
 	PodCacheDir            string
 	WhitelistManifestRegex string
 	TokenByteLimit         int
+	LogByteLimit           int
+	FileTransferByteLimit  int
 	NfsStorageRoot         string
 	TestingHost            string
 	LocalRegistryURL       string
@@ -135,6 +272,17 @@ type GlobalConfig struct {
 	TestUser               string
 	HostnameList           []HostnameListEntry
 	HostnameMap            map[string]string
+	Kubeconfig             string
+	KubeContext            string
+	AuthKeyDir             string
+	AuthDisabled           bool
+	AuthMaxSkew            time.Duration
+	ReconcileInterval      time.Duration
+	IdleTimeout            time.Duration
+	IdleCheckInterval      time.Duration
+	DefaultLifetime        time.Duration
+	MaxLifetime            time.Duration
+	ExpiryCheckInterval    time.Duration
 }
 
 func SaveGlobalConfig(c GlobalConfig) error {
@@ -218,6 +366,70 @@ func MustLoadGlobalConfig() GlobalConfig {
 		}
 	}
 
+	// Bound each call to the apiserver even if the config doesn't set a timeout
+	if config.TimeoutApiCall <= 0 {
+		config.TimeoutApiCall = defaultTimeoutApiCall
+	}
+
+	// By default, wait long enough on shutdown for a creation or deletion that just started to finish
+	if config.TimeoutShutdown <= 0 {
+		config.TimeoutShutdown = config.TimeoutCreate
+		if config.TimeoutDelete > config.TimeoutShutdown {
+			config.TimeoutShutdown = config.TimeoutDelete
+		}
+	}
+
+	// Retry calls that fail with transient errors unless the config says otherwise.
+	// RetryMaxAttempts: 1 disables retries.
+	if config.RetryMaxAttempts <= 0 {
+		config.RetryMaxAttempts = defaultRetryMaxAttempts
+	}
+	if config.RetryInitialBackoff <= 0 {
+		config.RetryInitialBackoff = defaultRetryInitialBackoff
+	}
+	if config.RetryMaxBackoff < config.RetryInitialBackoff {
+		config.RetryMaxBackoff = defaultRetryMaxBackoff
+		if config.RetryMaxBackoff < config.RetryInitialBackoff {
+			config.RetryMaxBackoff = config.RetryInitialBackoff
+		}
+	}
+
+	if config.AuthMaxSkew <= 0 {
+		config.AuthMaxSkew = defaultAuthMaxSkew
+	}
+
+	if config.ReconcileInterval <= 0 {
+		config.ReconcileInterval = defaultReconcileInterval
+	}
+
+	if config.IdleTimeout < 0 {
+		config.IdleTimeout = 0
+	}
+
+	if config.IdleCheckInterval <= 0 {
+		config.IdleCheckInterval = defaultIdleCheckInterval
+	}
+
+	if config.MaxLifetime < 0 {
+		config.MaxLifetime = 0
+	}
+
+	if config.DefaultLifetime < 0 {
+		config.DefaultLifetime = 0
+	}
+
+	if config.ExpiryCheckInterval <= 0 {
+		config.ExpiryCheckInterval = defaultExpiryCheckInterval
+	}
+
+	if config.LogByteLimit <= 0 {
+		config.LogByteLimit = defaultLogByteLimit
+	}
+
+	if config.FileTransferByteLimit <= 0 {
+		config.FileTransferByteLimit = defaultFileTransferByteLimit
+	}
+
 	_, config.PodSubnet, err = net.ParseCIDR(config.PodSubnetCidr)
 	if err != nil {
 		panic(fmt.Sprintf("Couldn't parse PodSubnetCidr %s, %s", config.PodSubnetCidr, err.Error()))
@@ -1,38 +1,130 @@
 package util
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-func TestReadyChannel(t *testing.T) {
-	c := NewReadyChannel(1 * time.Second)
-	nReceivers := 15
-	receiveCounter := 0
+func TestFuture(t *testing.T) {
+	f := NewFuture(1 * time.Second)
+	nWaiters := 15
+	var waitCounter int32
 	var w sync.WaitGroup
-	for i := 0; i < nReceivers; i++ {
+	for i := 0; i < nWaiters; i++ {
 		w.Add(1)
 		go func() {
-			c.Receive()
-			receiveCounter += 1
+			f.Wait()
+			atomic.AddInt32(&waitCounter, 1)
 			w.Done()
 		}()
 	}
-	received := c.Receive()
-	t.Logf("Received %+v from readyChannel\n", received)
-	c.Send(true)
-	received = c.Receive()
-	t.Logf("Received %+v from readyChannel\n", received)
-	if received {
-		t.Fatal("Later send overwrote first input to channel")
+	err := f.Wait()
+	t.Logf("Future completed with %v\n", err)
+	if !errors.Is(err, ErrTimedOut) || !f.TimedOut() {
+		t.Fatalf("Future completed with %v instead of timing out", err)
+	}
+	f.Succeed()
+	if f.Wait() != err {
+		t.Fatal("Later completion overwrote the first result of the future")
 	}
 	w.Wait()
-	if receiveCounter != nReceivers {
-		t.Fatal("Not all goroutines finished c.Receive")
+	if int(waitCounter) != nWaiters {
+		t.Fatal("Not all goroutines finished f.Wait")
+	}
+}
+
+func TestFutureFail(t *testing.T) {
+	reason := errors.New("Pod was deleted")
+	f := NewFuture(time.Minute)
+	f.Fail(reason)
+	if f.Wait() != reason || f.TimedOut() {
+		t.Fatalf("Future completed with %v instead of %v", f.Wait(), reason)
+	}
+
+	f = NewFuture(time.Minute)
+	f.Fail(nil)
+	if f.Wait() != ErrFailed {
+		t.Fatalf("Future failed without a reason completed with %v instead of ErrFailed", f.Wait())
+	}
+
+	f = NewFuture(time.Minute)
+	ctx := f.Context(context.Background())
+	f.Cancel()
+	if !errors.Is(f.Wait(), context.Canceled) {
+		t.Fatalf("Cancelled future completed with %v", f.Wait())
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Context of the future wasn't cancelled when it completed")
+	}
+}
+
+func TestFutureOnComplete(t *testing.T) {
+	f := NewFuture(time.Minute)
+	called := make(chan error, 2)
+	f.OnComplete(func(err error) { called <- err })
+	if f.Err() != nil || len(called) != 0 {
+		t.Fatal("Future completed before it was completed")
+	}
+	f.Succeed()
+	// A callback added after completion is called right away
+	f.OnComplete(func(err error) { called <- err })
+	for i := 0; i < 2; i++ {
+		if err := <-called; err != nil {
+			t.Fatalf("Callback got %v for a successful future", err)
+		}
+	}
+}
+
+func TestFutureDescribeTimeout(t *testing.T) {
+	f := NewFuture(10 * time.Millisecond)
+	described := fmt.Errorf("Pod was still pulling its image: %w", ErrTimedOut)
+	release := make(chan struct{})
+	f.DescribeTimeout(func() error {
+		<-release
+		return described
+	})
+	time.Sleep(50 * time.Millisecond)
+	// Completing the future while it's being described waits for the description
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+	f.Fail(errors.New("Couldn't start ssh service"))
+	if f.Wait() != described || !f.TimedOut() {
+		t.Fatalf("Timed out future completed with %v instead of its description", f.Wait())
+	}
+}
+
+func TestCombineFutures(t *testing.T) {
+	reason := errors.New("PVC was deleted")
+	inputs := []*Future{NewFuture(time.Minute), NewFuture(time.Minute), NewFuture(time.Minute)}
+	output := NewFuture(time.Minute)
+	CombineFutures(inputs, output)
+	inputs[2].Fail(reason)
+	inputs[0].Succeed()
+	select {
+	case <-output.Done():
+		t.Fatal("Combined future completed before all of its inputs")
+	default:
+	}
+	inputs[1].Succeed()
+	if output.Wait() != reason || WaitFutures(inputs) != reason {
+		t.Fatalf("Combined future completed with %v instead of %v", output.Wait(), reason)
+	}
+
+	output = NewFuture(time.Minute)
+	CombineFutures(nil, output)
+	if output.Wait() != nil {
+		t.Fatal("Combining no futures should succeed")
 	}
 }
 